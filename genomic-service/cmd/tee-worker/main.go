@@ -0,0 +1,59 @@
+// Command tee-worker holds the TEE keys and decrypts gene data in its own
+// process. The gateway reaches it over a Unix socket and only ever sees
+// ciphertext and signed results.
+package main
+
+import (
+	"genomic-service/internal/config"
+	"genomic-service/internal/storage"
+	"genomic-service/internal/tee"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var cfg *config.Config
+
+func init() {
+	config.LoadEnv(".env")
+	cfg = config.SetupConfigSettings("internal/config/app.ini")
+	cfg.SetupEnvVariable()
+}
+
+func main() {
+	socket := cfg.TEESettings.WorkerSocket
+	if socket == "" {
+		log.Fatalf("[tee] WorkerSocket is not configured")
+	}
+
+	// Reads the same storage as the gateway, which stores uploads
+	store, err := storage.NewStorage(cfg.StorageSettings)
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+
+	service, err := tee.NewTEEService(store, cfg.TEESettings)
+	if err != nil {
+		log.Fatalf("Failed to start TEE: %v", err)
+	}
+
+	listener, err := tee.ListenUnix(socket)
+	if err != nil {
+		log.Fatalf("Failed to open socket: %v", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	log.Printf("TEE worker listening on %s", socket)
+	if err := tee.ServeRPC(listener, service); err != nil {
+		log.Fatalf("TEE worker failed: %v", err)
+	}
+	service.Close()
+	os.Remove(socket)
+}
@@ -33,19 +33,22 @@ var (
 type ControllerDataDoc struct {
 	Id          string
 	HashContent string
+	ModelId     string
+	ModelHash   [32]byte
 }
 
 // ControllerUploadSession is an auto generated low-level Go binding around an user-defined struct.
 type ControllerUploadSession struct {
 	Id        *big.Int
 	User      common.Address
-	Proof     string
+	Owner     common.Address
+	Proof     []byte
 	Confirmed bool
 }
 
 // ControllerMetaData contains all meta data concerning the Controller contract.
 var ControllerMetaData = &bind.MetaData{
-	ABI: "[{\"inputs\":[{\"internalType\":\"address\",\"name\":\"nftAddress\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"pcspAddress\",\"type\":\"address\"}],\"stateMutability\":\"nonpayable\",\"type\":\"constructor\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"tokenId\",\"type\":\"uint256\"},{\"indexed\":false,\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"}],\"name\":\"GeneNFTMinted\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"PCSPRewarded\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"}],\"name\":\"UploadData\",\"type\":\"event\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"contentHash\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"proof\",\"type\":\"string\"},{\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"riskScore\",\"type\":\"uint256\"}],\"name\":\"confirm\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"geneNFT\",\"outputs\":[{\"internalType\":\"contractGeneNFT\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"}],\"name\":\"getDoc\",\"outputs\":[{\"components\":[{\"internalType\":\"string\",\"name\":\"id\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"hashContent\",\"type\":\"string\"}],\"internalType\":\"structController.DataDoc\",\"name\":\"\",\"type\":\"tuple\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"}],\"name\":\"getSession\",\"outputs\":[{\"components\":[{\"internalType\":\"uint256\",\"name\":\"id\",\"type\":\"uint256\"},{\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"internalType\":\"string\",\"name\":\"proof\",\"type\":\"string\"},{\"internalType\":\"bool\",\"name\":\"confirmed\",\"type\":\"bool\"}],\"internalType\":\"structController.UploadSession\",\"name\":\"\",\"type\":\"tuple\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"pcspToken\",\"outputs\":[{\"internalType\":\"contractPostCovidStrokePrevention\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"}],\"name\":\"uploadData\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"nonpayable\",\"type\":\"function\"}]",
+	ABI: "[{\"inputs\":[{\"internalType\":\"address\",\"name\":\"nftAddress\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"pcspAddress\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"trustedForwarder\",\"type\":\"address\"}],\"stateMutability\":\"nonpayable\",\"type\":\"constructor\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"tokenId\",\"type\":\"uint256\"},{\"indexed\":false,\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"}],\"name\":\"GeneNFTMinted\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"internalType\":\"address\",\"name\":\"previousOwner\",\"type\":\"address\",\"indexed\":true},{\"internalType\":\"address\",\"name\":\"newOwner\",\"type\":\"address\",\"indexed\":true}],\"name\":\"OwnershipTransferred\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"amount\",\"type\":\"uint256\"}],\"name\":\"PCSPRewarded\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"internalType\":\"address\",\"name\":\"signer\",\"type\":\"address\",\"indexed\":false},{\"internalType\":\"bool\",\"name\":\"allowed\",\"type\":\"bool\",\"indexed\":false}],\"name\":\"TeeSignerUpdated\",\"type\":\"event\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"},{\"indexed\":false,\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"},{\"internalType\":\"address\",\"name\":\"owner\",\"type\":\"address\",\"indexed\":false}],\"name\":\"UploadData\",\"type\":\"event\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"contentHash\",\"type\":\"string\"},{\"internalType\":\"bytes\",\"name\":\"proof\",\"type\":\"bytes\"},{\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"riskScore\",\"type\":\"uint256\"},{\"internalType\":\"string\",\"name\":\"modelId\",\"type\":\"string\"},{\"internalType\":\"bytes32\",\"name\":\"modelHash\",\"type\":\"bytes32\"}],\"name\":\"confirm\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"geneNFT\",\"outputs\":[{\"internalType\":\"contractGeneNFT\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"}],\"name\":\"getDoc\",\"outputs\":[{\"components\":[{\"internalType\":\"string\",\"name\":\"id\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"hashContent\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"modelId\",\"type\":\"string\"},{\"internalType\":\"bytes32\",\"name\":\"modelHash\",\"type\":\"bytes32\"}],\"internalType\":\"structController.DataDoc\",\"name\":\"\",\"type\":\"tuple\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"}],\"name\":\"getSession\",\"outputs\":[{\"components\":[{\"internalType\":\"uint256\",\"name\":\"id\",\"type\":\"uint256\"},{\"internalType\":\"address\",\"name\":\"user\",\"type\":\"address\"},{\"internalType\":\"address\",\"name\":\"owner\",\"type\":\"address\"},{\"internalType\":\"bytes\",\"name\":\"proof\",\"type\":\"bytes\"},{\"internalType\":\"bool\",\"name\":\"confirmed\",\"type\":\"bool\"}],\"internalType\":\"structController.UploadSession\",\"name\":\"\",\"type\":\"tuple\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"forwarder\",\"type\":\"address\"}],\"name\":\"isTrustedForwarder\",\"outputs\":[{\"internalType\":\"bool\",\"name\":\"\",\"type\":\"bool\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"owner\",\"outputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"pcspToken\",\"outputs\":[{\"internalType\":\"contractPostCovidStrokePrevention\",\"name\":\"\",\"type\":\"address\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"},{\"internalType\":\"string\",\"name\":\"contentHash\",\"type\":\"string\"},{\"internalType\":\"uint256\",\"name\":\"sessionId\",\"type\":\"uint256\"},{\"internalType\":\"uint256\",\"name\":\"riskScore\",\"type\":\"uint256\"},{\"internalType\":\"string\",\"name\":\"modelId\",\"type\":\"string\"},{\"internalType\":\"bytes32\",\"name\":\"modelHash\",\"type\":\"bytes32\"}],\"name\":\"proofDigest\",\"outputs\":[{\"internalType\":\"bytes32\",\"name\":\"\",\"type\":\"bytes32\"}],\"stateMutability\":\"pure\",\"type\":\"function\"},{\"inputs\":[],\"name\":\"renounceOwnership\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"signer\",\"type\":\"address\"},{\"internalType\":\"bool\",\"name\":\"allowed\",\"type\":\"bool\"}],\"name\":\"setTeeSigner\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"\",\"type\":\"address\"}],\"name\":\"teeSigners\",\"outputs\":[{\"internalType\":\"bool\",\"name\":\"\",\"type\":\"bool\"}],\"stateMutability\":\"view\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"address\",\"name\":\"newOwner\",\"type\":\"address\"}],\"name\":\"transferOwnership\",\"outputs\":[],\"stateMutability\":\"nonpayable\",\"type\":\"function\"},{\"inputs\":[{\"internalType\":\"string\",\"name\":\"docId\",\"type\":\"string\"},{\"internalType\":\"address\",\"name\":\"wallet\",\"type\":\"address\"}],\"name\":\"uploadData\",\"outputs\":[{\"internalType\":\"uint256\",\"name\":\"\",\"type\":\"uint256\"}],\"stateMutability\":\"nonpayable\",\"type\":\"function\"}]",
 }
 
 // ControllerABI is the input ABI used to generate the binding from.
@@ -227,7 +230,7 @@ func (_Controller *ControllerCallerSession) GeneNFT() (common.Address, error) {
 
 // GetDoc is a free data retrieval call binding the contract method 0xa5bde23b.
 //
-// Solidity: function getDoc(string docId) view returns((string,string))
+// Solidity: function getDoc(string docId) view returns((string,string,string,bytes32))
 func (_Controller *ControllerCaller) GetDoc(opts *bind.CallOpts, docId string) (ControllerDataDoc, error) {
 	var out []interface{}
 	err := _Controller.contract.Call(opts, &out, "getDoc", docId)
@@ -244,21 +247,21 @@ func (_Controller *ControllerCaller) GetDoc(opts *bind.CallOpts, docId string) (
 
 // GetDoc is a free data retrieval call binding the contract method 0xa5bde23b.
 //
-// Solidity: function getDoc(string docId) view returns((string,string))
+// Solidity: function getDoc(string docId) view returns((string,string,string,bytes32))
 func (_Controller *ControllerSession) GetDoc(docId string) (ControllerDataDoc, error) {
 	return _Controller.Contract.GetDoc(&_Controller.CallOpts, docId)
 }
 
 // GetDoc is a free data retrieval call binding the contract method 0xa5bde23b.
 //
-// Solidity: function getDoc(string docId) view returns((string,string))
+// Solidity: function getDoc(string docId) view returns((string,string,string,bytes32))
 func (_Controller *ControllerCallerSession) GetDoc(docId string) (ControllerDataDoc, error) {
 	return _Controller.Contract.GetDoc(&_Controller.CallOpts, docId)
 }
 
 // GetSession is a free data retrieval call binding the contract method 0x402ff0db.
 //
-// Solidity: function getSession(uint256 sessionId) view returns((uint256,address,string,bool))
+// Solidity: function getSession(uint256 sessionId) view returns((uint256,address,address,bytes,bool))
 func (_Controller *ControllerCaller) GetSession(opts *bind.CallOpts, sessionId *big.Int) (ControllerUploadSession, error) {
 	var out []interface{}
 	err := _Controller.contract.Call(opts, &out, "getSession", sessionId)
@@ -275,18 +278,80 @@ func (_Controller *ControllerCaller) GetSession(opts *bind.CallOpts, sessionId *
 
 // GetSession is a free data retrieval call binding the contract method 0x402ff0db.
 //
-// Solidity: function getSession(uint256 sessionId) view returns((uint256,address,string,bool))
+// Solidity: function getSession(uint256 sessionId) view returns((uint256,address,address,bytes,bool))
 func (_Controller *ControllerSession) GetSession(sessionId *big.Int) (ControllerUploadSession, error) {
 	return _Controller.Contract.GetSession(&_Controller.CallOpts, sessionId)
 }
 
 // GetSession is a free data retrieval call binding the contract method 0x402ff0db.
 //
-// Solidity: function getSession(uint256 sessionId) view returns((uint256,address,string,bool))
+// Solidity: function getSession(uint256 sessionId) view returns((uint256,address,address,bytes,bool))
 func (_Controller *ControllerCallerSession) GetSession(sessionId *big.Int) (ControllerUploadSession, error) {
 	return _Controller.Contract.GetSession(&_Controller.CallOpts, sessionId)
 }
 
+// IsTrustedForwarder is a free data retrieval call binding the contract method 0x572b6c05.
+//
+// Solidity: function isTrustedForwarder(address forwarder) view returns(bool)
+func (_Controller *ControllerCaller) IsTrustedForwarder(opts *bind.CallOpts, forwarder common.Address) (bool, error) {
+	var out []interface{}
+	err := _Controller.contract.Call(opts, &out, "isTrustedForwarder", forwarder)
+
+	if err != nil {
+		return *new(bool), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(bool)).(*bool)
+
+	return out0, err
+
+}
+
+// IsTrustedForwarder is a free data retrieval call binding the contract method 0x572b6c05.
+//
+// Solidity: function isTrustedForwarder(address forwarder) view returns(bool)
+func (_Controller *ControllerSession) IsTrustedForwarder(forwarder common.Address) (bool, error) {
+	return _Controller.Contract.IsTrustedForwarder(&_Controller.CallOpts, forwarder)
+}
+
+// IsTrustedForwarder is a free data retrieval call binding the contract method 0x572b6c05.
+//
+// Solidity: function isTrustedForwarder(address forwarder) view returns(bool)
+func (_Controller *ControllerCallerSession) IsTrustedForwarder(forwarder common.Address) (bool, error) {
+	return _Controller.Contract.IsTrustedForwarder(&_Controller.CallOpts, forwarder)
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_Controller *ControllerCaller) Owner(opts *bind.CallOpts) (common.Address, error) {
+	var out []interface{}
+	err := _Controller.contract.Call(opts, &out, "owner")
+
+	if err != nil {
+		return *new(common.Address), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(common.Address)).(*common.Address)
+
+	return out0, err
+
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_Controller *ControllerSession) Owner() (common.Address, error) {
+	return _Controller.Contract.Owner(&_Controller.CallOpts)
+}
+
+// Owner is a free data retrieval call binding the contract method 0x8da5cb5b.
+//
+// Solidity: function owner() view returns(address)
+func (_Controller *ControllerCallerSession) Owner() (common.Address, error) {
+	return _Controller.Contract.Owner(&_Controller.CallOpts)
+}
+
 // PcspToken is a free data retrieval call binding the contract method 0xdab3761e.
 //
 // Solidity: function pcspToken() view returns(address)
@@ -318,46 +383,171 @@ func (_Controller *ControllerCallerSession) PcspToken() (common.Address, error)
 	return _Controller.Contract.PcspToken(&_Controller.CallOpts)
 }
 
-// Confirm is a paid mutator transaction binding the contract method 0xb62fdfce.
+// ProofDigest is a free data retrieval call binding the contract method 0x579a220b.
+//
+// Solidity: function proofDigest(string docId, string contentHash, uint256 sessionId, uint256 riskScore, string modelId, bytes32 modelHash) pure returns(bytes32)
+func (_Controller *ControllerCaller) ProofDigest(opts *bind.CallOpts, docId string, contentHash string, sessionId *big.Int, riskScore *big.Int, modelId string, modelHash [32]byte) ([32]byte, error) {
+	var out []interface{}
+	err := _Controller.contract.Call(opts, &out, "proofDigest", docId, contentHash, sessionId, riskScore, modelId, modelHash)
+
+	if err != nil {
+		return *new([32]byte), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new([32]byte)).(*[32]byte)
+
+	return out0, err
+
+}
+
+// ProofDigest is a free data retrieval call binding the contract method 0x579a220b.
+//
+// Solidity: function proofDigest(string docId, string contentHash, uint256 sessionId, uint256 riskScore, string modelId, bytes32 modelHash) pure returns(bytes32)
+func (_Controller *ControllerSession) ProofDigest(docId string, contentHash string, sessionId *big.Int, riskScore *big.Int, modelId string, modelHash [32]byte) ([32]byte, error) {
+	return _Controller.Contract.ProofDigest(&_Controller.CallOpts, docId, contentHash, sessionId, riskScore, modelId, modelHash)
+}
+
+// ProofDigest is a free data retrieval call binding the contract method 0x579a220b.
+//
+// Solidity: function proofDigest(string docId, string contentHash, uint256 sessionId, uint256 riskScore, string modelId, bytes32 modelHash) pure returns(bytes32)
+func (_Controller *ControllerCallerSession) ProofDigest(docId string, contentHash string, sessionId *big.Int, riskScore *big.Int, modelId string, modelHash [32]byte) ([32]byte, error) {
+	return _Controller.Contract.ProofDigest(&_Controller.CallOpts, docId, contentHash, sessionId, riskScore, modelId, modelHash)
+}
+
+// TeeSigners is a free data retrieval call binding the contract method 0xcd88f94e.
+//
+// Solidity: function teeSigners(address ) view returns(bool)
+func (_Controller *ControllerCaller) TeeSigners(opts *bind.CallOpts, arg0 common.Address) (bool, error) {
+	var out []interface{}
+	err := _Controller.contract.Call(opts, &out, "teeSigners", arg0)
+
+	if err != nil {
+		return *new(bool), err
+	}
+
+	out0 := *abi.ConvertType(out[0], new(bool)).(*bool)
+
+	return out0, err
+
+}
+
+// TeeSigners is a free data retrieval call binding the contract method 0xcd88f94e.
+//
+// Solidity: function teeSigners(address ) view returns(bool)
+func (_Controller *ControllerSession) TeeSigners(arg0 common.Address) (bool, error) {
+	return _Controller.Contract.TeeSigners(&_Controller.CallOpts, arg0)
+}
+
+// TeeSigners is a free data retrieval call binding the contract method 0xcd88f94e.
+//
+// Solidity: function teeSigners(address ) view returns(bool)
+func (_Controller *ControllerCallerSession) TeeSigners(arg0 common.Address) (bool, error) {
+	return _Controller.Contract.TeeSigners(&_Controller.CallOpts, arg0)
+}
+
+// Confirm is a paid mutator transaction binding the contract method 0x81665d59.
+//
+// Solidity: function confirm(string docId, string contentHash, bytes proof, uint256 sessionId, uint256 riskScore, string modelId, bytes32 modelHash) returns()
+func (_Controller *ControllerTransactor) Confirm(opts *bind.TransactOpts, docId string, contentHash string, proof []byte, sessionId *big.Int, riskScore *big.Int, modelId string, modelHash [32]byte) (*types.Transaction, error) {
+	return _Controller.contract.Transact(opts, "confirm", docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
+}
+
+// Confirm is a paid mutator transaction binding the contract method 0x81665d59.
+//
+// Solidity: function confirm(string docId, string contentHash, bytes proof, uint256 sessionId, uint256 riskScore, string modelId, bytes32 modelHash) returns()
+func (_Controller *ControllerSession) Confirm(docId string, contentHash string, proof []byte, sessionId *big.Int, riskScore *big.Int, modelId string, modelHash [32]byte) (*types.Transaction, error) {
+	return _Controller.Contract.Confirm(&_Controller.TransactOpts, docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
+}
+
+// Confirm is a paid mutator transaction binding the contract method 0x81665d59.
+//
+// Solidity: function confirm(string docId, string contentHash, bytes proof, uint256 sessionId, uint256 riskScore, string modelId, bytes32 modelHash) returns()
+func (_Controller *ControllerTransactorSession) Confirm(docId string, contentHash string, proof []byte, sessionId *big.Int, riskScore *big.Int, modelId string, modelHash [32]byte) (*types.Transaction, error) {
+	return _Controller.Contract.Confirm(&_Controller.TransactOpts, docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
+}
+
+// RenounceOwnership is a paid mutator transaction binding the contract method 0x715018a6.
 //
-// Solidity: function confirm(string docId, string contentHash, string proof, uint256 sessionId, uint256 riskScore) returns()
-func (_Controller *ControllerTransactor) Confirm(opts *bind.TransactOpts, docId string, contentHash string, proof string, sessionId *big.Int, riskScore *big.Int) (*types.Transaction, error) {
-	return _Controller.contract.Transact(opts, "confirm", docId, contentHash, proof, sessionId, riskScore)
+// Solidity: function renounceOwnership() returns()
+func (_Controller *ControllerTransactor) RenounceOwnership(opts *bind.TransactOpts) (*types.Transaction, error) {
+	return _Controller.contract.Transact(opts, "renounceOwnership")
 }
 
-// Confirm is a paid mutator transaction binding the contract method 0xb62fdfce.
+// RenounceOwnership is a paid mutator transaction binding the contract method 0x715018a6.
 //
-// Solidity: function confirm(string docId, string contentHash, string proof, uint256 sessionId, uint256 riskScore) returns()
-func (_Controller *ControllerSession) Confirm(docId string, contentHash string, proof string, sessionId *big.Int, riskScore *big.Int) (*types.Transaction, error) {
-	return _Controller.Contract.Confirm(&_Controller.TransactOpts, docId, contentHash, proof, sessionId, riskScore)
+// Solidity: function renounceOwnership() returns()
+func (_Controller *ControllerSession) RenounceOwnership() (*types.Transaction, error) {
+	return _Controller.Contract.RenounceOwnership(&_Controller.TransactOpts)
 }
 
-// Confirm is a paid mutator transaction binding the contract method 0xb62fdfce.
+// RenounceOwnership is a paid mutator transaction binding the contract method 0x715018a6.
 //
-// Solidity: function confirm(string docId, string contentHash, string proof, uint256 sessionId, uint256 riskScore) returns()
-func (_Controller *ControllerTransactorSession) Confirm(docId string, contentHash string, proof string, sessionId *big.Int, riskScore *big.Int) (*types.Transaction, error) {
-	return _Controller.Contract.Confirm(&_Controller.TransactOpts, docId, contentHash, proof, sessionId, riskScore)
+// Solidity: function renounceOwnership() returns()
+func (_Controller *ControllerTransactorSession) RenounceOwnership() (*types.Transaction, error) {
+	return _Controller.Contract.RenounceOwnership(&_Controller.TransactOpts)
 }
 
-// UploadData is a paid mutator transaction binding the contract method 0x50969f44.
+// SetTeeSigner is a paid mutator transaction binding the contract method 0x61e8ecad.
 //
-// Solidity: function uploadData(string docId) returns(uint256)
-func (_Controller *ControllerTransactor) UploadData(opts *bind.TransactOpts, docId string) (*types.Transaction, error) {
-	return _Controller.contract.Transact(opts, "uploadData", docId)
+// Solidity: function setTeeSigner(address signer, bool allowed) returns()
+func (_Controller *ControllerTransactor) SetTeeSigner(opts *bind.TransactOpts, signer common.Address, allowed bool) (*types.Transaction, error) {
+	return _Controller.contract.Transact(opts, "setTeeSigner", signer, allowed)
 }
 
-// UploadData is a paid mutator transaction binding the contract method 0x50969f44.
+// SetTeeSigner is a paid mutator transaction binding the contract method 0x61e8ecad.
 //
-// Solidity: function uploadData(string docId) returns(uint256)
-func (_Controller *ControllerSession) UploadData(docId string) (*types.Transaction, error) {
-	return _Controller.Contract.UploadData(&_Controller.TransactOpts, docId)
+// Solidity: function setTeeSigner(address signer, bool allowed) returns()
+func (_Controller *ControllerSession) SetTeeSigner(signer common.Address, allowed bool) (*types.Transaction, error) {
+	return _Controller.Contract.SetTeeSigner(&_Controller.TransactOpts, signer, allowed)
 }
 
-// UploadData is a paid mutator transaction binding the contract method 0x50969f44.
+// SetTeeSigner is a paid mutator transaction binding the contract method 0x61e8ecad.
 //
-// Solidity: function uploadData(string docId) returns(uint256)
-func (_Controller *ControllerTransactorSession) UploadData(docId string) (*types.Transaction, error) {
-	return _Controller.Contract.UploadData(&_Controller.TransactOpts, docId)
+// Solidity: function setTeeSigner(address signer, bool allowed) returns()
+func (_Controller *ControllerTransactorSession) SetTeeSigner(signer common.Address, allowed bool) (*types.Transaction, error) {
+	return _Controller.Contract.SetTeeSigner(&_Controller.TransactOpts, signer, allowed)
+}
+
+// TransferOwnership is a paid mutator transaction binding the contract method 0xf2fde38b.
+//
+// Solidity: function transferOwnership(address newOwner) returns()
+func (_Controller *ControllerTransactor) TransferOwnership(opts *bind.TransactOpts, newOwner common.Address) (*types.Transaction, error) {
+	return _Controller.contract.Transact(opts, "transferOwnership", newOwner)
+}
+
+// TransferOwnership is a paid mutator transaction binding the contract method 0xf2fde38b.
+//
+// Solidity: function transferOwnership(address newOwner) returns()
+func (_Controller *ControllerSession) TransferOwnership(newOwner common.Address) (*types.Transaction, error) {
+	return _Controller.Contract.TransferOwnership(&_Controller.TransactOpts, newOwner)
+}
+
+// TransferOwnership is a paid mutator transaction binding the contract method 0xf2fde38b.
+//
+// Solidity: function transferOwnership(address newOwner) returns()
+func (_Controller *ControllerTransactorSession) TransferOwnership(newOwner common.Address) (*types.Transaction, error) {
+	return _Controller.Contract.TransferOwnership(&_Controller.TransactOpts, newOwner)
+}
+
+// UploadData is a paid mutator transaction binding the contract method 0x43682325.
+//
+// Solidity: function uploadData(string docId, address wallet) returns(uint256)
+func (_Controller *ControllerTransactor) UploadData(opts *bind.TransactOpts, docId string, wallet common.Address) (*types.Transaction, error) {
+	return _Controller.contract.Transact(opts, "uploadData", docId, wallet)
+}
+
+// UploadData is a paid mutator transaction binding the contract method 0x43682325.
+//
+// Solidity: function uploadData(string docId, address wallet) returns(uint256)
+func (_Controller *ControllerSession) UploadData(docId string, wallet common.Address) (*types.Transaction, error) {
+	return _Controller.Contract.UploadData(&_Controller.TransactOpts, docId, wallet)
+}
+
+// UploadData is a paid mutator transaction binding the contract method 0x43682325.
+//
+// Solidity: function uploadData(string docId, address wallet) returns(uint256)
+func (_Controller *ControllerTransactorSession) UploadData(docId string, wallet common.Address) (*types.Transaction, error) {
+	return _Controller.Contract.UploadData(&_Controller.TransactOpts, docId, wallet)
 }
 
 // ControllerGeneNFTMintedIterator is returned from FilterGeneNFTMinted and is used to iterate over the raw logs and unpacked data for GeneNFTMinted events raised by the Controller contract.
@@ -495,6 +685,159 @@ func (_Controller *ControllerFilterer) ParseGeneNFTMinted(log types.Log) (*Contr
 	return event, nil
 }
 
+// ControllerOwnershipTransferredIterator is returned from FilterOwnershipTransferred and is used to iterate over the raw logs and unpacked data for OwnershipTransferred events raised by the Controller contract.
+type ControllerOwnershipTransferredIterator struct {
+	Event *ControllerOwnershipTransferred // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *ControllerOwnershipTransferredIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(ControllerOwnershipTransferred)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(ControllerOwnershipTransferred)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *ControllerOwnershipTransferredIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *ControllerOwnershipTransferredIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// ControllerOwnershipTransferred represents a OwnershipTransferred event raised by the Controller contract.
+type ControllerOwnershipTransferred struct {
+	PreviousOwner common.Address
+	NewOwner      common.Address
+	Raw           types.Log // Blockchain specific contextual infos
+}
+
+// FilterOwnershipTransferred is a free log retrieval operation binding the contract event 0x8be0079c531659141344cd1fd0a4f28419497f9722a3daafe3b4186f6b6457e0.
+//
+// Solidity: event OwnershipTransferred(address indexed previousOwner, address indexed newOwner)
+func (_Controller *ControllerFilterer) FilterOwnershipTransferred(opts *bind.FilterOpts, previousOwner []common.Address, newOwner []common.Address) (*ControllerOwnershipTransferredIterator, error) {
+
+	var previousOwnerRule []interface{}
+	for _, previousOwnerItem := range previousOwner {
+		previousOwnerRule = append(previousOwnerRule, previousOwnerItem)
+	}
+	var newOwnerRule []interface{}
+	for _, newOwnerItem := range newOwner {
+		newOwnerRule = append(newOwnerRule, newOwnerItem)
+	}
+
+	logs, sub, err := _Controller.contract.FilterLogs(opts, "OwnershipTransferred", previousOwnerRule, newOwnerRule)
+	if err != nil {
+		return nil, err
+	}
+	return &ControllerOwnershipTransferredIterator{contract: _Controller.contract, event: "OwnershipTransferred", logs: logs, sub: sub}, nil
+}
+
+// WatchOwnershipTransferred is a free log subscription operation binding the contract event 0x8be0079c531659141344cd1fd0a4f28419497f9722a3daafe3b4186f6b6457e0.
+//
+// Solidity: event OwnershipTransferred(address indexed previousOwner, address indexed newOwner)
+func (_Controller *ControllerFilterer) WatchOwnershipTransferred(opts *bind.WatchOpts, sink chan<- *ControllerOwnershipTransferred, previousOwner []common.Address, newOwner []common.Address) (event.Subscription, error) {
+
+	var previousOwnerRule []interface{}
+	for _, previousOwnerItem := range previousOwner {
+		previousOwnerRule = append(previousOwnerRule, previousOwnerItem)
+	}
+	var newOwnerRule []interface{}
+	for _, newOwnerItem := range newOwner {
+		newOwnerRule = append(newOwnerRule, newOwnerItem)
+	}
+
+	logs, sub, err := _Controller.contract.WatchLogs(opts, "OwnershipTransferred", previousOwnerRule, newOwnerRule)
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(ControllerOwnershipTransferred)
+				if err := _Controller.contract.UnpackLog(event, "OwnershipTransferred", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseOwnershipTransferred is a log parse operation binding the contract event 0x8be0079c531659141344cd1fd0a4f28419497f9722a3daafe3b4186f6b6457e0.
+//
+// Solidity: event OwnershipTransferred(address indexed previousOwner, address indexed newOwner)
+func (_Controller *ControllerFilterer) ParseOwnershipTransferred(log types.Log) (*ControllerOwnershipTransferred, error) {
+	event := new(ControllerOwnershipTransferred)
+	if err := _Controller.contract.UnpackLog(event, "OwnershipTransferred", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
 // ControllerPCSPRewardedIterator is returned from FilterPCSPRewarded and is used to iterate over the raw logs and unpacked data for PCSPRewarded events raised by the Controller contract.
 type ControllerPCSPRewardedIterator struct {
 	Event *ControllerPCSPRewarded // Event containing the contract specifics and raw log
@@ -630,6 +973,141 @@ func (_Controller *ControllerFilterer) ParsePCSPRewarded(log types.Log) (*Contro
 	return event, nil
 }
 
+// ControllerTeeSignerUpdatedIterator is returned from FilterTeeSignerUpdated and is used to iterate over the raw logs and unpacked data for TeeSignerUpdated events raised by the Controller contract.
+type ControllerTeeSignerUpdatedIterator struct {
+	Event *ControllerTeeSignerUpdated // Event containing the contract specifics and raw log
+
+	contract *bind.BoundContract // Generic contract to use for unpacking event data
+	event    string              // Event name to use for unpacking event data
+
+	logs chan types.Log        // Log channel receiving the found contract events
+	sub  ethereum.Subscription // Subscription for errors, completion and termination
+	done bool                  // Whether the subscription completed delivering logs
+	fail error                 // Occurred error to stop iteration
+}
+
+// Next advances the iterator to the subsequent event, returning whether there
+// are any more events found. In case of a retrieval or parsing error, false is
+// returned and Error() can be queried for the exact failure.
+func (it *ControllerTeeSignerUpdatedIterator) Next() bool {
+	// If the iterator failed, stop iterating
+	if it.fail != nil {
+		return false
+	}
+	// If the iterator completed, deliver directly whatever's available
+	if it.done {
+		select {
+		case log := <-it.logs:
+			it.Event = new(ControllerTeeSignerUpdated)
+			if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+				it.fail = err
+				return false
+			}
+			it.Event.Raw = log
+			return true
+
+		default:
+			return false
+		}
+	}
+	// Iterator still in progress, wait for either a data or an error event
+	select {
+	case log := <-it.logs:
+		it.Event = new(ControllerTeeSignerUpdated)
+		if err := it.contract.UnpackLog(it.Event, it.event, log); err != nil {
+			it.fail = err
+			return false
+		}
+		it.Event.Raw = log
+		return true
+
+	case err := <-it.sub.Err():
+		it.done = true
+		it.fail = err
+		return it.Next()
+	}
+}
+
+// Error returns any retrieval or parsing error occurred during filtering.
+func (it *ControllerTeeSignerUpdatedIterator) Error() error {
+	return it.fail
+}
+
+// Close terminates the iteration process, releasing any pending underlying
+// resources.
+func (it *ControllerTeeSignerUpdatedIterator) Close() error {
+	it.sub.Unsubscribe()
+	return nil
+}
+
+// ControllerTeeSignerUpdated represents a TeeSignerUpdated event raised by the Controller contract.
+type ControllerTeeSignerUpdated struct {
+	Signer  common.Address
+	Allowed bool
+	Raw     types.Log // Blockchain specific contextual infos
+}
+
+// FilterTeeSignerUpdated is a free log retrieval operation binding the contract event 0xa00e064304cb0cabf8298e6c4b18d1552f927d0d0ebd6ff07516f9a6156a4799.
+//
+// Solidity: event TeeSignerUpdated(address signer, bool allowed)
+func (_Controller *ControllerFilterer) FilterTeeSignerUpdated(opts *bind.FilterOpts) (*ControllerTeeSignerUpdatedIterator, error) {
+
+	logs, sub, err := _Controller.contract.FilterLogs(opts, "TeeSignerUpdated")
+	if err != nil {
+		return nil, err
+	}
+	return &ControllerTeeSignerUpdatedIterator{contract: _Controller.contract, event: "TeeSignerUpdated", logs: logs, sub: sub}, nil
+}
+
+// WatchTeeSignerUpdated is a free log subscription operation binding the contract event 0xa00e064304cb0cabf8298e6c4b18d1552f927d0d0ebd6ff07516f9a6156a4799.
+//
+// Solidity: event TeeSignerUpdated(address signer, bool allowed)
+func (_Controller *ControllerFilterer) WatchTeeSignerUpdated(opts *bind.WatchOpts, sink chan<- *ControllerTeeSignerUpdated) (event.Subscription, error) {
+
+	logs, sub, err := _Controller.contract.WatchLogs(opts, "TeeSignerUpdated")
+	if err != nil {
+		return nil, err
+	}
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case log := <-logs:
+				// New log arrived, parse the event and forward to the user
+				event := new(ControllerTeeSignerUpdated)
+				if err := _Controller.contract.UnpackLog(event, "TeeSignerUpdated", log); err != nil {
+					return err
+				}
+				event.Raw = log
+
+				select {
+				case sink <- event:
+				case err := <-sub.Err():
+					return err
+				case <-quit:
+					return nil
+				}
+			case err := <-sub.Err():
+				return err
+			case <-quit:
+				return nil
+			}
+		}
+	}), nil
+}
+
+// ParseTeeSignerUpdated is a log parse operation binding the contract event 0xa00e064304cb0cabf8298e6c4b18d1552f927d0d0ebd6ff07516f9a6156a4799.
+//
+// Solidity: event TeeSignerUpdated(address signer, bool allowed)
+func (_Controller *ControllerFilterer) ParseTeeSignerUpdated(log types.Log) (*ControllerTeeSignerUpdated, error) {
+	event := new(ControllerTeeSignerUpdated)
+	if err := _Controller.contract.UnpackLog(event, "TeeSignerUpdated", log); err != nil {
+		return nil, err
+	}
+	event.Raw = log
+	return event, nil
+}
+
 // ControllerUploadDataIterator is returned from FilterUploadData and is used to iterate over the raw logs and unpacked data for UploadData events raised by the Controller contract.
 type ControllerUploadDataIterator struct {
 	Event *ControllerUploadData // Event containing the contract specifics and raw log
@@ -701,12 +1179,13 @@ func (it *ControllerUploadDataIterator) Close() error {
 type ControllerUploadData struct {
 	DocId     string
 	SessionId *big.Int
+	Owner     common.Address
 	Raw       types.Log // Blockchain specific contextual infos
 }
 
-// FilterUploadData is a free log retrieval operation binding the contract event 0x698b35ede3baa51dbaa3b9a040c287690e40d0101d312c80eb364c7b17c458bc.
+// FilterUploadData is a free log retrieval operation binding the contract event 0x4dc09148991a84e56dcc89ef07495ef2e927bc914e46d2f754e022a359b315c9.
 //
-// Solidity: event UploadData(string docId, uint256 sessionId)
+// Solidity: event UploadData(string docId, uint256 sessionId, address owner)
 func (_Controller *ControllerFilterer) FilterUploadData(opts *bind.FilterOpts) (*ControllerUploadDataIterator, error) {
 
 	logs, sub, err := _Controller.contract.FilterLogs(opts, "UploadData")
@@ -716,9 +1195,9 @@ func (_Controller *ControllerFilterer) FilterUploadData(opts *bind.FilterOpts) (
 	return &ControllerUploadDataIterator{contract: _Controller.contract, event: "UploadData", logs: logs, sub: sub}, nil
 }
 
-// WatchUploadData is a free log subscription operation binding the contract event 0x698b35ede3baa51dbaa3b9a040c287690e40d0101d312c80eb364c7b17c458bc.
+// WatchUploadData is a free log subscription operation binding the contract event 0x4dc09148991a84e56dcc89ef07495ef2e927bc914e46d2f754e022a359b315c9.
 //
-// Solidity: event UploadData(string docId, uint256 sessionId)
+// Solidity: event UploadData(string docId, uint256 sessionId, address owner)
 func (_Controller *ControllerFilterer) WatchUploadData(opts *bind.WatchOpts, sink chan<- *ControllerUploadData) (event.Subscription, error) {
 
 	logs, sub, err := _Controller.contract.WatchLogs(opts, "UploadData")
@@ -753,9 +1232,9 @@ func (_Controller *ControllerFilterer) WatchUploadData(opts *bind.WatchOpts, sin
 	}), nil
 }
 
-// ParseUploadData is a log parse operation binding the contract event 0x698b35ede3baa51dbaa3b9a040c287690e40d0101d312c80eb364c7b17c458bc.
+// ParseUploadData is a log parse operation binding the contract event 0x4dc09148991a84e56dcc89ef07495ef2e927bc914e46d2f754e022a359b315c9.
 //
-// Solidity: event UploadData(string docId, uint256 sessionId)
+// Solidity: event UploadData(string docId, uint256 sessionId, address owner)
 func (_Controller *ControllerFilterer) ParseUploadData(log types.Log) (*ControllerUploadData, error) {
 	event := new(ControllerUploadData)
 	if err := _Controller.contract.UnpackLog(event, "UploadData", log); err != nil {
@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"errors"
+	"math/big"
+	"time"
+
+	"genomic-service/internal/config"
+
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Fee policy defaults, used for settings left at zero
+const (
+	defaultBaseFeeMultiplier = 2.0
+	defaultGasLimitMargin    = 0.2
+	defaultFeeBumpPercent    = 15
+	defaultStuckAfter        = time.Minute
+	defaultTxDeadline        = 10 * time.Minute
+
+	// minFeeBumpPercent is the least increase nodes accept to replace a
+	// pending transaction
+	minFeeBumpPercent = 10
+)
+
+// ErrTxTimeout is returned for calls given up at the deadline. It is only
+// returned once the transfer cancelling the call is mined at its nonce, so
+// the call didn't happen.
+var ErrTxTimeout = errors.New("transaction not mined before the deadline")
+
+// FeePolicy prices EIP-1559 transactions and decides when a pending one is
+// replaced or given up
+type FeePolicy struct {
+	MinTip            *big.Int // floor under the tip suggested by the node
+	MaxFee            *big.Int // ceiling on the fee cap, nil = none
+	BaseFeeMultiplier float64  // fee cap = base fee * multiplier + tip
+	GasLimitMargin    float64  // share added to the estimated gas
+	BumpPercent       int64    // fee increase of a replacement
+	StuckAfter        time.Duration
+	Deadline          time.Duration
+}
+
+func NewFeePolicy(settings *config.BlockchainSettings) *FeePolicy {
+	policy := &FeePolicy{
+		MinTip:            gwei(settings.MinTipGwei),
+		BaseFeeMultiplier: settings.BaseFeeMultiplier,
+		GasLimitMargin:    settings.GasLimitMargin,
+		BumpPercent:       int64(settings.FeeBumpPercent),
+		StuckAfter:        settings.StuckAfter,
+		Deadline:          settings.TxDeadline,
+	}
+	if settings.MaxFeeGwei > 0 {
+		policy.MaxFee = gwei(settings.MaxFeeGwei)
+	}
+	if policy.BaseFeeMultiplier <= 0 {
+		policy.BaseFeeMultiplier = defaultBaseFeeMultiplier
+	}
+	if policy.GasLimitMargin <= 0 {
+		policy.GasLimitMargin = defaultGasLimitMargin
+	}
+	if policy.BumpPercent < minFeeBumpPercent {
+		policy.BumpPercent = defaultFeeBumpPercent
+	}
+	if policy.StuckAfter <= 0 {
+		policy.StuckAfter = defaultStuckAfter
+	}
+	if policy.Deadline <= 0 {
+		policy.Deadline = defaultTxDeadline
+	}
+	return policy
+}
+
+// Fees prices a new transaction from the tip suggested by the node and the
+// base fee of the latest block
+func (p *FeePolicy) Fees(suggestedTip, baseFee *big.Int) (tip, feeCap *big.Int) {
+	return p.capped(p.market(suggestedTip, baseFee))
+}
+
+// Bump prices the replacement of a pending transaction: the fees it replaces
+// raised by BumpPercent, or the market price if higher. ok is false when the
+// ceiling leaves no room for a replacement the node would accept.
+func (p *FeePolicy) Bump(oldTip, oldFeeCap, suggestedTip, baseFee *big.Int) (tip, feeCap *big.Int, ok bool) {
+	tip, feeCap = p.market(suggestedTip, baseFee)
+	tip = maxInt(tip, percent(oldTip, 100+p.BumpPercent))
+	feeCap = maxInt(feeCap, percent(oldFeeCap, 100+p.BumpPercent))
+	tip, feeCap = p.capped(tip, feeCap)
+
+	ok = tip.Cmp(percent(oldTip, 100+minFeeBumpPercent)) >= 0 &&
+		feeCap.Cmp(percent(oldFeeCap, 100+minFeeBumpPercent)) >= 0
+	return tip, feeCap, ok
+}
+
+// GasLimit adds the safety margin to a gas estimate
+func (p *FeePolicy) GasLimit(estimate uint64) uint64 {
+	return estimate + uint64(float64(estimate)*p.GasLimitMargin)
+}
+
+func (p *FeePolicy) market(suggestedTip, baseFee *big.Int) (tip, feeCap *big.Int) {
+	tip = maxInt(suggestedTip, p.MinTip)
+	feeCap = new(big.Int).Set(tip)
+	if baseFee != nil {
+		scaled, _ := new(big.Float).Mul(new(big.Float).SetInt(baseFee), big.NewFloat(p.BaseFeeMultiplier)).Int(nil)
+		feeCap.Add(feeCap, scaled)
+	}
+	return tip, feeCap
+}
+
+func (p *FeePolicy) capped(tip, feeCap *big.Int) (*big.Int, *big.Int) {
+	if p.MaxFee != nil && feeCap.Cmp(p.MaxFee) > 0 {
+		feeCap = new(big.Int).Set(p.MaxFee)
+	}
+	if tip.Cmp(feeCap) > 0 {
+		tip = new(big.Int).Set(feeCap)
+	}
+	return tip, feeCap
+}
+
+func gwei(amount float64) *big.Int {
+	wei, _ := new(big.Float).Mul(big.NewFloat(amount), big.NewFloat(params.GWei)).Int(nil)
+	return wei
+}
+
+// percent returns value * pct / 100, rounded up so a bump is never short
+func percent(value *big.Int, pct int64) *big.Int {
+	scaled := new(big.Int).Mul(value, big.NewInt(pct))
+	scaled.Add(scaled, big.NewInt(99))
+	return scaled.Div(scaled, big.NewInt(100))
+}
+
+func maxInt(a, b *big.Int) *big.Int {
+	if b != nil && (a == nil || b.Cmp(a) > 0) {
+		return new(big.Int).Set(b)
+	}
+	return new(big.Int).Set(a)
+}
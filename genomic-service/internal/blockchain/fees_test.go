@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"genomic-service/internal/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeePolicy(t *testing.T) {
+	policy := NewFeePolicy(&config.BlockchainSettings{MinTipGwei: 1, MaxFeeGwei: 100})
+	assert.Equal(t, defaultStuckAfter, policy.StuckAfter)
+	assert.Equal(t, defaultTxDeadline, policy.Deadline)
+	assert.Equal(t, uint64(120000), policy.GasLimit(100000))
+
+	testCases := []struct {
+		name       string
+		tip        *big.Int
+		baseFee    *big.Int
+		wantTip    *big.Int
+		wantFeeCap *big.Int
+	}{
+		{"Suggested tip", gwei(2), gwei(25), gwei(2), gwei(52)},
+		{"Tip floor", gwei(0.5), gwei(25), gwei(1), gwei(51)},
+		{"Fee ceiling", gwei(2), gwei(80), gwei(2), gwei(100)},
+		{"Tip above the ceiling", gwei(150), gwei(25), gwei(100), gwei(100)},
+		{"No base fee", gwei(2), nil, gwei(2), gwei(2)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tip, feeCap := policy.Fees(tc.tip, tc.baseFee)
+			assert.Equal(t, tc.wantTip, tip)
+			assert.Equal(t, tc.wantFeeCap, feeCap)
+		})
+	}
+}
+
+func TestFeeBump(t *testing.T) {
+	policy := NewFeePolicy(&config.BlockchainSettings{
+		MinTipGwei:     1,
+		MaxFeeGwei:     100,
+		FeeBumpPercent: 20,
+		StuckAfter:     30 * time.Second,
+	})
+	assert.Equal(t, 30*time.Second, policy.StuckAfter)
+
+	testCases := []struct {
+		name       string
+		oldTip     *big.Int
+		oldFeeCap  *big.Int
+		baseFee    *big.Int
+		wantTip    *big.Int
+		wantFeeCap *big.Int
+		ok         bool
+	}{
+		{"Raised by the bump", gwei(2), gwei(50), gwei(20), big.NewInt(2400000000), gwei(60), true},
+		{"Market moved above the bump", gwei(2), gwei(50), gwei(40), big.NewInt(2400000000), gwei(81), true},
+		{"Capped but still enough", gwei(2), gwei(90), gwei(20), big.NewInt(2400000000), gwei(100), true},
+		{"At the ceiling", gwei(2), gwei(95), gwei(20), big.NewInt(2400000000), gwei(100), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tip, feeCap, ok := policy.Bump(tc.oldTip, tc.oldFeeCap, gwei(1), tc.baseFee)
+			assert.Equal(t, tc.wantTip, tip)
+			assert.Equal(t, tc.wantFeeCap, feeCap)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
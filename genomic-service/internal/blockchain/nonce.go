@@ -0,0 +1,137 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// nonceSource is what the nonce manager needs from the node
+type nonceSource interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+}
+
+// NonceManager hands out the nonces of one wallet locally, so transactions
+// can be signed concurrently without waiting for earlier ones to reach the
+// node's pending state.
+//
+// Nonces that were allocated but never used are handed out again first, and
+// so are gaps found when resyncing: until they are used, no transaction
+// after them can be mined.
+type NonceManager struct {
+	source  nonceSource
+	address common.Address
+
+	mu     sync.Mutex
+	synced bool
+	next   uint64
+	free   []uint64 // below next, sorted
+}
+
+func NewNonceManager(source nonceSource, address common.Address) *NonceManager {
+	return &NonceManager{source: source, address: address}
+}
+
+// Next allocates a nonce, the lowest free one if any
+func (n *NonceManager) Next(ctx context.Context) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.synced {
+		if err := n.resync(ctx, nil); err != nil {
+			return 0, err
+		}
+	}
+	if len(n.free) > 0 {
+		nonce := n.free[0]
+		n.free = n.free[1:]
+		return nonce, nil
+	}
+	nonce := n.next
+	n.next++
+	return nonce, nil
+}
+
+// Release gives back a nonce whose transaction never reached the node
+func (n *NonceManager) Release(nonce uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.synced || nonce >= n.next {
+		return
+	}
+	i := sort.Search(len(n.free), func(i int) bool { return n.free[i] >= nonce })
+	if i < len(n.free) && n.free[i] == nonce {
+		return
+	}
+	n.free = append(n.free, 0)
+	copy(n.free[i+1:], n.free[i:])
+	n.free[i] = nonce
+
+	// Free nonces at the top are no gap, nothing waits behind them
+	for len(n.free) > 0 && n.free[len(n.free)-1] == n.next-1 {
+		n.free = n.free[:len(n.free)-1]
+		n.next--
+	}
+}
+
+// Resync realigns with the pending nonce of the node. held lists the nonces
+// of transactions signed and still in flight; nonces between the node's and
+// the highest held one that nobody holds are gaps, reused first. It must not
+// run while nonces are allocated and not yet held.
+func (n *NonceManager) Resync(ctx context.Context, held []uint64) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.resync(ctx, held)
+}
+
+func (n *NonceManager) resync(ctx context.Context, held []uint64) error {
+	pending, err := n.source.PendingNonceAt(ctx, n.address)
+	if err != nil {
+		return fmt.Errorf("failed to get pending nonce: %v", err)
+	}
+
+	next := pending
+	isHeld := make(map[uint64]bool, len(held))
+	for _, nonce := range held {
+		isHeld[nonce] = true
+		if nonce >= next {
+			next = nonce + 1
+		}
+	}
+
+	var free []uint64
+	for nonce := pending; nonce < next; nonce++ {
+		if !isHeld[nonce] {
+			free = append(free, nonce)
+		}
+	}
+	n.next, n.free, n.synced = next, free, true
+	return nil
+}
+
+// Gaps returns the free nonces. Transactions after them wait until they are
+// used, by a new call or a filler transaction.
+func (n *NonceManager) Gaps() []uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]uint64(nil), n.free...)
+}
+
+// Take allocates a specific free nonce, e.g. to fill a gap. It reports false
+// when the nonce isn't free anymore.
+func (n *NonceManager) Take(nonce uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for i, free := range n.free {
+		if free == nonce {
+			n.free = append(n.free[:i], n.free[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
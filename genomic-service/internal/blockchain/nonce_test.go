@@ -0,0 +1,97 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNonceSource struct {
+	pending uint64
+	err     error
+	calls   int
+}
+
+func (f *fakeNonceSource) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	f.calls++
+	return f.pending, f.err
+}
+
+func TestNonceManager(t *testing.T) {
+	ctx := context.Background()
+	source := &fakeNonceSource{pending: 5}
+	nonces := NewNonceManager(source, common.Address{})
+
+	// Allocated locally after the first sync
+	for want := uint64(5); want < 8; want++ {
+		nonce, err := nonces.Next(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, want, nonce)
+	}
+	assert.Equal(t, 1, source.calls)
+
+	// A released nonce is handed out again before new ones
+	nonces.Release(6)
+	assert.Equal(t, []uint64{6}, nonces.Gaps())
+	nonce, err := nonces.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), nonce)
+
+	// Releasing the last one is no gap
+	nonces.Release(7)
+	assert.Empty(t, nonces.Gaps())
+	nonce, err = nonces.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), nonce)
+
+	// The node saw up to 5; 9 is in flight, so 6 to 8 were dropped
+	source.pending = 6
+	assert.NoError(t, nonces.Resync(ctx, []uint64{5, 9}))
+	assert.Equal(t, []uint64{6, 7, 8}, nonces.Gaps())
+	assert.True(t, nonces.Take(7))
+	assert.False(t, nonces.Take(7))
+	nonce, err = nonces.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), nonce)
+
+	// Another sender moved the nonce ahead of us
+	source.pending = 20
+	assert.NoError(t, nonces.Resync(ctx, []uint64{9}))
+	assert.Empty(t, nonces.Gaps())
+	nonce, err = nonces.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20), nonce)
+
+	// A failed resync keeps what we had
+	source.err = errors.New("connection refused")
+	assert.Error(t, nonces.Resync(ctx, nil))
+	nonce, err = nonces.Next(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(21), nonce)
+}
+
+func TestNonceManagerConcurrent(t *testing.T) {
+	nonces := NewNonceManager(&fakeNonceSource{}, common.Address{})
+
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nonce, err := nonces.Next(context.Background())
+			assert.NoError(t, err)
+			mu.Lock()
+			defer mu.Unlock()
+			assert.False(t, seen[nonce], "nonce %d handed out twice", nonce)
+			seen[nonce] = true
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, seen, 50)
+}
@@ -0,0 +1,341 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// OutboxStatus is where an outgoing contract call is
+type OutboxStatus string
+
+const (
+	OutboxQueued   OutboxStatus = "queued"   // persisted, not signed yet
+	OutboxSent     OutboxStatus = "sent"     // signed, broadcast at least once unless Broadcast is false
+	OutboxIncluded OutboxStatus = "included" // receipt in a block, not yet deep enough to be final
+	OutboxMined    OutboxStatus = "mined"    // final receipt with a successful status
+	OutboxFailed   OutboxStatus = "failed"   // reverted, rejected or timed out for good, see Error
+)
+
+var ErrOutboxNotFound = errors.New("outbox entry not found")
+
+var (
+	outboxBucket = []byte("outbox")
+	hashesBucket = []byte("outbox_hashes") // tx hash -> entry ID
+)
+
+// OutboxEntry is a contract call the service intends to make. It is stored
+// before anything is signed, and its signed transaction is stored before it
+// is broadcast, so a crash or RPC failure at any point loses nothing and a
+// retry rebroadcasts the same transaction instead of making a new one.
+type OutboxEntry struct {
+	ID     string          `json:"id"` // idempotency key, e.g. confirm:<sessionId>, with :<n> for retries
+	Seq    uint64          `json:"seq"`
+	Method string          `json:"method"`
+	Args   json.RawMessage `json:"args"`
+	Status OutboxStatus    `json:"status"`
+
+	Nonce         uint64     `json:"nonce,omitempty"`
+	RawTx         []byte     `json:"rawTx,omitempty"` // signed transaction, binary encoded
+	TxHash        string     `json:"txHash,omitempty"`
+	Broadcast     bool       `json:"broadcast"`
+	LastBroadcast *time.Time `json:"lastBroadcast,omitempty"`
+	FirstSigned   *time.Time `json:"firstSigned,omitempty"` // the deadline runs from here
+	Signed        *time.Time `json:"signed,omitempty"`      // current transaction, replaced when stuck
+	Replaced      []string   `json:"replaced,omitempty"`    // earlier transactions at the same nonce, any may be mined
+	Cancels       []string   `json:"cancels,omitempty"`     // transfers to ourselves sent at the deadline to cancel the call
+	TimedOut      bool       `json:"timedOut,omitempty"`
+
+	Receipt *gethtypes.Receipt `json:"receipt,omitempty"`
+
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// Done reports whether the entry reached a final status
+func (e *OutboxEntry) Done() bool {
+	return e.Status == OutboxMined || e.Status == OutboxFailed
+}
+
+// hashes lists the current transaction and the ones it replaced
+func (e *OutboxEntry) hashes() []string {
+	return append([]string{e.TxHash}, e.Replaced...)
+}
+
+// cancelling reports whether the call was given up at the deadline
+func (e *OutboxEntry) cancelling() bool {
+	return len(e.Cancels) > 0
+}
+
+// isCancel reports whether a transaction is one of the cancellations
+func (e *OutboxEntry) isCancel(txHash string) bool {
+	for _, cancel := range e.Cancels {
+		if cancel == txHash {
+			return true
+		}
+	}
+	return false
+}
+
+// Transaction decodes the signed transaction
+func (e *OutboxEntry) Transaction() (*gethtypes.Transaction, error) {
+	tx := new(gethtypes.Transaction)
+	if err := tx.UnmarshalBinary(e.RawTx); err != nil {
+		return nil, fmt.Errorf("corrupt signed transaction in %s: %v", e.ID, err)
+	}
+	return tx, nil
+}
+
+// Outbox persists intended contract calls in an embedded bbolt database
+type Outbox struct {
+	db *bolt.DB
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every update
+}
+
+func NewOutbox(path string) (*Outbox, error) {
+	if path == "" {
+		return nil, fmt.Errorf("outbox path is not configured")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{outboxBucket, hashesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize outbox: %v", err)
+	}
+	return &Outbox{db: db, changed: make(chan struct{})}, nil
+}
+
+// Enqueue stores a call under its idempotency key. When the key is known
+// its last attempt is returned as is, so the call is never made twice.
+func (o *Outbox) Enqueue(id, method string, args any) (*OutboxEntry, error) {
+	return o.store(id, method, args, false)
+}
+
+// Retry stores a new attempt of a call whose last attempt failed, under
+// <id>:<n>. Callers check on chain first that the call is still needed. An
+// attempt that didn't fail is returned as is, so concurrent retries make a
+// single new attempt.
+func (o *Outbox) Retry(id, method string, args any) (*OutboxEntry, error) {
+	return o.store(id, method, args, true)
+}
+
+func (o *Outbox) store(id, method string, args any, retry bool) (*OutboxEntry, error) {
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s arguments: %v", method, err)
+	}
+
+	var entry *OutboxEntry
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		last, attempt, err := lastAttempt(tx, id)
+		if err == nil && (!retry || last.Status != OutboxFailed) {
+			entry = last
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrOutboxNotFound) {
+			return err
+		}
+
+		bucket := tx.Bucket(outboxBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		entry = &OutboxEntry{
+			ID:          attemptID(id, attempt+1),
+			Seq:         seq,
+			Method:      method,
+			Args:        encoded,
+			Status:      OutboxQueued,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		return putEntry(tx, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.notify()
+	return entry, nil
+}
+
+func (o *Outbox) Get(id string) (*OutboxEntry, error) {
+	var entry *OutboxEntry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getEntry(tx, id)
+		return err
+	})
+	return entry, err
+}
+
+// GetByTxHash finds the entry a transaction was signed for
+func (o *Outbox) GetByTxHash(txHash string) (*OutboxEntry, error) {
+	var entry *OutboxEntry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(hashesBucket).Get([]byte(txHash))
+		if id == nil {
+			return fmt.Errorf("%w: %s", ErrOutboxNotFound, txHash)
+		}
+		var err error
+		entry, err = getEntry(tx, string(id))
+		return err
+	})
+	return entry, err
+}
+
+// Update changes an entry inside a transaction, indexing its tx hash
+func (o *Outbox) Update(id string, fn func(entry *OutboxEntry) error) (*OutboxEntry, error) {
+	var entry *OutboxEntry
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		entry, err = getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+		entry.UpdatedAt = time.Now()
+		if entry.TxHash != "" {
+			if err := tx.Bucket(hashesBucket).Put([]byte(entry.TxHash), []byte(entry.ID)); err != nil {
+				return err
+			}
+		}
+		return putEntry(tx, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.notify()
+	return entry, nil
+}
+
+// Pending lists the entries that are not done, oldest first
+func (o *Outbox) Pending() ([]*OutboxEntry, error) {
+	var entries []*OutboxEntry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, value []byte) error {
+			var entry OutboxEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			if !entry.Done() {
+				entries = append(entries, &entry)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox: %v", err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
+
+// Changed returns a channel closed on the next update of any entry
+func (o *Outbox) Changed() <-chan struct{} {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.changed
+}
+
+func (o *Outbox) notify() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+func getEntry(tx *bolt.Tx, id string) (*OutboxEntry, error) {
+	value := tx.Bucket(outboxBucket).Get([]byte(id))
+	if value == nil {
+		return nil, fmt.Errorf("%w: %s", ErrOutboxNotFound, id)
+	}
+	var entry OutboxEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil, fmt.Errorf("corrupt outbox entry %s: %v", id, err)
+	}
+	return &entry, nil
+}
+
+// lastAttempt returns the last attempt of a call and its number, counting
+// from 1 for the entry stored under the key itself
+func lastAttempt(tx *bolt.Tx, id string) (*OutboxEntry, int, error) {
+	entry, err := getEntry(tx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	attempt := 1
+	for {
+		next, err := getEntry(tx, attemptID(id, attempt+1))
+		if errors.Is(err, ErrOutboxNotFound) {
+			return entry, attempt, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		entry = next
+		attempt++
+	}
+}
+
+func attemptID(id string, attempt int) string {
+	if attempt <= 1 {
+		return id
+	}
+	return fmt.Sprintf("%s:%d", id, attempt)
+}
+
+func putEntry(tx *bolt.Tx, entry *OutboxEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(outboxBucket).Put([]byte(entry.ID), value)
+}
+
+// backoff is the delay before the next attempt of a failing entry
+func backoff(attempts int) time.Duration {
+	if attempts > 6 {
+		return maxBackoff
+	}
+	delay := minBackoff << uint(attempts)
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
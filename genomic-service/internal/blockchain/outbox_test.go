@@ -0,0 +1,182 @@
+package blockchain
+
+import (
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	outbox, err := NewOutbox(path)
+	assert.NoError(t, err)
+
+	first, err := outbox.Enqueue("confirm:1", methodConfirm, confirmArgs{DocID: "a", SessionID: big.NewInt(1)})
+	assert.NoError(t, err)
+	second, err := outbox.Enqueue("confirm:2", methodConfirm, confirmArgs{DocID: "b", SessionID: big.NewInt(2)})
+	assert.NoError(t, err)
+	assert.Less(t, first.Seq, second.Seq)
+
+	// The same key never makes a second call, whatever the arguments
+	again, err := outbox.Enqueue("confirm:1", methodConfirm, confirmArgs{DocID: "other", SessionID: big.NewInt(1)})
+	assert.NoError(t, err)
+	assert.Equal(t, first.Seq, again.Seq)
+	assert.Equal(t, first.Args, again.Args)
+
+	// A signed transaction is found by hash, and survives a restart
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	tx, err := gethtypes.SignNewTx(key, gethtypes.LatestSignerForChainID(big.NewInt(9999)), &gethtypes.DynamicFeeTx{
+		ChainID:   big.NewInt(9999),
+		Nonce:     7,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(2),
+		Gas:       21000,
+		To:        &common.Address{},
+	})
+	assert.NoError(t, err)
+	raw, err := tx.MarshalBinary()
+	assert.NoError(t, err)
+
+	changed := outbox.Changed()
+	_, err = outbox.Update(first.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxSent
+		entry.Nonce = tx.Nonce()
+		entry.RawTx = raw
+		entry.TxHash = tx.Hash().Hex()
+		return nil
+	})
+	assert.NoError(t, err)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("update was not notified")
+	}
+
+	assert.NoError(t, outbox.Close())
+	outbox, err = NewOutbox(path)
+	assert.NoError(t, err)
+	defer outbox.Close()
+
+	entry, err := outbox.GetByTxHash(tx.Hash().Hex())
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, entry.ID)
+	stored, err := entry.Transaction()
+	assert.NoError(t, err)
+	assert.Equal(t, tx.Hash(), stored.Hash())
+
+	// An included entry isn't final yet
+	entry, err = outbox.Update(first.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxIncluded
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.False(t, entry.Done())
+	assert.True(t, isBroadcast(entry))
+	assert.False(t, isMined(entry))
+
+	// Mined entries keep their receipt and leave the pending list
+	_, err = outbox.Update(first.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxMined
+		entry.Receipt = &gethtypes.Receipt{
+			Status:      gethtypes.ReceiptStatusSuccessful,
+			TxHash:      tx.Hash(),
+			BlockNumber: big.NewInt(42),
+			Logs:        []*gethtypes.Log{{Address: common.Address{1}, Topics: []common.Hash{{2}}, Data: []byte{3}, TxHash: tx.Hash()}},
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	entry, err = outbox.Get(first.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), entry.Receipt.BlockNumber.Uint64())
+	assert.Equal(t, []byte{3}, entry.Receipt.Logs[0].Data)
+
+	pending, err := outbox.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, second.ID, pending[0].ID)
+
+	_, err = outbox.GetByTxHash("0xunknown")
+	assert.ErrorIs(t, err, ErrOutboxNotFound)
+}
+
+func TestOutboxRetry(t *testing.T) {
+	outbox := newTestOutbox(t)
+	args := confirmArgs{DocID: "a", SessionID: big.NewInt(1)}
+
+	first, err := outbox.Enqueue("confirm:1", methodConfirm, args)
+	assert.NoError(t, err)
+
+	// Nothing to retry while the first attempt may still go through
+	again, err := outbox.Retry("confirm:1", methodConfirm, args)
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, again.ID)
+
+	_, err = outbox.Update(first.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxFailed
+		entry.Error = "transaction reverted"
+		return nil
+	})
+	assert.NoError(t, err)
+	second, err := outbox.Retry("confirm:1", methodConfirm, args)
+	assert.NoError(t, err)
+	assert.Equal(t, "confirm:1:2", second.ID)
+	assert.Equal(t, OutboxQueued, second.Status)
+
+	// Enqueue and Retry both return the last attempt from now on
+	again, err = outbox.Enqueue("confirm:1", methodConfirm, args)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, again.ID)
+	again, err = outbox.Retry("confirm:1", methodConfirm, args)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, again.ID)
+
+	_, err = outbox.Update(second.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxFailed
+		return nil
+	})
+	assert.NoError(t, err)
+	third, err := outbox.Retry("confirm:1", methodConfirm, args)
+	assert.NoError(t, err)
+	assert.Equal(t, "confirm:1:3", third.ID)
+
+	pending, err := outbox.Pending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, third.ID, pending[0].ID)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, 2*time.Second, backoff(1))
+	assert.Equal(t, 32*time.Second, backoff(5))
+	assert.Equal(t, maxBackoff, backoff(6))
+	assert.Equal(t, maxBackoff, backoff(100))
+}
+
+func TestTransientErrors(t *testing.T) {
+	testCases := []struct {
+		message  string
+		revert   bool
+		known    bool
+		nonceLow bool
+	}{
+		{"failed to estimate gas needed: execution reverted: session already confirmed", true, false, false},
+		{"already known", false, true, false},
+		{"nonce too low: next nonce 8, tx nonce 7", false, false, true},
+		{"dial tcp 127.0.0.1:9650: connect: connection refused", false, false, false},
+	}
+	for _, tc := range testCases {
+		err := errors.New(tc.message)
+		assert.Equal(t, tc.revert, isRevert(err), tc.message)
+		assert.Equal(t, tc.known, isKnown(err), tc.message)
+		assert.Equal(t, tc.nonceLow, isNonceTooLow(err), tc.message)
+	}
+}
@@ -0,0 +1,268 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"genomic-service/contracts"
+	"genomic-service/internal/config"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Relay quota defaults, used for settings left at zero
+const (
+	defaultRelayMaxRequests = 10
+	defaultRelayWindow      = 24 * time.Hour
+	defaultRelayMaxGas      = 1_000_000
+)
+
+var (
+	// ErrRelayRejected is returned for requests the relayer won't pay for
+	ErrRelayRejected = errors.New("forward request rejected")
+	// ErrRelayQuota is returned once a user has used up their relayed calls
+	ErrRelayQuota = errors.New("relay quota exceeded")
+)
+
+// relayedMethods are the controller methods users may call through the relayer
+var relayedMethods = []string{"uploadData", "confirm"}
+
+// ForwardRequest is a controller call signed by a user for the trusted
+// forwarder, as EIP-712 typed data in the forwarder's domain:
+// ForwardRequest(address from,address to,uint256 value,uint256 gas,uint256 nonce,bytes data)
+type ForwardRequest = contracts.MinimalForwarderForwardRequest
+
+// Relayer sends users' signed controller calls through the trusted forwarder
+// (EIP-2771), so users without funds can open sessions and confirm them. The
+// service wallet pays the gas, the controller sees the user as the sender.
+type Relayer struct {
+	service    *BlockchainService
+	forwarder  *contracts.Forwarder
+	address    common.Address // of the forwarder
+	controller common.Address
+	methods    map[[4]byte]bool
+	maxGas     *big.Int
+	quota      *relayQuota
+}
+
+// NewRelayer relays through the forwarder of the settings, which the
+// controller must trust. Quotas are kept in store.
+func NewRelayer(service *BlockchainService, controllerAddr string, settings *config.RelayerSettings, store QuotaStore) (*Relayer, error) {
+	if !common.IsHexAddress(settings.ForwarderAddress) {
+		return nil, fmt.Errorf("invalid forwarder address: %q", settings.ForwarderAddress)
+	}
+	address := common.HexToAddress(settings.ForwarderAddress)
+	forwarder, err := contracts.NewForwarder(address, service.client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load forwarder: %v", err)
+	}
+
+	trusted, err := service.controller.IsTrustedForwarder(nil, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check forwarder: %v", err)
+	}
+	if !trusted {
+		return nil, fmt.Errorf("forwarder %s is not trusted by the controller", address.Hex())
+	}
+
+	controllerABI, err := contracts.ControllerMetaData.GetAbi()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load controller ABI: %v", err)
+	}
+	methods := make(map[[4]byte]bool)
+	for _, name := range relayedMethods {
+		methods[[4]byte(controllerABI.Methods[name].ID)] = true
+	}
+
+	maxRequests, window, maxGas := settings.MaxRequests, settings.Window, settings.MaxGas
+	if maxRequests <= 0 {
+		maxRequests = defaultRelayMaxRequests
+	}
+	if window <= 0 {
+		window = defaultRelayWindow
+	}
+	if maxGas == 0 {
+		maxGas = defaultRelayMaxGas
+	}
+
+	return &Relayer{
+		service:    service,
+		forwarder:  forwarder,
+		address:    address,
+		controller: common.HexToAddress(controllerAddr),
+		methods:    methods,
+		maxGas:     new(big.Int).SetUint64(maxGas),
+		quota:      newRelayQuota(maxRequests, window, store),
+	}, nil
+}
+
+// Forwarder is the address users sign requests for, the verifying contract
+// of the EIP-712 domain
+func (r *Relayer) Forwarder() common.Address {
+	return r.address
+}
+
+// Nonce is the nonce of the next request of a user. Requests are relayed in
+// nonce order, the next one once the previous is mined.
+func (r *Relayer) Nonce(ctx context.Context, user common.Address) (*big.Int, error) {
+	nonce, err := r.forwarder.GetNonce(&bind.CallOpts{Context: ctx}, user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get forwarder nonce: %v", err)
+	}
+	return nonce, nil
+}
+
+// Relay checks a signed request and queues it, returning the transaction hash
+// once broadcast. A request is relayed once: sending it again returns the
+// same transaction without counting against the quota.
+func (r *Relayer) Relay(ctx context.Context, req *ForwardRequest, signature []byte) (string, error) {
+	if req.Nonce == nil {
+		return "", fmt.Errorf("%w: nonce is required", ErrRelayRejected)
+	}
+	id := fmt.Sprintf("%s:%s:%s", methodExecute, req.From.Hex(), req.Nonce)
+	if _, err := r.service.outbox.Get(id); err == nil {
+		return r.sent(ctx, id)
+	}
+
+	if err := r.check(req); err != nil {
+		return "", err
+	}
+
+	// Signed by from, for its current nonce
+	valid, err := r.forwarder.Verify(&bind.CallOpts{Context: ctx}, *req, signature)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify forward request: %v", err)
+	}
+	if !valid {
+		return "", fmt.Errorf("%w: signature does not match the request or its nonce", ErrRelayRejected)
+	}
+
+	// The forwarder doesn't revert when the call does, so the call is
+	// simulated rather than paid for to fail
+	if err := r.simulate(ctx, req, signature); err != nil {
+		return "", err
+	}
+
+	ok, err := r.quota.take(req.From, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%w for %s", ErrRelayQuota, req.From.Hex())
+	}
+	if _, err := r.service.enqueue(id, methodExecute, executeArgs{Forwarder: r.address, Request: *req, Signature: signature}); err != nil {
+		return "", err
+	}
+	return r.sent(ctx, id)
+}
+
+// check applies the relay policy: controller calls only, no value, bounded
+// gas
+func (r *Relayer) check(req *ForwardRequest) error {
+	if req.To != r.controller {
+		return fmt.Errorf("%w: only controller calls are relayed", ErrRelayRejected)
+	}
+	if req.Value != nil && req.Value.Sign() != 0 {
+		return fmt.Errorf("%w: value can't be relayed", ErrRelayRejected)
+	}
+	if req.Gas == nil || req.Gas.Sign() <= 0 || req.Gas.Cmp(r.maxGas) > 0 {
+		return fmt.Errorf("%w: gas must be between 1 and %s", ErrRelayRejected, r.maxGas)
+	}
+	if len(req.Data) < 4 || !r.methods[[4]byte(req.Data[:4])] {
+		return fmt.Errorf("%w: method is not relayed", ErrRelayRejected)
+	}
+	return nil
+}
+
+// simulate runs the request as the service wallet would send it and fails
+// when the controller call reverts
+func (r *Relayer) simulate(ctx context.Context, req *ForwardRequest, signature []byte) error {
+	forwarderABI, err := contracts.ForwarderMetaData.GetAbi()
+	if err != nil {
+		return fmt.Errorf("failed to load forwarder ABI: %v", err)
+	}
+	input, err := forwarderABI.Pack("execute", *req, signature)
+	if err != nil {
+		return fmt.Errorf("failed to encode forward request: %v", err)
+	}
+
+	output, err := r.service.client.CallContract(ctx, ethereum.CallMsg{
+		From: r.service.wallet.Address,
+		To:   &r.address,
+		Data: input,
+	}, nil)
+	if err != nil {
+		if isRevert(err) {
+			return fmt.Errorf("%w: %v", ErrRelayRejected, err)
+		}
+		return fmt.Errorf("failed to simulate forward request: %v", err)
+	}
+
+	results, err := forwarderABI.Unpack("execute", output)
+	if err != nil || len(results) != 2 {
+		return fmt.Errorf("failed to decode forward result: %v", err)
+	}
+	if success, _ := results[0].(bool); !success {
+		returned, _ := results[1].([]byte)
+		reason, err := abi.UnpackRevert(returned)
+		if err != nil {
+			reason = "call reverted"
+		}
+		return fmt.Errorf("%w: %s", ErrRelayRejected, reason)
+	}
+	return nil
+}
+
+// sent waits for a relayed request to be broadcast
+func (r *Relayer) sent(ctx context.Context, id string) (string, error) {
+	entry, err := r.service.wait(ctx, id, isBroadcast)
+	if err != nil {
+		return "", fmt.Errorf("failed to relay request: %w", err)
+	}
+	return entry.TxHash, nil
+}
+
+// QuotaStore persists the times of each user's relayed requests, so quotas
+// survive restarts. It is implemented by uploads.Store.
+type QuotaStore interface {
+	// UpdateRelayed replaces the times of a user's requests by what fn
+	// returns, in a single transaction
+	UpdateRelayed(user string, fn func(used []time.Time) []time.Time) error
+}
+
+// relayQuota counts each user's relayed requests over a sliding window
+type relayQuota struct {
+	max    int
+	window time.Duration
+	store  QuotaStore
+}
+
+func newRelayQuota(max int, window time.Duration, store QuotaStore) *relayQuota {
+	return &relayQuota{max: max, window: window, store: store}
+}
+
+// take counts a request of user at now, false when over the quota
+func (q *relayQuota) take(user common.Address, now time.Time) (bool, error) {
+	var ok bool
+	err := q.store.UpdateRelayed(user.Hex(), func(used []time.Time) []time.Time {
+		// Drop the requests that left the window
+		for len(used) > 0 && now.Sub(used[0]) >= q.window {
+			used = used[1:]
+		}
+		ok = len(used) < q.max
+		if ok {
+			used = append(used, now)
+		}
+		return used
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to count relayed requests: %v", err)
+	}
+	return ok, nil
+}
@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"genomic-service/contracts"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// memQuotaStore keeps relayed requests in memory
+type memQuotaStore map[string][]time.Time
+
+func (m memQuotaStore) UpdateRelayed(user string, fn func(used []time.Time) []time.Time) error {
+	m[user] = fn(m[user])
+	return nil
+}
+
+func TestRelayQuota(t *testing.T) {
+	quota := newRelayQuota(2, time.Hour, memQuotaStore{})
+	alice, bob := common.Address{1}, common.Address{2}
+	now := time.Now()
+
+	take := func(user common.Address, at time.Time) bool {
+		ok, err := quota.take(user, at)
+		assert.NoError(t, err)
+		return ok
+	}
+
+	assert.True(t, take(alice, now))
+	assert.True(t, take(alice, now.Add(time.Minute)))
+	assert.False(t, take(alice, now.Add(2*time.Minute)))
+
+	// Users have their own quota
+	assert.True(t, take(bob, now))
+
+	// A request leaving the window makes room for one more
+	assert.True(t, take(alice, now.Add(time.Hour)))
+	assert.False(t, take(alice, now.Add(time.Hour+time.Second)))
+	assert.True(t, take(alice, now.Add(2*time.Hour)))
+}
+
+func TestRelayCheck(t *testing.T) {
+	controllerABI, err := contracts.ControllerMetaData.GetAbi()
+	assert.NoError(t, err)
+	uploadData, err := controllerABI.Pack("uploadData", "doc", common.Address{1})
+	assert.NoError(t, err)
+	setTeeSigner, err := controllerABI.Pack("setTeeSigner", common.Address{1}, true)
+	assert.NoError(t, err)
+
+	controller := common.HexToAddress("0x5aa01B3b5877255cE50cc55e8986a7a5fe29C70e")
+	relayer := &Relayer{
+		controller: controller,
+		methods:    map[[4]byte]bool{[4]byte(controllerABI.Methods["uploadData"].ID): true},
+		maxGas:     big.NewInt(1_000_000),
+	}
+
+	testCases := []struct {
+		name    string
+		to      common.Address
+		value   int64
+		gas     int64
+		data    []byte
+		allowed bool
+	}{
+		{"Controller call", controller, 0, 500_000, uploadData, true},
+		{"Other contract", common.Address{9}, 0, 500_000, uploadData, false},
+		{"With value", controller, 1, 500_000, uploadData, false},
+		{"Too much gas", controller, 0, 2_000_000, uploadData, false},
+		{"No gas", controller, 0, 0, uploadData, false},
+		{"Owner method", controller, 0, 500_000, setTeeSigner, false},
+		{"No method", controller, 0, 500_000, nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := relayer.check(&ForwardRequest{
+				From:  common.Address{1},
+				To:    tc.to,
+				Value: big.NewInt(tc.value),
+				Gas:   big.NewInt(tc.gas),
+				Nonce: big.NewInt(0),
+				Data:  tc.data,
+			})
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrRelayRejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,703 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"genomic-service/contracts"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+const (
+	// senderInterval is how often the sender looks at pending entries
+	senderInterval = time.Second
+	// rebroadcastInterval is how long a sent transaction may go without a
+	// receipt before it is broadcast again
+	rebroadcastInterval = 30 * time.Second
+	// senderConcurrency is how many entries the sender works on at once
+	senderConcurrency = 8
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Outbox methods and their arguments
+const (
+	methodUploadData   = "uploadData"
+	methodConfirm      = "confirm"
+	methodSetTeeSigner = "setTeeSigner"
+	methodExecute      = "execute" // a user's call relayed through the forwarder
+)
+
+type uploadDataArgs struct {
+	DocID string         `json:"docId"`
+	Owner common.Address `json:"owner"` // user's wallet, gets the G-NFT and reward
+}
+
+type confirmArgs struct {
+	DocID       string      `json:"docId"`
+	ContentHash string      `json:"contentHash"`
+	Proof       []byte      `json:"proof"`
+	SessionID   *big.Int    `json:"sessionId"`
+	RiskScore   int         `json:"riskScore"`
+	ModelID     string      `json:"modelId"`
+	ModelHash   common.Hash `json:"modelHash"`
+}
+
+type setTeeSignerArgs struct {
+	Signer  common.Address `json:"signer"`
+	Allowed bool           `json:"allowed"`
+}
+
+type executeArgs struct {
+	Forwarder common.Address                           `json:"forwarder"`
+	Request   contracts.MinimalForwarderForwardRequest `json:"request"`
+	Signature []byte                                   `json:"signature"`
+}
+
+// enqueue persists a call and wakes the sender up
+func (s *BlockchainService) enqueue(id, method string, args any) (*OutboxEntry, error) {
+	entry, err := s.outbox.Enqueue(id, method, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue %s: %v", method, err)
+	}
+	s.wakeUp()
+	return entry, nil
+}
+
+func (s *BlockchainService) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retry persists a new attempt of a failed call and wakes the sender up
+func (s *BlockchainService) retry(id, method string, args any) (*OutboxEntry, error) {
+	entry, err := s.outbox.Retry(id, method, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue %s again: %v", method, err)
+	}
+	s.wakeUp()
+	return entry, nil
+}
+
+// wait blocks until an entry satisfies until, or fails
+func (s *BlockchainService) wait(ctx context.Context, id string, until func(entry *OutboxEntry) bool) (*OutboxEntry, error) {
+	for {
+		// Taken before reading, so no update is missed in between
+		changed := s.outbox.Changed()
+
+		entry, err := s.outbox.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Status == OutboxFailed {
+			cause := ErrTxReverted
+			if entry.TimedOut {
+				cause = ErrTxTimeout
+			}
+			return entry, fmt.Errorf("%s %s failed: %s: %w", entry.Method, entry.ID, entry.Error, cause)
+		}
+		if until(entry) {
+			return entry, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func isMined(entry *OutboxEntry) bool {
+	return entry.Status == OutboxMined
+}
+
+func isBroadcast(entry *OutboxEntry) bool {
+	return entry.Status == OutboxMined || entry.Status == OutboxIncluded || (entry.Status == OutboxSent && entry.Broadcast)
+}
+
+// runSender works through the outbox until ctx is done
+func (s *BlockchainService) runSender(ctx context.Context) {
+	defer close(s.senderDone)
+
+	ticker := time.NewTicker(senderInterval)
+	defer ticker.Stop()
+	for {
+		s.sendPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// sendPending moves every due entry one step further, several at a time.
+// Nonces are allocated locally, so entries don't wait for each other: a
+// transaction signed but not broadcast keeps its nonce until it is.
+func (s *BlockchainService) sendPending(ctx context.Context) {
+	entries, err := s.outbox.Pending()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+
+	// Nothing is being signed between passes, so every allocated nonce is
+	// held by a sent entry
+	if s.needResync.Load() {
+		if err := s.resyncNonces(ctx, entries); err != nil {
+			log.Printf("Warning: %v", err)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, senderConcurrency)
+	for _, entry := range entries {
+		if time.Now().Before(entry.NextAttempt) {
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(entry *OutboxEntry) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			var err error
+			switch entry.Status {
+			case OutboxQueued:
+				err = s.sign(ctx, entry)
+			case OutboxSent:
+				err = s.track(ctx, entry)
+			case OutboxIncluded:
+				err = s.settle(ctx, entry)
+			}
+			if err != nil && ctx.Err() == nil {
+				s.needResync.Store(true)
+				s.retryLater(entry, err)
+			}
+		}(entry)
+	}
+	wg.Wait()
+
+	s.fillGaps(ctx)
+}
+
+// resyncNonces realigns the nonce manager with the node, keeping the nonces
+// of the transactions in flight
+func (s *BlockchainService) resyncNonces(ctx context.Context, entries []*OutboxEntry) error {
+	var held []uint64
+	for _, entry := range entries {
+		if entry.Status == OutboxSent || entry.Status == OutboxIncluded {
+			held = append(held, entry.Nonce)
+		}
+	}
+	if err := s.nonces.Resync(ctx, held); err != nil {
+		return err
+	}
+	s.needResync.Store(false)
+	return nil
+}
+
+// fillGaps sends a transfer to ourselves at every nonce no entry is going to
+// use, e.g. one left by a call that failed after it was allocated. Every
+// transaction after a gap stays pending until it is filled.
+func (s *BlockchainService) fillGaps(ctx context.Context) {
+	for _, nonce := range s.nonces.Gaps() {
+		if !s.nonces.Take(nonce) {
+			continue
+		}
+		if err := s.sendFiller(ctx, nonce); err != nil {
+			log.Printf("Warning: failed to fill nonce gap %d: %v", nonce, err)
+			s.nonces.Release(nonce)
+			s.needResync.Store(true)
+			return
+		}
+		log.Printf("Filled nonce gap %d", nonce)
+	}
+}
+
+func (s *BlockchainService) sendFiller(ctx context.Context, nonce uint64) error {
+	suggestedTip, baseFee, err := s.market(ctx)
+	if err != nil {
+		return err
+	}
+	tip, feeCap := s.fees.Fees(suggestedTip, baseFee)
+	tx, err := s.wallet.SignTx(transferToSelf(s.wallet.Address, nonce, tip, feeCap))
+	if err != nil {
+		return fmt.Errorf("failed to sign filler: %v", err)
+	}
+	return s.client.SendTransaction(ctx, tx)
+}
+
+// market returns the tip suggested by the node and the latest base fee
+func (s *BlockchainService) market(ctx context.Context) (*big.Int, *big.Int, error) {
+	tip, err := s.client.SuggestGasTipCap(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to suggest gas tip: %v", err)
+	}
+	head, err := s.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get latest header: %v", err)
+	}
+	return tip, head.BaseFee, nil
+}
+
+// transferToSelf is a transaction doing nothing but using up a nonce
+func transferToSelf(address common.Address, nonce uint64, tip, feeCap *big.Int) *gethtypes.Transaction {
+	return gethtypes.NewTx(&gethtypes.DynamicFeeTx{
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       params.TxGas,
+		To:        &address,
+		Value:     new(big.Int),
+	})
+}
+
+// sign builds and signs the transaction of an entry, stores it and then
+// broadcasts it. Calls the chain rejects at gas estimation fail for good.
+func (s *BlockchainService) sign(ctx context.Context, entry *OutboxEntry) error {
+	nonce, err := s.nonces.Next(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := s.transact(ctx, entry, nonce)
+	if err != nil {
+		s.nonces.Release(nonce)
+		if isRevert(err) {
+			s.fail(entry, err)
+			return nil
+		}
+		return err
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		s.nonces.Release(nonce)
+		return err
+	}
+
+	entry, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		now := time.Now()
+		entry.Status = OutboxSent
+		entry.Nonce = tx.Nonce()
+		entry.RawTx = raw
+		entry.TxHash = tx.Hash().Hex()
+		entry.Broadcast = false
+		entry.Signed = &now
+		if entry.FirstSigned == nil {
+			entry.FirstSigned = &now
+		}
+		return nil
+	})
+	if err != nil {
+		s.nonces.Release(nonce)
+		return err
+	}
+	return s.broadcast(ctx, entry)
+}
+
+// broadcast sends the stored transaction. Sending it again is harmless, the
+// node knows it by hash.
+func (s *BlockchainService) broadcast(ctx context.Context, entry *OutboxEntry) error {
+	tx, err := entry.Transaction()
+	if err != nil {
+		return err
+	}
+	err = s.client.SendTransaction(ctx, tx)
+	if err != nil && isNonceTooLow(err) {
+		return s.superseded(ctx, entry)
+	}
+	if err != nil && !isKnown(err) {
+		return fmt.Errorf("failed to broadcast %s: %v", entry.TxHash, err)
+	}
+
+	_, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		now := time.Now()
+		entry.Broadcast = true
+		entry.LastBroadcast = &now
+		entry.Attempts = 0
+		entry.Error = ""
+		return nil
+	})
+	return err
+}
+
+// superseded handles a transaction whose nonce is used up. Either it was
+// mined and track will find its receipt, or another transaction took the
+// nonce and the entry is signed again with a new one.
+func (s *BlockchainService) superseded(ctx context.Context, entry *OutboxEntry) error {
+	for _, hash := range entry.hashes() {
+		_, _, err := s.client.TransactionByHash(ctx, common.HexToHash(hash))
+		if err == nil {
+			_, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+				now := time.Now()
+				entry.Broadcast = true
+				entry.LastBroadcast = &now
+				return nil
+			})
+			return err
+		}
+		if !errors.Is(err, ethereum.NotFound) {
+			return fmt.Errorf("failed to look up %s: %v", hash, err)
+		}
+	}
+
+	s.needResync.Store(true)
+	// Given up already, the call isn't made again
+	if entry.cancelling() {
+		log.Printf("Outbox %s failed: nonce %d was taken by another transaction while cancelling", entry.ID, entry.Nonce)
+		_, err := s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+			entry.Status = OutboxFailed
+			entry.TimedOut = true
+			entry.Error = fmt.Sprintf("not mined within %s, nonce taken by another transaction", s.fees.Deadline)
+			return nil
+		})
+		return err
+	}
+
+	log.Printf("Warning: nonce %d of outbox %s was taken by another transaction, signing it again", entry.Nonce, entry.ID)
+	// The old hashes stay indexed, so waiters holding them still find the entry
+	_, err := s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxQueued
+		entry.RawTx = nil
+		entry.TxHash = ""
+		entry.Broadcast = false
+		entry.LastBroadcast = nil
+		entry.Signed = nil
+		entry.Replaced = nil
+		return nil
+	})
+	return err
+}
+
+// track checks for the receipt of a sent entry, of any transaction sent at
+// its nonce. Without one, it broadcasts the transaction again when it was
+// never broadcast or seems to have been dropped, replaces it with higher fees
+// when stuck, and cancels it at the deadline.
+func (s *BlockchainService) track(ctx context.Context, entry *OutboxEntry) error {
+	if !entry.Broadcast {
+		return s.broadcast(ctx, entry)
+	}
+
+	receipt, err := s.receipt(ctx, entry)
+	if errors.Is(err, ethereum.NotFound) {
+		switch {
+		case !entry.cancelling() && entry.FirstSigned != nil && time.Since(*entry.FirstSigned) > s.fees.Deadline:
+			return s.giveUp(ctx, entry)
+		case entry.Signed != nil && time.Since(*entry.Signed) > s.fees.StuckAfter:
+			return s.speedUp(ctx, entry)
+		case entry.LastBroadcast == nil || time.Since(*entry.LastBroadcast) > rebroadcastInterval:
+			return s.broadcast(ctx, entry)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxIncluded
+		entry.Receipt = receipt
+		return nil
+	})
+	return err
+}
+
+// settle makes the receipt of an included entry final once it is
+// confirmations blocks deep and its block is still on the canonical chain.
+// A receipt reorged out puts the entry back to sent, so its transaction is
+// broadcast and tracked again.
+func (s *BlockchainService) settle(ctx context.Context, entry *OutboxEntry) error {
+	head, err := s.client.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get head block: %v", err)
+	}
+	block := entry.Receipt.BlockNumber.Uint64()
+	if head < block+s.confirmations {
+		return nil
+	}
+	header, err := s.client.HeaderByNumber(ctx, entry.Receipt.BlockNumber)
+	if err != nil {
+		return fmt.Errorf("failed to get block %d: %v", block, err)
+	}
+
+	if header.Hash() != entry.Receipt.BlockHash {
+		log.Printf("Warning: outbox %s: block %d of %s was reorged out, tracking it again", entry.ID, block, entry.Receipt.TxHash.Hex())
+		_, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+			entry.Status = OutboxSent
+			entry.Receipt = nil
+			entry.Broadcast = false
+			return nil
+		})
+		return err
+	}
+
+	_, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		switch {
+		case entry.isCancel(entry.Receipt.TxHash.Hex()):
+			entry.Status = OutboxFailed
+			entry.TimedOut = true
+			entry.Error = fmt.Sprintf("not mined within %s, cancelled", s.fees.Deadline)
+		case entry.Receipt.Status == gethtypes.ReceiptStatusSuccessful:
+			entry.Status = OutboxMined
+		default:
+			entry.Status = OutboxFailed
+			entry.Error = "transaction reverted"
+		}
+		return nil
+	})
+	return err
+}
+
+// receipt looks for the receipt of the current transaction of an entry and
+// of those it replaced
+func (s *BlockchainService) receipt(ctx context.Context, entry *OutboxEntry) (*gethtypes.Receipt, error) {
+	for _, hash := range entry.hashes() {
+		receipt, err := s.client.TransactionReceipt(ctx, common.HexToHash(hash))
+		if err == nil {
+			return receipt, nil
+		}
+		if !errors.Is(err, ethereum.NotFound) {
+			return nil, fmt.Errorf("failed to get receipt of %s: %v", hash, err)
+		}
+	}
+	return nil, ethereum.NotFound
+}
+
+// speedUp replaces a stuck transaction by the same call at the same nonce
+// with higher fees. At the fee ceiling it is left as is.
+func (s *BlockchainService) speedUp(ctx context.Context, entry *OutboxEntry) error {
+	stuck, err := entry.Transaction()
+	if err != nil {
+		return err
+	}
+	suggestedTip, baseFee, err := s.market(ctx)
+	if err != nil {
+		return err
+	}
+
+	tip, feeCap, ok := s.fees.Bump(stuck.GasTipCap(), stuck.GasFeeCap(), suggestedTip, baseFee)
+	if !ok {
+		log.Printf("Warning: outbox %s is stuck at the fee ceiling", entry.ID)
+		_, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+			now := time.Now()
+			entry.Signed = &now
+			return nil
+		})
+		return err
+	}
+
+	tx, err := s.wallet.SignTx(gethtypes.NewTx(&gethtypes.DynamicFeeTx{
+		Nonce:     stuck.Nonce(),
+		GasTipCap: tip,
+		GasFeeCap: feeCap,
+		Gas:       stuck.Gas(),
+		To:        stuck.To(),
+		Value:     stuck.Value(),
+		Data:      stuck.Data(),
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to sign replacement: %v", err)
+	}
+
+	log.Printf("Replacing stuck transaction %s of outbox %s by %s", entry.TxHash, entry.ID, tx.Hash().Hex())
+	// A faster cancellation is a cancellation too
+	return s.replace(ctx, entry, tx, entry.cancelling())
+}
+
+// giveUp cancels an entry still pending at the deadline by a transfer to
+// ourselves at its nonce. The entry keeps being tracked with every
+// transaction sent at the nonce: it fails once the cancellation is mined,
+// and settles as usual if the call is mined first.
+func (s *BlockchainService) giveUp(ctx context.Context, entry *OutboxEntry) error {
+	stuck, err := entry.Transaction()
+	if err != nil {
+		return err
+	}
+	suggestedTip, baseFee, err := s.market(ctx)
+	if err != nil {
+		return err
+	}
+
+	tip, feeCap, ok := s.fees.Bump(stuck.GasTipCap(), stuck.GasFeeCap(), suggestedTip, baseFee)
+	if !ok {
+		return fmt.Errorf("can't cancel %s at the fee ceiling", entry.TxHash)
+	}
+	cancel, err := s.wallet.SignTx(transferToSelf(s.wallet.Address, stuck.Nonce(), tip, feeCap))
+	if err != nil {
+		return fmt.Errorf("failed to sign cancellation: %v", err)
+	}
+
+	log.Printf("Cancelling outbox %s, not mined within %s, by %s", entry.ID, s.fees.Deadline, cancel.Hash().Hex())
+	return s.replace(ctx, entry, cancel, true)
+}
+
+// replace makes tx the current transaction of an entry, at the same nonce,
+// and broadcasts it. The transactions it replaces are still tracked.
+func (s *BlockchainService) replace(ctx context.Context, entry *OutboxEntry, tx *gethtypes.Transaction, cancel bool) error {
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	entry, err = s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		now := time.Now()
+		entry.Replaced = append(entry.Replaced, entry.TxHash)
+		if cancel {
+			entry.Cancels = append(entry.Cancels, tx.Hash().Hex())
+		}
+		entry.RawTx = raw
+		entry.TxHash = tx.Hash().Hex()
+		entry.Broadcast = false
+		entry.Signed = &now
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.broadcast(ctx, entry)
+}
+
+// retryLater backs off an entry after a transient failure
+func (s *BlockchainService) retryLater(entry *OutboxEntry, cause error) {
+	log.Printf("Warning: outbox %s: %v", entry.ID, cause)
+	_, err := s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		entry.Attempts++
+		entry.NextAttempt = time.Now().Add(backoff(entry.Attempts))
+		entry.Error = cause.Error()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: failed to update outbox %s: %v", entry.ID, err)
+	}
+}
+
+func (s *BlockchainService) fail(entry *OutboxEntry, cause error) {
+	log.Printf("Outbox %s failed: %v", entry.ID, cause)
+	_, err := s.outbox.Update(entry.ID, func(entry *OutboxEntry) error {
+		entry.Status = OutboxFailed
+		entry.Error = cause.Error()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: failed to update outbox %s: %v", entry.ID, err)
+	}
+}
+
+// transact signs the contract call of an entry without sending it
+func (s *BlockchainService) transact(ctx context.Context, entry *OutboxEntry, nonce uint64) (*gethtypes.Transaction, error) {
+	opts, err := s.wallet.GetTransactOpts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction opts: %v", err)
+	}
+	opts.Context = ctx
+	opts.Nonce = new(big.Int).SetUint64(nonce)
+	opts.NoSend = true
+
+	suggestedTip, baseFee, err := s.market(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts.GasTipCap, opts.GasFeeCap = s.fees.Fees(suggestedTip, baseFee)
+
+	// The binding estimates gas, the transaction is signed once the margin
+	// is added
+	opts.Signer = func(_ common.Address, tx *gethtypes.Transaction) (*gethtypes.Transaction, error) {
+		return tx, nil
+	}
+	tx, err := s.call(opts, entry)
+	if err != nil {
+		return nil, err
+	}
+	return s.wallet.SignTx(gethtypes.NewTx(&gethtypes.DynamicFeeTx{
+		Nonce:     tx.Nonce(),
+		GasTipCap: tx.GasTipCap(),
+		GasFeeCap: tx.GasFeeCap(),
+		Gas:       s.fees.GasLimit(tx.Gas()),
+		To:        tx.To(),
+		Value:     tx.Value(),
+		Data:      tx.Data(),
+	}))
+}
+
+// call builds the unsigned transaction of the contract call of an entry
+func (s *BlockchainService) call(opts *bind.TransactOpts, entry *OutboxEntry) (*gethtypes.Transaction, error) {
+	switch entry.Method {
+	case methodUploadData:
+		var args uploadDataArgs
+		if err := json.Unmarshal(entry.Args, &args); err != nil {
+			return nil, err
+		}
+		return s.controller.UploadData(opts, args.DocID, args.Owner)
+
+	case methodConfirm:
+		var args confirmArgs
+		if err := json.Unmarshal(entry.Args, &args); err != nil {
+			return nil, err
+		}
+		return s.controller.Confirm(
+			opts,
+			args.DocID,
+			args.ContentHash,
+			args.Proof,
+			args.SessionID,
+			big.NewInt(int64(args.RiskScore)),
+			args.ModelID,
+			args.ModelHash,
+		)
+
+	case methodSetTeeSigner:
+		var args setTeeSignerArgs
+		if err := json.Unmarshal(entry.Args, &args); err != nil {
+			return nil, err
+		}
+		return s.controller.SetTeeSigner(opts, args.Signer, args.Allowed)
+
+	case methodExecute:
+		var args executeArgs
+		if err := json.Unmarshal(entry.Args, &args); err != nil {
+			return nil, err
+		}
+		forwarder, err := contracts.NewForwarder(args.Forwarder, s.client)
+		if err != nil {
+			return nil, err
+		}
+		return forwarder.Execute(opts, args.Request, args.Signature)
+	}
+	return nil, fmt.Errorf("unknown outbox method %s", entry.Method)
+}
+
+// isRevert tells calls the contract rejects from transient RPC failures
+func isRevert(err error) bool {
+	return strings.Contains(err.Error(), "execution reverted")
+}
+
+// isKnown tells whether the node already has the transaction
+func isKnown(err error) bool {
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "already known") ||
+		strings.Contains(message, "known transaction")
+}
+
+// isNonceTooLow tells whether a transaction with the same nonce was mined
+func isNonceTooLow(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "nonce too low")
+}
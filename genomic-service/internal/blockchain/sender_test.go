@@ -0,0 +1,199 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"genomic-service/internal/config"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSimulatedService returns a service sending through a simulated chain,
+// blocks are only mined on Commit. The sender loop isn't started, tests move
+// entries along with sendPending.
+func newSimulatedService(t *testing.T) (*BlockchainService, *simulated.Backend) {
+	key, err := crypto.GenerateKey()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	wallet := &Wallet{PrivateKey: key, PublicKey: &key.PublicKey, Address: crypto.PubkeyToAddress(key.PublicKey)}
+
+	alloc := gethtypes.GenesisAlloc{wallet.Address: {Balance: big.NewInt(1e18)}}
+	backend := simulated.NewBackend(alloc, func(_ *node.Config, ethConf *ethconfig.Config) {
+		chainConfig := *ethConf.Genesis.Config
+		chainConfig.ChainID = big.NewInt(ChainID)
+		ethConf.Genesis.Config = &chainConfig
+		ethConf.NetworkId = ChainID
+	})
+	t.Cleanup(func() { backend.Close() })
+
+	// Receipts can't be looked up until the transaction indexer has run on
+	// a block past genesis
+	backend.Commit()
+	unknown := common.HexToHash("0x01")
+	assert.Eventually(t, func() bool {
+		_, err := backend.Client().TransactionReceipt(context.Background(), unknown)
+		return errors.Is(err, ethereum.NotFound)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	service := &BlockchainService{
+		client: backend.Client(),
+		wallet: wallet,
+		outbox: newTestOutbox(t),
+		wake:   make(chan struct{}, 1),
+		nonces: NewNonceManager(backend.Client(), wallet.Address),
+		fees:   NewFeePolicy(&config.BlockchainSettings{}),
+	}
+	service.needResync.Store(true)
+	return service, backend
+}
+
+// sentEntry stores an entry whose transfer was signed with the given tip and
+// is about to be broadcast. A tip of 1 wei is below what the simulated miner
+// takes, so it stays pending until replaced.
+func sentEntry(t *testing.T, service *BlockchainService, id string, tip *big.Int) *OutboxEntry {
+	ctx := context.Background()
+	head, err := service.client.HeaderByNumber(ctx, nil)
+	assert.NoError(t, err)
+	nonce, err := service.nonces.Next(ctx)
+	assert.NoError(t, err)
+
+	recipient := common.HexToAddress("0x0000000000000000000000000000000000001234")
+	tx, err := service.wallet.SignTx(gethtypes.NewTx(&gethtypes.DynamicFeeTx{
+		Nonce:     nonce,
+		GasTipCap: tip,
+		GasFeeCap: new(big.Int).Add(new(big.Int).Mul(head.BaseFee, big.NewInt(2)), tip),
+		Gas:       21000,
+		To:        &recipient,
+		Value:     big.NewInt(1),
+	}))
+	assert.NoError(t, err)
+	raw, err := tx.MarshalBinary()
+	assert.NoError(t, err)
+
+	_, err = service.outbox.Enqueue(id, methodSetTeeSigner, setTeeSignerArgs{})
+	assert.NoError(t, err)
+	entry, err := service.outbox.Update(id, func(entry *OutboxEntry) error {
+		now := time.Now()
+		entry.Status = OutboxSent
+		entry.Nonce = nonce
+		entry.RawTx = raw
+		entry.TxHash = tx.Hash().Hex()
+		entry.Signed = &now
+		entry.FirstSigned = &now
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return entry
+}
+
+// backdate moves the signing times of an entry into the past
+func backdate(t *testing.T, service *BlockchainService, id string, signed, firstSigned time.Duration) *OutboxEntry {
+	entry, err := service.outbox.Update(id, func(entry *OutboxEntry) error {
+		signedAt, firstSignedAt := time.Now().Add(-signed), time.Now().Add(-firstSigned)
+		entry.Signed = &signedAt
+		entry.FirstSigned = &firstSignedAt
+		return nil
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return entry
+}
+
+func currentEntry(t *testing.T, service *BlockchainService, id string) *OutboxEntry {
+	entry, err := service.outbox.Get(id)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return entry
+}
+
+func TestSender(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("stuck transaction is replaced", func(t *testing.T) {
+		service, backend := newSimulatedService(t)
+		original := sentEntry(t, service, "stuck", big.NewInt(1))
+		service.sendPending(ctx)
+		backend.Commit()
+		service.sendPending(ctx)
+		assert.Equal(t, OutboxSent, currentEntry(t, service, "stuck").Status)
+
+		backdate(t, service, "stuck", 2*service.fees.StuckAfter, 2*service.fees.StuckAfter)
+		service.sendPending(ctx)
+		entry := currentEntry(t, service, "stuck")
+		assert.Equal(t, []string{original.TxHash}, entry.Replaced)
+		assert.NotEqual(t, original.TxHash, entry.TxHash)
+
+		backend.Commit()
+		service.sendPending(ctx)
+		service.sendPending(ctx)
+		entry = currentEntry(t, service, "stuck")
+		assert.Equal(t, OutboxMined, entry.Status)
+		if !assert.NotNil(t, entry.Receipt) {
+			t.FailNow()
+		}
+		assert.Equal(t, entry.TxHash, entry.Receipt.TxHash.Hex())
+	})
+
+	t.Run("call given up fails once the cancellation is mined", func(t *testing.T) {
+		service, backend := newSimulatedService(t)
+		original := sentEntry(t, service, "late", big.NewInt(1))
+		service.sendPending(ctx)
+
+		backdate(t, service, "late", time.Second, 2*service.fees.Deadline)
+		service.sendPending(ctx)
+		entry := currentEntry(t, service, "late")
+		assert.Equal(t, OutboxSent, entry.Status)
+		assert.Equal(t, []string{original.TxHash}, entry.Replaced)
+		assert.Equal(t, []string{entry.TxHash}, entry.Cancels)
+
+		backend.Commit()
+		service.sendPending(ctx)
+		service.sendPending(ctx)
+		entry = currentEntry(t, service, "late")
+		assert.Equal(t, OutboxFailed, entry.Status)
+		assert.True(t, entry.TimedOut)
+
+		_, err := service.wait(ctx, "late", isMined)
+		assert.True(t, errors.Is(err, ErrTxTimeout))
+	})
+
+	t.Run("call mined while cancelling settles as mined", func(t *testing.T) {
+		service, backend := newSimulatedService(t)
+		tip, err := service.client.SuggestGasTipCap(ctx)
+		assert.NoError(t, err)
+		original := sentEntry(t, service, "raced", tip)
+		service.sendPending(ctx)
+		backend.Commit()
+
+		// The deadline passed before the receipt was seen
+		assert.NoError(t, service.giveUp(ctx, currentEntry(t, service, "raced")))
+		entry := currentEntry(t, service, "raced")
+		assert.Len(t, entry.Cancels, 1)
+
+		service.sendPending(ctx)
+		service.sendPending(ctx)
+		entry = currentEntry(t, service, "raced")
+		assert.Equal(t, OutboxMined, entry.Status)
+		assert.False(t, entry.TimedOut)
+		if !assert.NotNil(t, entry.Receipt) {
+			t.FailNow()
+		}
+		assert.Equal(t, original.TxHash, entry.Receipt.TxHash.Hex())
+	})
+}
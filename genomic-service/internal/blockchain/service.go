@@ -2,26 +2,75 @@ package blockchain
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"math/big"
+	"sync/atomic"
+	"time"
 
 	"genomic-service/contracts"
 	"genomic-service/internal/types"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/google/uuid"
 )
 
+// receiptPollInterval is how often a pending transaction is checked
+const receiptPollInterval = time.Second
+
+// ErrTxReverted is returned for transactions mined with a failed status,
+// sending them again won't help
+var ErrTxReverted = errors.New("transaction reverted")
+
+// ErrSessionOwner is returned when an upload session was opened for another
+// wallet than the one given, its G-NFT and reward would go there
+var ErrSessionOwner = errors.New("upload session belongs to another wallet")
+
+// ErrNoSession is returned for a relayed uploadData transaction that opened
+// no session for the document, e.g. because the forwarded call reverted
+var ErrNoSession = errors.New("transaction opened no upload session")
+
+// Backend is what the service needs from the node. ethclient.Client has it,
+// so does the simulated backend of the tests.
+type Backend interface {
+	bind.ContractBackend
+	ethereum.ChainStateReader
+	ethereum.TransactionReader
+	ethereum.BlockNumberReader
+}
+
 type BlockchainService struct {
-	client     *ethclient.Client
-	wallet     *Wallet
-	controller *contracts.Controller
-	nft        *contracts.GeneNFT
-	token      *contracts.PCSPToken
+	client         Backend
+	wallet         *Wallet
+	controller     *contracts.Controller
+	controllerAddr common.Address
+	nft            *contracts.GeneNFT
+	token          *contracts.PCSPToken
+
+	// Every transaction goes through the outbox, sent by a background loop
+	outbox     *Outbox
+	wake       chan struct{}
+	stopSender context.CancelFunc
+	senderDone chan struct{}
+
+	// Nonces are allocated locally, resynced with the node after errors
+	nonces     *NonceManager
+	needResync atomic.Bool
+
+	fees          *FeePolicy
+	confirmations uint64 // blocks on top of a receipt before it is final
 }
 
-func NewBlockchainService(rpcURL, privateKey, controllerAddr string) (*BlockchainService, error) {
+// NewBlockchainService connects to the controller and starts sending the
+// calls queued in outbox, including those left by a previous run, priced by
+// fees. Receipts are final once confirmations blocks deep.
+func NewBlockchainService(rpcURL, privateKey, controllerAddr string, outbox *Outbox, fees *FeePolicy, confirmations uint64) (*BlockchainService, error) {
 	// Connect to network
 	client, err := ethclient.Dial(rpcURL)
 	if err != nil {
@@ -62,38 +111,75 @@ func NewBlockchainService(rpcURL, privateKey, controllerAddr string) (*Blockchai
 		return nil, fmt.Errorf("failed to load token contract: %v", err)
 	}
 
-	return &BlockchainService{
-		client:     client,
-		wallet:     wallet,
-		controller: controller,
-		nft:        nft,
-		token:      token,
-	}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	service := &BlockchainService{
+		client:         client,
+		wallet:         wallet,
+		controller:     controller,
+		controllerAddr: common.HexToAddress(controllerAddr),
+		nft:            nft,
+		token:          token,
+		outbox:         outbox,
+		wake:           make(chan struct{}, 1),
+		stopSender:     cancel,
+		senderDone:     make(chan struct{}),
+		nonces:         NewNonceManager(client, wallet.Address),
+		fees:           fees,
+		confirmations:  confirmations,
+	}
+	service.needResync.Store(true)
+	go service.runSender(ctx)
+	return service, nil
+}
+
+// Client returns the connection to the network, for readers like the indexer
+func (s *BlockchainService) Client() Backend {
+	return s.client
+}
+
+// Close stops the sender, pending calls stay in the outbox for the next run
+func (s *BlockchainService) Close() {
+	s.stopSender()
+	<-s.senderDone
 }
 
-// InitiateDataUpload starts the upload session on blockchain
-func (s *BlockchainService) InitiateDataUpload(docID string) (string, error) {
-	opts, err := s.wallet.GetTransactOpts()
+// InitiateDataUpload starts the upload session on blockchain for the user's
+// wallet, which receives the G-NFT and reward of the document. It is queued
+// once per document, so calling it again returns the same session. A call
+// that failed opened no session, calling again makes a new attempt.
+func (s *BlockchainService) InitiateDataUpload(docID, wallet string) (string, error) {
+	owner, err := parseWallet(wallet)
 	if err != nil {
-		return "", fmt.Errorf("failed to get transaction opts: %v", err)
+		return "", err
 	}
 
-	// Call uploadData on controller contract
-	tx, err := s.controller.UploadData(opts, docID)
+	id := methodUploadData + ":" + docID
+	args := uploadDataArgs{DocID: docID, Owner: owner}
+	entry, err := s.enqueue(id, methodUploadData, args)
 	if err != nil {
-		return "", fmt.Errorf("failed to initiate upload: %v", err)
+		return "", err
+	}
+	if entry.Status == OutboxFailed {
+		log.Printf("Retrying %s, the last attempt failed: %s", entry.ID, entry.Error)
+		entry, err = s.retry(id, methodUploadData, args)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	// Wait for transaction to be mined
-	receipt, err := bind.WaitMined(context.Background(), s.client, tx)
+	entry, err = s.wait(context.Background(), entry.ID, isMined)
 	if err != nil {
-		return "", fmt.Errorf("failed to wait for transaction: %v", err)
+		return "", fmt.Errorf("failed to initiate upload: %w", err)
 	}
 
 	// Get session ID from event
-	for _, log := range receipt.Logs {
+	for _, log := range entry.Receipt.Logs {
 		event, err := s.controller.ParseUploadData(*log)
 		if err == nil && event != nil {
+			if event.Owner != owner {
+				return "", fmt.Errorf("session %s of %s: %w", event.SessionId, docID, ErrSessionOwner)
+			}
 			return event.SessionId.String(), nil
 		}
 	}
@@ -101,47 +187,305 @@ func (s *BlockchainService) InitiateDataUpload(docID string) (string, error) {
 	return "", fmt.Errorf("failed to get session ID from event")
 }
 
-// ProcessAndMint handles the confirmation, NFT minting, and token rewards
-func (s *BlockchainService) ProcessAndMint(result *types.ProcessResult) error {
-	opts, err := s.wallet.GetTransactOpts()
+// RelayedSession finds the session a user opened for a document by sending
+// uploadData through the relayer themselves. The session must be opened by
+// the wallet for itself, so the user confirms it, and final like the ones
+// the service opens.
+func (s *BlockchainService) RelayedSession(ctx context.Context, txHash, docID, wallet string) (string, error) {
+	owner, err := parseWallet(wallet)
+	if err != nil {
+		return "", err
+	}
+
+	receipt, err := s.waitFinal(ctx, common.HexToHash(txHash))
+	if err != nil {
+		return "", err
+	}
+	if receipt.Status != gethtypes.ReceiptStatusSuccessful {
+		return "", fmt.Errorf("relayed transaction %s: %w", txHash, ErrTxReverted)
+	}
+
+	for _, log := range receipt.Logs {
+		if log.Address != s.controllerAddr {
+			continue
+		}
+		event, err := s.controller.ParseUploadData(*log)
+		if err != nil || event.DocId != docID {
+			continue
+		}
+		if event.Owner != owner {
+			return "", fmt.Errorf("session %s of %s: %w", event.SessionId, docID, ErrSessionOwner)
+		}
+		session, err := s.controller.GetSession(&bind.CallOpts{Context: ctx}, event.SessionId)
+		if err != nil {
+			return "", fmt.Errorf("failed to get session: %v", err)
+		}
+		if session.User != owner {
+			return "", fmt.Errorf("session %s was opened by %s: %w", event.SessionId, session.User.Hex(), ErrSessionOwner)
+		}
+		return event.SessionId.String(), nil
+	}
+	return "", fmt.Errorf("relayed transaction %s for %s: %w", txHash, docID, ErrNoSession)
+}
+
+// waitFinal waits for a transaction we don't hold to be confirmations
+// blocks deep on the canonical chain, at most the transaction deadline
+func (s *BlockchainService) waitFinal(ctx context.Context, hash common.Hash) (*gethtypes.Receipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.fees.Deadline)
+	defer cancel()
+
+	for {
+		receipt, err := s.waitReceipt(ctx, hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for transaction %s: %v", hash.Hex(), err)
+		}
+		head, err := s.client.BlockNumber(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get head block: %v", err)
+		}
+		if head >= receipt.BlockNumber.Uint64()+s.confirmations {
+			header, err := s.client.HeaderByNumber(ctx, receipt.BlockNumber)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get block %d: %v", receipt.BlockNumber, err)
+			}
+			// Otherwise reorged out, the receipt is asked for again
+			if header.Hash() == receipt.BlockHash {
+				return receipt, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to wait for transaction %s: %v", hash.Hex(), ctx.Err())
+		case <-time.After(receiptPollInterval):
+		}
+	}
+}
+
+// ProcessAndMint handles the confirmation, NFT minting, and token rewards to
+// the wallet the session was opened for
+func (s *BlockchainService) ProcessAndMint(result *types.ProcessResult, wallet string) error {
+	ctx := context.Background()
+	txHash, err := s.SubmitConfirm(ctx, result, wallet)
 	if err != nil {
-		return fmt.Errorf("failed to get transaction opts: %v", err)
+		return err
 	}
 
+	mint, err := s.WaitForMint(ctx, txHash)
+	if err != nil {
+		return err
+	}
+	log.Printf("Minted G-NFT %s to %s with a PCSP reward of %s", mint.TokenID, mint.Owner, mint.Reward)
+	return nil
+}
+
+// SubmitConfirm queues the confirm transaction for a TEE result and returns
+// its hash once broadcast. The controller mints to the session owner, which
+// must be wallet. There is one confirm per session: submitting the session
+// again returns the transaction queued the first time, unless that one failed
+// and the session is still unconfirmed on chain.
+func (s *BlockchainService) SubmitConfirm(ctx context.Context, result *types.ProcessResult, wallet string) (string, error) {
 	// Convert session ID to big.Int
-	sessionID := new(big.Int)
-	sessionID.SetString(result.SessionID, 10)
+	sessionID, ok := new(big.Int).SetString(result.SessionID, 10)
+	if !ok {
+		return "", fmt.Errorf("invalid session ID: %s", result.SessionID)
+	}
+
+	owner, err := parseWallet(wallet)
+	if err != nil {
+		return "", err
+	}
+	session, err := s.controller.GetSession(&bind.CallOpts{Context: ctx}, sessionID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get session: %v", err)
+	}
+	if session.Owner != owner {
+		return "", fmt.Errorf("session %s: %w", sessionID, ErrSessionOwner)
+	}
+
+	// The TEE signature over the result, checked by the controller
+	proof, err := hexutil.Decode(result.Proof)
+	if err != nil {
+		return "", fmt.Errorf("invalid proof: %v", err)
+	}
+	modelHash, err := hexutil.Decode(result.ModelHash)
+	if err != nil || len(modelHash) != common.HashLength {
+		return "", fmt.Errorf("invalid model hash: %s", result.ModelHash)
+	}
+
+	// Only what goes on chain is stored, the salt stays out of the outbox
+	id := methodConfirm + ":" + sessionID.String()
+	args := confirmArgs{
+		DocID:       result.DocID,
+		ContentHash: result.ContentHash,
+		Proof:       proof,
+		SessionID:   sessionID,
+		RiskScore:   result.RiskScore,
+		ModelID:     result.ModelID,
+		ModelHash:   common.BytesToHash(modelHash),
+	}
+	entry, err := s.enqueue(id, methodConfirm, args)
+	if err != nil {
+		return "", err
+	}
+	// A failed attempt is final, so the session read above is up to date
+	// with it
+	if entry.Status == OutboxFailed && !session.Confirmed {
+		log.Printf("Retrying %s, the last attempt failed and session %s is unconfirmed: %s", entry.ID, sessionID, entry.Error)
+		entry, err = s.retry(id, methodConfirm, args)
+		if err != nil {
+			return "", err
+		}
+	}
 
-	// Call confirm on controller contract
-	tx, err := s.controller.Confirm(
-		opts,
-		result.DocID,
-		result.ContentHash,
-		"0x1234", // Simplified proof for development
-		sessionID,
-		big.NewInt(int64(result.RiskScore)),
-	)
+	entry, err = s.wait(ctx, entry.ID, isBroadcast)
 	if err != nil {
-		return fmt.Errorf("failed to confirm upload: %v", err)
+		return "", fmt.Errorf("failed to confirm upload: %w", err)
 	}
+	return entry.TxHash, nil
+}
 
-	// Wait for transaction and process events
-	receipt, err := bind.WaitMined(context.Background(), s.client, tx)
+// SessionConfirmed reads whether an upload session was confirmed on chain
+func (s *BlockchainService) SessionConfirmed(sessionID string) (bool, error) {
+	id, ok := new(big.Int).SetString(sessionID, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid session ID: %s", sessionID)
+	}
+	session, err := s.controller.GetSession(nil, id)
 	if err != nil {
-		return fmt.Errorf("failed to wait for transaction: %v", err)
+		return false, fmt.Errorf("failed to get session: %v", err)
 	}
+	return session.Confirmed, nil
+}
 
-	// Process events
+// WaitForMint waits for a confirm transaction to be mined and reads the
+// minted G-NFT and PCSP reward from its events
+func (s *BlockchainService) WaitForMint(ctx context.Context, txHash string) (*types.MintResult, error) {
+	var receipt *gethtypes.Receipt
+	entry, err := s.outbox.GetByTxHash(txHash)
+	switch {
+	case err == nil:
+		entry, err = s.wait(ctx, entry.ID, isMined)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for transaction: %w", err)
+		}
+		receipt = entry.Receipt
+	case errors.Is(err, ErrOutboxNotFound):
+		// Sent before the outbox existed, nothing replaces it when stuck
+		waitCtx, cancel := context.WithTimeout(ctx, s.fees.Deadline)
+		defer cancel()
+		receipt, err = s.waitReceipt(waitCtx, common.HexToHash(txHash))
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, fmt.Errorf("confirm transaction %s: %w", txHash, ErrTxTimeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to wait for transaction: %v", err)
+		}
+		if receipt.Status != gethtypes.ReceiptStatusSuccessful {
+			return nil, fmt.Errorf("confirm transaction %s: %w", txHash, ErrTxReverted)
+		}
+	default:
+		return nil, err
+	}
+
+	// The entry may have been signed again since txHash was handed out
+	mint := &types.MintResult{
+		TxHash:      receipt.TxHash.Hex(),
+		BlockNumber: receipt.BlockNumber.Uint64(),
+	}
 	for _, log := range receipt.Logs {
 		// Check for NFT minted event
 		if nftEvent, err := s.controller.ParseGeneNFTMinted(*log); err == nil && nftEvent != nil {
-			fmt.Printf("NFT minted with token ID: %s\n", nftEvent.TokenId)
+			mint.TokenID = nftEvent.TokenId.String()
 		}
-		// Check for PCSP rewarded event
+		// Check for PCSP rewarded event, paid to the session owner
 		if pcspEvent, err := s.controller.ParsePCSPRewarded(*log); err == nil && pcspEvent != nil {
-			fmt.Printf("PCSP tokens rewarded: %s\n", pcspEvent.Amount)
+			mint.Owner = pcspEvent.User.Hex()
+			mint.Reward = pcspEvent.Amount.String()
+		}
+	}
+	if mint.TokenID == "" {
+		return nil, fmt.Errorf("no G-NFT minted by transaction %s", txHash)
+	}
+	return mint, nil
+}
+
+// waitReceipt polls for a receipt by hash, like bind.WaitMined does for a
+// transaction we still hold
+func (s *BlockchainService) waitReceipt(ctx context.Context, hash common.Hash) (*gethtypes.Receipt, error) {
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+
+	for {
+		receipt, err := s.client.TransactionReceipt(ctx, hash)
+		if err == nil {
+			return receipt, nil
+		}
+		if !errors.Is(err, ethereum.NotFound) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
 		}
 	}
+}
 
+// SetTeeSigner allows or revokes a TEE key to sign proofs. Only the controller
+// owner can call it, e.g. after a key rotation.
+func (s *BlockchainService) SetTeeSigner(signer string, allowed bool) error {
+	entry, err := s.enqueue(methodSetTeeSigner+":"+uuid.New().String(), methodSetTeeSigner, setTeeSignerArgs{
+		Signer:  common.HexToAddress(signer),
+		Allowed: allowed,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.wait(context.Background(), entry.ID, isMined); err != nil {
+		return fmt.Errorf("failed to set TEE signer: %w", err)
+	}
 	return nil
 }
+
+// IsTeeSigner reports whether the controller accepts proofs signed by signer
+func (s *BlockchainService) IsTeeSigner(signer string) (bool, error) {
+	allowed, err := s.controller.TeeSigners(nil, common.HexToAddress(signer))
+	if err != nil {
+		return false, fmt.Errorf("failed to get TEE signer: %v", err)
+	}
+	return allowed, nil
+}
+
+// EnsureTeeSigner allows signer unless the controller already does, so the
+// TEE's proofs are accepted. Signers allowed before are kept for the proofs
+// they signed.
+func (s *BlockchainService) EnsureTeeSigner(signer string) error {
+	allowed, err := s.IsTeeSigner(signer)
+	if err != nil || allowed {
+		return err
+	}
+	return s.SetTeeSigner(signer, true)
+}
+
+// parseWallet checks a user's wallet address
+func parseWallet(wallet string) (common.Address, error) {
+	if !common.IsHexAddress(wallet) {
+		return common.Address{}, fmt.Errorf("invalid wallet address: %q", wallet)
+	}
+	address := common.HexToAddress(wallet)
+	if address == (common.Address{}) {
+		return common.Address{}, fmt.Errorf("invalid wallet address: %q", wallet)
+	}
+	return address, nil
+}
+
+// GetContentHash returns the genome commitment anchored for a document
+func (s *BlockchainService) GetContentHash(docID string) (string, error) {
+	doc, err := s.controller.GetDoc(nil, docID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get doc: %v", err)
+	}
+	return doc.HashContent, nil
+}
@@ -1,11 +1,17 @@
 package blockchain
 
 import (
+	"context"
 	"genomic-service/internal/config"
+	"genomic-service/internal/tee"
 	"genomic-service/internal/types"
+	teesdk "genomic-service/pkg/tee"
 	"math/big"
+	"path/filepath"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
@@ -15,6 +21,20 @@ func setupTestConfig() *config.Config {
 	return config.NewConfig("../config/app.ini")
 }
 
+func newTestOutbox(t *testing.T) *Outbox {
+	outbox, err := NewOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { outbox.Close() })
+	return outbox
+}
+
+// newTestUser returns a fresh wallet address, standing for a user
+func newTestUser(t *testing.T) common.Address {
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	return crypto.PubkeyToAddress(key.PublicKey)
+}
+
 func TestBlockchainService(t *testing.T) {
 	// Load configuration
 	cfg := setupTestConfig()
@@ -24,6 +44,9 @@ func TestBlockchainService(t *testing.T) {
 		cfg.BlockchainSettings.RPCURL,
 		cfg.WalletSettings.PrivateKey,
 		cfg.BlockchainSettings.ControllerAddress,
+		newTestOutbox(t),
+		NewFeePolicy(cfg.BlockchainSettings),
+		cfg.BlockchainSettings.ConfirmationDepth,
 	)
 
 	// Fetch NFTs
@@ -40,14 +63,21 @@ func TestInitiateDataUpload(t *testing.T) {
 		cfg.BlockchainSettings.RPCURL,
 		cfg.WalletSettings.PrivateKey,
 		cfg.BlockchainSettings.ControllerAddress,
+		newTestOutbox(t),
+		NewFeePolicy(cfg.BlockchainSettings),
+		cfg.BlockchainSettings.ConfirmationDepth,
 	)
 
 	// random docID
 	docID := uuid.New().String()
-	sessionID, err := service.InitiateDataUpload(docID)
+	sessionID, err := service.InitiateDataUpload(docID, newTestUser(t).Hex())
 	assert.NoError(t, err)
 	assert.NotEmpty(t, sessionID)
 
+	// The session of a document is the wallet's it was opened for
+	_, err = service.InitiateDataUpload(docID, newTestUser(t).Hex())
+	assert.ErrorIs(t, err, ErrSessionOwner)
+
 	t.Logf("Session ID: %s", sessionID)
 }
 
@@ -57,21 +87,55 @@ func TestProcessAndMint(t *testing.T) {
 		cfg.BlockchainSettings.RPCURL,
 		cfg.WalletSettings.PrivateKey,
 		cfg.BlockchainSettings.ControllerAddress,
+		newTestOutbox(t),
+		NewFeePolicy(cfg.BlockchainSettings),
+		cfg.BlockchainSettings.ConfirmationDepth,
 	)
 
 	// random docID
 	docID := uuid.New().String()
-	// upload docs
-	sessionID, err := service.InitiateDataUpload(docID)
+	// upload docs for a user other than the service wallet
+	user := newTestUser(t)
+	sessionID, err := service.InitiateDataUpload(docID, user.Hex())
+	assert.NoError(t, err)
+
+	// sign the result with a TEE key the controller trusts
+	enclave := tee.NewTEE()
+	signer := enclave.Keyring().Current().Address().Hex()
+	assert.NoError(t, service.SetTeeSigner(signer, true))
+
+	salt, err := teesdk.NewSalt()
+	assert.NoError(t, err)
+	model, err := enclave.Models().Resolve("")
 	assert.NoError(t, err)
 
 	result := &types.ProcessResult{
 		SessionID:   sessionID,
 		RiskScore:   2,
-		ContentHash: "0x1234",
+		ContentHash: teesdk.ContentHash([]byte("slightly high risk"), salt),
 		DocID:       docID,
+		ModelID:     tee.ModelID(model),
+		ModelHash:   model.Hash(),
 	}
+	assert.NoError(t, enclave.SignResult(result))
+
+	// only the session owner's wallet is accepted
+	_, err = service.SubmitConfirm(context.Background(), result, service.wallet.Address.Hex())
+	assert.ErrorIs(t, err, ErrSessionOwner)
+
+	err = service.ProcessAndMint(result, user.Hex())
+	assert.NoError(t, err)
+
+	// the G-NFT and reward went to the user
+	nfts, err := service.nft.BalanceOf(nil, user)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), nfts.Int64())
+	reward, err := service.token.BalanceOf(nil, user)
+	assert.NoError(t, err)
+	assert.Greater(t, reward.Sign(), 0)
 
-	err = service.ProcessAndMint(result)
+	// the commitment is anchored with the doc
+	contentHash, err := service.GetContentHash(docID)
 	assert.NoError(t, err)
+	assert.Equal(t, result.ContentHash, contentHash)
 }
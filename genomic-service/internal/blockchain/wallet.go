@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"math/big"
 
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/ethclient"
 )
 
+// ChainID is the LIFENetwork chain ID
+const ChainID = 9999
+
 type Wallet struct {
 	PrivateKey *ecdsa.PrivateKey
 	PublicKey  *ecdsa.PublicKey
@@ -39,12 +43,12 @@ func NewWallet(privateKeyHex string) (*Wallet, error) {
 	}, nil
 }
 
-func (w *Wallet) GetBalance(client *ethclient.Client) (*big.Int, error) {
+func (w *Wallet) GetBalance(client ethereum.ChainStateReader) (*big.Int, error) {
 	return client.BalanceAt(context.Background(), w.Address, nil)
 }
 
 func (w *Wallet) GetTransactOpts() (*bind.TransactOpts, error) {
-	chainID := big.NewInt(9999) // LIFENetwork Chain ID
+	chainID := big.NewInt(ChainID)
 
 	opts, err := bind.NewKeyedTransactorWithChainID(w.PrivateKey, chainID)
 	if err != nil {
@@ -53,3 +57,12 @@ func (w *Wallet) GetTransactOpts() (*bind.TransactOpts, error) {
 
 	return opts, nil
 }
+
+// SignTx signs a transaction built by hand, for the chain of GetTransactOpts
+func (w *Wallet) SignTx(tx *gethtypes.Transaction) (*gethtypes.Transaction, error) {
+	opts, err := w.GetTransactOpts()
+	if err != nil {
+		return nil, err
+	}
+	return opts.Signer(w.Address, tx)
+}
@@ -18,6 +18,9 @@ func TestWalletSetup(t *testing.T) {
 		cfg.BlockchainSettings.RPCURL,
 		cfg.WalletSettings.PrivateKey,
 		cfg.BlockchainSettings.ControllerAddress,
+		newTestOutbox(t),
+		NewFeePolicy(cfg.BlockchainSettings),
+		cfg.BlockchainSettings.ConfirmationDepth,
 	)
 	assert.NoError(t, err)
 	assert.NotNil(t, service)
@@ -23,7 +23,12 @@ func getEnvOrDefault(key, defaultValue string) string {
 
 func loadEnvVariable() *EnvVariable {
 	return &EnvVariable{
-		PrivateKey: getEnvOrDefault("PRIVATE_KEY", ""),
+		PrivateKey:  getEnvOrDefault("PRIVATE_KEY", ""),
+		S3AccessKey: getEnvOrDefault("S3_ACCESS_KEY_ID", ""),
+		S3SecretKey: getEnvOrDefault("S3_SECRET_ACCESS_KEY", ""),
+
+		TEESealingPassphrase: getEnvOrDefault("TEE_SEALING_PASSPHRASE", ""),
+		AdminToken:           getEnvOrDefault("ADMIN_TOKEN", ""),
 	}
 }
 
@@ -31,4 +36,8 @@ func loadEnvVariable() *EnvVariable {
 func (cfg *Config) SetupEnvVariable() {
 	envVariable := loadEnvVariable()
 	cfg.WalletSettings.PrivateKey = envVariable.PrivateKey
+	cfg.StorageSettings.S3AccessKey = envVariable.S3AccessKey
+	cfg.StorageSettings.S3SecretKey = envVariable.S3SecretKey
+	cfg.TEESettings.SealingPassphrase = envVariable.TEESealingPassphrase
+	cfg.ServerSettings.AdminToken = envVariable.AdminToken
 }
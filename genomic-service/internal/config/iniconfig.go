@@ -8,9 +8,14 @@ import (
 
 // Update Config struct to be more specific
 type Config struct {
+	ServerSettings     *ServerSettings
 	StorageSettings    *StorageSettings
 	TEESettings        *TEESettings
+	StateSettings      *StateSettings
+	JobSettings        *JobSettings
 	BlockchainSettings *BlockchainSettings
+	IndexerSettings    *IndexerSettings
+	RelayerSettings    *RelayerSettings
 	WalletSettings     *WalletSettings
 }
 
@@ -22,19 +27,34 @@ func SetupConfigSettings(path string) *Config {
 		log.Fatalf("setting.Setup, fail to parse config file: %v", err)
 	}
 
+	serverSetting := &ServerSettings{}
 	storageSetting := &StorageSettings{}
 	teeSetting := &TEESettings{}
+	stateSetting := &StateSettings{}
+	jobSetting := &JobSettings{}
 	blockchainSetting := &BlockchainSettings{}
+	indexerSetting := &IndexerSettings{}
+	relayerSetting := &RelayerSettings{}
 	walletSetting := &WalletSettings{}
 
+	mapTo(cfg, "server", serverSetting)
 	mapTo(cfg, "storage", storageSetting)
 	mapTo(cfg, "tee", teeSetting)
+	mapTo(cfg, "state", stateSetting)
+	mapTo(cfg, "jobs", jobSetting)
 	mapTo(cfg, "blockchain", blockchainSetting)
+	mapTo(cfg, "indexer", indexerSetting)
+	mapTo(cfg, "relayer", relayerSetting)
 
 	return &Config{
+		ServerSettings:     serverSetting,
 		StorageSettings:    storageSetting,
 		TEESettings:        teeSetting,
+		StateSettings:      stateSetting,
+		JobSettings:        jobSetting,
 		BlockchainSettings: blockchainSetting,
+		IndexerSettings:    indexerSetting,
+		RelayerSettings:    relayerSetting,
 		WalletSettings:     walletSetting,
 	}
 }
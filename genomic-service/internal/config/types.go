@@ -1,16 +1,103 @@
 package config
 
+import "time"
+
 // Store environment variables
 type EnvVariable struct {
-	PrivateKey string // env: PRIVATE_KEY
+	PrivateKey  string // env: PRIVATE_KEY
+	S3AccessKey string // env: S3_ACCESS_KEY_ID
+	S3SecretKey string // env: S3_SECRET_ACCESS_KEY
+
+	TEESealingPassphrase string // env: TEE_SEALING_PASSPHRASE
+	AdminToken           string // env: ADMIN_TOKEN
+}
+
+type ServerSettings struct {
+	AdminToken string // bearer token for /api/admin, admin API is disabled when empty
 }
 
 type StorageSettings struct {
-	// Setting for storage service
+	Type          string // memory | file | s3
+	Path          string // root directory for file storage, spool directory for s3
+	MaxUploadSize int64  // bytes, 0 = unlimited
+
+	// S3-compatible object storage
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3Prefix    string
+	S3PartSize  int64 // multipart part size in bytes
+	S3PathStyle bool  // bucket in path instead of host, e.g. for MinIO
+	S3AccessKey string
+	S3SecretKey string
 }
 
 type TEESettings struct {
-	// Setting for TEE service
+	MaxConcurrency int // concurrent decryptions, 0 = unlimited
+
+	// Unix socket of the tee-worker, the gateway runs the TEE in-process when empty
+	WorkerSocket string
+
+	// Sealed private key, an ephemeral key is generated when KeyPath is empty
+	KeyPath           string
+	SealingMethod     string // passphrase | file | kms
+	SealingKeyFile    string // 32-byte key (raw or hex) for SealingMethod=file
+	KMSName           string // registered KMS for SealingMethod=kms
+	KMSKeyID          string
+	SealingPassphrase string
+
+	// Rewrapped envelope headers of blobs moved to a newer key (bbolt), in
+	// memory when empty
+	HeaderPath string
+
+	// Simulated remote attestation
+	AttestationRootKeyPath string // hex root key standing in for the vendor key, ephemeral when empty
+	Measurement            string // hex code measurement, defaults to the SHA-256 of the executable
+
+	// Risk model registry, the bundled stroke panel is always registered
+	RiskModelPaths  []string  // PGS Catalog scoring files
+	DefaultModel    string    // name@version scoring the default product, the last configured file when empty
+	ProductModels   []string  // product=name@version
+	RiskPercentiles []float64 // percentile cut-offs of the slightly high, high and extremely high categories
+	RiskMinCoverage float64   // share of model variants that must be called, 0-1
+	VCFMinQual      float64   // VCF records below this QUAL are not scored
+
+	// Sandboxed WebAssembly risk models, stored as <sha256>.wasm in WasmModelDir
+	WasmModelDir        string
+	WasmModels          []string // SHA-256 hashes of the models to load
+	WasmMaxInstructions uint64   // per scoring run, 0 = default
+}
+
+// StateSettings locates the embedded database tracking uploads through
+// their lifecycle
+type StateSettings struct {
+	Path string
+}
+
+// JobSettings sizes the pipeline running confirmations in the background
+type JobSettings struct {
+	Workers   int           // jobs processed concurrently
+	QueueSize int           // jobs waiting for a worker, confirms are rejected when full
+	Retention time.Duration // how long finished jobs can be queried
+}
+
+// IndexerSettings configures the local history of controller events
+type IndexerSettings struct {
+	Enabled      bool
+	Path         string
+	StartBlock   uint64        // first block to backfill, e.g. the controller deployment
+	BatchSize    uint64        // blocks per log query
+	PollInterval time.Duration // how often new blocks are looked for
+}
+
+// RelayerSettings configures the relaying of users' signed calls through the
+// trusted forwarder, paid by the service wallet
+type RelayerSettings struct {
+	Enabled          bool
+	ForwarderAddress string
+	MaxRequests      int           // relayed calls per user and window
+	Window           time.Duration // quota window
+	MaxGas           uint64        // gas a request may ask for
 }
 
 type BlockchainSettings struct {
@@ -18,6 +105,17 @@ type BlockchainSettings struct {
 	GeneNFTAddress    string
 	PCSPTokenAddress  string
 	ControllerAddress string
+	OutboxPath        string // persisted contract calls, sent in the background
+	ConfirmationDepth uint64 // blocks on top of a receipt or event before it is final
+
+	// EIP-1559 fee policy, defaults apply to settings left at zero
+	MinTipGwei        float64       // floor under the tip suggested by the node
+	MaxFeeGwei        float64       // ceiling on the fee cap, 0 = none
+	BaseFeeMultiplier float64       // fee cap = base fee * multiplier + tip
+	GasLimitMargin    float64       // share added to estimated gas, 0.2 = 20%
+	FeeBumpPercent    int           // fee increase of a replacement, at least 10
+	StuckAfter        time.Duration // pending this long, a transaction is replaced with higher fees
+	TxDeadline        time.Duration // pending this long, a transaction is cancelled and its call failed
 }
 
 type WalletSettings struct {
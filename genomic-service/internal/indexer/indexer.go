@@ -0,0 +1,279 @@
+package indexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"genomic-service/contracts"
+	"genomic-service/internal/config"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+)
+
+const (
+	DefaultBatchSize    = 2000
+	DefaultPollInterval = 5 * time.Second
+)
+
+// Chain is what the indexer reads from the node, ethclient.Client has it
+type Chain interface {
+	BlockNumber(ctx context.Context) (uint64, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*gethtypes.Header, error)
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]gethtypes.Log, error)
+}
+
+// Indexer copies the UploadData, GeneNFTMinted and PCSPRewarded events of
+// the controller into a Store. It backfills from the start block, or the
+// checkpoint of a previous run, then follows new blocks.
+//
+// Records are pending until their block is confirmations deep, then final.
+// The hashes of the blocks in between are kept: when one no longer matches
+// the chain, its records and those after it are rolled back and indexed
+// again from the new chain.
+type Indexer struct {
+	chain      Chain
+	address    common.Address
+	controller *contracts.ControllerFilterer
+	topics     []common.Hash
+	store      *Store
+
+	confirmations uint64
+	startBlock    uint64
+	batchSize     uint64
+	pollInterval  time.Duration
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// NewIndexer starts indexing in the background until Close. Records are
+// final once confirmations blocks deep.
+func NewIndexer(chain Chain, controllerAddr string, confirmations uint64, store *Store, settings *config.IndexerSettings) (*Indexer, error) {
+	address := common.HexToAddress(controllerAddr)
+	controller, err := contracts.NewControllerFilterer(address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load controller: %v", err)
+	}
+	abi, err := contracts.ControllerMetaData.GetAbi()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load controller ABI: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	indexer := &Indexer{
+		chain:      chain,
+		address:    address,
+		controller: controller,
+		topics: []common.Hash{
+			abi.Events["UploadData"].ID,
+			abi.Events["GeneNFTMinted"].ID,
+			abi.Events["PCSPRewarded"].ID,
+		},
+		store:         store,
+		confirmations: confirmations,
+		startBlock:    settings.StartBlock,
+		batchSize:     settings.BatchSize,
+		pollInterval:  settings.PollInterval,
+		stop:          cancel,
+		done:          make(chan struct{}),
+	}
+	if indexer.batchSize == 0 {
+		indexer.batchSize = DefaultBatchSize
+	}
+	if indexer.pollInterval <= 0 {
+		indexer.pollInterval = DefaultPollInterval
+	}
+
+	go indexer.run(ctx)
+	return indexer, nil
+}
+
+// Close stops indexing, the next run resumes from the checkpoint
+func (i *Indexer) Close() {
+	i.stop()
+	<-i.done
+}
+
+func (i *Indexer) run(ctx context.Context) {
+	defer close(i.done)
+
+	ticker := time.NewTicker(i.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := i.sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: indexer: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync indexes every block up to the current head, one batch at a time,
+// after rolling back blocks reorged out since the last time
+func (i *Indexer) sync(ctx context.Context) error {
+	head, err := i.chain.BlockNumber(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get head block: %v", err)
+	}
+	var finalized uint64
+	if head > i.confirmations {
+		finalized = head - i.confirmations
+	}
+
+	if err := i.checkReorg(ctx); err != nil {
+		return err
+	}
+
+	from := i.startBlock
+	checkpoint, ok, err := i.store.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	if ok && checkpoint+1 > from {
+		from = checkpoint + 1
+	}
+
+	for from <= head {
+		to := from + i.batchSize - 1
+		if to > head {
+			to = head
+		}
+
+		logs, err := i.chain.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: []common.Address{i.address},
+			Topics:    [][]common.Hash{i.topics},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get logs of blocks %d-%d: %v", from, to, err)
+		}
+		batch := i.parse(logs)
+		batch.To = to
+
+		// Blocks that may still be reorged out are remembered by hash
+		hashes := make(map[uint64]string)
+		for number := max(from, finalized+1); number <= to; number++ {
+			header, err := i.chain.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+			if err != nil {
+				return fmt.Errorf("failed to get block %d: %v", number, err)
+			}
+			hashes[number] = header.Hash().Hex()
+			batch.Blocks = append(batch.Blocks, Block{Number: number, Hash: hashes[number]})
+		}
+		for _, entry := range logs {
+			if hash, ok := hashes[entry.BlockNumber]; ok && hash != entry.BlockHash.Hex() {
+				return fmt.Errorf("block %d changed while indexing", entry.BlockNumber)
+			}
+		}
+
+		if err := i.store.Apply(batch); err != nil {
+			return fmt.Errorf("failed to store blocks %d-%d: %v", from, to, err)
+		}
+		from = to + 1
+	}
+
+	if err := i.store.Finalize(finalized); err != nil {
+		return fmt.Errorf("failed to finalize up to block %d: %v", finalized, err)
+	}
+	return nil
+}
+
+// checkReorg compares the blocks that are not final yet with the chain,
+// newest first, and rolls back from the oldest one that changed. As every
+// block commits to its parent, a matching block means the ones before it
+// match too.
+func (i *Indexer) checkReorg(ctx context.Context) error {
+	blocks, err := i.store.Blocks()
+	if err != nil {
+		return fmt.Errorf("failed to read indexed blocks: %v", err)
+	}
+
+	var forked *Block
+	for j := len(blocks) - 1; j >= 0; j-- {
+		header, err := i.chain.HeaderByNumber(ctx, new(big.Int).SetUint64(blocks[j].Number))
+		if err != nil && !errors.Is(err, ethereum.NotFound) {
+			return fmt.Errorf("failed to get block %d: %v", blocks[j].Number, err)
+		}
+		if err == nil && header.Hash().Hex() == blocks[j].Hash {
+			break
+		}
+		forked = &blocks[j]
+	}
+	if forked == nil {
+		return nil
+	}
+
+	log.Printf("Warning: indexer: blocks from %d were reorged out, indexing them again", forked.Number)
+	if err := i.store.Rollback(forked.Number); err != nil {
+		return fmt.Errorf("failed to roll back from block %d: %v", forked.Number, err)
+	}
+	return nil
+}
+
+// parse turns logs into records. A confirm emits GeneNFTMinted then
+// PCSPRewarded, so a reward is linked to the mint of its transaction.
+func (i *Indexer) parse(logs []gethtypes.Log) *Batch {
+	batch := &Batch{}
+	mints := make(map[common.Hash]*Mint)
+
+	for _, entry := range logs {
+		if entry.Removed || len(entry.Topics) == 0 {
+			continue
+		}
+		event := Event{
+			Block:     entry.BlockNumber,
+			BlockHash: entry.BlockHash.Hex(),
+			TxHash:    entry.TxHash.Hex(),
+			LogIndex:  entry.Index,
+		}
+
+		switch entry.Topics[0] {
+		case i.topics[0]:
+			upload, err := i.controller.ParseUploadData(entry)
+			if err != nil {
+				log.Printf("Warning: indexer: skipping UploadData in %s: %v", event.TxHash, err)
+				continue
+			}
+			batch.Sessions = append(batch.Sessions, &Session{
+				SessionID: upload.SessionId.String(),
+				DocID:     upload.DocId,
+				Owner:     upload.Owner.Hex(),
+				Event:     event,
+			})
+
+		case i.topics[1]:
+			minted, err := i.controller.ParseGeneNFTMinted(entry)
+			if err != nil {
+				log.Printf("Warning: indexer: skipping GeneNFTMinted in %s: %v", event.TxHash, err)
+				continue
+			}
+			mint := &Mint{TokenID: minted.TokenId.String(), DocID: minted.DocId, Event: event}
+			mints[entry.TxHash] = mint
+			batch.Mints = append(batch.Mints, mint)
+
+		case i.topics[2]:
+			rewarded, err := i.controller.ParsePCSPRewarded(entry)
+			if err != nil {
+				log.Printf("Warning: indexer: skipping PCSPRewarded in %s: %v", event.TxHash, err)
+				continue
+			}
+			reward := &Reward{User: rewarded.User.Hex(), Amount: rewarded.Amount.String(), Event: event}
+			if mint, ok := mints[entry.TxHash]; ok {
+				reward.DocID, reward.TokenID = mint.DocID, mint.TokenID
+				mint.Owner, mint.Reward = reward.User, reward.Amount
+			}
+			batch.Rewards = append(batch.Rewards, reward)
+		}
+	}
+	return batch
+}
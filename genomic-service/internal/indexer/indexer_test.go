@@ -0,0 +1,255 @@
+package indexer_test
+
+import (
+	"context"
+	"genomic-service/contracts"
+	"genomic-service/internal/config"
+	"genomic-service/internal/indexer"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	gethtypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	controllerAddr = common.HexToAddress("0x5aa01B3b5877255cE50cc55e8986a7a5fe29C70e")
+	user           = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+)
+
+type fakeChain struct {
+	mu      sync.Mutex
+	head    uint64
+	forks   map[uint64]byte // how many times each block was replaced
+	logs    []gethtypes.Log
+	queries [][2]uint64
+}
+
+func (c *fakeChain) BlockNumber(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.head, nil
+}
+
+func (c *fakeChain) HeaderByNumber(ctx context.Context, number *big.Int) (*gethtypes.Header, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if number.Uint64() > c.head {
+		return nil, ethereum.NotFound
+	}
+	return c.header(number.Uint64()), nil
+}
+
+func (c *fakeChain) header(block uint64) *gethtypes.Header {
+	return &gethtypes.Header{Number: new(big.Int).SetUint64(block), Extra: []byte{c.forks[block]}}
+}
+
+func (c *fakeChain) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]gethtypes.Log, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	from, to := query.FromBlock.Uint64(), query.ToBlock.Uint64()
+	c.queries = append(c.queries, [2]uint64{from, to})
+	var logs []gethtypes.Log
+	for _, log := range c.logs {
+		if log.BlockNumber >= from && log.BlockNumber <= to {
+			log.BlockHash = c.header(log.BlockNumber).Hash()
+			logs = append(logs, log)
+		}
+	}
+	return logs, nil
+}
+
+// emit adds a controller event, seen once the head reaches its block
+func (c *fakeChain) emit(t *testing.T, block uint64, tx byte, name string, args ...any) {
+	abi, err := contracts.ControllerMetaData.GetAbi()
+	assert.NoError(t, err)
+	data, err := abi.Events[name].Inputs.NonIndexed().Pack(args...)
+	assert.NoError(t, err)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs = append(c.logs, gethtypes.Log{
+		Address:     controllerAddr,
+		Topics:      []common.Hash{abi.Events[name].ID},
+		Data:        data,
+		BlockNumber: block,
+		TxHash:      common.Hash{tx},
+		Index:       uint(len(c.logs)),
+	})
+}
+
+func (c *fakeChain) setHead(block uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.head = block
+}
+
+// reorg replaces the blocks from block on, dropping their events
+func (c *fakeChain) reorg(block uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for number := block; number <= c.head; number++ {
+		c.forks[number]++
+	}
+	var logs []gethtypes.Log
+	for _, log := range c.logs {
+		if log.BlockNumber < block {
+			logs = append(logs, log)
+		}
+	}
+	c.logs = logs
+}
+
+func newChain(head uint64) *fakeChain {
+	return &fakeChain{head: head, forks: make(map[uint64]byte)}
+}
+
+func newIndexer(t *testing.T, chain *fakeChain, path string, confirmations uint64) (*indexer.Indexer, *indexer.Store) {
+	settings := &config.IndexerSettings{Path: path, StartBlock: 10, BatchSize: 5, PollInterval: 10 * time.Millisecond}
+	store, err := indexer.NewStore(settings)
+	assert.NoError(t, err)
+	idx, err := indexer.NewIndexer(chain, controllerAddr.Hex(), confirmations, store, settings)
+	assert.NoError(t, err)
+	return idx, store
+}
+
+func waitForBlock(t *testing.T, store *indexer.Store, block uint64) {
+	assert.Eventually(t, func() bool {
+		checkpoint, ok, err := store.Checkpoint()
+		return err == nil && ok && checkpoint >= block
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIndexer(t *testing.T) {
+	chain := newChain(20)
+	chain.emit(t, 12, 1, "UploadData", "doc-1", big.NewInt(0), user)
+	chain.emit(t, 13, 2, "UploadData", "doc-2", big.NewInt(1), user)
+	chain.emit(t, 19, 3, "GeneNFTMinted", big.NewInt(7), "doc-1")
+	chain.emit(t, 19, 3, "PCSPRewarded", user, big.NewInt(3000))
+
+	path := filepath.Join(t.TempDir(), "index.db")
+	idx, store := newIndexer(t, chain, path, 0)
+	waitForBlock(t, store, 20)
+
+	// Backfilled from the start block in batches
+	chain.mu.Lock()
+	assert.Equal(t, [2]uint64{10, 14}, chain.queries[0])
+	assert.Equal(t, [2]uint64{15, 19}, chain.queries[1])
+	chain.mu.Unlock()
+
+	doc, err := store.Doc("doc-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "0", doc.Session.SessionID)
+	assert.Equal(t, uint64(12), doc.Session.Block)
+	assert.Equal(t, user.Hex(), doc.Session.Owner)
+	assert.Equal(t, "7", doc.Mint.TokenID)
+	assert.Equal(t, user.Hex(), doc.Mint.Owner)
+	assert.Equal(t, "3000", doc.Mint.Reward)
+	assert.Equal(t, indexer.Final, doc.Mint.Status)
+
+	doc, err = store.Doc("doc-2")
+	assert.NoError(t, err)
+	assert.Nil(t, doc.Mint)
+
+	// New blocks are followed
+	chain.emit(t, 25, 4, "GeneNFTMinted", big.NewInt(8), "doc-2")
+	chain.emit(t, 25, 4, "PCSPRewarded", user, big.NewInt(500))
+	chain.setHead(25)
+	waitForBlock(t, store, 25)
+
+	rewards, err := store.Rewards(user)
+	assert.NoError(t, err)
+	assert.Len(t, rewards, 2)
+	assert.Equal(t, "7", rewards[0].TokenID)
+	assert.Equal(t, "doc-2", rewards[1].DocID)
+
+	// A restart resumes from the checkpoint
+	idx.Close()
+	assert.NoError(t, store.Close())
+	chain.mu.Lock()
+	chain.queries = nil
+	chain.head = 27
+	chain.mu.Unlock()
+
+	idx, store = newIndexer(t, chain, path, 0)
+	defer store.Close()
+	defer idx.Close()
+	waitForBlock(t, store, 27)
+	chain.mu.Lock()
+	assert.Equal(t, [2]uint64{26, 27}, chain.queries[0])
+	chain.mu.Unlock()
+
+	session, err := store.Session("1")
+	assert.NoError(t, err)
+	assert.Equal(t, "doc-2", session.DocID)
+	mint, err := store.Mint("8")
+	assert.NoError(t, err)
+	assert.Equal(t, "500", mint.Reward)
+
+	_, err = store.Mint("9")
+	assert.ErrorIs(t, err, indexer.ErrNotFound)
+	rewards, err = store.Rewards(common.Address{1})
+	assert.NoError(t, err)
+	assert.Empty(t, rewards)
+}
+
+func TestIndexerReorg(t *testing.T) {
+	chain := newChain(20)
+	chain.emit(t, 12, 1, "UploadData", "doc-1", big.NewInt(0), user)
+	chain.emit(t, 19, 2, "GeneNFTMinted", big.NewInt(7), "doc-1")
+	chain.emit(t, 19, 2, "PCSPRewarded", user, big.NewInt(3000))
+
+	idx, store := newIndexer(t, chain, filepath.Join(t.TempDir(), "index.db"), 3)
+	defer store.Close()
+	defer idx.Close()
+	waitForBlock(t, store, 20)
+
+	// Only blocks at least 3 deep are final
+	session, err := store.Session("0")
+	assert.NoError(t, err)
+	assert.Equal(t, indexer.Final, session.Status)
+	mint, err := store.Mint("7")
+	assert.NoError(t, err)
+	assert.Equal(t, indexer.Pending, mint.Status)
+	finalized, err := store.Finalized()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(17), finalized)
+
+	// The confirm moves to another block on the new chain
+	chain.reorg(19)
+	chain.emit(t, 21, 3, "GeneNFTMinted", big.NewInt(8), "doc-1")
+	chain.emit(t, 21, 3, "PCSPRewarded", user, big.NewInt(500))
+	chain.setHead(21)
+	assert.Eventually(t, func() bool {
+		_, err := store.Mint("8")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = store.Mint("7")
+	assert.ErrorIs(t, err, indexer.ErrNotFound)
+	doc, err := store.Doc("doc-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "8", doc.Mint.TokenID)
+	assert.Equal(t, "0", doc.Session.SessionID)
+	rewards, err := store.Rewards(user)
+	assert.NoError(t, err)
+	assert.Len(t, rewards, 1)
+	assert.Equal(t, "500", rewards[0].Amount)
+	assert.Equal(t, indexer.Pending, rewards[0].Status)
+
+	// Final once deep enough
+	chain.setHead(24)
+	assert.Eventually(t, func() bool {
+		mint, err := store.Mint("8")
+		return err == nil && mint.Status == indexer.Final
+	}, 5*time.Second, 10*time.Millisecond)
+	rewards, err = store.Rewards(user)
+	assert.NoError(t, err)
+	assert.Equal(t, indexer.Final, rewards[0].Status)
+}
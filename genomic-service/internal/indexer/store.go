@@ -0,0 +1,482 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"genomic-service/internal/config"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+var ErrNotFound = errors.New("not found in chain history")
+
+var (
+	sessionsBucket    = []byte("sessions")     // session ID -> Session
+	docsBucket        = []byte("docs")         // doc ID -> docRefs
+	mintsBucket       = []byte("mints")        // token ID -> Mint
+	rewardsBucket     = []byte("rewards")      // block, log index -> Reward
+	userRewardsBucket = []byte("user_rewards") // user, block, log index -> nothing
+	pendingBucket     = []byte("pending")      // block, log index -> recordRef, records not final yet
+	blocksBucket      = []byte("blocks")       // block -> hash, blocks not final yet
+	metaBucket        = []byte("meta")
+
+	checkpointKey = []byte("checkpoint")
+	finalizedKey  = []byte("finalized")
+)
+
+// Finality tells whether a record may still be reorged out
+type Finality string
+
+const (
+	Pending Finality = "pending" // in a block not deep enough yet
+	Final   Finality = "final"   // confirmation depth reached
+)
+
+// Event locates the log an indexed record comes from
+type Event struct {
+	Block     uint64   `json:"block"`
+	BlockHash string   `json:"blockHash"`
+	TxHash    string   `json:"txHash"`
+	LogIndex  uint     `json:"logIndex"`
+	Status    Finality `json:"status"`
+}
+
+func (e *Event) setStatus(status Finality) {
+	e.Status = status
+}
+
+// Session is an upload session opened by UploadData
+type Session struct {
+	SessionID string `json:"sessionId"`
+	DocID     string `json:"docId"`
+	Owner     string `json:"owner"` // wallet the G-NFT and reward go to
+	Event
+}
+
+// Mint is a G-NFT minted by a confirm. Owner and Reward come from the
+// PCSPRewarded event of the same transaction.
+type Mint struct {
+	TokenID string `json:"tokenId"`
+	DocID   string `json:"docId"`
+	Owner   string `json:"owner,omitempty"`
+	Reward  string `json:"reward,omitempty"`
+	Event
+}
+
+// Reward is a PCSP reward, linked to the mint of the same transaction
+type Reward struct {
+	User    string `json:"user"`
+	Amount  string `json:"amount"`
+	DocID   string `json:"docId,omitempty"`
+	TokenID string `json:"tokenId,omitempty"`
+	Event
+}
+
+// Doc is the history of a document: its session and its mint, if any yet
+type Doc struct {
+	DocID   string   `json:"docId"`
+	Session *Session `json:"session,omitempty"`
+	Mint    *Mint    `json:"mint,omitempty"`
+}
+
+type docRefs struct {
+	SessionID string `json:"sessionId,omitempty"`
+	TokenID   string `json:"tokenId,omitempty"`
+}
+
+// recordRef points from the pending index to a record
+type recordRef struct {
+	Bucket string `json:"bucket"`
+	Key    []byte `json:"key"`
+}
+
+// Block is an indexed block not final yet, kept to detect reorgs
+type Block struct {
+	Number uint64
+	Hash   string
+}
+
+// Batch is what the indexer found in a range of blocks, up to To. Blocks
+// lists those of the range that are not final yet.
+type Batch struct {
+	Sessions []*Session
+	Mints    []*Mint
+	Rewards  []*Reward
+	Blocks   []Block
+	To       uint64
+}
+
+// Store keeps indexed controller events in an embedded bbolt database
+type Store struct {
+	db *bolt.DB
+}
+
+func NewStore(settings *config.IndexerSettings) (*Store, error) {
+	if settings.Path == "" {
+		return nil, fmt.Errorf("indexer path is not configured")
+	}
+	if err := os.MkdirAll(filepath.Dir(settings.Path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create indexer directory: %v", err)
+	}
+
+	db, err := bolt.Open(settings.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chain history: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{sessionsBucket, docsBucket, mintsBucket, rewardsBucket, userRewardsBucket, pendingBucket, blocksBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize chain history: %v", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Apply stores a batch as pending and moves the checkpoint to its last
+// block, in one transaction. Applying the same blocks again changes nothing.
+func (s *Store) Apply(batch *Batch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, session := range batch.Sessions {
+			session.Status = Pending
+			if err := putPending(tx, sessionsBucket, []byte(session.SessionID), session, session.Event); err != nil {
+				return err
+			}
+			if err := updateDoc(tx, session.DocID, func(refs *docRefs) { refs.SessionID = session.SessionID }); err != nil {
+				return err
+			}
+		}
+		for _, mint := range batch.Mints {
+			mint.Status = Pending
+			if err := putPending(tx, mintsBucket, []byte(mint.TokenID), mint, mint.Event); err != nil {
+				return err
+			}
+			if err := updateDoc(tx, mint.DocID, func(refs *docRefs) { refs.TokenID = mint.TokenID }); err != nil {
+				return err
+			}
+		}
+		for _, reward := range batch.Rewards {
+			reward.Status = Pending
+			key := eventKey(reward.Block, reward.LogIndex)
+			if err := putPending(tx, rewardsBucket, key, reward, reward.Event); err != nil {
+				return err
+			}
+			userKey := append(common.HexToAddress(reward.User).Bytes(), key...)
+			if err := tx.Bucket(userRewardsBucket).Put(userKey, nil); err != nil {
+				return err
+			}
+		}
+		for _, block := range batch.Blocks {
+			if err := tx.Bucket(blocksBucket).Put(blockKey(block.Number), []byte(block.Hash)); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx, metaBucket, checkpointKey, batch.To)
+	})
+}
+
+// Finalize marks the records up to height final, they are no longer
+// checked for reorgs
+func (s *Store) Finalize(height uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket(pendingBucket).Cursor()
+		for key, value := pending.First(); key != nil && binary.BigEndian.Uint64(key) <= height; key, value = pending.First() {
+			var ref recordRef
+			if err := json.Unmarshal(value, &ref); err != nil {
+				return fmt.Errorf("corrupt pending record: %v", err)
+			}
+			if err := finalizeRecord(tx, ref); err != nil {
+				return err
+			}
+			if err := pending.Delete(); err != nil {
+				return err
+			}
+		}
+
+		blocks := tx.Bucket(blocksBucket).Cursor()
+		for key, _ := blocks.First(); key != nil && binary.BigEndian.Uint64(key) <= height; key, _ = blocks.First() {
+			if err := blocks.Delete(); err != nil {
+				return err
+			}
+		}
+		var finalized uint64
+		if err := getJSON(tx, metaBucket, finalizedKey, &finalized); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if height < finalized {
+			return nil
+		}
+		return putJSON(tx, metaBucket, finalizedKey, height)
+	})
+}
+
+// Rollback removes every record from block from on and moves the
+// checkpoint before it, so the blocks are indexed again. Only blocks that
+// are not final can be rolled back.
+func (s *Store) Rollback(from uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var finalized uint64
+		if err := getJSON(tx, metaBucket, finalizedKey, &finalized); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if from <= finalized {
+			return fmt.Errorf("block %d is final, can't roll back", from)
+		}
+
+		pending := tx.Bucket(pendingBucket).Cursor()
+		for key, value := pending.Seek(blockKey(from)); key != nil; key, value = pending.Seek(blockKey(from)) {
+			var ref recordRef
+			if err := json.Unmarshal(value, &ref); err != nil {
+				return fmt.Errorf("corrupt pending record: %v", err)
+			}
+			if err := removeRecord(tx, ref); err != nil {
+				return err
+			}
+			if err := pending.Delete(); err != nil {
+				return err
+			}
+		}
+
+		blocks := tx.Bucket(blocksBucket).Cursor()
+		for key, _ := blocks.Seek(blockKey(from)); key != nil; key, _ = blocks.Seek(blockKey(from)) {
+			if err := blocks.Delete(); err != nil {
+				return err
+			}
+		}
+		return putJSON(tx, metaBucket, checkpointKey, from-1)
+	})
+}
+
+// Blocks lists the indexed blocks that are not final yet, oldest first
+func (s *Store) Blocks() ([]Block, error) {
+	var blocks []Block
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blocksBucket).ForEach(func(key, value []byte) error {
+			blocks = append(blocks, Block{Number: binary.BigEndian.Uint64(key), Hash: string(value)})
+			return nil
+		})
+	})
+	return blocks, err
+}
+
+// Checkpoint returns the last indexed block, ok is false before the first
+// batch
+func (s *Store) Checkpoint() (block uint64, ok bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get(checkpointKey)
+		if value == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(value, &block)
+	})
+	return block, ok, err
+}
+
+// Finalized returns the block up to which records are final
+func (s *Store) Finalized() (uint64, error) {
+	var block uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := getJSON(tx, metaBucket, finalizedKey, &block)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+	return block, err
+}
+
+func (s *Store) Session(sessionID string) (*Session, error) {
+	var session Session
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx, sessionsBucket, []byte(sessionID), &session)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *Store) Mint(tokenID string) (*Mint, error) {
+	var mint Mint
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJSON(tx, mintsBucket, []byte(tokenID), &mint)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mint, nil
+}
+
+func (s *Store) Doc(docID string) (*Doc, error) {
+	doc := &Doc{DocID: docID}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var refs docRefs
+		if err := getJSON(tx, docsBucket, []byte(docID), &refs); err != nil {
+			return err
+		}
+		if refs.SessionID != "" {
+			doc.Session = new(Session)
+			if err := getJSON(tx, sessionsBucket, []byte(refs.SessionID), doc.Session); err != nil {
+				return err
+			}
+		}
+		if refs.TokenID != "" {
+			doc.Mint = new(Mint)
+			if err := getJSON(tx, mintsBucket, []byte(refs.TokenID), doc.Mint); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Rewards lists the rewards of a user, oldest first
+func (s *Store) Rewards(user common.Address) ([]*Reward, error) {
+	rewards := []*Reward{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := user.Bytes()
+		cursor := tx.Bucket(userRewardsBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			var reward Reward
+			if err := getJSON(tx, rewardsBucket, key[len(prefix):], &reward); err != nil {
+				return err
+			}
+			rewards = append(rewards, &reward)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rewards, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// putPending stores a record and indexes it as pending
+func putPending(tx *bolt.Tx, bucket, key []byte, record any, event Event) error {
+	if err := putJSON(tx, bucket, key, record); err != nil {
+		return err
+	}
+	return putJSON(tx, pendingBucket, eventKey(event.Block, event.LogIndex), recordRef{Bucket: string(bucket), Key: key})
+}
+
+// finalizeRecord marks a record final
+func finalizeRecord(tx *bolt.Tx, ref recordRef) error {
+	var record interface{ setStatus(status Finality) }
+	switch ref.Bucket {
+	case string(sessionsBucket):
+		record = new(Session)
+	case string(mintsBucket):
+		record = new(Mint)
+	case string(rewardsBucket):
+		record = new(Reward)
+	default:
+		return fmt.Errorf("unknown pending record in %s", ref.Bucket)
+	}
+	bucket := []byte(ref.Bucket)
+	if err := getJSON(tx, bucket, ref.Key, record); err != nil {
+		return err
+	}
+	record.setStatus(Final)
+	return putJSON(tx, bucket, ref.Key, record)
+}
+
+// removeRecord deletes a rolled back record and what points to it
+func removeRecord(tx *bolt.Tx, ref recordRef) error {
+	switch ref.Bucket {
+	case string(sessionsBucket):
+		var session Session
+		if err := getJSON(tx, sessionsBucket, ref.Key, &session); err != nil {
+			return err
+		}
+		err := updateDoc(tx, session.DocID, func(refs *docRefs) { refs.SessionID = "" })
+		if err != nil {
+			return err
+		}
+	case string(mintsBucket):
+		var mint Mint
+		if err := getJSON(tx, mintsBucket, ref.Key, &mint); err != nil {
+			return err
+		}
+		err := updateDoc(tx, mint.DocID, func(refs *docRefs) { refs.TokenID = "" })
+		if err != nil {
+			return err
+		}
+	case string(rewardsBucket):
+		var reward Reward
+		if err := getJSON(tx, rewardsBucket, ref.Key, &reward); err != nil {
+			return err
+		}
+		userKey := append(common.HexToAddress(reward.User).Bytes(), ref.Key...)
+		if err := tx.Bucket(userRewardsBucket).Delete(userKey); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(ref.Bucket)).Delete(ref.Key)
+}
+
+// updateDoc changes the references of a doc, dropping it when none is left
+func updateDoc(tx *bolt.Tx, docID string, fn func(refs *docRefs)) error {
+	var refs docRefs
+	if err := getJSON(tx, docsBucket, []byte(docID), &refs); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	fn(&refs)
+	if refs == (docRefs{}) {
+		return tx.Bucket(docsBucket).Delete([]byte(docID))
+	}
+	return putJSON(tx, docsBucket, []byte(docID), &refs)
+}
+
+// eventKey orders records by where they were emitted
+func eventKey(block uint64, logIndex uint) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint64(key, block)
+	binary.BigEndian.PutUint32(key[8:], uint32(logIndex))
+	return key
+}
+
+func blockKey(block uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, block)
+	return key
+}
+
+func getJSON(tx *bolt.Tx, bucket, key []byte, v any) error {
+	value := tx.Bucket(bucket).Get(key)
+	if value == nil {
+		return fmt.Errorf("%w: %s %s", ErrNotFound, bucket, key)
+	}
+	if err := json.Unmarshal(value, v); err != nil {
+		return fmt.Errorf("corrupt %s record: %v", bucket, err)
+	}
+	return nil
+}
+
+func putJSON(tx *bolt.Tx, bucket, key []byte, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(key, value)
+}
@@ -0,0 +1,354 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"genomic-service/internal/config"
+	"genomic-service/internal/types"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 100
+)
+
+// ErrQueueFull is returned when no more jobs can wait for a worker
+var ErrQueueFull = errors.New("job queue is full")
+
+// Stage is a step of a confirmation, run in this order
+type Stage string
+
+const (
+	StageTEE     Stage = "tee"     // decrypt, score and sign in the TEE
+	StageConfirm Stage = "confirm" // send the confirm transaction
+	StageMint    Stage = "mint"    // wait for it to mint the G-NFT and reward
+)
+
+var stages = []Stage{StageTEE, StageConfirm, StageMint}
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusSkipped   Status = "skipped" // left to the user, see Request.Relayed
+)
+
+type StageState struct {
+	Name       Stage      `json:"name"`
+	Status     Status     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	TxHash     string     `json:"txHash,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Request is what a client asks to confirm. Wallet is the user's, the
+// session must have been opened for it. A session the user opened through
+// the relayer is Relayed: only the TEE stage runs, the user relays confirm
+// with the proof of the result.
+type Request struct {
+	FileHash  string `json:"fileHash"`
+	SessionID string `json:"sessionId"`
+	Product   string `json:"product,omitempty"`
+	Wallet    string `json:"wallet,omitempty"`
+	Relayed   bool   `json:"relayed,omitempty"`
+}
+
+type Job struct {
+	ID string `json:"id"`
+	Request
+	Status    Status               `json:"status"`
+	Stages    []StageState         `json:"stages"`
+	Result    *types.ProcessResult `json:"result,omitempty"`
+	Mint      *types.MintResult    `json:"mint,omitempty"`
+	CreatedAt time.Time            `json:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+}
+
+// Processor runs the TEE stage, implemented by tee.Service
+type Processor interface {
+	ProcessGeneData(fileHash, sessionID, product string) (*types.ProcessResult, error)
+}
+
+// Chain runs the blockchain stages, implemented by blockchain.BlockchainService
+type Chain interface {
+	SubmitConfirm(ctx context.Context, result *types.ProcessResult, wallet string) (string, error)
+	WaitForMint(ctx context.Context, txHash string) (*types.MintResult, error)
+}
+
+// Recorder persists the progress of jobs, so interrupted ones can be resumed.
+// Record is called when a stage finishes, err is the stage error.
+type Recorder interface {
+	Record(job *Job, stage Stage, err error) error
+}
+
+// Manager queues confirmations and drives them through their stages with a
+// fixed pool of workers
+type Manager struct {
+	processor Processor
+	chain     Chain
+	recorder  Recorder
+	retention time.Duration
+
+	queue  chan string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewManager starts the workers. recorder may be nil.
+func NewManager(processor Processor, chain Chain, recorder Recorder, settings *config.JobSettings) *Manager {
+	workers, queueSize := settings.Workers, settings.QueueSize
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		processor: processor,
+		chain:     chain,
+		recorder:  recorder,
+		retention: settings.Retention,
+		queue:     make(chan string, queueSize),
+		ctx:       ctx,
+		cancel:    cancel,
+		jobs:      make(map[string]*Job),
+	}
+
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.work()
+	}
+	return m
+}
+
+// Submit queues a confirmation and returns it as a pending job
+func (m *Manager) Submit(req Request) (*Job, error) {
+	return m.Resume(req, nil, "")
+}
+
+// Resume queues a confirmation that was interrupted, e.g. by a restart.
+// Stages already done are skipped: the TEE stage when result is set, the
+// confirm stage when confirmTx is.
+func (m *Manager) Resume(req Request, result *types.ProcessResult, confirmTx string) (*Job, error) {
+	job := newJob(req)
+	if result != nil {
+		job.Result = result
+		job.Stage(StageTEE).Status = StatusSucceeded
+	}
+	if confirmTx != "" {
+		confirm := job.Stage(StageConfirm)
+		confirm.Status = StatusSucceeded
+		confirm.TxHash = confirmTx
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prune(job.CreatedAt)
+	select {
+	case m.queue <- job.ID:
+	default:
+		return nil, ErrQueueFull
+	}
+	m.jobs[job.ID] = job
+	return job.snapshot(), nil
+}
+
+func newJob(req Request) *Job {
+	now := time.Now()
+	job := &Job{
+		ID:        uuid.New().String(),
+		Request:   req,
+		Status:    StatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, stage := range stages {
+		job.Stages = append(job.Stages, StageState{Name: stage, Status: StatusPending})
+	}
+	return job
+}
+
+// Get returns a copy of a job
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.snapshot(), true
+}
+
+// Close stops the workers. Jobs still waiting in the queue are not run.
+func (m *Manager) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// prune forgets finished jobs past the retention period
+func (m *Manager) prune(now time.Time) {
+	if m.retention <= 0 {
+		return
+	}
+	for id, job := range m.jobs {
+		if job.finished() && now.Sub(job.UpdatedAt) > m.retention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *Manager) work() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case id := <-m.queue:
+			m.run(id)
+		}
+	}
+}
+
+// run drives a job through its stages, stopping at the first failure.
+// Resumed jobs start after the stages they already completed, relayed ones
+// stop after the TEE stage.
+func (m *Manager) run(id string) {
+	m.mu.Lock()
+	job := m.jobs[id]
+	req, result, txHash := job.Request, job.Result, job.Stage(StageConfirm).TxHash
+	m.mu.Unlock()
+
+	if result == nil {
+		err := m.stage(id, StageTEE, func(state *StageState) error {
+			var err error
+			result, err = m.processor.ProcessGeneData(req.FileHash, req.SessionID, req.Product)
+			if err == nil {
+				m.update(id, func(job *Job) { job.Result = result })
+			}
+			return err
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if req.Relayed {
+		m.update(id, func(job *Job) {
+			job.Stage(StageConfirm).Status = StatusSkipped
+			job.Stage(StageMint).Status = StatusSkipped
+			job.Status = StatusSucceeded
+		})
+		return
+	}
+
+	if txHash == "" {
+		err := m.stage(id, StageConfirm, func(state *StageState) error {
+			var err error
+			txHash, err = m.chain.SubmitConfirm(m.ctx, result, req.Wallet)
+			state.TxHash = txHash
+			return err
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	m.stage(id, StageMint, func(state *StageState) error {
+		state.TxHash = txHash
+		mint, err := m.chain.WaitForMint(m.ctx, txHash)
+		if err != nil {
+			return err
+		}
+		m.update(id, func(job *Job) { job.Mint = mint })
+		return nil
+	})
+}
+
+// stage runs fn as the given stage of a job and records its outcome. fn may
+// fill in the stage state, e.g. its transaction hash.
+func (m *Manager) stage(id string, name Stage, fn func(state *StageState) error) error {
+	m.update(id, func(job *Job) {
+		now := time.Now()
+		job.Status = StatusRunning
+		state := job.Stage(name)
+		state.Status = StatusRunning
+		state.StartedAt = &now
+	})
+
+	state := StageState{}
+	err := fn(&state)
+
+	var snapshot *Job
+	m.update(id, func(job *Job) {
+		defer func() { snapshot = job.snapshot() }()
+
+		now := time.Now()
+		current := job.Stage(name)
+		current.TxHash = state.TxHash
+		current.FinishedAt = &now
+		if err != nil {
+			log.Printf("Job %s failed at %s: %v", id, name, err)
+			current.Status = StatusFailed
+			current.Error = err.Error()
+			job.Status = StatusFailed
+			return
+		}
+		current.Status = StatusSucceeded
+		if name == stages[len(stages)-1] {
+			job.Status = StatusSucceeded
+		}
+	})
+
+	if m.recorder != nil {
+		if recordErr := m.recorder.Record(snapshot, name, err); recordErr != nil {
+			log.Printf("Warning: failed to record job %s at %s: %v", id, name, recordErr)
+		}
+	}
+	return err
+}
+
+func (m *Manager) update(id string, fn func(job *Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := m.jobs[id]
+	fn(job)
+	job.UpdatedAt = time.Now()
+}
+
+// Stage returns the state of one of the job stages
+func (j *Job) Stage(name Stage) *StageState {
+	for i := range j.Stages {
+		if j.Stages[i].Name == name {
+			return &j.Stages[i]
+		}
+	}
+	panic("unknown job stage " + string(name))
+}
+
+func (j *Job) finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+func (j *Job) snapshot() *Job {
+	snapshot := *j
+	snapshot.Stages = append([]StageState(nil), j.Stages...)
+	return &snapshot
+}
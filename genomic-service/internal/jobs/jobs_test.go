@@ -0,0 +1,248 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"genomic-service/internal/config"
+	"genomic-service/internal/jobs"
+	"genomic-service/internal/types"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const wallet = "0x00000000000000000000000000000000000000aa"
+
+type fakeProcessor struct {
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func (p *fakeProcessor) ProcessGeneData(fileHash, sessionID, product string) (*types.ProcessResult, error) {
+	if p.started != nil {
+		p.started <- struct{}{}
+		<-p.release
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &types.ProcessResult{DocID: fileHash, SessionID: sessionID, RiskScore: 3}, nil
+}
+
+type fakeChain struct {
+	submitErr error
+	mintErr   error
+	submitted int
+	wallet    string
+}
+
+func (c *fakeChain) SubmitConfirm(ctx context.Context, result *types.ProcessResult, wallet string) (string, error) {
+	c.submitted++
+	c.wallet = wallet
+	if c.submitErr != nil {
+		return "", c.submitErr
+	}
+	return "0xconfirm-" + result.SessionID, nil
+}
+
+func (c *fakeChain) WaitForMint(ctx context.Context, txHash string) (*types.MintResult, error) {
+	if c.mintErr != nil {
+		return nil, c.mintErr
+	}
+	return &types.MintResult{TxHash: txHash, TokenID: "7", Owner: c.wallet, Reward: "3000"}, nil
+}
+
+type record struct {
+	stage jobs.Stage
+	err   error
+}
+
+type fakeRecorder struct {
+	mu      sync.Mutex
+	records []record
+}
+
+func (r *fakeRecorder) Record(job *jobs.Job, stage jobs.Stage, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record{stage: stage, err: err})
+	return nil
+}
+
+func waitForJob(t *testing.T, manager *jobs.Manager, id string) *jobs.Job {
+	var job *jobs.Job
+	assert.Eventually(t, func() bool {
+		job, _ = manager.Get(id)
+		return job.Status == jobs.StatusSucceeded || job.Status == jobs.StatusFailed
+	}, 5*time.Second, 5*time.Millisecond)
+	return job
+}
+
+func TestManager(t *testing.T) {
+	testCases := []struct {
+		name         string
+		processorErr error
+		submitErr    error
+		mintErr      error
+		expected     []jobs.Status
+		failedStage  jobs.Stage
+		expectTxHash bool
+	}{
+		{
+			name:         "All stages succeed",
+			expected:     []jobs.Status{jobs.StatusSucceeded, jobs.StatusSucceeded, jobs.StatusSucceeded},
+			expectTxHash: true,
+		},
+		{
+			name:         "TEE failure stops the job",
+			processorErr: errors.New("chunk 2 failed authentication"),
+			expected:     []jobs.Status{jobs.StatusFailed, jobs.StatusPending, jobs.StatusPending},
+			failedStage:  jobs.StageTEE,
+		},
+		{
+			name:        "Confirm failure",
+			submitErr:   errors.New("execution reverted"),
+			expected:    []jobs.Status{jobs.StatusSucceeded, jobs.StatusFailed, jobs.StatusPending},
+			failedStage: jobs.StageConfirm,
+		},
+		{
+			name:         "Mint failure keeps the tx hash",
+			mintErr:      errors.New("confirm transaction reverted"),
+			expected:     []jobs.Status{jobs.StatusSucceeded, jobs.StatusSucceeded, jobs.StatusFailed},
+			failedStage:  jobs.StageMint,
+			expectTxHash: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			manager := jobs.NewManager(
+				&fakeProcessor{err: tc.processorErr},
+				&fakeChain{submitErr: tc.submitErr, mintErr: tc.mintErr},
+				nil,
+				&config.JobSettings{Workers: 2, QueueSize: 4},
+			)
+			defer manager.Close()
+
+			queued, err := manager.Submit(jobs.Request{FileHash: "abc", SessionID: "42", Wallet: wallet})
+			assert.NoError(t, err)
+			assert.Equal(t, jobs.StatusPending, queued.Status)
+
+			job := waitForJob(t, manager, queued.ID)
+			for i, stage := range job.Stages {
+				assert.Equal(t, tc.expected[i], stage.Status, stage.Name)
+				if stage.Name == tc.failedStage {
+					assert.NotEmpty(t, stage.Error)
+				}
+			}
+
+			if tc.failedStage == "" {
+				assert.Equal(t, jobs.StatusSucceeded, job.Status)
+				assert.Equal(t, 3, job.Result.RiskScore)
+				assert.Equal(t, "7", job.Mint.TokenID)
+				assert.Equal(t, wallet, job.Mint.Owner)
+			} else {
+				assert.Equal(t, jobs.StatusFailed, job.Status)
+			}
+			if tc.expectTxHash {
+				assert.Equal(t, "0xconfirm-42", job.Stages[1].TxHash)
+				assert.Equal(t, "0xconfirm-42", job.Stages[2].TxHash)
+			}
+		})
+	}
+}
+
+func TestManagerQueue(t *testing.T) {
+	processor := &fakeProcessor{started: make(chan struct{}), release: make(chan struct{})}
+	manager := jobs.NewManager(processor, &fakeChain{}, nil, &config.JobSettings{Workers: 1, QueueSize: 1})
+	defer manager.Close()
+
+	// The only worker is busy with the first job, the second one waits
+	first, err := manager.Submit(jobs.Request{FileHash: "a", SessionID: "1"})
+	assert.NoError(t, err)
+	<-processor.started
+	second, err := manager.Submit(jobs.Request{FileHash: "b", SessionID: "2"})
+	assert.NoError(t, err)
+
+	_, err = manager.Submit(jobs.Request{FileHash: "c", SessionID: "3"})
+	assert.ErrorIs(t, err, jobs.ErrQueueFull)
+
+	job, ok := manager.Get(first.ID)
+	assert.True(t, ok)
+	assert.Equal(t, jobs.StatusRunning, job.Status)
+	assert.Equal(t, jobs.StatusRunning, job.Stages[0].Status)
+
+	processor.release <- struct{}{}
+	<-processor.started
+	processor.release <- struct{}{}
+	assert.Equal(t, jobs.StatusSucceeded, waitForJob(t, manager, first.ID).Status)
+	assert.Equal(t, jobs.StatusSucceeded, waitForJob(t, manager, second.ID).Status)
+
+	_, ok = manager.Get("unknown")
+	assert.False(t, ok)
+}
+
+func TestManagerResume(t *testing.T) {
+	processor := &fakeProcessor{err: errors.New("the TEE must not run again")}
+
+	t.Run("Resume after the TEE stage", func(t *testing.T) {
+		chain, recorder := &fakeChain{}, &fakeRecorder{}
+		manager := jobs.NewManager(processor, chain, recorder, &config.JobSettings{})
+		defer manager.Close()
+
+		result := &types.ProcessResult{DocID: "abc", SessionID: "42", RiskScore: 2}
+		queued, err := manager.Resume(jobs.Request{FileHash: "abc", SessionID: "42"}, result, "")
+		assert.NoError(t, err)
+
+		job := waitForJob(t, manager, queued.ID)
+		assert.Equal(t, jobs.StatusSucceeded, job.Status)
+		assert.Equal(t, 2, job.Result.RiskScore)
+
+		// Stages are recorded after the job status changes
+		manager.Close()
+		assert.Equal(t, 1, chain.submitted)
+		assert.Equal(t, []record{{stage: jobs.StageConfirm}, {stage: jobs.StageMint}}, recorder.records)
+	})
+
+	t.Run("Resume waiting for the mint", func(t *testing.T) {
+		chain, recorder := &fakeChain{}, &fakeRecorder{}
+		manager := jobs.NewManager(processor, chain, recorder, &config.JobSettings{})
+		defer manager.Close()
+
+		result := &types.ProcessResult{DocID: "abc", SessionID: "42", RiskScore: 2}
+		queued, err := manager.Resume(jobs.Request{FileHash: "abc", SessionID: "42"}, result, "0xsent")
+		assert.NoError(t, err)
+
+		// The confirm transaction was sent before, it must not be sent twice
+		job := waitForJob(t, manager, queued.ID)
+		assert.Equal(t, jobs.StatusSucceeded, job.Status)
+		assert.Equal(t, "0xsent", job.Mint.TxHash)
+
+		manager.Close()
+		assert.Equal(t, 0, chain.submitted)
+		assert.Equal(t, []record{{stage: jobs.StageMint}}, recorder.records)
+	})
+}
+
+func TestManagerRelayed(t *testing.T) {
+	chain, recorder := &fakeChain{}, &fakeRecorder{}
+	manager := jobs.NewManager(&fakeProcessor{}, chain, recorder, &config.JobSettings{})
+	defer manager.Close()
+
+	queued, err := manager.Submit(jobs.Request{FileHash: "abc", SessionID: "42", Wallet: wallet, Relayed: true})
+	assert.NoError(t, err)
+
+	// The user relays confirm with the result, the gateway sends nothing
+	job := waitForJob(t, manager, queued.ID)
+	assert.Equal(t, jobs.StatusSucceeded, job.Status)
+	assert.Equal(t, 3, job.Result.RiskScore)
+	assert.Equal(t, jobs.StatusSkipped, job.Stage(jobs.StageConfirm).Status)
+	assert.Equal(t, jobs.StatusSkipped, job.Stage(jobs.StageMint).Status)
+
+	manager.Close()
+	assert.Equal(t, 0, chain.submitted)
+	assert.Equal(t, []record{{stage: jobs.StageTEE}}, recorder.records)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"genomic-service/internal/blockchain"
+	"genomic-service/internal/jobs"
+	"genomic-service/internal/uploads"
+	teesdk "genomic-service/pkg/tee"
+	"log"
+	"time"
+)
+
+var errNotConfirmed = errors.New("upload is not confirmed yet")
+
+// jobRecorder moves uploads through their lifecycle as confirmation jobs
+// finish their stages
+type jobRecorder struct {
+	uploads    *uploads.Store
+	blockchain *blockchain.BlockchainService
+}
+
+func (r *jobRecorder) Record(job *jobs.Job, stage jobs.Stage, err error) error {
+	fileHash := job.FileHash
+
+	if err != nil {
+		if reason, final := r.final(job, err); final {
+			_, transitionErr := r.uploads.Transition(fileHash, uploads.StateFailed, func(upload *uploads.Upload) {
+				upload.Error = reason
+			})
+			return transitionErr
+		}
+
+		// Anything else may be retried, by the client or on the next start
+		_, updateErr := r.uploads.Update(fileHash, func(upload *uploads.Upload) error {
+			upload.Error = err.Error()
+			if upload.JobID == job.ID {
+				upload.JobID = ""
+			}
+			return nil
+		})
+		return updateErr
+	}
+
+	switch stage {
+	case jobs.StageTEE:
+		_, err = r.uploads.Transition(fileHash, uploads.StateProcessed, func(upload *uploads.Upload) {
+			upload.Result = job.Result
+			upload.Error = ""
+		})
+	case jobs.StageConfirm:
+		confirmed := func(upload *uploads.Upload) {
+			upload.ConfirmTx = job.Stage(jobs.StageConfirm).TxHash
+			upload.Error = ""
+		}
+		// Retried after the mint failed, the upload is confirmed already
+		_, err = r.uploads.Update(fileHash, func(upload *uploads.Upload) error {
+			if upload.State != uploads.StateConfirmed {
+				return errNotConfirmed
+			}
+			confirmed(upload)
+			return nil
+		})
+		if errors.Is(err, errNotConfirmed) {
+			_, err = r.uploads.Transition(fileHash, uploads.StateConfirmed, confirmed)
+		}
+	case jobs.StageMint:
+		_, err = r.uploads.Transition(fileHash, uploads.StateMinted, func(upload *uploads.Upload) {
+			upload.TokenID = job.Mint.TokenID
+			upload.Error = ""
+		})
+	}
+	return err
+}
+
+// final tells whether a stage error fails the upload for good, and why.
+// Corrupt data fails the same way again and a session of another wallet
+// stays so. A reverted confirm is final only once the session reads
+// confirmed on chain, so no confirm of ours can go through any more; while
+// it is unconfirmed a retry sends a new one. A confirm cancelled at the
+// deadline didn't happen and is retried the same way.
+func (r *jobRecorder) final(job *jobs.Job, err error) (string, bool) {
+	var chunkErr *teesdk.ChunkError
+	switch {
+	case errors.As(err, &chunkErr), errors.Is(err, blockchain.ErrSessionOwner):
+		return err.Error(), true
+	case errors.Is(err, blockchain.ErrTxReverted):
+		confirmed, checkErr := r.blockchain.SessionConfirmed(job.SessionID)
+		if checkErr != nil {
+			log.Printf("Warning: failed to check session %s after a revert: %v", job.SessionID, checkErr)
+			return "", false
+		}
+		if confirmed {
+			return fmt.Sprintf("%v, session %s was confirmed by another transaction", err, job.SessionID), true
+		}
+	}
+	return "", false
+}
+
+// recoverUploads picks up every upload a previous run left in flight:
+//   - uploaded: the session was never recorded, so it is opened again, which
+//     returns the session already mined for the blob if there is one, or the
+//     upload is failed when its blob is gone
+//   - session-opened: resumed only when a confirmation was requested,
+//     otherwise it waits for the client as before
+//   - processed and confirmed: the confirmation is resumed after the last
+//     completed stage, so the TEE isn't run again; confirm is never sent
+//     twice as the outbox keeps one per session. Relayed sessions are left
+//     to the user once processed.
+func (s *Server) recoverUploads() {
+	inFlight, err := s.uploads.InFlight()
+	if err != nil {
+		log.Printf("Warning: failed to recover uploads: %v", err)
+		return
+	}
+
+	for _, upload := range inFlight {
+		if err := s.recoverUpload(upload); err != nil {
+			log.Printf("Warning: failed to recover upload %s: %v", upload.FileHash, err)
+		}
+	}
+}
+
+func (s *Server) recoverUpload(upload *uploads.Upload) error {
+	// Recorded before uploads carried the user's wallet, nobody to mint to
+	if upload.Wallet == "" {
+		_, err := s.uploads.Transition(upload.FileHash, uploads.StateFailed, func(upload *uploads.Upload) {
+			upload.Error = "no wallet recorded for the upload"
+		})
+		return err
+	}
+
+	switch upload.State {
+	case uploads.StateUploaded:
+		reader, err := s.storage.RetrieveStream(upload.FileHash)
+		if err != nil {
+			_, err = s.uploads.Transition(upload.FileHash, uploads.StateFailed, func(upload *uploads.Upload) {
+				upload.Error = "blob missing from storage"
+			})
+			return err
+		}
+		reader.Close()
+		return s.openSession(upload.FileHash, upload.Wallet, upload.RelayTx)
+
+	case uploads.StateSessionOpened:
+		if upload.JobID == "" {
+			return nil
+		}
+		return s.resumeConfirmation(upload)
+
+	case uploads.StateProcessed, uploads.StateConfirmed:
+		// The user confirms a relayed session with the result
+		if upload.RelayTx != "" {
+			return nil
+		}
+		return s.resumeConfirmation(upload)
+	}
+	return nil
+}
+
+// openSession starts the on-chain upload session of a stored blob for the
+// user's wallet, or records the one they opened through the relayer with
+// relayTx
+func (s *Server) openSession(fileHash, wallet, relayTx string) error {
+	var sessionID string
+	var err error
+	if relayTx != "" {
+		sessionID, err = s.blockchain.RelayedSession(context.Background(), relayTx, fileHash, wallet)
+	} else {
+		sessionID, err = s.blockchain.InitiateDataUpload(fileHash, wallet)
+	}
+	if sessionRefused(err, relayTx != "") {
+		s.uploads.Transition(fileHash, uploads.StateFailed, func(upload *uploads.Upload) {
+			upload.Error = err.Error()
+		})
+		return err
+	}
+	if err != nil {
+		s.uploads.Update(fileHash, func(upload *uploads.Upload) error {
+			upload.Error = err.Error()
+			return nil
+		})
+		return err
+	}
+
+	_, err = s.uploads.Transition(fileHash, uploads.StateSessionOpened, func(upload *uploads.Upload) {
+		upload.SessionID = sessionID
+		upload.Error = ""
+	})
+	return err
+}
+
+// sessionRefused tells whether opening a session failed for good, so the
+// upload fails and may be sent again. A relayed transaction that opened no
+// session of the wallet never will.
+func sessionRefused(err error, relayed bool) bool {
+	if errors.Is(err, blockchain.ErrSessionOwner) {
+		return true
+	}
+	return relayed && (errors.Is(err, blockchain.ErrNoSession) || errors.Is(err, blockchain.ErrTxReverted))
+}
+
+// resumeConfirmation queues the rest of a confirmation, waiting for room in
+// the queue since nobody is there to retry
+func (s *Server) resumeConfirmation(upload *uploads.Upload) error {
+	for {
+		_, err := s.uploads.Update(upload.FileHash, func(upload *uploads.Upload) error {
+			// Queued inside the update, so the job can't record its stages
+			// before its ID is stored
+			req := jobs.Request{FileHash: upload.FileHash, SessionID: upload.SessionID, Product: upload.Product, Wallet: upload.Wallet, Relayed: upload.RelayTx != ""}
+			job, err := s.jobs.Resume(req, upload.Result, upload.ConfirmTx)
+			if err != nil {
+				return err
+			}
+			upload.JobID = job.ID
+			return nil
+		})
+		if errors.Is(err, jobs.ErrQueueFull) {
+			time.Sleep(time.Second)
+			continue
+		}
+		return err
+	}
+}
@@ -1,130 +1,884 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"genomic-service/internal/blockchain"
 	"genomic-service/internal/config"
+	"genomic-service/internal/indexer"
+	"genomic-service/internal/jobs"
 	"genomic-service/internal/storage"
 	"genomic-service/internal/tee"
+	"genomic-service/internal/uploads"
+	teesdk "genomic-service/pkg/tee"
 	"io"
+	"log"
+	"math/big"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/gin-gonic/gin"
 )
 
+// intentSignatureHeader carries the upload intent signature, and the confirm
+// intent signature to read a job, kept out of the URL so request logs don't
+// record it
+const intentSignatureHeader = "X-Intent-Signature"
+
+var (
+	errSessionMismatch = errors.New("sessionId does not match the upload")
+	errWalletMismatch  = errors.New("wallet does not match the upload")
+	errNoIntent        = errors.New("upload has no signed intent")
+	errIntentMismatch  = errors.New("confirm signature or product does not match the upload intent")
+	errNotConfirmable  = errors.New("upload is already being confirmed, was minted or failed")
+)
+
 type Server struct {
-	router     *gin.Engine
-	storage    storage.Storage
-	tee        *tee.TEEService
-	blockchain *blockchain.BlockchainService
+	router        *gin.Engine
+	storage       storage.StreamStorage
+	tee           tee.Service
+	blockchain    *blockchain.BlockchainService
+	outbox        *blockchain.Outbox
+	uploads       *uploads.Store
+	jobs          *jobs.Manager
+	history       *indexer.Store      // nil when the indexer is disabled
+	indexer       *indexer.Indexer    // nil when the indexer is disabled
+	relayer       *blockchain.Relayer // nil when the relayer is disabled
+	intentDomain  *teesdk.IntentDomain
+	maxUploadSize int64
+	adminToken    string
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
-	router := gin.Default()
+	srv := &Server{
+		router:        gin.Default(),
+		maxUploadSize: cfg.StorageSettings.MaxUploadSize,
+		adminToken:    cfg.ServerSettings.AdminToken,
+	}
+	// Whatever was opened before a failure is closed again
+	fail := func(err error) (*Server, error) {
+		srv.Close()
+		return nil, err
+	}
 
 	// Initialize storage
-	storage := storage.NewMemoryStorage()
+	var err error
+	srv.storage, err = storage.NewStorage(cfg.StorageSettings)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize TEE service
-	teeService := tee.NewTEEService(storage)
+	srv.tee, err = newTEEService(srv.storage, cfg)
+	if err != nil {
+		return fail(err)
+	}
 
 	// Initialize blockchain service
-	blockchainService, err := blockchain.NewBlockchainService(
+	srv.outbox, err = blockchain.NewOutbox(cfg.BlockchainSettings.OutboxPath)
+	if err != nil {
+		return fail(err)
+	}
+	srv.blockchain, err = blockchain.NewBlockchainService(
 		cfg.BlockchainSettings.RPCURL,
 		cfg.WalletSettings.PrivateKey,
 		cfg.BlockchainSettings.ControllerAddress,
+		srv.outbox,
+		blockchain.NewFeePolicy(cfg.BlockchainSettings),
+		cfg.BlockchainSettings.ConfirmationDepth,
 	)
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 
-	srv := &Server{
-		router:     router,
-		storage:    storage,
-		tee:        teeService,
-		blockchain: blockchainService,
+	// Initialize upload lifecycle store
+	srv.uploads, err = uploads.NewStore(cfg.StateSettings)
+	if err != nil {
+		return fail(err)
+	}
+	srv.jobs = jobs.NewManager(srv.tee, srv.blockchain, &jobRecorder{uploads: srv.uploads, blockchain: srv.blockchain}, cfg.JobSettings)
+
+	// Users sign upload intents for this chain and controller
+	srv.intentDomain = &teesdk.IntentDomain{
+		ChainID:           big.NewInt(blockchain.ChainID),
+		VerifyingContract: common.HexToAddress(cfg.BlockchainSettings.ControllerAddress),
+	}
+
+	// Index controller events for history queries
+	if cfg.IndexerSettings.Enabled {
+		srv.history, err = indexer.NewStore(cfg.IndexerSettings)
+		if err != nil {
+			return fail(err)
+		}
+		srv.indexer, err = indexer.NewIndexer(
+			srv.blockchain.Client(),
+			cfg.BlockchainSettings.ControllerAddress,
+			cfg.BlockchainSettings.ConfirmationDepth,
+			srv.history,
+			cfg.IndexerSettings,
+		)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// Relay users' signed controller calls, paid by the service wallet
+	if cfg.RelayerSettings.Enabled {
+		srv.relayer, err = blockchain.NewRelayer(srv.blockchain, cfg.BlockchainSettings.ControllerAddress, cfg.RelayerSettings, srv.uploads)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	// The controller only accepts proofs of allowed TEE keys
+	if err := srv.registerTEESigner(); err != nil {
+		return fail(err)
 	}
 
 	srv.setupRoutes()
+
+	// Resume what a previous run left in flight
+	go srv.recoverUploads()
+
 	return srv, nil
 }
 
+// newTEEService connects to the tee-worker when a socket is configured, so
+// keys and plaintext stay out of the gateway. Without one the TEE runs
+// in-process, which is only meant for development.
+func newTEEService(storage storage.StreamStorage, cfg *config.Config) (tee.Service, error) {
+	if cfg.TEESettings.WorkerSocket == "" {
+		service, err := tee.NewTEEService(storage, cfg.TEESettings)
+		if err != nil {
+			return nil, err
+		}
+		return service, nil
+	}
+	if cfg.StorageSettings.Type == "memory" {
+		return nil, fmt.Errorf("memory storage can't be shared with the TEE worker")
+	}
+	return tee.NewClient(cfg.TEESettings.WorkerSocket), nil
+}
+
 func (s *Server) setupRoutes() {
 	api := s.router.Group("/api")
 	{
 		api.POST("/upload", s.handleUploadDoc)
 		api.POST("/confirm", s.handleConfirmDoc)
+		api.GET("/jobs/:id", s.handleGetJob)
+		api.GET("/uploads/:fileHash", s.handleGetUpload)
 
 		api.GET("/tee/public-key", s.handleGetTEEPublicKey)
+		api.GET("/tee/attestation", s.handleGetTEEAttestation)
+		api.GET("/tee/models", s.handleGetTEEModels)
+
+		history := api.Group("/history", s.requireHistory)
+		{
+			history.GET("/status", s.handleGetHistoryStatus)
+			history.GET("/sessions/:sessionId", s.handleGetSessionHistory)
+			history.GET("/docs/:docId", s.handleGetDocHistory)
+			history.GET("/tokens/:tokenId", s.handleGetTokenHistory)
+			history.GET("/rewards/:address", s.handleGetRewardHistory)
+		}
+
+		relay := api.Group("/relay", s.requireRelayer)
+		{
+			relay.POST("", s.handleRelay)
+			relay.GET("/nonce/:address", s.handleGetRelayNonce)
+		}
+
+		admin := api.Group("/admin", s.requireAdmin)
+		{
+			admin.POST("/tee/rotate", s.handleRotateTEEKey)
+			admin.POST("/tee/reencrypt", s.handleReencryptTEEData)
+			admin.POST("/tee/retire", s.handleRetireTEEKey)
+		}
 	}
 }
 
+// handleUploadDoc stores a blob and opens its upload session for the user's
+// wallet, which receives the G-NFT and PCSP reward. The user agrees to it by
+// signing an UploadIntent for the file hash, given with the wallet, product
+// and nonce as query parameters and the signature in the X-Intent-Signature
+// header, which request logs leave out. The intent is checked before the body
+// is read, so nothing unsigned is stored. Blobs that aren't chunked envelopes
+// for the current TEE key are discarded. A user who opened the session
+// through the relayer gives its uploadData transaction as relayTx instead.
 func (s *Server) handleUploadDoc(c *gin.Context) {
-	// Read file data
-	data, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+	wallet := c.Query("wallet")
+	if !isWallet(wallet) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A valid wallet address is required"})
+		return
+	}
+	wallet = common.HexToAddress(wallet).Hex()
+
+	declared := strings.ToLower(strings.TrimPrefix(c.Query("fileHash"), "0x"))
+	nonce, ok := new(big.Int).SetString(c.Query("nonce"), 10)
+	signature, err := hexutil.Decode(c.GetHeader(intentSignatureHeader))
+	if declared == "" || !ok || nonce.Sign() < 0 || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A signed upload intent (fileHash, nonce and " + intentSignatureHeader + ") is required"})
+		return
+	}
+	relayTx := c.Query("relayTx")
+	if relayTx != "" {
+		if hash, err := hexutil.Decode(relayTx); err != nil || len(hash) != common.HashLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "relayTx must be a transaction hash"})
+			return
+		}
+	}
+	intent := &uploads.Intent{Product: c.Query("product"), Nonce: nonce.String(), Signature: hexutil.Encode(signature)}
+	if !s.checkProduct(c, intent.Product) {
 		return
 	}
+	if err := s.verifyIntent(declared, wallet, intent); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid upload intent signature"})
+		return
+	}
+
+	body := c.Request.Body
+	if s.maxUploadSize > 0 {
+		body = http.MaxBytesReader(c.Writer, body, s.maxUploadSize)
+	}
 
-	// Store data
-	fileHash, err := s.storage.Store(data)
+	// Stream file data straight into storage, keeping the envelope header
+	header := &headerRecorder{r: body}
+	fileHash, err := s.storage.StoreStream(header)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store data"})
 		return
 	}
 
-	// Initiate blockchain upload
-	sessionID, err := s.blockchain.InitiateDataUpload(fileHash)
+	// The intent was signed for this content only
+	if fileHash != declared {
+		s.discardBlob(fileHash)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fileHash does not match the uploaded data", "fileHash": fileHash})
+		return
+	}
+
+	// Whole-file envelopes are decrypted in memory and can't be rewrapped, so
+	// they would pin their key forever
+	if !teesdk.IsChunked(header.prefix) {
+		s.discardBlob(fileHash)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Data must be a chunked envelope"})
+		return
+	}
+
+	// Only data encrypted to the current key is accepted. It is checked once
+	// stored, so an old key being retired already sees every blob it still
+	// has to move.
+	info, err := s.tee.GetInfo()
+	if err != nil {
+		s.discardBlob(fileHash)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TEE is unavailable"})
+		return
+	}
+	if keyID, _, ok, err := teesdk.ParseHeader(header.prefix); err != nil || !ok || keyID != info.KeyID {
+		s.discardBlob(fileHash)
+		c.JSON(http.StatusConflict, gin.H{"error": "Data must be encrypted to the current TEE key, fetch it again", "keyId": info.KeyID})
+		return
+	}
+
+	// Record the blob before anything happens on chain
+	if _, err := s.uploads.Create(fileHash, wallet, intent, relayTx); err != nil {
+		if errors.Is(err, uploads.ErrExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "File already uploaded", "fileHash": fileHash})
+			return
+		}
+		if errors.Is(err, uploads.ErrNonceUsed) {
+			s.discardBlob(fileHash)
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "fileHash": fileHash})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record upload"})
+		return
+	}
+
+	// Initiate blockchain upload. When it fails the upload stays recorded,
+	// and the session is opened again on the next start.
+	if err := s.openSession(fileHash, wallet, relayTx); err != nil {
+		if relayTx != "" && sessionRefused(err, true) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "relayTx did not open a session of the wallet for this file", "fileHash": fileHash})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate blockchain upload", "fileHash": fileHash})
+		return
+	}
+	upload, err := s.uploads.Get(fileHash)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initiate blockchain upload"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"fileHash":  fileHash,
-		"sessionId": sessionID,
+		"sessionId": upload.SessionID,
+		"wallet":    upload.Wallet,
 	})
 }
 
+// headerRecorder keeps the envelope header of the data read through it
+type headerRecorder struct {
+	r      io.Reader
+	prefix []byte
+}
+
+func (h *headerRecorder) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if missing := teesdk.HeaderSize - len(h.prefix); missing > 0 {
+		h.prefix = append(h.prefix, p[:min(n, missing)]...)
+	}
+	return n, err
+}
+
+// discardBlob deletes a blob stored for a rejected upload, unless an upload
+// of the same content is recorded
+func (s *Server) discardBlob(fileHash string) {
+	if _, err := s.uploads.Get(fileHash); !errors.Is(err, uploads.ErrNotFound) {
+		return
+	}
+	if err := s.storage.Delete(fileHash); err != nil {
+		log.Printf("Warning: failed to delete rejected upload %s: %v", fileHash, err)
+	}
+}
+
+// isWallet tells whether s is a usable wallet address
+func isWallet(s string) bool {
+	return common.IsHexAddress(s) && common.HexToAddress(s) != (common.Address{})
+}
+
+// verifyIntent checks that wallet signed intent for the file
+func (s *Server) verifyIntent(fileHash, wallet string, intent *uploads.Intent) error {
+	nonce, ok := new(big.Int).SetString(intent.Nonce, 10)
+	if !ok {
+		return fmt.Errorf("invalid nonce: %s", intent.Nonce)
+	}
+	signature, err := hexutil.Decode(intent.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return teesdk.VerifyUploadIntent(&teesdk.UploadIntent{
+		FileHash: fileHash,
+		Wallet:   common.HexToAddress(wallet),
+		Product:  intent.Product,
+		Nonce:    nonce,
+	}, s.intentDomain, signature)
+}
+
+// checkProduct rejects unknown products now rather than in a failed job
+func (s *Server) checkProduct(c *gin.Context, product string) bool {
+	if product == "" {
+		return true
+	}
+	catalog, err := s.tee.GetModelCatalog()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TEE is unavailable"})
+		return false
+	}
+	if _, ok := catalog.Products[product]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%v: %s", tee.ErrUnknownProduct, product)})
+		return false
+	}
+	return true
+}
+
+// handleConfirmDoc queues the TEE processing, confirmation and minting of an
+// upload. The wallet's signature of a ConfirmIntent for the file and session
+// is required, so only the user confirms. Clients follow the returned job
+// with GET /api/jobs/:id.
 func (s *Server) handleConfirmDoc(c *gin.Context) {
-	var req struct {
-		FileHash  string `json:"fileHash"`
-		SessionID string `json:"sessionId"`
+	var body struct {
+		jobs.Request        // product selects the risk model, the intent's by default
+		Signature    string `json:"signature"` // of the ConfirmIntent
 	}
 
-	if err := c.BindJSON(&req); err != nil {
+	if err := c.BindJSON(&body); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
+	req := body.Request
+	if req.FileHash == "" || req.SessionID == "" || body.Signature == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "fileHash, sessionId and signature are required"})
+		return
+	}
+	signature, err := hexutil.Decode(body.Signature)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+	if !s.checkProduct(c, req.Product) {
+		return
+	}
+
+	// Claim the upload for this confirmation, atomically, so a session is
+	// never confirmed twice
+	var job *jobs.Job
+	_, err = s.uploads.Update(req.FileHash, func(upload *uploads.Upload) error {
+		if upload.SessionID != req.SessionID {
+			return errSessionMismatch
+		}
+		// The wallet is optional, the one the session was opened for is used
+		if req.Wallet != "" && (!isWallet(req.Wallet) || common.HexToAddress(req.Wallet).Hex() != upload.Wallet) {
+			return errWalletMismatch
+		}
+		req.Wallet = upload.Wallet
+		req.Relayed = upload.RelayTx != ""
+
+		// Signed by the wallet for this file, at upload
+		if upload.Intent == nil {
+			return errNoIntent
+		}
+		if req.Product == "" {
+			req.Product = upload.Intent.Product
+		}
+		if req.Product != upload.Intent.Product {
+			return errIntentMismatch
+		}
+		sessionID, ok := new(big.Int).SetString(upload.SessionID, 10)
+		if !ok {
+			return fmt.Errorf("invalid session ID: %s", upload.SessionID)
+		}
+		confirm := &teesdk.ConfirmIntent{FileHash: upload.FileHash, SessionID: sessionID}
+		if err := teesdk.VerifyConfirmIntent(confirm, s.intentDomain, common.HexToAddress(upload.Wallet), signature); err != nil {
+			return fmt.Errorf("%w: %v", errIntentMismatch, err)
+		}
+		if upload.JobID != "" || !confirmable(upload.State) {
+			return errNotConfirmable
+		}
+
+		// A confirmation that failed after the TEE stage picks up from there.
+		// One that failed to mint sends confirm again, which gets back the
+		// transaction already sent, or a new one when that failed. A relayed
+		// one is done once processed, asking again gives the result back.
+		var err error
+		job, err = s.jobs.Resume(req, upload.Result, "")
+		if err != nil {
+			return err
+		}
+		upload.Product = req.Product
+		upload.JobID = job.ID
+		upload.Error = ""
+		return nil
+	})
+	switch {
+	case errors.Is(err, uploads.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	case errors.Is(err, errSessionMismatch), errors.Is(err, errWalletMismatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errNoIntent), errors.Is(err, errIntentMismatch):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errNotConfirmable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, jobs.ErrQueueFull):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many pending confirmations, retry later"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue confirmation"})
+		return
+	}
+
+	c.Header("Location", "/api/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Document queued for processing",
+		"jobId":   job.ID,
+		"status":  job.Status,
+	})
+}
+
+// confirmable tells whether an upload without a running job may be
+// confirmed, again after a failure
+func confirmable(state uploads.State) bool {
+	return state == uploads.StateSessionOpened || state == uploads.StateProcessed || state == uploads.StateConfirmed
+}
+
+// handleGetJob reports the stages of a confirmation, with their errors and
+// transaction hashes. The result holds the risk score and the salt opening
+// the content hash, so the job is only shown to its wallet: the confirm
+// intent signature must be sent again in the intent signature header.
+func (s *Server) handleGetJob(c *gin.Context) {
+	job, ok := s.jobs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	signature, err := hexutil.Decode(c.GetHeader(intentSignatureHeader))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The confirm intent signature is required in " + intentSignatureHeader})
+		return
+	}
+	sessionID, ok := new(big.Int).SetString(job.SessionID, 10)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid session ID"})
+		return
+	}
+	confirm := &teesdk.ConfirmIntent{FileHash: job.FileHash, SessionID: sessionID}
+	if err := teesdk.VerifyConfirmIntent(confirm, s.intentDomain, common.HexToAddress(job.Wallet), signature); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// handleGetUpload reports where an upload is in its lifecycle
+func (s *Server) handleGetUpload(c *gin.Context) {
+	upload, err := s.uploads.Get(c.Param("fileHash"))
+	if errors.Is(err, uploads.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload"})
+		return
+	}
+
+	// The result stays with the job, it holds the salt
+	c.JSON(http.StatusOK, gin.H{
+		"fileHash":  upload.FileHash,
+		"state":     upload.State,
+		"sessionId": upload.SessionID,
+		"relayTx":   upload.RelayTx,
+		"jobId":     upload.JobID,
+		"confirmTx": upload.ConfirmTx,
+		"tokenId":   upload.TokenID,
+		"error":     upload.Error,
+		"updatedAt": upload.UpdatedAt,
+	})
+}
+
+func (s *Server) requireHistory(c *gin.Context) {
+	if s.history == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Chain history is disabled"})
+		return
+	}
+	c.Next()
+}
 
-	// Process in TEE
-	result, err := s.tee.ProcessGeneData(req.FileHash)
+// handleGetHistoryStatus tells how far the indexer got
+func (s *Server) handleGetHistoryStatus(c *gin.Context) {
+	block, ok, err := s.history.Checkpoint()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process in TEE"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read chain history"})
 		return
 	}
+	finalized, err := s.history.Finalized()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read chain history"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"indexed": ok, "block": block, "finalized": finalized})
+}
+
+func (s *Server) handleGetSessionHistory(c *gin.Context) {
+	session, err := s.history.Session(c.Param("sessionId"))
+	s.respondHistory(c, session, err)
+}
 
-	// Update result with session ID
-	result.SessionID = req.SessionID
+func (s *Server) handleGetDocHistory(c *gin.Context) {
+	doc, err := s.history.Doc(c.Param("docId"))
+	s.respondHistory(c, doc, err)
+}
+
+func (s *Server) handleGetTokenHistory(c *gin.Context) {
+	mint, err := s.history.Mint(c.Param("tokenId"))
+	s.respondHistory(c, mint, err)
+}
 
-	// Confirm on blockchain and mint NFT
-	err = s.blockchain.ProcessAndMint(result)
+func (s *Server) handleGetRewardHistory(c *gin.Context) {
+	address := c.Param("address")
+	if !common.IsHexAddress(address) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address"})
+		return
+	}
+	rewards, err := s.history.Rewards(common.HexToAddress(address))
+	s.respondHistory(c, gin.H{"rewards": rewards}, err)
+}
+
+func (s *Server) respondHistory(c *gin.Context, record any, err error) {
+	if errors.Is(err, indexer.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found in chain history"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process blockchain operations"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read chain history"})
+		return
+	}
+	c.JSON(http.StatusOK, record)
+}
+
+func (s *Server) requireRelayer(c *gin.Context) {
+	if s.relayer == nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Relayer is disabled"})
+		return
+	}
+	c.Next()
+}
+
+// handleRelay sends a controller call the user signed as an EIP-712
+// ForwardRequest through the trusted forwarder, the service wallet paying the
+// gas. The controller sees the user as the sender.
+func (s *Server) handleRelay(c *gin.Context) {
+	var body struct {
+		Request struct {
+			From  common.Address        `json:"from"`
+			To    common.Address        `json:"to"`
+			Value *math.HexOrDecimal256 `json:"value"`
+			Gas   *math.HexOrDecimal256 `json:"gas"`
+			Nonce *math.HexOrDecimal256 `json:"nonce"`
+			Data  hexutil.Bytes         `json:"data"`
+		} `json:"request"`
+		Signature hexutil.Bytes `json:"signature"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if body.Request.Gas == nil || body.Request.Nonce == nil || len(body.Signature) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "gas, nonce and signature are required"})
+		return
+	}
+
+	req := &blockchain.ForwardRequest{
+		From:  body.Request.From,
+		To:    body.Request.To,
+		Value: new(big.Int),
+		Gas:   (*big.Int)(body.Request.Gas),
+		Nonce: (*big.Int)(body.Request.Nonce),
+		Data:  body.Request.Data,
+	}
+	if body.Request.Value != nil {
+		req.Value = (*big.Int)(body.Request.Value)
+	}
+
+	txHash, err := s.relayer.Relay(c.Request.Context(), req, body.Signature)
+	switch {
+	case errors.Is(err, blockchain.ErrRelayRejected):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, blockchain.ErrRelayQuota):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to relay request"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"txHash": txHash})
+}
+
+// handleGetRelayNonce returns what a user needs to sign their next request
+func (s *Server) handleGetRelayNonce(c *gin.Context) {
+	address := c.Param("address")
+	if !common.IsHexAddress(address) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address"})
+		return
+	}
+	nonce, err := s.relayer.Nonce(c.Request.Context(), common.HexToAddress(address))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get forwarder nonce"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Document confirmed and processed successfully",
-		"result":  result,
+		"forwarder": s.relayer.Forwarder().Hex(),
+		"chainId":   blockchain.ChainID,
+		"nonce":     nonce.String(),
 	})
 }
 
 func (s *Server) handleGetTEEPublicKey(c *gin.Context) {
-	publicKey := s.tee.GetTEEPublicKey()
-	c.JSON(http.StatusOK, gin.H{"publicKey": publicKey})
+	info, err := s.tee.GetInfo()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TEE is unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"publicKey": info.PublicKey,
+		"keyId":     info.KeyID,
+		"signer":    info.Signer,
+	})
+}
+
+// handleGetTEEAttestation returns the attestation document clients must
+// verify before encrypting to the TEE key
+func (s *Server) handleGetTEEAttestation(c *gin.Context) {
+	attestation, err := s.tee.GetAttestation(c.Query("nonce"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to produce attestation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, attestation)
+}
+
+// handleGetTEEModels lists the risk models the TEE runs, so results can be
+// matched to the model ID and hash in their proofs
+func (s *Server) handleGetTEEModels(c *gin.Context) {
+	catalog, err := s.tee.GetModelCatalog()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "TEE is unavailable"})
+		return
+	}
+
+	list := make([]gin.H, 0, len(catalog.Models))
+	for _, model := range catalog.Models {
+		list = append(list, gin.H{
+			"id":      model.ID,
+			"name":    model.Name,
+			"version": model.Version,
+			"hash":    model.Hash,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"models":   list,
+		"products": catalog.Products,
+	})
 }
 
+// requireAdmin guards operator endpoints with the ADMIN_TOKEN bearer token
+func (s *Server) requireAdmin(c *gin.Context) {
+	if s.adminToken == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin API is disabled"})
+		return
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+		return
+	}
+	c.Next()
+}
+
+// registerTEESigner allows the signer of the current TEE key on the
+// controller, from the service wallet that owns it
+func (s *Server) registerTEESigner() error {
+	info, err := s.tee.GetInfo()
+	if err != nil {
+		return fmt.Errorf("failed to read TEE key: %v", err)
+	}
+	if err := s.blockchain.EnsureTeeSigner(info.Signer); err != nil {
+		return fmt.Errorf("failed to register TEE signer %s: %v", info.Signer, err)
+	}
+	return nil
+}
+
+func (s *Server) handleRotateTEEKey(c *gin.Context) {
+	keyID, err := s.tee.RotateKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate TEE key"})
+		return
+	}
+	info, err := s.tee.GetInfo()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read TEE key"})
+		return
+	}
+	if err := s.registerTEESigner(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Key rotated but its signer could not be registered", "keyId": keyID})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keyId":     keyID,
+		"publicKey": info.PublicKey,
+	})
+}
+
+func (s *Server) handleReencryptTEEData(c *gin.Context) {
+	report, err := s.tee.ReencryptAll()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to re-encrypt data"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func (s *Server) handleRetireTEEKey(c *gin.Context) {
+	var req struct {
+		KeyID string `json:"keyId"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := s.tee.RetireKey(req.KeyID); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key retired"})
+}
+
+// Run serves until SIGINT or SIGTERM, then waits for requests in flight
 func (s *Server) Run() error {
-	return s.router.Run(":8080")
+	httpServer := &http.Server{Addr: ":8080", Handler: s.router}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	drained := make(chan error, 1)
+	go func() {
+		<-signals
+		drained <- httpServer.Shutdown(context.Background())
+	}()
+
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-drained
+}
+
+// Close stops every component in the reverse order of opening. It also
+// releases a server NewServer gave up on halfway.
+func (s *Server) Close() {
+	closeWith := func(name string, close func() error) {
+		if err := close(); err != nil {
+			log.Printf("Failed to close %s: %v", name, err)
+		}
+	}
+
+	if s.indexer != nil {
+		s.indexer.Close()
+	}
+	if s.history != nil {
+		closeWith("chain history", s.history.Close)
+	}
+	if s.jobs != nil {
+		s.jobs.Close()
+	}
+	if s.uploads != nil {
+		closeWith("upload store", s.uploads.Close)
+	}
+	if s.blockchain != nil {
+		s.blockchain.Close()
+	}
+	if s.outbox != nil {
+		closeWith("outbox", s.outbox.Close)
+	}
+	if closer, ok := s.tee.(io.Closer); ok {
+		closeWith("TEE", closer.Close)
+	}
 }
@@ -2,25 +2,83 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"genomic-service/internal/config"
+	"genomic-service/internal/jobs"
+	"genomic-service/internal/storage"
+	"genomic-service/internal/tee"
 	"genomic-service/internal/types"
 	teesdk "genomic-service/pkg/tee"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
+// testKey is the data owner's wallet key, the wallet gets the G-NFT and reward
+var (
+	testKey, _ = crypto.HexToECDSA("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318")
+	testWallet = crypto.PubkeyToAddress(testKey.PublicKey).Hex()
+)
+
 func setupTestServer(t *testing.T) *Server {
 	config.LoadEnv("../../.env")
 	cfg := config.NewConfig("../config/app.ini")
+	cfg.TEESettings.WorkerSocket = filepath.Join(t.TempDir(), "worker.sock")
+	cfg.StateSettings.Path = filepath.Join(t.TempDir(), "uploads.db")
+	cfg.BlockchainSettings.OutboxPath = filepath.Join(t.TempDir(), "outbox.db")
+	cfg.IndexerSettings.Path = filepath.Join(t.TempDir(), "index.db")
+	cfg.StorageSettings.Path = filepath.Join(t.TempDir(), "storage")
+	cfg.TEESettings.AttestationRootKeyPath = filepath.Join(t.TempDir(), "attestation_root.key")
+	// A fresh key sealed with a test passphrase, whatever .env holds
+	cfg.TEESettings.KeyPath = filepath.Join(t.TempDir(), "sealed_key.json")
+	cfg.TEESettings.SealingMethod = tee.SealingPassphrase
+	cfg.TEESettings.SealingPassphrase = "test sealing passphrase"
+	startTEEWorker(t, cfg)
+
 	server, err := NewServer(cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(server.Close)
+
+	// Proofs of the TEE are accepted by the controller
+	info, err := server.tee.GetInfo()
+	assert.NoError(t, err)
+	allowed, err := server.blockchain.IsTeeSigner(info.Signer)
 	assert.NoError(t, err)
+	assert.True(t, allowed)
 	return server
 }
 
+// startTEEWorker serves the TEE next to the gateway, like cmd/tee-worker
+func startTEEWorker(t *testing.T, cfg *config.Config) {
+	store, err := storage.NewStorage(cfg.StorageSettings)
+	assert.NoError(t, err)
+	settings := *cfg.TEESettings
+	settings.HeaderPath = filepath.Join(t.TempDir(), "headers.db")
+	service, err := tee.NewTEEService(store, &settings)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { service.Close() })
+
+	listener, err := tee.ListenUnix(cfg.TEESettings.WorkerSocket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go tee.ServeRPC(listener, service)
+}
+
 func TestServerEndpoints(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -63,14 +121,16 @@ func TestServerEndpoints(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			server := setupTestServer(t)
 
-			// 1. Get TEE public key
+			// 1. Get TEE public key and its attestation
 			pubKey := getTEEPublicKey(t, server)
+			attestation := getTEEAttestation(t, server, tc.geneDataFile)
+			assert.Equal(t, pubKey, attestation.PublicKey)
 
-			// 2. Encrypt gene data
-			encryptedData := encryptGeneData(t, pubKey, tc.geneDataFile)
+			// 2. Encrypt gene data after verifying the attestation
+			encryptedData := encryptGeneData(t, server, attestation, tc.geneDataFile)
 
 			// 3. Upload encrypted data
-			uploadResp := uploadData(t, server, encryptedData)
+			uploadResp := uploadData(t, server, encryptedData, testWallet)
 
 			if tc.expectError {
 				assert.Empty(t, uploadResp)
@@ -80,10 +140,97 @@ func TestServerEndpoints(t *testing.T) {
 			// 4. Confirm and process data
 			result := confirmData(t, server, uploadResp["fileHash"], uploadResp["sessionId"])
 			assert.Equal(t, tc.expectedScore, result.RiskScore)
+
+			// 5. The anchored content hash opens with the genome and returned salt
+			fileData, err := teesdk.GetFileDataFromFile("../../gene-datas/" + tc.geneDataFile)
+			assert.NoError(t, err)
+			assert.NoError(t, teesdk.VerifyContentHash(fileData.Data, result.Salt, result.ContentHash))
 		})
 	}
 }
 
+func TestUploadRequiresWallet(t *testing.T) {
+	server := setupTestServer(t)
+
+	for _, wallet := range []string{"", "not-a-wallet", "0x0000000000000000000000000000000000000000"} {
+		req, _ := http.NewRequest("POST", "/api/upload?wallet="+wallet, bytes.NewBufferString("data"))
+		resp := httptest.NewRecorder()
+		server.router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusBadRequest, resp.Code, wallet)
+	}
+}
+
+func TestUploadIntent(t *testing.T) {
+	server := setupTestServer(t)
+	data := encryptGeneData(t, server, getTEEAttestation(t, server, "dave.txt"), "dave.txt")
+	stale := encryptGeneData(t, server, getTEEAttestation(t, server, "charlie.txt"), "charlie.txt")
+
+	upload := func(query, signature string, body []byte) int {
+		req, _ := http.NewRequest("POST", "/api/upload?wallet="+testWallet+query, bytes.NewBuffer(body))
+		req.Header.Set("X-Intent-Signature", signature)
+		resp := httptest.NewRecorder()
+		server.router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	confirm := func(fileHash, sessionID, signature string) int {
+		body, _ := json.Marshal(map[string]string{"fileHash": fileHash, "sessionId": sessionID, "signature": signature})
+		req, _ := http.NewRequest("POST", "/api/confirm", bytes.NewBuffer(body))
+		resp := httptest.NewRecorder()
+		server.router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// Unsigned, or signed for another nonce or product
+	sum := sha256.Sum256(data)
+	fileHash := hex.EncodeToString(sum[:])
+	signature := signIntent(t, server, data, 7)
+	assert.Equal(t, http.StatusBadRequest, upload("", "", data))
+	assert.Equal(t, http.StatusBadRequest, upload("&fileHash="+fileHash+"&nonce=7", "", data))
+	assert.Equal(t, http.StatusForbidden, upload("&fileHash="+fileHash+"&nonce=8", signature, data))
+	assert.Equal(t, http.StatusForbidden, upload("&fileHash="+fileHash+"&nonce=7&product=stroke", signature, data))
+
+	// Rejected before anything is stored
+	_, err := server.storage.RetrieveStream(fileHash)
+	assert.Error(t, err)
+
+	// Data other than the signed file is not kept
+	other := []byte(uuid.New().String())
+	otherSum := sha256.Sum256(other)
+	assert.Equal(t, http.StatusBadRequest, upload("&fileHash="+fileHash+"&nonce=7", signature, other))
+	_, err = server.storage.RetrieveStream(hex.EncodeToString(otherSum[:]))
+	assert.Error(t, err)
+
+	// Nor is data that isn't a chunked envelope
+	otherHash := hex.EncodeToString(otherSum[:])
+	assert.Equal(t, http.StatusBadRequest, upload("&fileHash="+otherHash+"&nonce=9", signIntent(t, server, other, 9), other))
+	_, err = server.storage.RetrieveStream(otherHash)
+	assert.Error(t, err)
+
+	// A confirm needs the wallet's signature for the file and session, not a
+	// replay of the upload intent's
+	uploadResp := uploadData(t, server, data, testWallet)
+	assert.NotEmpty(t, uploadResp)
+	sessionID := uploadResp["sessionId"]
+	assert.Equal(t, http.StatusBadRequest, confirm(fileHash, sessionID, ""))
+	assert.Equal(t, http.StatusForbidden, confirm(fileHash, sessionID, uploadResp["signature"]))
+	sessionNumber, _ := new(big.Int).SetString(sessionID, 10)
+	otherSession, err := teesdk.SignConfirmIntent(&teesdk.ConfirmIntent{
+		FileHash:  fileHash,
+		SessionID: new(big.Int).Add(sessionNumber, big.NewInt(1)),
+	}, server.intentDomain, testKey)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, confirm(fileHash, sessionID, hexutil.Encode(otherSession)))
+
+	// Or one encrypted to a key that was rotated out
+	_, err = server.tee.RotateKey()
+	assert.NoError(t, err)
+	staleSum := sha256.Sum256(stale)
+	staleHash := hex.EncodeToString(staleSum[:])
+	assert.Equal(t, http.StatusConflict, upload("&fileHash="+staleHash+"&nonce=10", signIntent(t, server, stale, 10), stale))
+	_, err = server.storage.RetrieveStream(staleHash)
+	assert.Error(t, err)
+}
+
 func getTEEPublicKey(t *testing.T, server *Server) string {
 	req, _ := http.NewRequest("GET", "/api/tee/public-key", nil)
 	resp := httptest.NewRecorder()
@@ -100,9 +247,31 @@ func getTEEPublicKey(t *testing.T, server *Server) string {
 	return publicKey
 }
 
-func encryptGeneData(t *testing.T, publicKey, filename string) []byte {
-	encoder := teesdk.NewTeeEncoder(publicKey)
-	fileData, err := encoder.GetFileDataFromFile("../../gene-datas/" + filename)
+func getTEEAttestation(t *testing.T, server *Server, nonce string) *teesdk.AttestationDocument {
+	req, _ := http.NewRequest("GET", "/api/tee/attestation?nonce="+nonce, nil)
+	resp := httptest.NewRecorder()
+	server.router.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	var attestation teesdk.AttestationDocument
+	err := json.Unmarshal(resp.Body.Bytes(), &attestation)
+	assert.NoError(t, err)
+	return &attestation
+}
+
+func encryptGeneData(t *testing.T, server *Server, attestation *teesdk.AttestationDocument, filename string) []byte {
+	// Clients pin the root and measurements out of band
+	info, err := server.tee.GetInfo()
+	assert.NoError(t, err)
+	encoder, err := teesdk.NewAttestedTeeEncoder(attestation, teesdk.AttestationPolicy{
+		RootPublicKey:       info.AttestationRoot,
+		AllowedMeasurements: []string{info.Measurement},
+		Nonce:               filename,
+	})
+	assert.NoError(t, err)
+
+	fileData, err := teesdk.GetFileDataFromFile("../../gene-datas/" + filename)
 	assert.NoError(t, err)
 
 	encryptedData, err := encoder.EncryptGeneData(fileData.Data)
@@ -110,8 +279,32 @@ func encryptGeneData(t *testing.T, publicKey, filename string) []byte {
 	return encryptedData
 }
 
-func uploadData(t *testing.T, server *Server, encryptedData []byte) map[string]string {
-	req, _ := http.NewRequest("POST", "/api/upload", bytes.NewBuffer(encryptedData))
+// signIntent signs the upload intent of data for the test wallet
+func signIntent(t *testing.T, server *Server, data []byte, nonce int64) string {
+	fileHash := sha256.Sum256(data)
+	signature, err := teesdk.SignUploadIntent(&teesdk.UploadIntent{
+		FileHash: hex.EncodeToString(fileHash[:]),
+		Wallet:   common.HexToAddress(testWallet),
+		Nonce:    big.NewInt(nonce),
+	}, server.intentDomain, testKey)
+	assert.NoError(t, err)
+	return hexutil.Encode(signature)
+}
+
+// signConfirm signs the confirm intent of an upload for the test wallet
+func signConfirm(t *testing.T, server *Server, fileHash, sessionID string) string {
+	session, ok := new(big.Int).SetString(sessionID, 10)
+	assert.True(t, ok)
+	signature, err := teesdk.SignConfirmIntent(&teesdk.ConfirmIntent{FileHash: fileHash, SessionID: session}, server.intentDomain, testKey)
+	assert.NoError(t, err)
+	return hexutil.Encode(signature)
+}
+
+func uploadData(t *testing.T, server *Server, encryptedData []byte, wallet string) map[string]string {
+	signature := signIntent(t, server, encryptedData, 1)
+	fileHash := sha256.Sum256(encryptedData)
+	req, _ := http.NewRequest("POST", "/api/upload?wallet="+wallet+"&fileHash="+hex.EncodeToString(fileHash[:])+"&nonce=1", bytes.NewBuffer(encryptedData))
+	req.Header.Set("X-Intent-Signature", signature)
 	resp := httptest.NewRecorder()
 	server.router.ServeHTTP(resp, req)
 
@@ -122,13 +315,16 @@ func uploadData(t *testing.T, server *Server, encryptedData []byte) map[string]s
 	var response map[string]string
 	err := json.Unmarshal(resp.Body.Bytes(), &response)
 	assert.NoError(t, err)
+	response["signature"] = signature
 	return response
 }
 
 func confirmData(t *testing.T, server *Server, fileHash, sessionID string) *types.ProcessResult {
+	signature := signConfirm(t, server, fileHash, sessionID)
 	reqBody := map[string]string{
 		"fileHash":  fileHash,
 		"sessionId": sessionID,
+		"signature": signature,
 	}
 	reqBodyJSON, _ := json.Marshal(reqBody)
 
@@ -136,11 +332,41 @@ func confirmData(t *testing.T, server *Server, fileHash, sessionID string) *type
 	resp := httptest.NewRecorder()
 	server.router.ServeHTTP(resp, req)
 
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+
 	var response struct {
-		Message string               `json:"message"`
-		Result  *types.ProcessResult `json:"result"`
+		JobID string `json:"jobId"`
 	}
 	err := json.Unmarshal(resp.Body.Bytes(), &response)
 	assert.NoError(t, err)
-	return response.Result
+
+	// Only the wallet reads the job, its result holds the salt
+	req, _ = http.NewRequest("GET", "/api/jobs/"+response.JobID, nil)
+	resp = httptest.NewRecorder()
+	server.router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+
+	job := waitForJob(t, server, response.JobID, signature)
+	assert.Equal(t, jobs.StatusSucceeded, job.Status)
+	for _, stage := range job.Stages {
+		assert.Equal(t, jobs.StatusSucceeded, stage.Status, stage.Error)
+	}
+	assert.Equal(t, testWallet, job.Mint.Owner)
+	return job.Result
+}
+
+// waitForJob polls a confirmation job until it finishes
+func waitForJob(t *testing.T, server *Server, jobID, signature string) *jobs.Job {
+	var job jobs.Job
+	assert.Eventually(t, func() bool {
+		req, _ := http.NewRequest("GET", "/api/jobs/"+jobID, nil)
+		req.Header.Set(intentSignatureHeader, signature)
+		resp := httptest.NewRecorder()
+		server.router.ServeHTTP(resp, req)
+		if resp.Code != http.StatusOK || json.Unmarshal(resp.Body.Bytes(), &job) != nil {
+			return false
+		}
+		return job.Status == jobs.StatusSucceeded || job.Status == jobs.StatusFailed
+	}, time.Minute, 100*time.Millisecond)
+	return &job
 }
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Number of hex characters used for each shard directory level
+	shardWidth = 2
+	// Number of shard directory levels below the root
+	shardDepth = 2
+	// Directory holding partially written files before they are renamed into place
+	tmpDirName = "tmp"
+)
+
+// FileStorage implements Storage on the local filesystem.
+// Files are content-addressed by their SHA-256 hash and sharded into
+// sub-directories (e.g. ab/cd/abcd...) to keep directory sizes small.
+type FileStorage struct {
+	root string
+}
+
+// NewFileStorage creates a filesystem storage rooted at the given directory
+func NewFileStorage(root string) (StreamStorage, error) {
+	if root == "" {
+		return nil, fmt.Errorf("storage path is required")
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, tmpDirName), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+
+	return &FileStorage{root: root}, nil
+}
+
+func (fs *FileStorage) Store(data []byte) (string, error) {
+	return fs.StoreStream(bytes.NewReader(data))
+}
+
+// StoreStream copies the stream into a temporary file while hashing it,
+// fsyncs it and atomically renames it into its content-addressed location
+func (fs *FileStorage) StoreStream(r io.Reader) (string, error) {
+	tmpPath, fileHash, err := fs.writeTemp(r)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	path, err := fs.pathFor(fileHash)
+	if err != nil {
+		return "", err
+	}
+
+	// Content-addressed: identical data is already stored
+	if _, err := os.Stat(path); err == nil {
+		return fileHash, nil
+	}
+
+	if err := fs.commit(tmpPath, path); err != nil {
+		return "", err
+	}
+
+	return fileHash, nil
+}
+
+// List walks the shard directories and returns every stored file hash
+func (fs *FileStorage) List() ([]string, error) {
+	var fileHashes []string
+
+	err := filepath.WalkDir(fs.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == tmpDirName {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && isValidFileHash(d.Name()) {
+			fileHashes = append(fileHashes, d.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	return fileHashes, nil
+}
+
+// writeTemp copies the stream into a synced temporary file and returns its
+// path together with the SHA-256 of its content
+func (fs *FileStorage) writeTemp(r io.Reader) (string, string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(fs.root, tmpDirName), "upload-*")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create temp file: %v", err)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to write data: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to sync data: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", "", fmt.Errorf("failed to close temp file: %v", err)
+	}
+
+	return tmp.Name(), hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// commit renames a temporary file into place and persists the rename
+func (fs *FileStorage) commit(tmpPath, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create shard directory: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to move data into place: %v", err)
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func (fs *FileStorage) Retrieve(fileHash string) ([]byte, error) {
+	path, err := fs.pathFor(fileHash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("file not found: %s", fileHash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	return data, nil
+}
+
+func (fs *FileStorage) RetrieveStream(fileHash string) (io.ReadCloser, error) {
+	path, err := fs.pathFor(fileHash)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("file not found: %s", fileHash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	return f, nil
+}
+
+func (fs *FileStorage) Delete(fileHash string) error {
+	path, err := fs.pathFor(fileHash)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("file not found: %s", fileHash)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// pathFor returns the sharded location of a file hash, rejecting anything
+// that is not a hex-encoded SHA-256 so callers can't escape the root
+func (fs *FileStorage) pathFor(fileHash string) (string, error) {
+	if !isValidFileHash(fileHash) {
+		return "", fmt.Errorf("invalid file hash: %s", fileHash)
+	}
+
+	parts := make([]string, 0, shardDepth+2)
+	parts = append(parts, fs.root)
+	for i := 0; i < shardDepth; i++ {
+		parts = append(parts, fileHash[i*shardWidth:(i+1)*shardWidth])
+	}
+	parts = append(parts, fileHash)
+
+	return filepath.Join(parts...), nil
+}
+
+func isValidFileHash(fileHash string) bool {
+	if len(fileHash) != sha256.Size*2 {
+		return false
+	}
+	decoded, err := hex.DecodeString(fileHash)
+	return err == nil && hex.EncodeToString(decoded) == fileHash
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
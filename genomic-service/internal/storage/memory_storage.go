@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"sync"
 )
 
@@ -14,7 +16,7 @@ type MemoryStorage struct {
 }
 
 // NewMemoryStorage creates a new in-memory storage
-func NewMemoryStorage() Storage {
+func NewMemoryStorage() StreamStorage {
 	return &MemoryStorage{
 		store: make(map[string][]byte),
 	}
@@ -61,3 +63,45 @@ func (ms *MemoryStorage) Delete(fileHash string) error {
 	delete(ms.store, fileHash)
 	return nil
 }
+
+// StoreStream reads the whole stream, as memory storage keeps data in RAM anyway
+func (ms *MemoryStorage) StoreStream(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read data: %v", err)
+	}
+
+	// Store copies the slice, keep ownership of this one instead
+	hash := sha256.Sum256(data)
+	fileHash := hex.EncodeToString(hash[:])
+
+	ms.mu.Lock()
+	ms.store[fileHash] = data
+	ms.mu.Unlock()
+
+	return fileHash, nil
+}
+
+func (ms *MemoryStorage) RetrieveStream(fileHash string) (io.ReadCloser, error) {
+	ms.mu.RLock()
+	data, exists := ms.store[fileHash]
+	ms.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("file not found: %s", fileHash)
+	}
+
+	// Stored slices are never mutated, so readers can share them without copying
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (ms *MemoryStorage) List() ([]string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	fileHashes := make([]string, 0, len(ms.store))
+	for fileHash := range ms.store {
+		fileHashes = append(fileHashes, fileHash)
+	}
+	return fileHashes, nil
+}
@@ -0,0 +1,568 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"genomic-service/internal/config"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default multipart part size, S3 requires at least 5MiB for all but the last part
+	defaultS3PartSize = 8 << 20
+	defaultS3Region   = "us-east-1"
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Storage implements StreamStorage on top of an S3-compatible object store.
+// Objects are content-addressed under the configured prefix, uploads carry a
+// SHA-256 checksum the server verifies, and files larger than the part size
+// use multipart upload.
+type S3Storage struct {
+	client    *http.Client
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  int64
+	pathStyle bool
+	tmpDir    string
+	now       func() time.Time
+}
+
+// NewS3Storage creates an S3 storage from the [storage] settings
+func NewS3Storage(settings *config.StorageSettings) (StreamStorage, error) {
+	if settings.S3Endpoint == "" || settings.S3Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+
+	endpoint, err := url.Parse(settings.S3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %v", err)
+	}
+
+	region := settings.S3Region
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	partSize := settings.S3PartSize
+	if partSize <= 0 {
+		partSize = defaultS3PartSize
+	}
+
+	prefix := strings.Trim(settings.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3Storage{
+		client:    &http.Client{},
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    settings.S3Bucket,
+		prefix:    prefix,
+		accessKey: settings.S3AccessKey,
+		secretKey: settings.S3SecretKey,
+		partSize:  partSize,
+		pathStyle: settings.S3PathStyle,
+		tmpDir:    settings.Path,
+		now:       time.Now,
+	}, nil
+}
+
+func (s *S3Storage) Store(data []byte) (string, error) {
+	return s.StoreStream(bytes.NewReader(data))
+}
+
+// StoreStream spools the stream to a temporary file while hashing it, since
+// the object key is the content hash, then uploads it
+func (s *S3Storage) StoreStream(r io.Reader) (string, error) {
+	spool, err := s.spool(r)
+	if err != nil {
+		return "", err
+	}
+	defer spool.Close()
+
+	fileHash := hex.EncodeToString(spool.sum)
+
+	// Content-addressed: identical data is already stored
+	if exists, err := s.exists(fileHash); err != nil {
+		return "", err
+	} else if exists {
+		return fileHash, nil
+	}
+
+	if err := s.upload(s.key(fileHash), spool); err != nil {
+		return "", err
+	}
+
+	return fileHash, nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2 under the configured prefix
+func (s *S3Storage) List() ([]string, error) {
+	var fileHashes []string
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, 0, emptyPayloadHash, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return nil, s3Error("list objects", resp)
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode object list: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			if fileHash := strings.TrimPrefix(object.Key, s.prefix); isValidFileHash(fileHash) {
+				fileHashes = append(fileHashes, fileHash)
+			}
+		}
+
+		if !result.IsTruncated {
+			return fileHashes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// spoolFile is a hashed temporary copy of an upload
+type spoolFile struct {
+	*os.File
+	size int64
+	sum  []byte
+}
+
+func (f *spoolFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+func (s *S3Storage) spool(r io.Reader) (*spoolFile, error) {
+	tmp, err := os.CreateTemp(s.tmpDir, "s3-upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to write data: %v", err)
+	}
+
+	return &spoolFile{File: tmp, size: size, sum: hasher.Sum(nil)}, nil
+}
+
+// upload sends the spooled file in one request or in parts depending on its size
+func (s *S3Storage) upload(key string, spool *spoolFile) error {
+	if spool.size <= s.partSize {
+		return s.putObject(key, io.NewSectionReader(spool, 0, spool.size), spool.size, spool.sum)
+	}
+	return s.multipartUpload(key, spool, spool.size)
+}
+
+func (s *S3Storage) Retrieve(fileHash string) ([]byte, error) {
+	reader, err := s.RetrieveStream(fileHash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object: %v", err)
+	}
+	return data, nil
+}
+
+func (s *S3Storage) RetrieveStream(fileHash string) (io.ReadCloser, error) {
+	if !isValidFileHash(fileHash) {
+		return nil, fmt.Errorf("invalid file hash: %s", fileHash)
+	}
+
+	resp, err := s.do(http.MethodGet, s.key(fileHash), nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("file not found: %s", fileHash)
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error("get object", resp)
+	}
+}
+
+func (s *S3Storage) Delete(fileHash string) error {
+	if !isValidFileHash(fileHash) {
+		return fmt.Errorf("invalid file hash: %s", fileHash)
+	}
+
+	// S3 deletes are idempotent, check first to keep Storage semantics
+	exists, err := s.exists(fileHash)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("file not found: %s", fileHash)
+	}
+
+	resp, err := s.do(http.MethodDelete, s.key(fileHash), nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("delete object", resp)
+	}
+	return nil
+}
+
+func (s *S3Storage) exists(fileHash string) (bool, error) {
+	resp, err := s.do(http.MethodHead, s.key(fileHash), nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, s3Error("head object", resp)
+	}
+}
+
+func (s *S3Storage) putObject(key string, body io.ReadSeeker, size int64, sum []byte) error {
+	headers := map[string]string{
+		"x-amz-checksum-sha256": base64.StdEncoding.EncodeToString(sum),
+	}
+
+	resp, err := s.do(http.MethodPut, key, nil, body, size, hex.EncodeToString(sum), headers)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put object", resp)
+	}
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber     int    `xml:"PartNumber"`
+	ETag           string `xml:"ETag"`
+	ChecksumSHA256 string `xml:"ChecksumSHA256"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// multipartUpload uploads the file in parts of partSize, each carrying its own
+// SHA-256 checksum, and aborts the upload if any step fails
+func (s *S3Storage) multipartUpload(key string, file io.ReaderAt, size int64) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, emptyPayloadHash,
+		map[string]string{"x-amz-checksum-algorithm": "SHA256"})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("create multipart upload", resp)
+	}
+
+	var initiated initiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&initiated); err != nil {
+		return fmt.Errorf("failed to decode multipart upload: %v", err)
+	}
+
+	parts, err := s.uploadParts(key, initiated.UploadID, file, size)
+	if err != nil {
+		s.abortMultipartUpload(key, initiated.UploadID)
+		return err
+	}
+
+	if err := s.completeMultipartUpload(key, initiated.UploadID, parts); err != nil {
+		s.abortMultipartUpload(key, initiated.UploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *S3Storage) uploadParts(key, uploadID string, file io.ReaderAt, size int64) ([]completedPart, error) {
+	var parts []completedPart
+
+	for offset, partNumber := int64(0), 1; offset < size; offset, partNumber = offset+s.partSize, partNumber+1 {
+		partLen := s.partSize
+		if remaining := size - offset; remaining < partLen {
+			partLen = remaining
+		}
+		section := io.NewSectionReader(file, offset, partLen)
+
+		// Hash the part first so the request can be signed and checksummed
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, section); err != nil {
+			return nil, fmt.Errorf("failed to hash part %d: %v", partNumber, err)
+		}
+		sum := hasher.Sum(nil)
+		checksum := base64.StdEncoding.EncodeToString(sum)
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to rewind part %d: %v", partNumber, err)
+		}
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := s.do(http.MethodPut, key, query, section, partLen, hex.EncodeToString(sum),
+			map[string]string{"x-amz-checksum-sha256": checksum})
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, s3Error(fmt.Sprintf("upload part %d", partNumber), resp)
+		}
+
+		parts = append(parts, completedPart{
+			PartNumber:     partNumber,
+			ETag:           resp.Header.Get("ETag"),
+			ChecksumSHA256: checksum,
+		})
+	}
+
+	return parts, nil
+}
+
+func (s *S3Storage) completeMultipartUpload(key, uploadID string, parts []completedPart) error {
+	body, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("failed to encode completed parts: %v", err)
+	}
+	sum := sha256.Sum256(body)
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body),
+		int64(len(body)), hex.EncodeToString(sum[:]), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may report a failed completion with a 200 status and an error body
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read complete multipart upload response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || bytes.Contains(respBody, []byte("<Error>")) {
+		resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		return s3Error("complete multipart upload", resp)
+	}
+	return nil
+}
+
+func (s *S3Storage) abortMultipartUpload(key, uploadID string) {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, 0, emptyPayloadHash, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (s *S3Storage) key(fileHash string) string {
+	return s.prefix + fileHash
+}
+
+// do builds, signs and sends a request for the given object key
+func (s *S3Storage) do(method, key string, query url.Values, body io.Reader, size int64, payloadHash string, headers map[string]string) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 request: %v", err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	s.sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 request failed: %v", err)
+	}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request, signing the host
+// and every header already set on it
+func (s *S3Storage) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := shortDate + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by key, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+// uriEncode percent-encodes everything except unreserved characters,
+// optionally keeping slashes for object paths
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func s3Error(op string, resp *http.Response) error {
+	var errResp s3ErrorResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&errResp); err == nil && errResp.Code != "" {
+		return fmt.Errorf("s3 %s failed: %s: %s", op, errResp.Code, errResp.Message)
+	}
+	return fmt.Errorf("s3 %s failed: status %d", op, resp.StatusCode)
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"fmt"
+	"genomic-service/internal/config"
+)
+
+// Supported storage backends, selected by [storage] Type in app.ini
+const (
+	TypeMemory = "memory"
+	TypeFile   = "file"
+	TypeS3     = "s3"
+)
+
+// NewStorage creates the storage backend selected in the settings
+func NewStorage(settings *config.StorageSettings) (StreamStorage, error) {
+	switch settings.Type {
+	case "", TypeMemory:
+		return NewMemoryStorage(), nil
+	case TypeFile:
+		return NewFileStorage(settings.Path)
+	case TypeS3:
+		return NewS3Storage(settings)
+	default:
+		return nil, fmt.Errorf("unknown storage type: %s", settings.Type)
+	}
+}
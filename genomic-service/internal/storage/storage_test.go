@@ -1,14 +1,26 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestStorage(t *testing.T) {
-	storages := map[string]Storage{
+	fileStorage, err := NewFileStorage(t.TempDir())
+	assert.NoError(t, err)
+	_, s3Server := newFakeS3(t, "genomic-data")
+
+	storages := map[string]StreamStorage{
 		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+		"s3":     newTestS3Storage(t, s3Server.URL, defaultS3PartSize),
 	}
 
 	for name, storage := range storages {
@@ -36,3 +48,84 @@ func TestStorage(t *testing.T) {
 		})
 	}
 }
+
+func TestStreamStorage(t *testing.T) {
+	fileStorage, err := NewFileStorage(t.TempDir())
+	assert.NoError(t, err)
+	_, s3Server := newFakeS3(t, "genomic-data")
+
+	storages := map[string]StreamStorage{
+		"memory": NewMemoryStorage(),
+		"file":   fileStorage,
+		"s3":     newTestS3Storage(t, s3Server.URL, defaultS3PartSize),
+	}
+
+	// Larger than any io.Copy buffer so hashing really happens incrementally
+	testData := bytes.Repeat([]byte("ACGT"), 1<<20)
+	expected := sha256.Sum256(testData)
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			hash, err := storage.StoreStream(bytes.NewReader(testData))
+			assert.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(expected[:]), hash)
+
+			reader, err := storage.RetrieveStream(hash)
+			assert.NoError(t, err)
+			retrieved, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.NoError(t, reader.Close())
+			assert.Equal(t, testData, retrieved)
+
+			// Streamed and buffered APIs address the same content
+			buffered, err := storage.Retrieve(hash)
+			assert.NoError(t, err)
+			assert.Equal(t, testData, buffered)
+
+			// List pages through every stored file
+			otherHashes := make([]string, 0, 3)
+			for i := 0; i < 3; i++ {
+				other, err := storage.Store([]byte{byte(i)})
+				assert.NoError(t, err)
+				otherHashes = append(otherHashes, other)
+			}
+			listed, err := storage.List()
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, append(otherHashes, hash), listed)
+
+			assert.NoError(t, storage.Delete(hash))
+			_, err = storage.RetrieveStream(hash)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFileStoragePersistence(t *testing.T) {
+	root := t.TempDir()
+	testData := []byte("persisted gene data")
+
+	first, err := NewFileStorage(root)
+	assert.NoError(t, err)
+	hash, err := first.Store(testData)
+	assert.NoError(t, err)
+
+	// Data is sharded by hash prefix
+	_, err = os.Stat(filepath.Join(root, hash[0:2], hash[2:4], hash))
+	assert.NoError(t, err)
+
+	// A new instance on the same root sees the data written before "restart"
+	second, err := NewFileStorage(root)
+	assert.NoError(t, err)
+	retrieved, err := second.Retrieve(hash)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, retrieved)
+
+	// No leftover temp files
+	entries, err := os.ReadDir(filepath.Join(root, tmpDirName))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Path traversal is rejected
+	_, err = second.Retrieve("../../etc/passwd")
+	assert.Error(t, err)
+}
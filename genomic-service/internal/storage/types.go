@@ -1,7 +1,19 @@
 package storage
 
+import "io"
+
 type Storage interface {
 	Store(data []byte) (string, error)
 	Retrieve(fileHash string) ([]byte, error)
 	Delete(fileHash string) error
 }
+
+// StreamStorage is the streaming variant of Storage for large gene files.
+// Data is hashed incrementally while it is written, so callers never need to
+// hold the whole file in memory.
+type StreamStorage interface {
+	Storage
+	StoreStream(r io.Reader) (string, error)
+	RetrieveStream(fileHash string) (io.ReadCloser, error)
+	List() ([]string, error)
+}
@@ -0,0 +1,131 @@
+package tee
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"genomic-service/internal/config"
+	teesdk "genomic-service/pkg/tee"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Attester produces simulated remote attestation documents. Its root key
+// stands in for the hardware vendor key that signs real enclave quotes.
+type Attester struct {
+	rootKey     *ecdsa.PrivateKey
+	measurement string
+}
+
+func NewAttester(rootKey *ecdsa.PrivateKey, measurement string) *Attester {
+	return &Attester{
+		rootKey:     rootKey,
+		measurement: measurement,
+	}
+}
+
+// NewAttesterFromSettings loads the attestation root and measures the code
+func NewAttesterFromSettings(settings *config.TEESettings) (*Attester, error) {
+	rootKey, err := loadOrCreateRootKey(settings.AttestationRootKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	measurement := settings.Measurement
+	if measurement == "" {
+		measurement, err = MeasureExecutable()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	attester := NewAttester(rootKey, measurement)
+	log.Printf("TEE attestation root %s, measurement %s", attester.RootPublicKey(), measurement)
+	return attester, nil
+}
+
+// Attest signs a document binding the key to the code measurement
+func (a *Attester) Attest(key *KeyEntry, nonce string) (*teesdk.AttestationDocument, error) {
+	doc := &teesdk.AttestationDocument{
+		PublicKey:   key.PublicKeyHex(),
+		KeyID:       key.ID,
+		Measurement: a.measurement,
+		Timestamp:   time.Now().Unix(),
+		Nonce:       nonce,
+	}
+
+	if err := doc.Sign(a.rootKey); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// RootPublicKey returns the hex-encoded compressed root key clients pin
+func (a *Attester) RootPublicKey() string {
+	return hex.EncodeToString(crypto.CompressPubkey(&a.rootKey.PublicKey))
+}
+
+// Measurement returns the hex-encoded code measurement
+func (a *Attester) Measurement() string {
+	return a.measurement
+}
+
+// MeasureExecutable hashes the running binary, standing in for an enclave
+// measurement register
+func MeasureExecutable() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate executable: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open executable: %v", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("failed to measure executable: %v", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// loadOrCreateRootKey reads the hex root key at path, creating one on first
+// use. Without a path an ephemeral root is generated.
+func loadOrCreateRootKey(path string) (*ecdsa.PrivateKey, error) {
+	if path == "" {
+		return crypto.GenerateKey()
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		rootKey, err := crypto.HexToECDSA(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid attestation root key: %v", err)
+		}
+		return rootKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read attestation root key: %v", err)
+	}
+
+	rootKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate attestation root key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(crypto.FromECDSA(rootKey))), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write attestation root key: %v", err)
+	}
+	return rootKey, nil
+}
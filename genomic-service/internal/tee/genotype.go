@@ -0,0 +1,293 @@
+package tee
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Raw data formats of consumer genotyping services
+const (
+	Format23andMe     = "23andme"
+	FormatAncestryDNA = "ancestrydna"
+	FormatVCF         = "vcf"
+)
+
+// Reference genome builds
+const (
+	BuildUnknown = ""
+	BuildGRCh37  = "GRCh37"
+	BuildGRCh38  = "GRCh38"
+)
+
+// maxGenotypeLine bounds a single line, real files have lines under 100 bytes
+const maxGenotypeLine = 64 * 1024
+
+// Genotype is one called (or not called) SNP of a raw data file
+type Genotype struct {
+	RSID       string
+	Chromosome string // 1-22, X, Y, XY or MT
+	Position   uint64
+	Alleles    string // e.g. "AG", "A" on haploid calls, "DI" for indels
+	NoCall     bool
+}
+
+// GenotypeTable is the parsed content of a raw data file, indexed by rsid.
+// Variants without an rsid, which only VCF has, are keyed by "chromosome:position".
+type GenotypeTable struct {
+	Format   string
+	Build    string
+	Variants map[string]Genotype
+	NoCalls  int
+	Skipped  int // records dropped by quality filters or not representable
+
+	positions map[string]string // "chromosome:position" -> variant key
+}
+
+// Get returns the genotype for an rsid. No-calls are reported as missing.
+func (g *GenotypeTable) Get(rsid string) (Genotype, bool) {
+	genotype, ok := g.Variants[strings.ToLower(rsid)]
+	if !ok || genotype.NoCall {
+		return Genotype{}, false
+	}
+	return genotype, true
+}
+
+// GetByPosition returns the genotype at a position of the table's build
+func (g *GenotypeTable) GetByPosition(chromosome string, position uint64) (Genotype, bool) {
+	key, ok := g.positions[positionKey(chromosome, position)]
+	if !ok {
+		return Genotype{}, false
+	}
+	return g.Get(key)
+}
+
+func positionKey(chromosome string, position uint64) string {
+	return fmt.Sprintf("%s:%d", strings.ToLower(chromosome), position)
+}
+
+// Len returns the number of variants, including no-calls
+func (g *GenotypeTable) Len() int {
+	return len(g.Variants)
+}
+
+// ParseGenotypes reads a 23andMe or AncestryDNA raw data file line by line, so
+// the whole file never has to be held as text. The format is taken from the
+// column header, or from the column count when the header is missing, and the
+// build from the comment preamble.
+func ParseGenotypes(r io.Reader) (*GenotypeTable, error) {
+	table := &GenotypeTable{Variants: make(map[string]Genotype)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxGenotypeLine)
+
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			table.parseComment(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if isColumnHeader(fields) {
+			table.Format = formatFromHeader(fields)
+			continue
+		}
+
+		genotype, err := table.parseRecord(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		table.add(genotype)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read genotypes: %v", err)
+	}
+
+	if len(table.Variants) == 0 {
+		return nil, fmt.Errorf("no genotypes found")
+	}
+	return table, nil
+}
+
+// add keeps the first call when a chip reports the same SNP twice
+func (g *GenotypeTable) add(genotype Genotype) {
+	if _, exists := g.Variants[genotype.RSID]; exists {
+		return
+	}
+	if genotype.NoCall {
+		g.NoCalls++
+	}
+	g.Variants[genotype.RSID] = genotype
+
+	if g.positions == nil {
+		g.positions = make(map[string]string)
+	}
+	g.positions[positionKey(genotype.Chromosome, genotype.Position)] = genotype.RSID
+}
+
+// parseComment picks the vendor and build out of the preamble. 23andMe
+// puts its column header in a comment too.
+func (g *GenotypeTable) parseComment(comment string) {
+	lower := strings.ToLower(comment)
+
+	if fields := strings.Split(comment, "\t"); isColumnHeader(fields) {
+		g.Format = formatFromHeader(fields)
+		return
+	}
+
+	switch {
+	case g.Format == "" && strings.Contains(lower, "23andme"):
+		g.Format = Format23andMe
+	case g.Format == "" && strings.Contains(lower, "ancestrydna"):
+		g.Format = FormatAncestryDNA
+	}
+
+	if g.Build == BuildUnknown {
+		g.Build = detectBuild(lower)
+	}
+}
+
+func (g *GenotypeTable) parseRecord(fields []string) (Genotype, error) {
+	if g.Format == "" {
+		// Headerless file, guess from the column count
+		switch len(fields) {
+		case 4:
+			g.Format = Format23andMe
+		case 5:
+			g.Format = FormatAncestryDNA
+		default:
+			return Genotype{}, fmt.Errorf("unrecognized format with %d columns", len(fields))
+		}
+	}
+
+	var alleles string
+	switch g.Format {
+	case Format23andMe:
+		if len(fields) != 4 {
+			return Genotype{}, fmt.Errorf("expected 4 columns, got %d", len(fields))
+		}
+		alleles = strings.ToUpper(strings.TrimSpace(fields[3]))
+		if strings.Contains(alleles, "-") {
+			alleles = ""
+		}
+	case FormatAncestryDNA:
+		if len(fields) != 5 {
+			return Genotype{}, fmt.Errorf("expected 5 columns, got %d", len(fields))
+		}
+		allele1 := strings.ToUpper(strings.TrimSpace(fields[3]))
+		allele2 := strings.ToUpper(strings.TrimSpace(fields[4]))
+		// A half call is as unusable as a no-call
+		if allele1 != "0" && allele2 != "0" {
+			alleles = allele1 + allele2
+		}
+	}
+
+	rsid := strings.ToLower(strings.TrimSpace(fields[0]))
+	if rsid == "" {
+		return Genotype{}, fmt.Errorf("missing rsid")
+	}
+
+	chromosome, err := normalizeChromosome(fields[1])
+	if err != nil {
+		return Genotype{}, err
+	}
+
+	position, err := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 64)
+	if err != nil {
+		return Genotype{}, fmt.Errorf("invalid position %q", fields[2])
+	}
+
+	if alleles != "" && !validAlleles(alleles) {
+		return Genotype{}, fmt.Errorf("invalid genotype %q", alleles)
+	}
+
+	return Genotype{
+		RSID:       rsid,
+		Chromosome: chromosome,
+		Position:   position,
+		Alleles:    alleles,
+		NoCall:     alleles == "",
+	}, nil
+}
+
+func isColumnHeader(fields []string) bool {
+	return len(fields) >= 4 && strings.EqualFold(strings.TrimSpace(fields[0]), "rsid")
+}
+
+func formatFromHeader(fields []string) string {
+	if len(fields) >= 5 && strings.EqualFold(strings.TrimSpace(fields[3]), "allele1") {
+		return FormatAncestryDNA
+	}
+	return Format23andMe
+}
+
+// detectBuild understands the wording used by 23andMe ("human assembly build
+// 37") and AncestryDNA ("build 37.1", "GRCh37"), plus UCSC and reference
+// FASTA names found in VCF headers. Only whole words are matched, so a
+// checksum or ID containing "b37" doesn't pass for a build.
+func detectBuild(comment string) string {
+	words := strings.FieldsFunc(comment, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		if word == "build" && i+1 < len(words) {
+			word += words[i+1]
+		}
+		switch word {
+		case "grch38", "hg38", "hs38", "hs38dh", "build38":
+			return BuildGRCh38
+		case "grch37", "hg19", "hs37", "hs37d5", "b37", "v37", "build37":
+			return BuildGRCh37
+		}
+	}
+	return BuildUnknown
+}
+
+// normalizeChromosome maps vendor chromosome names to 1-22, X, Y, XY and MT.
+// AncestryDNA numbers the sex chromosomes 23 (X), 24 (Y), 25 (PAR) and 26 (MT).
+func normalizeChromosome(raw string) (string, error) {
+	chromosome := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(raw)), "CHR")
+
+	switch chromosome {
+	case "X", "23":
+		return "X", nil
+	case "Y", "24":
+		return "Y", nil
+	case "XY", "25":
+		return "XY", nil
+	case "MT", "M", "26":
+		return "MT", nil
+	}
+
+	n, err := strconv.Atoi(chromosome)
+	if err != nil || n < 1 || n > 22 {
+		return "", fmt.Errorf("invalid chromosome %q", raw)
+	}
+	return chromosome, nil
+}
+
+// validAlleles accepts nucleotides and the D/I codes used for indels
+func validAlleles(alleles string) bool {
+	if len(alleles) > 2 {
+		return false
+	}
+	for _, allele := range alleles {
+		switch allele {
+		case 'A', 'C', 'G', 'T', 'D', 'I':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package tee
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var headersBucket = []byte("headers") // file hash -> chunked envelope header
+
+// HeaderStore keeps the envelope headers of blobs whose data key was
+// rewrapped for a newer TEE key. Blobs are content-addressed and never
+// rewritten, so the TEE reads a blob through its rewrapped header instead of
+// the stored one. Headers only hold data keys wrapped to TEE keys, nothing
+// readable outside the TEE.
+type HeaderStore struct {
+	db *bolt.DB // nil when kept in memory
+
+	mu      sync.RWMutex
+	headers map[string][]byte
+}
+
+// NewHeaderStore persists headers in a bbolt database at path, or keeps them
+// in memory when path is empty, for ephemeral keys
+func NewHeaderStore(path string) (*HeaderStore, error) {
+	if path == "" {
+		return &HeaderStore{headers: make(map[string][]byte)}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create header directory: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open header store: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(headersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize header store: %v", err)
+	}
+	return &HeaderStore{db: db}, nil
+}
+
+// Get returns the rewrapped header of a blob, false when it has none
+func (s *HeaderStore) Get(fileHash string) ([]byte, bool, error) {
+	if s.db == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		header, ok := s.headers[fileHash]
+		return header, ok, nil
+	}
+
+	var header []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(headersBucket).Get([]byte(fileHash)); value != nil {
+			header = append([]byte{}, value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read header of %s: %v", fileHash, err)
+	}
+	return header, header != nil, nil
+}
+
+// Put records the rewrapped header of a blob, replacing an older one
+func (s *HeaderStore) Put(fileHash string, header []byte) error {
+	if s.db == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.headers[fileHash] = header
+		return nil
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(headersBucket).Put([]byte(fileHash), header)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store header of %s: %v", fileHash, err)
+	}
+	return nil
+}
+
+// Close closes the header database
+func (s *HeaderStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
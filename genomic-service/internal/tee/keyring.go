@@ -0,0 +1,240 @@
+package tee
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	teesdk "genomic-service/pkg/tee"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// KeyEntry is one versioned key of the TEE keyring
+type KeyEntry struct {
+	ID         string
+	Version    int
+	PrivateKey *ecdsa.PrivateKey
+	CreatedAt  time.Time
+}
+
+// PublicKeyHex returns the hex-encoded compressed public key users encrypt to
+func (k *KeyEntry) PublicKeyHex() string {
+	return hex.EncodeToString(crypto.CompressPubkey(&k.PrivateKey.PublicKey))
+}
+
+// Address returns the Ethereum address of the key, used to check its proofs
+func (k *KeyEntry) Address() common.Address {
+	return crypto.PubkeyToAddress(k.PrivateKey.PublicKey)
+}
+
+// Keyring holds the TEE's versioned keys. The newest key is current and is
+// used for new uploads, older keys stay available for decryption until they
+// are retired. When a path is set, every change is sealed back to disk.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   []*KeyEntry // ordered by version, last is current
+	path   string
+	sealer Sealer
+}
+
+type keyringFile struct {
+	Keys []keyringFileEntry `json:"keys"`
+}
+
+type keyringFileEntry struct {
+	ID         string    `json:"id"`
+	Version    int       `json:"version"`
+	PrivateKey string    `json:"privateKey"` // hex
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// NewKeyring creates an in-memory keyring holding a single key
+func NewKeyring(privateKey *ecdsa.PrivateKey) *Keyring {
+	return &Keyring{keys: []*KeyEntry{newKeyEntry(privateKey, 1)}}
+}
+
+// LoadOrCreateKeyring unseals the keyring at path, or generates and seals a
+// new one with a single key when the file does not exist yet. Files sealed
+// before keyrings existed hold one raw key, which becomes version 1.
+func LoadOrCreateKeyring(path string, sealer Sealer) (*Keyring, error) {
+	keyring := &Keyring{path: path, sealer: sealer}
+
+	blob, err := readSealedBlob(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if blob == nil {
+		privateKey, err := crypto.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %v", err)
+		}
+		keyring.keys = []*KeyEntry{newKeyEntry(privateKey, 1)}
+		if err := keyring.save(); err != nil {
+			return nil, err
+		}
+		return keyring, nil
+	}
+
+	plaintext, err := sealer.Unseal(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	switch blob.Version {
+	case sealedKeyVersionSingle:
+		privateKey, err := crypto.ToECDSA(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sealed key: %v", err)
+		}
+		keyring.keys = []*KeyEntry{newKeyEntry(privateKey, 1)}
+		// Upgrade the file to the keyring format
+		if err := keyring.save(); err != nil {
+			return nil, err
+		}
+
+	case sealedKeyVersionKeyring:
+		var file keyringFile
+		if err := json.Unmarshal(plaintext, &file); err != nil {
+			return nil, fmt.Errorf("invalid sealed keyring: %v", err)
+		}
+		for _, entry := range file.Keys {
+			privateKey, err := crypto.HexToECDSA(entry.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s: %v", entry.ID, err)
+			}
+			keyring.keys = append(keyring.keys, &KeyEntry{
+				ID:         teesdk.KeyID(&privateKey.PublicKey),
+				Version:    entry.Version,
+				PrivateKey: privateKey,
+				CreatedAt:  entry.CreatedAt,
+			})
+		}
+		if len(keyring.keys) == 0 {
+			return nil, fmt.Errorf("sealed keyring is empty")
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported sealed key version: %d", blob.Version)
+	}
+
+	return keyring, nil
+}
+
+func newKeyEntry(privateKey *ecdsa.PrivateKey, version int) *KeyEntry {
+	return &KeyEntry{
+		ID:         teesdk.KeyID(&privateKey.PublicKey),
+		Version:    version,
+		PrivateKey: privateKey,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+// Current returns the key new uploads are encrypted to
+func (k *Keyring) Current() *KeyEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[len(k.keys)-1]
+}
+
+// Get returns the key with the given ID
+func (k *Keyring) Get(id string) (*KeyEntry, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Keys returns all keys, oldest first
+func (k *Keyring) Keys() []*KeyEntry {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]*KeyEntry, len(k.keys))
+	copy(keys, k.keys)
+	return keys
+}
+
+// Rotate generates a new current key. Older keys remain for decryption.
+func (k *Keyring) Rotate() (*KeyEntry, error) {
+	privateKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry := newKeyEntry(privateKey, k.keys[len(k.keys)-1].Version+1)
+	k.keys = append(k.keys, entry)
+
+	if err := k.save(); err != nil {
+		k.keys = k.keys[:len(k.keys)-1]
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Retire removes an old key. The current key can't be retired.
+func (k *Keyring) Retire(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys[len(k.keys)-1].ID == id {
+		return fmt.Errorf("cannot retire the current key")
+	}
+
+	for i, key := range k.keys {
+		if key.ID != id {
+			continue
+		}
+
+		previous := k.keys
+		k.keys = append(append([]*KeyEntry{}, k.keys[:i]...), k.keys[i+1:]...)
+		if err := k.save(); err != nil {
+			k.keys = previous
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("key not found: %s", id)
+}
+
+// save seals the keyring to disk, callers must hold the lock
+func (k *Keyring) save() error {
+	if k.path == "" {
+		return nil
+	}
+
+	file := keyringFile{}
+	for _, key := range k.keys {
+		file.Keys = append(file.Keys, keyringFileEntry{
+			ID:         key.ID,
+			Version:    key.Version,
+			PrivateKey: hex.EncodeToString(crypto.FromECDSA(key.PrivateKey)),
+			CreatedAt:  key.CreatedAt,
+		})
+	}
+
+	plaintext, err := json.Marshal(file)
+	if err != nil {
+		return fmt.Errorf("failed to encode keyring: %v", err)
+	}
+
+	blob, err := k.sealer.Seal(plaintext)
+	if err != nil {
+		return err
+	}
+	return writeSealedBlob(k.path, blob)
+}
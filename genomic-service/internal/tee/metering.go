@@ -0,0 +1,608 @@
+package tee
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// fuelExport is the global an instrumented module keeps its remaining
+// instruction budget in. It's exported so the host can tell a spent budget
+// apart from other traps and charge for host calls.
+const fuelExport = "genomic_fuel"
+
+// wasmModelSection is the custom section naming a model, as "name@version"
+const wasmModelSection = "genomic_model"
+
+// Section IDs of the WebAssembly binary format, in the order they must appear
+const (
+	sectionCustom   = 0
+	sectionType     = 1
+	sectionImport   = 2
+	sectionFunction = 3
+	sectionGlobal   = 6
+	sectionExport   = 7
+	sectionCode     = 10
+)
+
+var wasmHeader = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+// errTruncated is returned when a module ends in the middle of an item
+var errTruncated = errors.New("unexpected end of module")
+
+// meteredModule is a model binary rewritten to count its own instructions
+type meteredModule struct {
+	binary []byte
+	name   string // content of the genomic_model custom section
+}
+
+// meterModule rewrites a module so it charges a mutable global for every
+// instruction it runs and traps once the global drops below zero, wazero has
+// no fuel of its own. Each function body and loop body is charged its full
+// instruction count when entered, which is an upper bound of what it runs
+// before the next entry: only loops branch backwards. Bulk memory and table
+// instructions are charged their length on top, through a helper function
+// added to the module.
+//
+// The module must have been validated before, the rewrite would make valid
+// an access to the fuel global that doesn't exist in the original.
+//
+// Instructions the rewriter doesn't know, like SIMD, are rejected, so a model
+// can't run anything that isn't metered.
+func meterModule(module []byte, budget uint64) (*meteredModule, error) {
+	if len(module) < len(wasmHeader) || !bytes.Equal(module[:len(wasmHeader)], wasmHeader) {
+		return nil, fmt.Errorf("not a WebAssembly 1.0 module")
+	}
+
+	type section struct {
+		id      byte
+		content []byte
+	}
+	var sections []section
+
+	r := &wasmReader{data: module, pos: len(wasmHeader)}
+	for !r.done() {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		content, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section{id, content})
+	}
+
+	result := &meteredModule{}
+	importedFuncs, importedGlobals := 0, 0
+	types, definedFuncs, definedGlobals := 0, 0, 0
+	sawFunctions := false
+	for _, s := range sections {
+		switch s.id {
+		case sectionCustom:
+			sr := &wasmReader{data: s.content}
+			name, err := sr.name()
+			if err != nil {
+				return nil, err
+			}
+			if name == wasmModelSection {
+				result.name = string(s.content[sr.pos:])
+			}
+		case sectionImport:
+			var err error
+			importedFuncs, importedGlobals, err = countImports(s.content)
+			if err != nil {
+				return nil, err
+			}
+		case sectionType, sectionFunction, sectionGlobal:
+			sr := &wasmReader{data: s.content}
+			n, err := sr.u32()
+			if err != nil {
+				return nil, err
+			}
+			switch s.id {
+			case sectionType:
+				types = int(n)
+			case sectionFunction:
+				definedFuncs = int(n)
+				sawFunctions = true
+			default:
+				definedGlobals = int(n)
+			}
+		}
+	}
+	if !sawFunctions {
+		return nil, fmt.Errorf("module has no code")
+	}
+	fuel := uint32(importedGlobals + definedGlobals)
+	charge := uint32(importedFuncs + definedFuncs)
+
+	// i64 mutable global initialized to the budget
+	global := []byte{0x7e, 0x01, 0x42}
+	global = appendSLEB(global, int64(budget))
+	global = append(global, 0x0b)
+
+	export := appendName(nil, fuelExport)
+	export = append(export, 0x03)
+	export = appendULEB(export, uint64(fuel))
+
+	// charge_length(n i32) i32, charging and returning the length on top of
+	// the stack
+	chargeType := []byte{0x60, 0x01, 0x7f, 0x01, 0x7f}
+	chargeFunc := appendULEB(nil, uint64(types))
+	// no locals, global.get
+	chargeBody := []byte{0x00, 0x23}
+	chargeBody = appendULEB(chargeBody, uint64(fuel))
+	chargeBody = append(chargeBody, 0x20, 0x00, 0xad, 0x7d, 0x24) // local.get 0, i64.extend_i32_u, i64.sub, global.set
+	chargeBody = appendULEB(chargeBody, uint64(fuel))
+	chargeBody = append(chargeBody, 0x23) // global.get
+	chargeBody = appendULEB(chargeBody, uint64(fuel))
+	// i64.const 0, i64.lt_s, if, unreachable, end, local.get 0, end
+	chargeBody = append(chargeBody, 0x42, 0x00, 0x53, 0x04, 0x40, 0x00, 0x0b, 0x20, 0x00, 0x0b)
+	chargeCode := appendULEB(nil, uint64(len(chargeBody)))
+	chargeCode = append(chargeCode, chargeBody...)
+
+	out := append([]byte{}, wasmHeader...)
+	wroteGlobal, wroteExport, sawCode := false, false, false
+
+	// Sections are rewritten in place, missing global and export sections are
+	// added where the spec orders them, before any section with a higher ID
+	emit := func(id byte, content []byte) {
+		out = append(out, id)
+		out = appendULEB(out, uint64(len(content)))
+		out = append(out, content...)
+	}
+	flushBefore := func(id byte) {
+		if !wroteGlobal && id > sectionGlobal {
+			emit(sectionGlobal, appendVecItem(nil, 0, global))
+			wroteGlobal = true
+		}
+		if !wroteExport && id > sectionExport {
+			emit(sectionExport, appendVecItem(nil, 0, export))
+			wroteExport = true
+		}
+	}
+
+	for _, s := range sections {
+		switch s.id {
+		case sectionCustom:
+			emit(s.id, s.content)
+		case sectionType, sectionFunction:
+			item := chargeType
+			if s.id == sectionFunction {
+				item = chargeFunc
+			}
+			content, err := appendToVec(s.content, item)
+			if err != nil {
+				return nil, err
+			}
+			emit(s.id, content)
+		case sectionGlobal:
+			content, err := appendToVec(s.content, global)
+			if err != nil {
+				return nil, err
+			}
+			emit(s.id, content)
+			wroteGlobal = true
+		case sectionExport:
+			flushBefore(s.id)
+			content, err := appendToVec(s.content, export)
+			if err != nil {
+				return nil, err
+			}
+			emit(s.id, content)
+			wroteExport = true
+		case sectionCode:
+			flushBefore(s.id)
+			content, err := meterCode(s.content, fuel, charge)
+			if err != nil {
+				return nil, err
+			}
+			if content, err = appendToVec(content, chargeCode); err != nil {
+				return nil, err
+			}
+			emit(s.id, content)
+			sawCode = true
+		default:
+			flushBefore(s.id)
+			emit(s.id, s.content)
+		}
+	}
+	if !sawCode {
+		return nil, fmt.Errorf("module has no code")
+	}
+
+	result.binary = out
+	return result, nil
+}
+
+// countImports counts the function and global imports, which come first in
+// their index spaces
+func countImports(content []byte) (funcs, globals int, err error) {
+	r := &wasmReader{data: content}
+	n, err := r.u32()
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := uint32(0); i < n; i++ {
+		if _, err := r.name(); err != nil {
+			return 0, 0, err
+		}
+		if _, err := r.name(); err != nil {
+			return 0, 0, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch kind {
+		case 0x00: // function
+			funcs++
+			_, err = r.u32()
+		case 0x01: // table
+			if _, err = r.byte(); err == nil {
+				err = r.skipLimits()
+			}
+		case 0x02: // memory
+			err = r.skipLimits()
+		case 0x03: // global
+			globals++
+			err = r.skip(2)
+		default:
+			err = fmt.Errorf("invalid import kind %d", kind)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return funcs, globals, nil
+}
+
+// meterCode instruments every function body of a code section, charge is the
+// index of the charge_length helper
+func meterCode(content []byte, fuel, charge uint32) ([]byte, error) {
+	r := &wasmReader{data: content}
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+
+	out := appendULEB(nil, uint64(n))
+	for i := uint32(0); i < n; i++ {
+		body, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		metered, err := meterFunction(body, fuel, charge)
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %v", i, err)
+		}
+		out = appendULEB(out, uint64(len(metered)))
+		out = append(out, metered...)
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("trailing bytes in code section")
+	}
+	return out, nil
+}
+
+// meterFunction inserts a charge at the start of the body and of every loop,
+// and a call to charge before every bulk memory and table instruction
+func meterFunction(body []byte, fuel, charge uint32) ([]byte, error) {
+	r := &wasmReader{data: body}
+
+	groups, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < groups; i++ {
+		if _, err := r.u32(); err != nil {
+			return nil, err
+		}
+		if _, err := r.byte(); err != nil {
+			return nil, err
+		}
+	}
+
+	// A region is the function body or a loop body, excluding nested loops
+	type region struct {
+		offset int
+		cost   int64
+	}
+	regions := []region{{offset: r.pos}}
+	// Where charges go in the body, in order: a region index, or -1 for a
+	// charge of the length
+	type insertion struct {
+		offset int
+		region int
+	}
+	insertions := []insertion{{offset: r.pos, region: 0}}
+	// Open blocks, each pointing at the region its instructions are charged to
+	stack := []int{0}
+
+	for len(stack) > 0 {
+		offset := r.pos
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		current := stack[len(stack)-1]
+		regions[current].cost++
+
+		switch op {
+		case 0x02, 0x04: // block, if
+			if err := r.skipBlockType(); err != nil {
+				return nil, err
+			}
+			stack = append(stack, current)
+		case 0x03: // loop
+			if err := r.skipBlockType(); err != nil {
+				return nil, err
+			}
+			regions = append(regions, region{offset: r.pos})
+			stack = append(stack, len(regions)-1)
+			insertions = append(insertions, insertion{offset: r.pos, region: len(regions) - 1})
+		case 0x0b: // end
+			stack = stack[:len(stack)-1]
+		case 0xfc:
+			bulk, err := r.skipMisc()
+			if err != nil {
+				return nil, err
+			}
+			if bulk {
+				insertions = append(insertions, insertion{offset: offset, region: -1})
+			}
+		default:
+			if err := r.skipImmediates(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !r.done() {
+		return nil, fmt.Errorf("trailing bytes after function end")
+	}
+
+	var out []byte
+	last := 0
+	for _, insert := range insertions {
+		out = append(out, body[last:insert.offset]...)
+		if insert.region < 0 {
+			out = append(out, 0x10) // call
+			out = appendULEB(out, uint64(charge))
+		} else {
+			out = appendCharge(out, fuel, regions[insert.region].cost)
+		}
+		last = insert.offset
+	}
+	return append(out, body[last:]...), nil
+}
+
+// appendCharge subtracts cost from the fuel global and traps when it's spent
+func appendCharge(out []byte, fuel uint32, cost int64) []byte {
+	out = append(out, 0x23) // global.get
+	out = appendULEB(out, uint64(fuel))
+	out = append(out, 0x42) // i64.const
+	out = appendSLEB(out, cost)
+	out = append(out, 0x7d, 0x24) // i64.sub, global.set
+	out = appendULEB(out, uint64(fuel))
+	out = append(out, 0x23) // global.get
+	out = appendULEB(out, uint64(fuel))
+	// i64.const 0, i64.lt_s, if, unreachable, end
+	return append(out, 0x42, 0x00, 0x53, 0x04, 0x40, 0x00, 0x0b)
+}
+
+// appendToVec adds an item to an encoded vector
+func appendToVec(content, item []byte) ([]byte, error) {
+	r := &wasmReader{data: content}
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	return appendVecItem(content[r.pos:], n, item), nil
+}
+
+func appendVecItem(items []byte, n uint32, item []byte) []byte {
+	out := appendULEB(nil, uint64(n+1))
+	out = append(out, items...)
+	return append(out, item...)
+}
+
+func appendName(out []byte, name string) []byte {
+	out = appendULEB(out, uint64(len(name)))
+	return append(out, name...)
+}
+
+func appendULEB(out []byte, v uint64) []byte {
+	return binary.AppendUvarint(out, v)
+}
+
+func appendSLEB(out []byte, v int64) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// wasmReader decodes the parts of the binary format the rewriter needs
+type wasmReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *wasmReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.done() {
+		return 0, errTruncated
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *wasmReader) skip(n int) error {
+	if len(r.data)-r.pos < n {
+		return errTruncated
+	}
+	r.pos += n
+	return nil
+}
+
+func (r *wasmReader) u32() (uint32, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 || n > 5 || v > 0xffffffff {
+		return 0, fmt.Errorf("invalid LEB128 at offset %d", r.pos)
+	}
+	r.pos += n
+	return uint32(v), nil
+}
+
+// skipLEB skips a signed or unsigned LEB128 number of at most maxBytes
+func (r *wasmReader) skipLEB(maxBytes int) error {
+	for i := 0; i < maxBytes; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if b&0x80 == 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid LEB128 at offset %d", r.pos)
+}
+
+func (r *wasmReader) bytes() ([]byte, error) {
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	start := r.pos
+	if err := r.skip(int(n)); err != nil {
+		return nil, err
+	}
+	return r.data[start:r.pos], nil
+}
+
+func (r *wasmReader) name() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func (r *wasmReader) skipLimits() error {
+	flags, err := r.byte()
+	if err != nil {
+		return err
+	}
+	if err := r.skipLEB(5); err != nil {
+		return err
+	}
+	if flags&0x01 != 0 {
+		return r.skipLEB(5)
+	}
+	return nil
+}
+
+// skipBlockType skips the empty type, a value type or a type index
+func (r *wasmReader) skipBlockType() error {
+	if r.done() {
+		return errTruncated
+	}
+	switch r.data[r.pos] {
+	case 0x40, 0x7f, 0x7e, 0x7d, 0x7c, 0x70, 0x6f:
+		r.pos++
+		return nil
+	}
+	return r.skipLEB(5)
+}
+
+// skipImmediates skips the immediates of an instruction that doesn't open or
+// close a block. It knows the core 2.0 instruction set without SIMD.
+func (r *wasmReader) skipImmediates(op byte) error {
+	switch {
+	case op == 0x00, op == 0x01, op == 0x05, op == 0x0f, op == 0x1a, op == 0x1b, op == 0xd1:
+		// unreachable, nop, else, return, drop, select, ref.is_null
+		return nil
+	case op == 0x0c, op == 0x0d, op == 0x10, op == 0xd2, op >= 0x20 && op <= 0x26:
+		// br, br_if, call, ref.func, local/global/table get and set
+		return r.skipLEB(5)
+	case op == 0x0e: // br_table
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i <= n; i++ {
+			if err := r.skipLEB(5); err != nil {
+				return err
+			}
+		}
+		return nil
+	case op == 0x11: // call_indirect
+		if err := r.skipLEB(5); err != nil {
+			return err
+		}
+		return r.skipLEB(5)
+	case op == 0x1c: // typed select
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		return r.skip(int(n))
+	case op >= 0x28 && op <= 0x3e: // loads and stores
+		if err := r.skipLEB(5); err != nil {
+			return err
+		}
+		return r.skipLEB(5)
+	case op == 0x3f, op == 0x40, op == 0xd0: // memory.size, memory.grow, ref.null
+		return r.skip(1)
+	case op == 0x41:
+		return r.skipLEB(5)
+	case op == 0x42:
+		return r.skipLEB(10)
+	case op == 0x43:
+		return r.skip(4)
+	case op == 0x44:
+		return r.skip(8)
+	case op >= 0x45 && op <= 0xc4: // numeric
+		return nil
+	}
+	return fmt.Errorf("unsupported instruction 0x%02x at offset %d", op, r.pos-1)
+}
+
+// skipMisc skips saturating truncation, bulk memory and table instructions,
+// reporting whether the instruction takes a length from the top of the stack
+func (r *wasmReader) skipMisc() (bool, error) {
+	sub, err := r.u32()
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case sub <= 7: // trunc_sat
+		return false, nil
+	case sub == 8: // memory.init
+		if err := r.skipLEB(5); err != nil {
+			return false, err
+		}
+		return true, r.skip(1)
+	case sub == 9, sub == 13, sub == 15, sub == 16: // data.drop, elem.drop, table.grow, table.size
+		return false, r.skipLEB(5)
+	case sub == 17: // table.fill
+		return true, r.skipLEB(5)
+	case sub == 10: // memory.copy
+		return true, r.skip(2)
+	case sub == 11: // memory.fill
+		return true, r.skip(1)
+	case sub == 12, sub == 14: // table.init, table.copy
+		if err := r.skipLEB(5); err != nil {
+			return false, err
+		}
+		return true, r.skipLEB(5)
+	}
+	return false, fmt.Errorf("unsupported instruction 0xfc %d at offset %d", sub, r.pos)
+}
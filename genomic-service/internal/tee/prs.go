@@ -0,0 +1,511 @@
+package tee
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"genomic-service/internal/config"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Bundled stroke panel, used when no scoring file is configured
+//
+//go:embed models/stroke_panel.txt
+var defaultRiskModel []byte
+
+// Default percentile cut-offs for the slightly high, high and extremely high
+// risk categories
+var DefaultRiskPercentiles = []float64{50, 80, 95}
+
+// ScoreVariant is one weighted SNP of a polygenic score
+type ScoreVariant struct {
+	RSID         string
+	Chromosome   string
+	Position     uint64
+	EffectAllele string
+	OtherAllele  string  // empty when the scoring file doesn't list it
+	Weight       float64 // per effect allele, usually log(OR)
+	Frequency    float64 // effect allele frequency in the reference population, -1 if unknown
+	Dominant     bool
+	Recessive    bool
+}
+
+// RiskModel is a polygenic score loaded from a PGS Catalog scoring file
+type RiskModel struct {
+	ID       string // pgs_id
+	Version  string // model_version header, "1" when absent
+	Name     string
+	Trait    string
+	Build    string
+	Hash     string // 0x-prefixed SHA-256 of the scoring file as loaded
+	Variants []ScoreVariant
+
+	// Population score distribution from the reference_mean and reference_sd
+	// headers. Without them it is derived from the effect allele frequencies.
+	ReferenceMean float64
+	ReferenceSD   float64
+}
+
+// LoadRiskModel parses a PGS Catalog scoring file (format 1.0 or 2.0), plain
+// or gzip-compressed as the catalog distributes them
+func LoadRiskModel(r io.Reader) (*RiskModel, error) {
+	hash := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(r, hash))
+	if magic, _ := reader.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %v", err)
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+
+	model := &RiskModel{Version: "1"}
+	var columns map[string]int
+
+	scanner := bufio.NewScanner(reader)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			model.parseMetadata(strings.TrimLeft(line, "#"))
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if columns == nil {
+			var err error
+			if columns, err = scoreColumns(fields); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		variant, err := parseScoreVariant(fields, columns)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		model.Variants = append(model.Variants, variant)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read scoring file: %v", err)
+	}
+
+	if len(model.Variants) == 0 {
+		return nil, fmt.Errorf("scoring file has no variants")
+	}
+	if model.ID == "" {
+		return nil, fmt.Errorf("scoring file has no pgs_id")
+	}
+
+	// Hash the whole file, including anything after the last line read
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, fmt.Errorf("failed to read scoring file: %v", err)
+	}
+	model.Hash = hexutil.Encode(hash.Sum(nil))
+	return model, nil
+}
+
+// LoadRiskModelFile loads a scoring file from disk
+func LoadRiskModelFile(path string) (*RiskModel, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scoring file: %v", err)
+	}
+	defer file.Close()
+	return LoadRiskModel(file)
+}
+
+// DefaultRiskModel returns the bundled stroke panel
+func DefaultRiskModel() (*RiskModel, error) {
+	return LoadRiskModel(bytes.NewReader(defaultRiskModel))
+}
+
+func (m *RiskModel) parseMetadata(line string) {
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return
+	}
+	value = strings.TrimSpace(value)
+
+	switch strings.TrimSpace(key) {
+	case "pgs_id":
+		m.ID = value
+	case "model_version":
+		m.Version = value
+	case "pgs_name":
+		m.Name = value
+	case "trait_reported":
+		m.Trait = value
+	case "genome_build":
+		m.Build = detectBuild(strings.ToLower(value))
+	case "reference_mean":
+		m.ReferenceMean, _ = strconv.ParseFloat(value, 64)
+	case "reference_sd":
+		m.ReferenceSD, _ = strconv.ParseFloat(value, 64)
+	}
+}
+
+// scoreColumns indexes the header of the variant table
+func scoreColumns(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	for _, required := range []string{"effect_allele", "effect_weight"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("scoring file has no %s column", required)
+		}
+	}
+	_, hasRSID := columns["rsID"]
+	_, hasChr := columns["chr_name"]
+	_, hasPos := columns["chr_position"]
+	if !hasRSID && !(hasChr && hasPos) {
+		return nil, fmt.Errorf("scoring file needs rsID or chr_name and chr_position columns")
+	}
+	return columns, nil
+}
+
+func parseScoreVariant(fields []string, columns map[string]int) (ScoreVariant, error) {
+	get := func(name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(fields) {
+			return ""
+		}
+		return strings.TrimSpace(fields[i])
+	}
+
+	variant := ScoreVariant{
+		RSID:         strings.ToLower(get("rsID")),
+		EffectAllele: strings.ToUpper(get("effect_allele")),
+		OtherAllele:  strings.ToUpper(get("other_allele")),
+		Frequency:    -1,
+		Dominant:     strings.EqualFold(get("is_dominant"), "true"),
+		Recessive:    strings.EqualFold(get("is_recessive"), "true"),
+	}
+
+	if variant.EffectAllele == "" {
+		return ScoreVariant{}, fmt.Errorf("missing effect allele")
+	}
+
+	weight, err := strconv.ParseFloat(get("effect_weight"), 64)
+	if err != nil {
+		return ScoreVariant{}, fmt.Errorf("invalid effect weight %q", get("effect_weight"))
+	}
+	variant.Weight = weight
+
+	if chr := get("chr_name"); chr != "" {
+		if variant.Chromosome, err = normalizeChromosome(chr); err != nil {
+			return ScoreVariant{}, err
+		}
+	}
+	if pos := get("chr_position"); pos != "" {
+		if variant.Position, err = strconv.ParseUint(pos, 10, 64); err != nil {
+			return ScoreVariant{}, fmt.Errorf("invalid position %q", pos)
+		}
+	}
+	if variant.RSID == "" && (variant.Chromosome == "" || variant.Position == 0) {
+		return ScoreVariant{}, fmt.Errorf("variant has neither rsID nor position")
+	}
+
+	if freq := get("allelefrequency_effect"); freq != "" {
+		f, err := strconv.ParseFloat(freq, 64)
+		if err != nil || f < 0 || f > 1 {
+			return ScoreVariant{}, fmt.Errorf("invalid allele frequency %q", freq)
+		}
+		variant.Frequency = f
+	}
+
+	return variant, nil
+}
+
+// RiskEngine scores genotype tables with a polygenic model and maps the
+// score's population percentile onto the risk categories. It implements
+// Model, its hash covers the scoring file and the thresholds.
+type RiskEngine struct {
+	model       *RiskModel
+	percentiles []float64 // ascending cut-offs for categories 2, 3 and 4
+	minCoverage float64
+	hash        string
+}
+
+// RiskResult is the outcome of scoring one genome
+type RiskResult struct {
+	ModelID    string
+	Score      float64
+	Percentile float64
+	Category   int // 1 (low) to 4 (extremely high)
+	Matched    int // model variants found in the genome
+	Total      int // model variants
+	Coverage   float64
+}
+
+// NewRiskEngine creates an engine. Percentiles are the ascending cut-offs of
+// categories 2, 3 and 4, minCoverage the share of model variants a genome
+// must have called.
+func NewRiskEngine(model *RiskModel, percentiles []float64, minCoverage float64) (*RiskEngine, error) {
+	if len(percentiles) != 3 {
+		return nil, fmt.Errorf("need 3 percentile thresholds, got %d", len(percentiles))
+	}
+	if !sort.Float64sAreSorted(percentiles) || percentiles[0] <= 0 || percentiles[2] >= 100 {
+		return nil, fmt.Errorf("percentile thresholds must be ascending and within (0, 100): %v", percentiles)
+	}
+	if minCoverage < 0 || minCoverage > 1 {
+		return nil, fmt.Errorf("minimum coverage must be within [0, 1]: %v", minCoverage)
+	}
+
+	if model.ReferenceSD <= 0 && !model.hasFrequencies() {
+		return nil, fmt.Errorf("risk model %s has neither allele frequencies nor a reference distribution", model.ID)
+	}
+
+	engine := &RiskEngine{
+		model:       model,
+		percentiles: append([]float64{}, percentiles...),
+		minCoverage: minCoverage,
+	}
+
+	// The thresholds change the category as much as the weights do
+	params := fmt.Sprintf("model=%s\npercentiles=%v\nminCoverage=%v\n", model.Hash, engine.percentiles, minCoverage)
+	sum := sha256.Sum256([]byte(params))
+	engine.hash = hexutil.Encode(sum[:])
+	return engine, nil
+}
+
+// NewRiskEngineFromSettings applies the configured thresholds to a model
+func NewRiskEngineFromSettings(model *RiskModel, settings *config.TEESettings) (*RiskEngine, error) {
+	percentiles := settings.RiskPercentiles
+	if len(percentiles) == 0 {
+		percentiles = DefaultRiskPercentiles
+	}
+	return NewRiskEngine(model, percentiles, settings.RiskMinCoverage)
+}
+
+// DefaultRiskEngine scores with the bundled stroke panel and default thresholds
+func DefaultRiskEngine() *RiskEngine {
+	model, err := DefaultRiskModel()
+	if err != nil {
+		panic(err)
+	}
+	engine, err := NewRiskEngine(model, DefaultRiskPercentiles, 0.5)
+	if err != nil {
+		panic(err)
+	}
+	return engine
+}
+
+// ModelID returns the registry ID of the model, name@version
+func (m *RiskModel) ModelID() string {
+	return m.ID + "@" + m.Version
+}
+
+// Name returns the pgs_id of the scoring file
+func (e *RiskEngine) Name() string {
+	return e.model.ID
+}
+
+func (e *RiskEngine) Version() string {
+	return e.model.Version
+}
+
+func (e *RiskEngine) Hash() string {
+	return e.hash
+}
+
+// Model returns the polygenic model the engine scores with
+func (e *RiskEngine) Model() *RiskModel {
+	return e.model
+}
+
+func (m *RiskModel) hasFrequencies() bool {
+	for _, variant := range m.Variants {
+		if variant.Frequency < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Score sums weighted effect allele dosages over the model variants found in
+// the genome and places the sum in the reference distribution
+func (e *RiskEngine) Score(table *GenotypeTable) (*RiskResult, error) {
+	result := &RiskResult{ModelID: e.model.ModelID(), Total: len(e.model.Variants)}
+
+	var mean, variance float64
+	for _, variant := range e.model.Variants {
+		genotype, ok := e.lookup(table, variant)
+		if !ok {
+			continue
+		}
+		dosage, ok := harmonizedDosage(variant, genotype.Alleles)
+		if !ok {
+			continue
+		}
+
+		result.Matched++
+		result.Score += variant.Weight * dosage
+
+		// Expected contribution of this variant, under HWE
+		p := variant.Frequency
+		mean += variant.Weight * expectedDosage(variant, p)
+		variance += variant.Weight * variant.Weight * dosageVariance(variant, p)
+	}
+
+	result.Coverage = float64(result.Matched) / float64(result.Total)
+	if result.Matched == 0 || result.Coverage < e.minCoverage {
+		return nil, fmt.Errorf("insufficient variant coverage: %d of %d variants of %s", result.Matched, result.Total, e.model.ID)
+	}
+
+	sd := math.Sqrt(variance)
+	if e.model.ReferenceSD > 0 {
+		mean, sd = e.model.ReferenceMean, e.model.ReferenceSD
+	}
+	if sd == 0 || math.IsNaN(sd) {
+		return nil, fmt.Errorf("reference distribution of %s is degenerate", e.model.ID)
+	}
+
+	z := (result.Score - mean) / sd
+	result.Percentile = 50 * math.Erfc(-z/math.Sqrt2)
+	result.Category = e.category(result.Percentile)
+	return result, nil
+}
+
+// category maps a percentile onto the reward categories, 1 (low) to 4
+func (e *RiskEngine) category(percentile float64) int {
+	category := 1
+	for _, threshold := range e.percentiles {
+		if percentile >= threshold {
+			category++
+		}
+	}
+	return category
+}
+
+// lookup finds a model variant by rsid, or by position when the genome and
+// the model share a reference build
+func (e *RiskEngine) lookup(table *GenotypeTable, variant ScoreVariant) (Genotype, bool) {
+	if variant.RSID != "" {
+		if genotype, ok := table.Get(variant.RSID); ok {
+			return genotype, true
+		}
+	}
+
+	if variant.Position == 0 || e.model.Build == BuildUnknown || table.Build != e.model.Build {
+		return Genotype{}, false
+	}
+	return table.GetByPosition(variant.Chromosome, variant.Position)
+}
+
+// harmonizedDosage counts effect alleles in a genotype. Genotypes reported on
+// the opposite strand are complemented when that makes them match the
+// model's alleles. Palindromic SNPs (A/T, C/G) can't be told apart by strand
+// and are taken as forward strand, which is what consumer chips report.
+func harmonizedDosage(variant ScoreVariant, alleles string) (float64, bool) {
+	effect, other, ok := alleleCodes(variant)
+	if !ok {
+		return 0, false
+	}
+
+	matches := func(alleles string) bool {
+		for _, allele := range alleles {
+			if string(allele) != effect && string(allele) != other {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Without the other allele the strand can't be checked, trust forward
+	if other != "" && !matches(alleles) {
+		flipped := complement(alleles)
+		if !matches(flipped) {
+			return 0, false
+		}
+		alleles = flipped
+	}
+
+	dosage := float64(strings.Count(alleles, effect))
+	switch {
+	case variant.Dominant && dosage > 0:
+		dosage = 1
+	case variant.Recessive:
+		if dosage == float64(len(alleles)) {
+			dosage = 1
+		} else {
+			dosage = 0
+		}
+	}
+	return dosage, true
+}
+
+// alleleCodes returns the effect and other allele in genotype table terms:
+// bases for SNVs, I/D for indels
+func alleleCodes(variant ScoreVariant) (string, string, bool) {
+	effect, other := variant.EffectAllele, variant.OtherAllele
+	if len(effect) == 1 && len(other) <= 1 {
+		return effect, other, true
+	}
+	if other == "" || len(effect) == len(other) {
+		return "", "", false
+	}
+	if len(effect) > len(other) {
+		return "I", "D", true
+	}
+	return "D", "I", true
+}
+
+func complement(alleles string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case 'A':
+			return 'T'
+		case 'T':
+			return 'A'
+		case 'C':
+			return 'G'
+		case 'G':
+			return 'C'
+		default:
+			return r
+		}
+	}, alleles)
+}
+
+func expectedDosage(variant ScoreVariant, p float64) float64 {
+	switch {
+	case variant.Dominant:
+		return 1 - (1-p)*(1-p)
+	case variant.Recessive:
+		return p * p
+	default:
+		return 2 * p
+	}
+}
+
+func dosageVariance(variant ScoreVariant, p float64) float64 {
+	switch {
+	case variant.Dominant:
+		q := 1 - (1-p)*(1-p)
+		return q * (1 - q)
+	case variant.Recessive:
+		return p * p * (1 - p*p)
+	default:
+		return 2 * p * (1 - p)
+	}
+}
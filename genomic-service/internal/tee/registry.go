@@ -0,0 +1,186 @@
+package tee
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"genomic-service/internal/config"
+)
+
+// DefaultProduct is the product uploads are scored for when none is given
+const DefaultProduct = "stroke"
+
+// ErrUnknownProduct is returned when no model is registered for a product
+var ErrUnknownProduct = errors.New("no model for product")
+
+// ModelRegistry holds the risk models the TEE can run and which one each
+// product uses
+type ModelRegistry struct {
+	mu       sync.RWMutex
+	models   map[string]Model  // by ID
+	products map[string]string // product -> model ID
+}
+
+func NewModelRegistry() *ModelRegistry {
+	return &ModelRegistry{
+		models:   make(map[string]Model),
+		products: make(map[string]string),
+	}
+}
+
+// DefaultModelRegistry holds the bundled stroke panel, used for every product
+func DefaultModelRegistry() *ModelRegistry {
+	registry := NewModelRegistry()
+	engine := DefaultRiskEngine()
+	if err := registry.Register(engine); err != nil {
+		panic(err)
+	}
+	if err := registry.SetProduct(DefaultProduct, ModelID(engine)); err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+// NewModelRegistryFromSettings registers the bundled panel, every configured
+// scoring file and WASM model, and applies the product mapping
+func NewModelRegistryFromSettings(settings *config.TEESettings) (*ModelRegistry, error) {
+	registry := NewModelRegistry()
+
+	bundled, err := DefaultRiskModel()
+	if err != nil {
+		return nil, err
+	}
+	models := []*RiskModel{bundled}
+	for _, path := range settings.RiskModelPaths {
+		if path == "" {
+			continue
+		}
+		model, err := LoadRiskModelFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load risk model %s: %v", path, err)
+		}
+		models = append(models, model)
+	}
+
+	for _, model := range models {
+		engine, err := NewRiskEngineFromSettings(model, settings)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.Register(engine); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hash := range settings.WasmModels {
+		if hash == "" {
+			continue
+		}
+		model, err := LoadWasmModel(settings.WasmModelDir, hash, settings.WasmMaxInstructions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load WASM model %s: %v", hash, err)
+		}
+		if err := registry.Register(model); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without explicit configuration the last configured file is the default
+	defaultID := settings.DefaultModel
+	if defaultID == "" {
+		defaultID = models[len(models)-1].ModelID()
+	}
+	if err := registry.SetProduct(DefaultProduct, defaultID); err != nil {
+		return nil, err
+	}
+
+	for _, mapping := range settings.ProductModels {
+		product, modelID, ok := strings.Cut(mapping, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid product model mapping %q, expected product=name@version", mapping)
+		}
+		if err := registry.SetProduct(strings.TrimSpace(product), strings.TrimSpace(modelID)); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// Register adds a model. Re-registering an ID is only allowed with identical
+// content, a changed model must get a new version.
+func (r *ModelRegistry) Register(model Model) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := ModelID(model)
+	if existing, ok := r.models[id]; ok && existing.Hash() != model.Hash() {
+		return fmt.Errorf("model %s already registered with hash %s", id, existing.Hash())
+	}
+	r.models[id] = model
+	return nil
+}
+
+// SetProduct routes a product to a registered model
+func (r *ModelRegistry) SetProduct(product, modelID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.models[modelID]; !ok {
+		return fmt.Errorf("unknown model: %s", modelID)
+	}
+	r.products[product] = modelID
+	return nil
+}
+
+// Get returns a model by name@version
+func (r *ModelRegistry) Get(modelID string) (Model, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	model, ok := r.models[modelID]
+	return model, ok
+}
+
+// Resolve picks the model for a product, the default product's when empty
+func (r *ModelRegistry) Resolve(product string) (Model, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if product == "" {
+		product = DefaultProduct
+	}
+	modelID, ok := r.products[product]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProduct, product)
+	}
+	return r.models[modelID], nil
+}
+
+// Models lists the registered models, sorted by ID
+func (r *ModelRegistry) Models() []Model {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	models := make([]Model, 0, len(r.models))
+	for _, model := range r.models {
+		models = append(models, model)
+	}
+	sort.Slice(models, func(i, j int) bool { return ModelID(models[i]) < ModelID(models[j]) })
+	return models
+}
+
+// Products returns the product to model ID mapping
+func (r *ModelRegistry) Products() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	products := make(map[string]string, len(r.products))
+	for product, modelID := range r.products {
+		products[product] = modelID
+	}
+	return products
+}
@@ -0,0 +1,364 @@
+package tee
+
+import (
+	"errors"
+	"fmt"
+	"genomic-service/internal/types"
+	teesdk "genomic-service/pkg/tee"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rpcName is the net/rpc service name the worker registers
+const rpcName = "TEE"
+
+// Codes of errors the gateway needs to tell apart, net/rpc only carries text
+const (
+	errCodeUnknownProduct = "unknown_product"
+	errCodeCorruptChunk   = "corrupt_chunk"
+	errCodeOther          = "error"
+)
+
+// RemoteError is a Service error as it travels over the socket
+type RemoteError struct {
+	Code    string
+	Message string
+	Chunk   uint64 // index of the failing chunk for corrupt_chunk
+}
+
+func newRemoteError(err error) *RemoteError {
+	if err == nil {
+		return nil
+	}
+	remote := &RemoteError{Code: errCodeOther, Message: err.Error()}
+
+	var chunkErr *teesdk.ChunkError
+	switch {
+	case errors.Is(err, ErrUnknownProduct):
+		remote.Code = errCodeUnknownProduct
+	case errors.As(err, &chunkErr):
+		remote.Code = errCodeCorruptChunk
+		remote.Chunk = chunkErr.Index
+	}
+	return remote
+}
+
+// toError restores an error the gateway can match with errors.Is and errors.As
+func (e *RemoteError) toError() error {
+	if e == nil {
+		return nil
+	}
+	switch e.Code {
+	case errCodeUnknownProduct:
+		return &workerError{message: e.Message, cause: ErrUnknownProduct}
+	case errCodeCorruptChunk:
+		return &workerError{message: e.Message, cause: &teesdk.ChunkError{Index: e.Chunk}}
+	default:
+		return &workerError{message: e.Message}
+	}
+}
+
+type workerError struct {
+	message string
+	cause   error
+}
+
+func (e *workerError) Error() string {
+	return e.message
+}
+
+func (e *workerError) Unwrap() error {
+	return e.cause
+}
+
+// RPC arguments and replies. Service errors travel in the reply, so the
+// rpc error only ever reports transport failures.
+type (
+	ProcessArgs struct {
+		FileHash  string
+		SessionID string
+		Product   string
+	}
+	ProcessReply struct {
+		Result *types.ProcessResult
+		Err    *RemoteError
+	}
+	InfoReply struct {
+		Info *Info
+		Err  *RemoteError
+	}
+	AttestationArgs struct {
+		Nonce string
+	}
+	AttestationReply struct {
+		Document *teesdk.AttestationDocument
+		Err      *RemoteError
+	}
+	ModelCatalogReply struct {
+		Catalog *ModelCatalog
+		Err     *RemoteError
+	}
+	RotateKeyReply struct {
+		KeyID string
+		Err   *RemoteError
+	}
+	ReencryptAllReply struct {
+		Report *ReencryptReport
+		Err    *RemoteError
+	}
+	RetireKeyArgs struct {
+		KeyID string
+	}
+	RetireKeyReply struct {
+		Err *RemoteError
+	}
+	Empty struct{}
+)
+
+// RPCServer exposes a Service to the gateway
+type RPCServer struct {
+	service Service
+}
+
+func (s *RPCServer) ProcessGeneData(args *ProcessArgs, reply *ProcessReply) error {
+	result, err := s.service.ProcessGeneData(args.FileHash, args.SessionID, args.Product)
+	reply.Result, reply.Err = result, newRemoteError(err)
+	return nil
+}
+
+func (s *RPCServer) GetInfo(_ *Empty, reply *InfoReply) error {
+	info, err := s.service.GetInfo()
+	reply.Info, reply.Err = info, newRemoteError(err)
+	return nil
+}
+
+func (s *RPCServer) GetAttestation(args *AttestationArgs, reply *AttestationReply) error {
+	document, err := s.service.GetAttestation(args.Nonce)
+	reply.Document, reply.Err = document, newRemoteError(err)
+	return nil
+}
+
+func (s *RPCServer) GetModelCatalog(_ *Empty, reply *ModelCatalogReply) error {
+	catalog, err := s.service.GetModelCatalog()
+	reply.Catalog, reply.Err = catalog, newRemoteError(err)
+	return nil
+}
+
+func (s *RPCServer) RotateKey(_ *Empty, reply *RotateKeyReply) error {
+	keyID, err := s.service.RotateKey()
+	reply.KeyID, reply.Err = keyID, newRemoteError(err)
+	return nil
+}
+
+func (s *RPCServer) ReencryptAll(_ *Empty, reply *ReencryptAllReply) error {
+	report, err := s.service.ReencryptAll()
+	reply.Report, reply.Err = report, newRemoteError(err)
+	return nil
+}
+
+func (s *RPCServer) RetireKey(args *RetireKeyArgs, reply *RetireKeyReply) error {
+	reply.Err = newRemoteError(s.service.RetireKey(args.KeyID))
+	return nil
+}
+
+// ListenUnix opens the worker socket, readable and writable by the owner
+// only. A socket left behind by a crashed worker is replaced.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict socket: %v", err)
+	}
+	return listener, nil
+}
+
+// ServeRPC answers gateway calls until the listener is closed, then drops
+// the open connections
+func ServeRPC(listener net.Listener, service Service) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(rpcName, &RPCServer{service: service}); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		go func() {
+			server.ServeConn(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// Client is the gateway side of the worker socket. It dials lazily and
+// reconnects after the worker restarts.
+type Client struct {
+	socket string
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{socket: socket}
+}
+
+// call runs a method on the worker. Only calls that never reached a broken
+// connection are retried, so key rotation can't run twice.
+func (c *Client) call(method string, args, reply any) error {
+	for attempt := 0; ; attempt++ {
+		client, err := c.conn()
+		if err != nil {
+			return err
+		}
+
+		err = client.Call(rpcName+"."+method, args, reply)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, rpc.ErrShutdown) && attempt == 0 {
+			c.reset(client)
+			continue
+		}
+		if _, ok := err.(rpc.ServerError); !ok {
+			// The connection broke, the next call dials again
+			c.reset(client)
+		}
+		return fmt.Errorf("TEE worker call %s failed: %v", method, err)
+	}
+}
+
+func (c *Client) conn() (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		conn, err := net.Dial("unix", c.socket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach TEE worker: %v", err)
+		}
+		c.client = rpc.NewClient(conn)
+	}
+	return c.client, nil
+}
+
+func (c *Client) reset(broken *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == broken {
+		if err := c.client.Close(); err != nil && !errors.Is(err, rpc.ErrShutdown) {
+			log.Printf("Warning: failed to close TEE worker connection: %v", err)
+		}
+		c.client = nil
+	}
+}
+
+// Close drops the connection to the worker
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+func (c *Client) ProcessGeneData(fileHash, sessionID, product string) (*types.ProcessResult, error) {
+	var reply ProcessReply
+	if err := c.call("ProcessGeneData", &ProcessArgs{FileHash: fileHash, SessionID: sessionID, Product: product}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Result, reply.Err.toError()
+}
+
+func (c *Client) GetInfo() (*Info, error) {
+	var reply InfoReply
+	if err := c.call("GetInfo", &Empty{}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Info, reply.Err.toError()
+}
+
+func (c *Client) GetAttestation(nonce string) (*teesdk.AttestationDocument, error) {
+	var reply AttestationReply
+	if err := c.call("GetAttestation", &AttestationArgs{Nonce: nonce}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Document, reply.Err.toError()
+}
+
+func (c *Client) GetModelCatalog() (*ModelCatalog, error) {
+	var reply ModelCatalogReply
+	if err := c.call("GetModelCatalog", &Empty{}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Catalog, reply.Err.toError()
+}
+
+func (c *Client) RotateKey() (string, error) {
+	var reply RotateKeyReply
+	if err := c.call("RotateKey", &Empty{}, &reply); err != nil {
+		return "", err
+	}
+	return reply.KeyID, reply.Err.toError()
+}
+
+func (c *Client) ReencryptAll() (*ReencryptReport, error) {
+	var reply ReencryptAllReply
+	if err := c.call("ReencryptAll", &Empty{}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Report, reply.Err.toError()
+}
+
+func (c *Client) RetireKey(keyID string) error {
+	var reply RetireKeyReply
+	if err := c.call("RetireKey", &RetireKeyArgs{KeyID: keyID}, &reply); err != nil {
+		return err
+	}
+	return reply.Err.toError()
+}
@@ -0,0 +1,324 @@
+package tee
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"genomic-service/internal/config"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// Version of the sealed payload: 1 held a single raw key, 2 holds a keyring
+	sealedKeyVersionSingle  = 1
+	sealedKeyVersionKeyring = 2
+	sealingKeySize          = 32 // AES-256
+
+	// scrypt parameters for passphrase-derived sealing keys
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// Sealer encrypts the TEE private key at rest, standing in for hardware sealing
+type Sealer interface {
+	Seal(plaintext []byte) (*SealedBlob, error)
+	Unseal(blob *SealedBlob) ([]byte, error)
+}
+
+// KMS is implemented by external key management services that can wrap and
+// unwrap the TEE key without the sealing key ever leaving the service
+type KMS interface {
+	Encrypt(keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// SealedBlob is the on-disk format of a sealed key
+type SealedBlob struct {
+	Version    int    `json:"version"`
+	Method     string `json:"method"`
+	KeyID      string `json:"keyId,omitempty"` // KMS key ID
+	Salt       string `json:"salt,omitempty"`  // hex, passphrase KDF salt
+	Nonce      string `json:"nonce,omitempty"` // hex, AES-GCM nonce
+	Ciphertext string `json:"ciphertext"`      // hex
+}
+
+// Sealing methods, selected by [tee] SealingMethod in app.ini
+const (
+	SealingPassphrase = "passphrase"
+	SealingFile       = "file"
+	SealingKMS        = "kms"
+)
+
+var (
+	kmsMu       sync.RWMutex
+	kmsRegistry = make(map[string]KMS)
+)
+
+// RegisterKMS makes a KMS implementation available to [tee] KMSName
+func RegisterKMS(name string, kms KMS) {
+	kmsMu.Lock()
+	defer kmsMu.Unlock()
+	kmsRegistry[name] = kms
+}
+
+func lookupKMS(name string) (KMS, error) {
+	kmsMu.RLock()
+	defer kmsMu.RUnlock()
+
+	kms, ok := kmsRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("kms not registered: %s", name)
+	}
+	return kms, nil
+}
+
+// passphraseSealer derives an AES-256-GCM key from a passphrase with scrypt
+type passphraseSealer struct {
+	passphrase []byte
+}
+
+func NewPassphraseSealer(passphrase string) (Sealer, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("sealing passphrase is required")
+	}
+	return &passphraseSealer{passphrase: []byte(passphrase)}, nil
+}
+
+func (s *passphraseSealer) Seal(plaintext []byte) (*SealedBlob, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, sealingKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive sealing key: %v", err)
+	}
+
+	blob, err := sealAESGCM(key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	blob.Method = SealingPassphrase
+	blob.Salt = hex.EncodeToString(salt)
+	return blob, nil
+}
+
+func (s *passphraseSealer) Unseal(blob *SealedBlob) ([]byte, error) {
+	salt, err := hex.DecodeString(blob.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, sealingKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive sealing key: %v", err)
+	}
+
+	return unsealAESGCM(key, blob)
+}
+
+// fileSealer uses a 32-byte key read from a file, e.g. a mounted secret
+type fileSealer struct {
+	key []byte
+}
+
+func NewFileSealer(path string) (Sealer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sealing key file: %v", err)
+	}
+
+	// Accept raw bytes or hex
+	key := data
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		key = decoded
+	}
+	if len(key) != sealingKeySize {
+		return nil, fmt.Errorf("sealing key must be %d bytes, got %d", sealingKeySize, len(key))
+	}
+
+	return &fileSealer{key: key}, nil
+}
+
+func (s *fileSealer) Seal(plaintext []byte) (*SealedBlob, error) {
+	blob, err := sealAESGCM(s.key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	blob.Method = SealingFile
+	return blob, nil
+}
+
+func (s *fileSealer) Unseal(blob *SealedBlob) ([]byte, error) {
+	return unsealAESGCM(s.key, blob)
+}
+
+// kmsSealer delegates wrapping to a registered KMS
+type kmsSealer struct {
+	kms   KMS
+	keyID string
+}
+
+func NewKMSSealer(kms KMS, keyID string) Sealer {
+	return &kmsSealer{kms: kms, keyID: keyID}
+}
+
+func (s *kmsSealer) Seal(plaintext []byte) (*SealedBlob, error) {
+	ciphertext, err := s.kms.Encrypt(s.keyID, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("kms encrypt failed: %v", err)
+	}
+
+	return &SealedBlob{
+		Version:    sealedKeyVersionKeyring,
+		Method:     SealingKMS,
+		KeyID:      s.keyID,
+		Ciphertext: hex.EncodeToString(ciphertext),
+	}, nil
+}
+
+func (s *kmsSealer) Unseal(blob *SealedBlob) ([]byte, error) {
+	ciphertext, err := hex.DecodeString(blob.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %v", err)
+	}
+
+	plaintext, err := s.kms.Decrypt(blob.KeyID, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt failed: %v", err)
+	}
+	return plaintext, nil
+}
+
+func sealAESGCM(key, plaintext []byte) (*SealedBlob, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return &SealedBlob{
+		Version:    sealedKeyVersionKeyring,
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(gcm.Seal(nil, nonce, plaintext, nil)),
+	}, nil
+}
+
+func unsealAESGCM(key []byte, blob *SealedBlob) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := hex.DecodeString(blob.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %v", err)
+	}
+	ciphertext, err := hex.DecodeString(blob.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %v", err)
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unseal key: wrong sealing key or corrupted file")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sealing key: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return gcm, nil
+}
+
+// readSealedBlob loads a sealed file, returning nil when it does not exist yet
+func readSealedBlob(path string) (*SealedBlob, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sealed key: %v", err)
+	}
+
+	var blob SealedBlob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return nil, fmt.Errorf("invalid sealed key file: %v", err)
+	}
+	return &blob, nil
+}
+
+// writeSealedBlob writes atomically so a crash never leaves a truncated key
+func writeSealedBlob(path string, blob *SealedBlob) error {
+	data, err := json.MarshalIndent(blob, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sealed key: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp key file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write sealed key: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync sealed key: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close sealed key: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move sealed key into place: %v", err)
+	}
+	return nil
+}
+
+// NewSealer creates the sealer selected in the [tee] settings
+func NewSealer(settings *config.TEESettings) (Sealer, error) {
+	switch settings.SealingMethod {
+	case SealingPassphrase:
+		return NewPassphraseSealer(settings.SealingPassphrase)
+	case SealingFile:
+		return NewFileSealer(settings.SealingKeyFile)
+	case SealingKMS:
+		kms, err := lookupKMS(settings.KMSName)
+		if err != nil {
+			return nil, err
+		}
+		return NewKMSSealer(kms, settings.KMSKeyID), nil
+	default:
+		return nil, fmt.Errorf("unknown sealing method: %s", settings.SealingMethod)
+	}
+}
@@ -1,19 +1,30 @@
 package tee
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/ecdsa"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"genomic-service/internal/types"
-	"strings"
+	teesdk "genomic-service/pkg/tee"
+	"io"
+	"math/big"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/ecies"
 )
 
+// ErrNotRewrappable is returned for envelopes without a separate data key,
+// which can't move to another key without rewriting their content
+var ErrNotRewrappable = errors.New("only chunked envelopes can be rewrapped")
+
 type TEE struct {
-	privateKey *ecdsa.PrivateKey
-	publicKey  *ecdsa.PublicKey
+	keyring   *Keyring
+	models    *ModelRegistry
+	vcfFilter VCFFilter
 }
 
 func NewTEE() *TEE {
@@ -23,53 +34,282 @@ func NewTEE() *TEE {
 		panic(err)
 	}
 
+	return NewTEEWithKey(privateKey)
+}
+
+// NewTEEWithKey creates a TEE with a single existing key
+func NewTEEWithKey(privateKey *ecdsa.PrivateKey) *TEE {
+	return NewTEEWithKeyring(NewKeyring(privateKey))
+}
+
+// NewTEEWithKeyring creates a TEE from a keyring, e.g. one unsealed from disk
+func NewTEEWithKeyring(keyring *Keyring) *TEE {
 	return &TEE{
-		privateKey: privateKey,
-		publicKey:  &privateKey.PublicKey,
+		keyring:   keyring,
+		models:    DefaultModelRegistry(),
+		vcfFilter: DefaultVCFFilter,
 	}
 }
 
+// SetModels replaces the bundled stroke panel, e.g. with configured models
+func (t *TEE) SetModels(models *ModelRegistry, vcfFilter VCFFilter) {
+	t.models = models
+	t.vcfFilter = vcfFilter
+}
+
+// Models exposes the registry of risk models the TEE runs
+func (t *TEE) Models() *ModelRegistry {
+	return t.models
+}
+
 // GetPublicKey returns hex-encoded public key that users will use
 func (t *TEE) GetPublicKey() string {
-	pubKeyBytes := crypto.CompressPubkey(t.publicKey)
-	return hex.EncodeToString(pubKeyBytes)
+	return t.keyring.Current().PublicKeyHex()
+}
+
+// GetKeyID returns the ID of the current key
+func (t *TEE) GetKeyID() string {
+	return t.keyring.Current().ID
 }
 
-// ProcessEncryptedData decrypts and processes the data
+// Keyring exposes the keyring for rotation and retirement
+func (t *TEE) Keyring() *Keyring {
+	return t.keyring
+}
+
+// ProcessEncryptedData decrypts the data and scores it with the default model
 func (t *TEE) ProcessEncryptedData(encryptedData []byte, fileHash string) (types.GeneData, error) {
-	// Convert ECDSA private key to ECIES private key
-	eciesPrivKey := ecies.ImportECDSA(t.privateKey)
+	model, err := t.models.Resolve("")
+	if err != nil {
+		return types.GeneData{}, err
+	}
+	return t.ProcessWithModel(encryptedData, fileHash, model)
+}
+
+// ProcessWithModel decrypts the data and scores it with the given model
+func (t *TEE) ProcessWithModel(encryptedData []byte, fileHash string, model Model) (types.GeneData, error) {
+	geneData, err := t.ProcessStream(bytes.NewReader(encryptedData), fileHash, model)
+	if err != nil {
+		return types.GeneData{}, err
+	}
+	geneData.EncryptedData = encryptedData
+	return geneData, nil
+}
 
-	// Decrypt the data
-	decrypted, err := eciesPrivKey.Decrypt(encryptedData, nil, nil)
+// ProcessStream decrypts and parses the data as it is read, so chunked
+// envelopes are never held in memory as a whole, neither encrypted nor in
+// plaintext. A corrupted chunk fails with a *teesdk.ChunkError.
+func (t *TEE) ProcessStream(encrypted io.Reader, fileHash string, model Model) (types.GeneData, error) {
+	decrypted, _, err := t.decryptStream(encrypted)
 	if err != nil {
 		return types.GeneData{}, err
 	}
 
-	riskScore := t.calculateRiskScore(string(decrypted))
-	if riskScore == 0 {
-		return types.GeneData{}, fmt.Errorf("invalid risk score")
+	// Commit to the plaintext while it is inside the TEE
+	salt, err := teesdk.NewSalt()
+	if err != nil {
+		return types.GeneData{}, err
+	}
+	hasher := teesdk.NewContentHasher(salt)
+	plaintext := &readErrRecorder{r: io.TeeReader(decrypted, hasher)}
+
+	table, err := ParseGenomeData(plaintext, t.vcfFilter)
+	if err != nil {
+		if plaintext.err != nil {
+			return types.GeneData{}, plaintext.err
+		}
+		return types.GeneData{}, fmt.Errorf("invalid genome data: %v", err)
+	}
+	// Every chunk has to authenticate before the result counts, and the
+	// commitment covers the whole file
+	if _, err := io.Copy(io.Discard, plaintext); err != nil {
+		return types.GeneData{}, err
+	}
+
+	risk, err := model.Score(table)
+	if err != nil {
+		return types.GeneData{}, err
 	}
 
 	return types.GeneData{
-		ID:            fileHash,
-		FileHash:      fileHash,
-		EncryptedData: encryptedData,
-		RiskScore:     riskScore,
+		ID:          fileHash,
+		FileHash:    fileHash,
+		RiskScore:   risk.Category,
+		Percentile:  risk.Percentile,
+		Coverage:    risk.Coverage,
+		ContentHash: hasher.Sum(),
+		Salt:        hexutil.Encode(salt),
+		ModelID:     ModelID(model),
+		ModelHash:   model.Hash(),
 	}, nil
 }
 
-func (t *TEE) calculateRiskScore(data string) int {
-	switch strings.ToLower(data) {
-	case "extremely high risk":
-		return 4 // 15,000 PCSP
-	case "high risk":
-		return 3 // 3,000 PCSP
-	case "slightly high risk":
-		return 2 // 225 PCSP
-	case "low risk":
-		return 1 // 30 PCSP
-	default:
-		return 0 // invalid
+// readErrRecorder keeps the first read error, which parsers only pass on as text
+type readErrRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// SignResult signs the canonical digest of a result with the current enclave
+// key and fills in the proof, so the controller contract and auditors can
+// check it really came from the TEE
+func (t *TEE) SignResult(result *types.ProcessResult) error {
+	sessionID, ok := new(big.Int).SetString(result.SessionID, 10)
+	if !ok {
+		return fmt.Errorf("invalid session ID: %s", result.SessionID)
+	}
+
+	modelHash, err := hexutil.Decode(result.ModelHash)
+	if err != nil || len(modelHash) != common.HashLength {
+		return fmt.Errorf("invalid model hash: %s", result.ModelHash)
+	}
+
+	key := t.keyring.Current()
+	proof, err := teesdk.SignClaim(&teesdk.Claim{
+		DocID:       result.DocID,
+		ContentHash: result.ContentHash,
+		SessionID:   sessionID,
+		RiskScore:   big.NewInt(int64(result.RiskScore)),
+		ModelID:     result.ModelID,
+		ModelHash:   common.BytesToHash(modelHash),
+	}, key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	result.Proof = hexutil.Encode(proof)
+	result.Signer = key.Address().Hex()
+	return nil
+}
+
+// RewrapHeader reads the header of a chunked envelope and returns it with
+// the data key wrapped to the current key, leaving r at the first chunk. It
+// returns false when the header already uses the current key, and
+// ErrNotRewrappable for other formats.
+func (t *TEE) RewrapHeader(r io.Reader) ([]byte, bool, error) {
+	// Read exactly up to the first chunk, nothing is buffered past it
+	prefix := make([]byte, teesdk.HeaderSize)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, false, fmt.Errorf("failed to read header: %v", err)
+	}
+	if !teesdk.IsChunked(prefix[:n]) {
+		return nil, false, ErrNotRewrappable
+	}
+	header, err := teesdk.ReadChunkedHeader(io.MultiReader(bytes.NewReader(prefix), r))
+	if err != nil {
+		return nil, false, err
+	}
+
+	current := t.keyring.Current()
+	if header.KeyID == current.ID {
+		encoded, err := header.Bytes()
+		return encoded, false, err
+	}
+	dataKey, err := t.unwrapDataKey(header)
+	if err != nil {
+		return nil, false, err
+	}
+	header.KeyID = current.ID
+	header.WrappedKey, err = teesdk.WrapDataKey(&current.PrivateKey.PublicKey, dataKey)
+	if err != nil {
+		return nil, false, err
+	}
+	encoded, err := header.Bytes()
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, true, nil
+}
+
+// decryptStream returns the plaintext of an envelope and the ID of the key
+// it was encrypted to. Chunked envelopes are decrypted as they are read.
+func (t *TEE) decryptStream(encrypted io.Reader) (io.Reader, string, error) {
+	reader := bufio.NewReader(encrypted)
+	prefix, _ := reader.Peek(teesdk.HeaderSize)
+
+	if teesdk.IsChunked(prefix) {
+		header, dataKey, err := t.openChunkedHeader(reader)
+		if err != nil {
+			return nil, "", err
+		}
+		decrypted, err := teesdk.NewDecryptReader(reader, header, dataKey)
+		if err != nil {
+			return nil, "", err
+		}
+		return decrypted, header.KeyID, nil
+	}
+
+	// Whole-file ECIES envelopes and legacy data can only be decrypted at once
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read data: %v", err)
+	}
+	decrypted, keyID, err := t.decrypt(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewReader(decrypted), keyID, nil
+}
+
+// openChunkedHeader reads a chunked envelope header and unwraps its data key
+func (t *TEE) openChunkedHeader(r io.Reader) (*teesdk.ChunkedHeader, []byte, error) {
+	header, err := teesdk.ReadChunkedHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := t.unwrapDataKey(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, dataKey, nil
+}
+
+// unwrapDataKey recovers the data key with the key named in the header
+func (t *TEE) unwrapDataKey(header *teesdk.ChunkedHeader) ([]byte, error) {
+	key, found := t.keyring.Get(header.KeyID)
+	if !found {
+		return nil, fmt.Errorf("unknown key ID: %s", header.KeyID)
+	}
+	return teesdk.UnwrapDataKey(key.PrivateKey, header.WrappedKey)
+}
+
+// decrypt opens a whole-file ECIES envelope with the key named in its
+// header. Data without a header predates key IDs and is tried against every
+// key, newest first.
+func (t *TEE) decrypt(encryptedData []byte) ([]byte, string, error) {
+	keyID, payload, ok, err := teesdk.ParseHeader(encryptedData)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if ok {
+		key, found := t.keyring.Get(keyID)
+		if !found {
+			return nil, "", fmt.Errorf("unknown key ID: %s", keyID)
+		}
+		decrypted, err := ecies.ImportECDSA(key.PrivateKey).Decrypt(payload, nil, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		return decrypted, keyID, nil
+	}
+
+	keys := t.keyring.Keys()
+	for i := len(keys) - 1; i >= 0; i-- {
+		decrypted, err := ecies.ImportECDSA(keys[i].PrivateKey).Decrypt(payload, nil, nil)
+		if err == nil {
+			// Legacy data is never tagged with a key, so always report it as such
+			return decrypted, "", nil
+		}
 	}
+	return nil, "", fmt.Errorf("failed to decrypt data with any key")
 }
@@ -1,41 +1,328 @@
 package tee
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"genomic-service/internal/config"
 	"genomic-service/internal/storage"
 	"genomic-service/internal/types"
+	teesdk "genomic-service/pkg/tee"
+	"io"
+	"log"
 )
 
 type TEEService struct {
-	tee     *TEE
-	storage storage.Storage
+	tee      *TEE
+	attester *Attester
+	storage  storage.StreamStorage
+	// Rewrapped headers of blobs moved to a newer key, stored blobs are
+	// never rewritten
+	headers *HeaderStore
+	// Bounds concurrent decryptions, each of which holds a parsed genome in memory
+	slots chan struct{}
 }
 
-func NewTEEService(storage storage.Storage) *TEEService {
+func NewTEEService(storage storage.StreamStorage, settings *config.TEESettings) (*TEEService, error) {
+	tee, err := newTEEFromSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	attester, err := NewAttesterFromSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := NewHeaderStore(settings.HeaderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var slots chan struct{}
+	if settings.MaxConcurrency > 0 {
+		slots = make(chan struct{}, settings.MaxConcurrency)
+	}
+
 	return &TEEService{
-		tee:     NewTEE(),
-		storage: storage,
+		tee:      tee,
+		attester: attester,
+		storage:  storage,
+		headers:  headers,
+		slots:    slots,
+	}, nil
+}
+
+// newTEEFromSettings unseals the persisted TEE key so ciphertexts survive
+// restarts, and loads the configured risk models
+func newTEEFromSettings(settings *config.TEESettings) (*TEE, error) {
+	var tee *TEE
+	if settings.KeyPath == "" {
+		tee = NewTEE()
+	} else {
+		sealer, err := NewSealer(settings)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup key sealing: %v", err)
+		}
+
+		keyring, err := LoadOrCreateKeyring(settings.KeyPath, sealer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load sealed TEE keyring: %v", err)
+		}
+		tee = NewTEEWithKeyring(keyring)
+	}
+
+	models, err := NewModelRegistryFromSettings(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load risk models: %v", err)
 	}
+	tee.SetModels(models, VCFFilter{MinQual: settings.VCFMinQual})
+
+	return tee, nil
 }
 
-func (s *TEEService) ProcessGeneData(fileHash string) (*types.ProcessResult, error) {
-	encryptedData, err := s.storage.Retrieve(fileHash)
+// ProcessGeneData scores the stored data with the model registered for the
+// product, the default product when empty, and returns a result signed by the
+// TEE for the given upload session
+func (s *TEEService) ProcessGeneData(fileHash, sessionID, product string) (*types.ProcessResult, error) {
+	model, err := s.tee.Models().Resolve(product)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve data: %v", err)
+		return nil, err
+	}
+
+	var result *types.ProcessResult
+	err = s.withSlot(func() error {
+		var err error
+		result, err = s.processGeneData(fileHash, sessionID, model)
+		return err
+	})
+	return result, err
+}
+
+func (s *TEEService) processGeneData(fileHash, sessionID string, model Model) (*types.ProcessResult, error) {
+	reader, err := s.openBlob(fileHash)
+	if err != nil {
+		return nil, err
 	}
+	defer reader.Close()
 
 	// Process in TEE
-	geneData, err := s.tee.ProcessEncryptedData(encryptedData, fileHash)
+	geneData, err := s.tee.ProcessStream(reader, fileHash, model)
 	if err != nil {
-		return nil, fmt.Errorf("failed to process data: %v", err)
+		return nil, fmt.Errorf("failed to process data: %w", err)
+	}
+
+	// Lazily move blobs encrypted under an old key to the current one. The
+	// result is already computed, so a failure here only delays retirement.
+	if err := s.reencryptBlob(fileHash); err != nil && !errors.Is(err, ErrNotRewrappable) {
+		log.Printf("Warning: failed to re-encrypt %s: %v", fileHash, err)
+	}
+
+	result := &types.ProcessResult{
+		DocID:       fileHash,
+		RiskScore:   geneData.RiskScore,
+		Percentile:  geneData.Percentile,
+		Coverage:    geneData.Coverage,
+		ContentHash: geneData.ContentHash,
+		Salt:        geneData.Salt,
+		SessionID:   sessionID,
+		ModelID:     geneData.ModelID,
+		ModelHash:   geneData.ModelHash,
 	}
 
-	return &types.ProcessResult{
-		DocID:     fileHash,
-		RiskScore: geneData.RiskScore,
+	if err := s.tee.SignResult(result); err != nil {
+		return nil, fmt.Errorf("failed to sign result: %v", err)
+	}
+
+	return result, nil
+}
+
+// GetAttestation returns a signed attestation document for the current key.
+// Clients pass a random nonce to make sure the document is fresh.
+func (s *TEEService) GetAttestation(nonce string) (*teesdk.AttestationDocument, error) {
+	return s.attester.Attest(s.tee.Keyring().Current(), nonce)
+}
+
+// GetModels lists the registered risk models and the product mapping
+func (s *TEEService) GetModels() ([]Model, map[string]string) {
+	return s.tee.Models().Models(), s.tee.Models().Products()
+}
+
+// GetInfo returns the current key with what clients need to trust it
+func (s *TEEService) GetInfo() (*Info, error) {
+	key := s.tee.Keyring().Current()
+	return &Info{
+		PublicKey:       key.PublicKeyHex(),
+		KeyID:           key.ID,
+		Signer:          key.Address().Hex(),
+		AttestationRoot: s.attester.RootPublicKey(),
+		Measurement:     s.attester.Measurement(),
 	}, nil
 }
 
-func (s *TEEService) GetTEEPublicKey() string {
-	return s.tee.GetPublicKey()
+// GetModelCatalog describes the registered models
+func (s *TEEService) GetModelCatalog() (*ModelCatalog, error) {
+	models, products := s.GetModels()
+
+	catalog := &ModelCatalog{Products: products}
+	for _, model := range models {
+		catalog.Models = append(catalog.Models, ModelInfo{
+			ID:      ModelID(model),
+			Name:    model.Name(),
+			Version: model.Version(),
+			Hash:    model.Hash(),
+		})
+	}
+	return catalog, nil
+}
+
+// RotateKey makes a freshly generated key current. Blobs under older keys are
+// re-encrypted lazily on their next use or in bulk by ReencryptAll. Uploads
+// are only accepted for the current key, so once rotated no new blob needs
+// the older keys.
+func (s *TEEService) RotateKey() (string, error) {
+	key, err := s.tee.Keyring().Rotate()
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate key: %v", err)
+	}
+	return key.ID, nil
+}
+
+// ReencryptReport summarizes a bulk re-encryption run
+type ReencryptReport struct {
+	Scanned     int               `json:"scanned"`
+	Reencrypted int               `json:"reencrypted"`
+	Failed      map[string]string `json:"failed,omitempty"` // fileHash -> error
+}
+
+// ReencryptAll moves every stored blob to the current key, so that old keys
+// can be retired afterwards. Whole-file and legacy envelopes can't be moved
+// and are reported as failed.
+func (s *TEEService) ReencryptAll() (*ReencryptReport, error) {
+	fileHashes, err := s.storage.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data: %v", err)
+	}
+
+	report := &ReencryptReport{Failed: make(map[string]string)}
+	for _, fileHash := range fileHashes {
+		report.Scanned++
+
+		keyID, err := s.blobKeyID(fileHash)
+		if err == nil && keyID == s.tee.GetKeyID() {
+			continue
+		}
+
+		err = s.withSlot(func() error {
+			return s.reencryptBlob(fileHash)
+		})
+		if err != nil {
+			report.Failed[fileHash] = err.Error()
+			continue
+		}
+		report.Reencrypted++
+	}
+
+	return report, nil
+}
+
+// RetireKey removes an old key once no stored blob depends on it anymore
+func (s *TEEService) RetireKey(keyID string) error {
+	fileHashes, err := s.storage.List()
+	if err != nil {
+		return fmt.Errorf("failed to list data: %v", err)
+	}
+
+	remaining := 0
+	for _, fileHash := range fileHashes {
+		blobKeyID, err := s.blobKeyID(fileHash)
+		if err != nil {
+			return err
+		}
+		// Legacy blobs carry no key ID, so any of the keys may be needed
+		if blobKeyID == keyID || blobKeyID == "" {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d blobs still need key %s, re-encrypt them first", remaining, keyID)
+	}
+
+	return s.tee.Keyring().Retire(keyID)
+}
+
+func (s *TEEService) withSlot(fn func() error) error {
+	if s.slots != nil {
+		s.slots <- struct{}{}
+		defer func() { <-s.slots }()
+	}
+	return fn()
+}
+
+// Close releases the header store
+func (s *TEEService) Close() error {
+	return s.headers.Close()
+}
+
+// openBlob reads a stored blob through its rewrapped header, if it has one
+func (s *TEEService) openBlob(fileHash string) (io.ReadCloser, error) {
+	reader, err := s.storage.RetrieveStream(fileHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve data: %v", err)
+	}
+	header, ok, err := s.headers.Get(fileHash)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	if !ok {
+		return reader, nil
+	}
+
+	// Skip the stored header, the chunks follow unchanged
+	if _, err := teesdk.ReadChunkedHeader(reader); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(header), reader), reader}, nil
+}
+
+// blobKeyID reads only the envelope header of a stored blob
+func (s *TEEService) blobKeyID(fileHash string) (string, error) {
+	reader, err := s.openBlob(fileHash)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	header := make([]byte, teesdk.HeaderSize)
+	n, err := io.ReadFull(reader, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read header: %v", err)
+	}
+
+	keyID, _, _, err := teesdk.ParseHeader(header[:n])
+	return keyID, err
+}
+
+// reencryptBlob rewraps the data key of a blob for the current key. Only the
+// new header is recorded, the blob keeps the content its hash names.
+func (s *TEEService) reencryptBlob(fileHash string) error {
+	reader, err := s.openBlob(fileHash)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	header, ok, err := s.tee.RewrapHeader(reader)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	return s.headers.Put(fileHash, header)
 }
@@ -1,10 +1,29 @@
 package tee_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"genomic-service/internal/config"
+	"genomic-service/internal/storage"
 	"genomic-service/internal/tee"
 	teesdk "genomic-service/pkg/tee"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,7 +33,7 @@ func TestTEE(t *testing.T) {
 	assert.NotNil(t, tee)
 
 	// Create user with TEE's public key
-	user := teesdk.NewTeeEncoder(tee.GetPublicKey())
+	user := enclaveEncoder(t, tee)
 	assert.NotNil(t, user)
 
 	// Test cases for different gene data files
@@ -23,17 +42,17 @@ func TestTEE(t *testing.T) {
 		expectedScore int
 		expectedError bool
 	}{
-		{"invalid.txt", 0, true},  // "invalid" = 0
-		{"alice.txt", 4, false},   // "extremely high risk" = 4
-		{"bob.txt", 3, false},     // "high risk" = 3
-		{"charlie.txt", 2, false}, // "slightly high risk" = 2
-		{"dave.txt", 1, false},    // "low risk" = 1
+		{"invalid.txt", 0, true},  // not a genotype file
+		{"alice.txt", 4, false},   // >= 95th percentile, extremely high risk
+		{"bob.txt", 3, false},     // 80-95th percentile, high risk
+		{"charlie.txt", 2, false}, // 50-80th percentile, slightly high risk
+		{"dave.txt", 1, false},    // < 50th percentile, low risk
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.filename, func(t *testing.T) {
 			// Get gene data from file
-			fileData, err := user.GetFileDataFromFile("../../gene-datas/" + tc.filename)
+			fileData, err := teesdk.GetFileDataFromFile("../../gene-datas/" + tc.filename)
 			assert.NoError(t, err)
 			assert.NotNil(t, fileData)
 
@@ -53,3 +72,1149 @@ func TestTEE(t *testing.T) {
 		})
 	}
 }
+
+func readGeneData(t *testing.T, filename string) []byte {
+	data, err := os.ReadFile("../../gene-datas/" + filename)
+	assert.NoError(t, err)
+	return data
+}
+
+// currentInfo returns the current key of a TEE service
+func currentInfo(t *testing.T, service tee.Service) *tee.Info {
+	info, err := service.GetInfo()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return info
+}
+
+// attestedEncoder verifies the attestation of a TEE service like a client
+func attestedEncoder(t *testing.T, service tee.Service) *teesdk.TeeEncoder {
+	info, err := service.GetInfo()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	doc, err := service.GetAttestation("test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	encoder, err := teesdk.NewAttestedTeeEncoder(doc, teesdk.AttestationPolicy{
+		RootPublicKey:       info.AttestationRoot,
+		AllowedMeasurements: []string{info.Measurement},
+		Nonce:               "test",
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return encoder
+}
+
+// enclaveEncoder attests the current key of an enclave under a throwaway root
+func enclaveEncoder(t *testing.T, enclave *tee.TEE) *teesdk.TeeEncoder {
+	rootKey, err := crypto.GenerateKey()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	attester := tee.NewAttester(rootKey, strings.Repeat("22", 32))
+	doc, err := attester.Attest(enclave.Keyring().Current(), "test")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	encoder, err := teesdk.NewAttestedTeeEncoder(doc, teesdk.AttestationPolicy{
+		RootPublicKey:       attester.RootPublicKey(),
+		AllowedMeasurements: []string{attester.Measurement()},
+		Nonce:               "test",
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return encoder
+}
+
+// fakeKMS wraps keys with a fixed XOR pad, enough to exercise the KMS plumbing
+type fakeKMS struct{}
+
+func (fakeKMS) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	return xorPad(plaintext), nil
+}
+
+func (fakeKMS) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	return xorPad(ciphertext), nil
+}
+
+func xorPad(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ 0x5a
+	}
+	return out
+}
+
+func TestSealedKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "sealing.key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)), 0o600))
+	tee.RegisterKMS("fake", fakeKMS{})
+
+	testCases := []config.TEESettings{
+		{SealingMethod: tee.SealingPassphrase, SealingPassphrase: "correct horse battery staple"},
+		{SealingMethod: tee.SealingFile, SealingKeyFile: keyFile},
+		{SealingMethod: tee.SealingKMS, KMSName: "fake", KMSKeyID: "tee-key"},
+	}
+
+	for _, settings := range testCases {
+		t.Run(settings.SealingMethod, func(t *testing.T) {
+			settings.KeyPath = filepath.Join(dir, settings.SealingMethod, "sealed_key.json")
+
+			sealer, err := tee.NewSealer(&settings)
+			assert.NoError(t, err)
+
+			// First start generates and seals a key
+			first, err := tee.LoadOrCreateKeyring(settings.KeyPath, sealer)
+			assert.NoError(t, err)
+
+			// The private key is never written in the clear
+			sealed, err := os.ReadFile(settings.KeyPath)
+			assert.NoError(t, err)
+			assert.NotContains(t, string(sealed), hex.EncodeToString(crypto.FromECDSA(first.Current().PrivateKey)))
+
+			// Data encrypted before a restart can be decrypted after it
+			user := enclaveEncoder(t, tee.NewTEEWithKeyring(first))
+			encrypted, err := user.EncryptGeneData(readGeneData(t, "dave.txt"))
+			assert.NoError(t, err)
+
+			second, err := tee.LoadOrCreateKeyring(settings.KeyPath, sealer)
+			assert.NoError(t, err)
+			geneData, err := tee.NewTEEWithKeyring(second).ProcessEncryptedData(encrypted, "dave")
+			assert.NoError(t, err)
+			assert.Equal(t, 1, geneData.RiskScore)
+		})
+	}
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		keyPath := filepath.Join(dir, "wrong", "sealed_key.json")
+		right, _ := tee.NewPassphraseSealer("right")
+		wrong, _ := tee.NewPassphraseSealer("wrong")
+
+		_, err := tee.LoadOrCreateKeyring(keyPath, right)
+		assert.NoError(t, err)
+		_, err = tee.LoadOrCreateKeyring(keyPath, wrong)
+		assert.Error(t, err)
+	})
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewMemoryStorage()
+	settings := &config.TEESettings{
+		KeyPath:           filepath.Join(dir, "sealed_key.json"),
+		SealingMethod:     tee.SealingPassphrase,
+		SealingPassphrase: "rotate me",
+		HeaderPath:        filepath.Join(dir, "headers.db"),
+	}
+	service, err := tee.NewTEEService(store, settings)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	oldKeyID := currentInfo(t, service).KeyID
+
+	// The SDK derives the same key ID from the public key and embeds it
+	user := attestedEncoder(t, service)
+	sdkKeyID, err := user.KeyID()
+	assert.NoError(t, err)
+	assert.Equal(t, oldKeyID, sdkKeyID)
+
+	lazy, err := user.EncryptGeneData(readGeneData(t, "bob.txt"))
+	assert.NoError(t, err)
+	lazyHash, err := store.Store(lazy)
+	assert.NoError(t, err)
+
+	bulk, err := user.EncryptGeneData(readGeneData(t, "dave.txt"))
+	assert.NoError(t, err)
+	bulkHash, err := store.Store(bulk)
+	assert.NoError(t, err)
+
+	newKeyID, err := service.RotateKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, oldKeyID, newKeyID)
+	assert.Equal(t, newKeyID, currentInfo(t, service).KeyID)
+
+	// Old blobs still decrypt, and are moved to the new key on use without
+	// rewriting the stored data
+	result, err := service.ProcessGeneData(lazyHash, "1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.RiskScore)
+	stored, err := store.Retrieve(lazyHash)
+	assert.NoError(t, err)
+	assert.Equal(t, lazy, stored)
+
+	// The old key can't be retired while a blob still needs it
+	assert.Error(t, service.RetireKey(oldKeyID))
+
+	report, err := service.ReencryptAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Equal(t, 1, report.Reencrypted)
+	assert.Empty(t, report.Failed)
+
+	assert.NoError(t, service.RetireKey(oldKeyID))
+	assert.Error(t, service.RetireKey(newKeyID))
+
+	result, err = service.ProcessGeneData(bulkHash, "2", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.RiskScore)
+
+	// Rewrapped headers outlive a restart of the worker
+	assert.NoError(t, service.Close())
+	restarted, err := tee.NewTEEService(store, settings)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer restarted.Close()
+	result, err = restarted.ProcessGeneData(lazyHash, "3", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.RiskScore)
+}
+
+func TestAttestation(t *testing.T) {
+	rootKey, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	measurement := strings.Repeat("11", 32)
+
+	enclave := tee.NewTEE()
+	attester := tee.NewAttester(rootKey, measurement)
+	policy := teesdk.AttestationPolicy{
+		RootPublicKey:       attester.RootPublicKey(),
+		AllowedMeasurements: []string{measurement},
+		MaxAge:              time.Minute,
+		Nonce:               "client-nonce",
+	}
+
+	doc, err := attester.Attest(enclave.Keyring().Current(), "client-nonce")
+	assert.NoError(t, err)
+
+	// A verified document yields an encoder for the attested key
+	encoder, err := teesdk.NewAttestedTeeEncoder(doc, policy)
+	assert.NoError(t, err)
+	encrypted, err := encoder.EncryptGeneData(readGeneData(t, "charlie.txt"))
+	assert.NoError(t, err)
+	geneData, err := enclave.ProcessEncryptedData(encrypted, "charlie")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, geneData.RiskScore)
+
+	// A gateway swapping in its own key breaks the root signature
+	gatewayKey, _ := crypto.GenerateKey()
+	swapped := *doc
+	swapped.PublicKey = tee.NewTEEWithKey(gatewayKey).GetPublicKey()
+	swapped.KeyID = tee.NewTEEWithKey(gatewayKey).GetKeyID()
+	_, err = teesdk.NewAttestedTeeEncoder(&swapped, policy)
+	assert.Error(t, err)
+
+	// Re-signing with anything but the pinned root is rejected
+	assert.NoError(t, swapped.Sign(gatewayKey))
+	_, err = teesdk.NewAttestedTeeEncoder(&swapped, policy)
+	assert.ErrorContains(t, err, "pinned root")
+
+	// Unknown code measurement
+	untrusted, err := tee.NewAttester(rootKey, strings.Repeat("22", 32)).Attest(enclave.Keyring().Current(), "client-nonce")
+	assert.NoError(t, err)
+	_, err = teesdk.NewAttestedTeeEncoder(untrusted, policy)
+	assert.ErrorContains(t, err, "measurement not allowed")
+
+	// Replayed document for another nonce
+	replayed, err := attester.Attest(enclave.Keyring().Current(), "old-nonce")
+	assert.NoError(t, err)
+	_, err = teesdk.NewAttestedTeeEncoder(replayed, policy)
+	assert.ErrorContains(t, err, "nonce")
+
+	// Stale document
+	stale := *doc
+	stale.Timestamp = time.Now().Add(-time.Hour).Unix()
+	assert.NoError(t, stale.Sign(rootKey))
+	_, err = teesdk.NewAttestedTeeEncoder(&stale, policy)
+	assert.ErrorContains(t, err, "expired")
+}
+
+func TestProof(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	service, err := tee.NewTEEService(store, &config.TEESettings{})
+	assert.NoError(t, err)
+
+	user := attestedEncoder(t, service)
+	encrypted, err := user.EncryptGeneData(readGeneData(t, "bob.txt"))
+	assert.NoError(t, err)
+	fileHash, err := store.Store(encrypted)
+	assert.NoError(t, err)
+
+	result, err := service.ProcessGeneData(fileHash, "7", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "GDAO_STROKE_PANEL@1", result.ModelID)
+	assert.Len(t, result.ModelHash, 66)
+	assert.Equal(t, currentInfo(t, service).Signer, result.Signer)
+
+	// The content hash commits to the genome and opens only with the salt
+	assert.NoError(t, teesdk.VerifyContentHash(readGeneData(t, "bob.txt"), result.Salt, result.ContentHash))
+	assert.Error(t, teesdk.VerifyContentHash(readGeneData(t, "dave.txt"), result.Salt, result.ContentHash))
+	otherSalt, _ := teesdk.NewSalt()
+	assert.Error(t, teesdk.VerifyContentHash(readGeneData(t, "bob.txt"), hexutil.Encode(otherSalt), result.ContentHash))
+
+	// A fresh salt per upload keeps equal genomes unlinkable on chain
+	again, err := service.ProcessGeneData(fileHash, "8", "")
+	assert.NoError(t, err)
+	assert.NotEqual(t, result.ContentHash, again.ContentHash)
+
+	proof, err := hexutil.Decode(result.Proof)
+	assert.NoError(t, err)
+	signer := common.HexToAddress(currentInfo(t, service).Signer)
+
+	claim := func(riskScore int64, sessionID int64) *teesdk.Claim {
+		return &teesdk.Claim{
+			DocID:       result.DocID,
+			ContentHash: result.ContentHash,
+			SessionID:   big.NewInt(sessionID),
+			RiskScore:   big.NewInt(riskScore),
+			ModelID:     result.ModelID,
+			ModelHash:   common.HexToHash(result.ModelHash),
+		}
+	}
+
+	// The proof covers exactly the returned result
+	assert.NoError(t, teesdk.VerifyClaim(claim(3, 7), proof, signer))
+
+	// A relayer can't change the score, the commitment or the session
+	assert.Error(t, teesdk.VerifyClaim(claim(4, 7), proof, signer))
+	assert.Error(t, teesdk.VerifyClaim(claim(3, 8), proof, signer))
+	tampered := claim(3, 7)
+	tampered.ContentHash = again.ContentHash
+	assert.Error(t, teesdk.VerifyClaim(tampered, proof, signer))
+
+	// Or attribute the score to another model
+	tampered = claim(3, 7)
+	tampered.ModelHash = common.HexToHash("0x01")
+	assert.Error(t, teesdk.VerifyClaim(tampered, proof, signer))
+
+	// Nor sign its own results
+	otherKey, _ := crypto.GenerateKey()
+	forged, err := teesdk.SignClaim(claim(4, 7), otherKey)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, teesdk.VerifyClaim(claim(4, 7), forged, signer), "untrusted")
+
+	// Session IDs are decimal on-chain IDs
+	_, err = service.ProcessGeneData(fileHash, "not-a-session", "")
+	assert.Error(t, err)
+}
+
+func TestParseGenotypes(t *testing.T) {
+	const sample23andMe = `# This data file generated by 23andMe at: Mon Jan 01 00:00:00 2024
+#
+# We are using reference human assembly build 37 (also known as Annotation Release 104).
+#
+# rsid	chromosome	position	genotype
+rs4477212	1	82154	AA
+rs3094315	1	752566	ag
+rs3131972	1	752721	--
+i4000001	MT	3594	C
+rs9939609	16	53820527	AT
+rs9939609	16	53820527	TT
+`
+
+	const sampleAncestryDNA = `#AncestryDNA raw data download
+#This file was generated by AncestryDNA at: 01/01/2024 00:00:00 UTC
+#Genotypes are reported on the forward (+) strand with respect to the human reference build 37.1 coordinates.
+rsid	chromosome	position	allele1	allele2
+rs4477212	1	82154	A	A
+rs3131972	1	752721	0	0
+rs2229	23	1000	G	0
+rs1800	26	73	I	D
+`
+
+	testCases := []struct {
+		name     string
+		data     string
+		format   string
+		build    string
+		variants int
+		noCalls  int
+		wantErr  string
+	}{
+		{"23andMe", sample23andMe, tee.Format23andMe, tee.BuildGRCh37, 5, 1, ""},
+		{"AncestryDNA", sampleAncestryDNA, tee.FormatAncestryDNA, tee.BuildGRCh37, 4, 2, ""},
+		{"headerless GRCh38", "# assembly GRCh38\nrs1\tchr7\t100\tCT\n", tee.Format23andMe, tee.BuildGRCh38, 1, 0, ""},
+		{"no build", "rs1\t1\t100\tA\tG\n", tee.FormatAncestryDNA, tee.BuildUnknown, 1, 0, ""},
+		{"bad position", "rs1\t1\tabc\tAA\n", "", "", 0, 0, "line 1: invalid position"},
+		{"bad chromosome", "rs1\t30\t100\tAA\n", "", "", 0, 0, "invalid chromosome"},
+		{"bad genotype", "rs1\t1\t100\tAZ\n", "", "", 0, 0, "invalid genotype"},
+		{"wrong column count", "rs1\t1\t100\n", "", "", 0, 0, "unrecognized format"},
+		{"legacy text", "high risk", "", "", 0, 0, "unrecognized format"},
+		{"empty", "# only comments\n", "", "", 0, 0, "no genotypes"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			table, err := tee.ParseGenotypes(strings.NewReader(tc.data))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.format, table.Format)
+			assert.Equal(t, tc.build, table.Build)
+			assert.Equal(t, tc.variants, table.Len())
+			assert.Equal(t, tc.noCalls, table.NoCalls)
+		})
+	}
+
+	t.Run("lookups", func(t *testing.T) {
+		table, err := tee.ParseGenotypes(strings.NewReader(sample23andMe))
+		assert.NoError(t, err)
+
+		genotype, ok := table.Get("RS3094315")
+		assert.True(t, ok)
+		assert.Equal(t, tee.Genotype{RSID: "rs3094315", Chromosome: "1", Position: 752566, Alleles: "AG"}, genotype)
+
+		// No-calls and unknown SNPs are both missing
+		_, ok = table.Get("rs3131972")
+		assert.False(t, ok)
+		_, ok = table.Get("rs0")
+		assert.False(t, ok)
+
+		// First call wins on duplicates
+		genotype, _ = table.Get("rs9939609")
+		assert.Equal(t, "AT", genotype.Alleles)
+
+		table, err = tee.ParseGenotypes(strings.NewReader(sampleAncestryDNA))
+		assert.NoError(t, err)
+		genotype, _ = table.Get("rs1800")
+		assert.Equal(t, "MT", genotype.Chromosome)
+		assert.Equal(t, "ID", genotype.Alleles)
+		_, ok = table.Get("rs2229")
+		assert.False(t, ok)
+	})
+}
+
+func TestParseVCF(t *testing.T) {
+	const sample = `##fileformat=VCFv4.2
+##reference=file:///refs/GRCh38.fa
+##contig=<ID=chr1,length=248956422>
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	SAMPLE1	SAMPLE2
+chr1	752566	rs3094315	G	A	50	PASS	.	GT:GQ	0/1:99	1/1:99
+chr1	752721	rs3131972	A	G,T	60	PASS	.	GT	1|2	0/0
+chr1	800000	rs100	C	T	5	PASS	.	GT	1/1	0/0
+chr1	800001	rs101	C	T	50	LowQual	.	GT	1/1	0/0
+chr1	800002	rs102	C	T	.	.	.	GT	./.	0/0
+chr1	800003	.	C	G	50	PASS	.	GT	0/1	0/0
+chr1	800004	rs103;COSV1	CTT	C	50	PASS	.	GT	0/1	0/0
+chr1	800005	rs104	A	AT	50	PASS	.	GT	1/1	0/0
+chr1	800006	rs105	A	<DEL>	50	PASS	.	GT	0/1	0/0
+chrUn_KI270302v1	10	rs106	A	G	50	PASS	.	GT	0/1	0/0
+chrX	900000	rs107	A	G	50	PASS	.	GT	1	0
+`
+
+	assertTable := func(t *testing.T, table *tee.GenotypeTable) {
+		assert.Equal(t, tee.FormatVCF, table.Format)
+		assert.Equal(t, tee.BuildGRCh38, table.Build)
+		assert.Equal(t, 4, table.Skipped) // low QUAL, failed FILTER, symbolic, unplaced
+		assert.Equal(t, 1, table.NoCalls)
+
+		expected := map[string]string{
+			"rs3094315": "GA",
+			"rs3131972": "GT", // multi-allelic, both ALTs
+			"1:800003":  "CG", // no rsid
+			"rs103":     "ID", // deletion
+			"rs104":     "II", // insertion
+			"rs107":     "G",  // haploid
+		}
+		for rsid, alleles := range expected {
+			genotype, ok := table.Get(rsid)
+			assert.True(t, ok, rsid)
+			assert.Equal(t, alleles, genotype.Alleles, rsid)
+		}
+		_, ok := table.Get("rs102")
+		assert.False(t, ok)
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		table, err := tee.ParseGenomeData(strings.NewReader(sample), tee.DefaultVCFFilter)
+		assert.NoError(t, err)
+		assertTable(t, table)
+	})
+
+	t.Run("bgzip", func(t *testing.T) {
+		// bgzip writes independent gzip members, split the file in two
+		var compressed bytes.Buffer
+		half := len(sample) / 2
+		for _, part := range []string{sample[:half], sample[half:]} {
+			gz := gzip.NewWriter(&compressed)
+			_, err := gz.Write([]byte(part))
+			assert.NoError(t, err)
+			assert.NoError(t, gz.Close())
+		}
+
+		table, err := tee.ParseGenomeData(&compressed, tee.DefaultVCFFilter)
+		assert.NoError(t, err)
+		assertTable(t, table)
+	})
+
+	t.Run("text formats still detected", func(t *testing.T) {
+		table, err := tee.ParseGenomeData(strings.NewReader("rs1\t1\t100\tAG\n"), tee.DefaultVCFFilter)
+		assert.NoError(t, err)
+		assert.Equal(t, tee.Format23andMe, table.Format)
+	})
+
+	buildCases := []struct {
+		name   string
+		header string
+		build  string
+	}{
+		{"reference path", "##reference=file:///refs/human_g1k_v37.fasta", tee.BuildGRCh37},
+		{"contig assembly", "##contig=<ID=1,length=249250621,assembly=b37>", tee.BuildGRCh37},
+		{"assembly URL", "##assembly=ftp://ftp.ncbi.nlm.nih.gov/genomes/GRCh38.p14", tee.BuildGRCh38},
+		{"contig checksum", "##contig=<ID=chr1,length=248956422,md5=2648ae1b37d6d1a0b5a7a5b379e26a1f>", tee.BuildUnknown},
+		{"reference directory", "##reference=file:///b37/genome.fa", tee.BuildUnknown},
+		{"other header", "##source=hs37d5-pipeline", tee.BuildUnknown},
+	}
+	for _, tc := range buildCases {
+		t.Run(tc.name, func(t *testing.T) {
+			data := "##fileformat=VCFv4.2\n" + tc.header + "\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS\n" +
+				"1\t100\trs1\tA\tG\t50\tPASS\t.\tGT\t0/1\n"
+			table, err := tee.ParseGenomeData(strings.NewReader(data), tee.DefaultVCFFilter)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.build, table.Build)
+		})
+	}
+
+	errorCases := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"VCF 3", "##fileformat=VCFv3.3\n", "unsupported VCF version"},
+		{"no sample", "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n", "no sample column"},
+		{"no header", "##fileformat=VCFv4.1\n1\t1\trs1\tA\tG\t50\tPASS\t.\tGT\t0/1\n", "missing VCF header"},
+		{"bad GT", "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS\n1\t1\trs1\tA\tG\t50\tPASS\t.\tGT\t0/3\n", "invalid GT"},
+		{"no GT", "##fileformat=VCFv4.1\n#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS\n1\t1\trs1\tA\tG\t50\tPASS\t.\tGQ\t99\n", "no GT field"},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tee.ParseGenomeData(strings.NewReader(tc.data), tee.DefaultVCFFilter)
+			assert.ErrorContains(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestRiskEngine(t *testing.T) {
+	const scoringFile = `###PGS CATALOG SCORING FILE
+#format_version=2.0
+#pgs_id=PGS_TEST
+#genome_build=GRCh37
+rsID	chr_name	chr_position	effect_allele	other_allele	effect_weight	allelefrequency_effect
+rs1	1	100	A	G	1.0	0.5
+rs2	1	200	A	T	1.0	0.5
+rs3	1	300	AT	A	1.0	0.5
+	1	400	C	T	1.0	0.5
+rs5	1	500	G	C	1.0	0.5
+`
+	model, err := tee.LoadRiskModel(strings.NewReader(scoringFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "PGS_TEST", model.ID)
+	assert.Equal(t, tee.BuildGRCh37, model.Build)
+	assert.Len(t, model.Variants, 5)
+
+	engine, err := tee.NewRiskEngine(model, []float64{50, 80, 95}, 0.5)
+	assert.NoError(t, err)
+
+	score := func(t *testing.T, data string) *tee.RiskResult {
+		table, err := tee.ParseGenomeData(strings.NewReader(data), tee.DefaultVCFFilter)
+		assert.NoError(t, err)
+		result, err := engine.Score(table)
+		assert.NoError(t, err)
+		return result
+	}
+
+	t.Run("harmonization", func(t *testing.T) {
+		result := score(t, "# build 37\n"+
+			"rs1\t1\t100\tTC\n"+ // reverse strand A/G, one effect allele
+			"rs2\t1\t200\tAA\n"+ // palindromic, taken as forward
+			"rs3\t1\t300\tII\n"+ // insertion is the effect allele
+			"rs9\t1\t400\tCC\n"+ // matched by position, no rsID in the model
+			"rs5\t1\t500\tAC\n") // matches neither strand
+		assert.Equal(t, 4, result.Matched)
+		assert.Equal(t, 5, result.Total)
+		assert.InDelta(t, 0.8, result.Coverage, 1e-9)
+		assert.InDelta(t, 7.0, result.Score, 1e-9)
+	})
+
+	t.Run("VCF scored like text", func(t *testing.T) {
+		text := score(t, "# build 37\nrs1\t1\t100\tAG\nrs2\t1\t200\tTT\nrs3\t1\t300\tDI\n")
+		vcf := score(t, "##fileformat=VCFv4.2\n##reference=GRCh37\n"+
+			"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS\n"+
+			"1\t100\trs1\tG\tA\t50\tPASS\t.\tGT\t0/1\n"+
+			"1\t200\trs2\tT\tA\t50\tPASS\t.\tGT\t0/0\n"+
+			"1\t300\trs3\tA\tAT\t50\tPASS\t.\tGT\t0/1\n")
+		assert.Equal(t, text.Score, vcf.Score)
+		assert.Equal(t, text.Percentile, vcf.Percentile)
+		assert.Equal(t, text.Category, vcf.Category)
+	})
+
+	t.Run("percentiles map onto categories", func(t *testing.T) {
+		// 3 covered variants with p=0.5: mean 3, sd sqrt(1.5)
+		testCases := []struct {
+			genotypes string
+			category  int
+		}{
+			{"rs1\t1\t100\tGG\nrs2\t1\t200\tTT\nrs3\t1\t300\tDD\n", 1},
+			{"rs1\t1\t100\tAG\nrs2\t1\t200\tAT\nrs3\t1\t300\tDI\n", 2},
+			{"rs1\t1\t100\tAA\nrs2\t1\t200\tAT\nrs3\t1\t300\tII\n", 3},
+			{"rs1\t1\t100\tAA\nrs2\t1\t200\tAA\nrs3\t1\t300\tII\n", 4},
+		}
+		for _, tc := range testCases {
+			assert.Equal(t, tc.category, score(t, tc.genotypes).Category, tc.genotypes)
+		}
+	})
+
+	t.Run("insufficient coverage", func(t *testing.T) {
+		table, err := tee.ParseGenotypes(strings.NewReader("rs1\t1\t100\tAG\nrs7\t1\t700\tAG\n"))
+		assert.NoError(t, err)
+		_, err = engine.Score(table)
+		assert.ErrorContains(t, err, "insufficient variant coverage")
+	})
+
+	t.Run("reference distribution", func(t *testing.T) {
+		noFrequencies := "#pgs_id=PGS_NOFREQ\nrsID\teffect_allele\teffect_weight\nrs1\tA\t1.0\n"
+		model, err := tee.LoadRiskModel(strings.NewReader(noFrequencies))
+		assert.NoError(t, err)
+		_, err = tee.NewRiskEngine(model, tee.DefaultRiskPercentiles, 1)
+		assert.ErrorContains(t, err, "reference distribution")
+
+		model, err = tee.LoadRiskModel(strings.NewReader("#reference_mean=1\n#reference_sd=0.5\n" + noFrequencies))
+		assert.NoError(t, err)
+		engine, err := tee.NewRiskEngine(model, tee.DefaultRiskPercentiles, 1)
+		assert.NoError(t, err)
+
+		table, err := tee.ParseGenotypes(strings.NewReader("rs1\t1\t100\tAA\n"))
+		assert.NoError(t, err)
+		result, err := engine.Score(table)
+		assert.NoError(t, err)
+		assert.InDelta(t, 97.72, result.Percentile, 0.01) // z = 2
+		assert.Equal(t, 4, result.Category)
+	})
+
+	t.Run("gzip scoring file", func(t *testing.T) {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write([]byte(scoringFile))
+		gz.Close()
+
+		model, err := tee.LoadRiskModel(&compressed)
+		assert.NoError(t, err)
+		assert.Len(t, model.Variants, 5)
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		_, err := tee.NewRiskEngine(model, []float64{80, 50, 95}, 0.5)
+		assert.Error(t, err)
+		_, err = tee.NewRiskEngine(model, []float64{50, 80}, 0.5)
+		assert.Error(t, err)
+		_, err = tee.NewRiskEngine(model, tee.DefaultRiskPercentiles, 2)
+		assert.Error(t, err)
+		_, err = tee.NewRiskEngineFromSettings(model, &config.TEESettings{RiskPercentiles: []float64{50, 100, 120}})
+		assert.Error(t, err)
+		_, err = tee.LoadRiskModel(strings.NewReader("rsID\teffect_allele\teffect_weight\nrs1\tA\t1.0\n"))
+		assert.ErrorContains(t, err, "pgs_id")
+	})
+}
+
+func TestModelRegistry(t *testing.T) {
+	const scoringFile = `#pgs_id=PGS_TEST
+#model_version=2
+#genome_build=GRCh37
+rsID	effect_allele	other_allele	effect_weight	allelefrequency_effect
+rs2107595	A	G	1.0	0.2
+rs2383207	G	A	1.0	0.5
+`
+	path := filepath.Join(t.TempDir(), "PGS_TEST.txt")
+	assert.NoError(t, os.WriteFile(path, []byte(scoringFile), 0o600))
+
+	settings := &config.TEESettings{
+		RiskModelPaths: []string{path},
+		ProductModels:  []string{"legacy=GDAO_STROKE_PANEL@1"},
+	}
+	registry, err := tee.NewModelRegistryFromSettings(settings)
+	assert.NoError(t, err)
+	assert.Len(t, registry.Models(), 2)
+
+	// The last configured file becomes the default
+	model, err := registry.Resolve("")
+	assert.NoError(t, err)
+	assert.Equal(t, "PGS_TEST@2", tee.ModelID(model))
+
+	model, err = registry.Resolve("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, "GDAO_STROKE_PANEL@1", tee.ModelID(model))
+
+	_, err = registry.Resolve("diabetes")
+	assert.ErrorIs(t, err, tee.ErrUnknownProduct)
+
+	// A changed model can't reuse a registered version
+	changed, err := tee.LoadRiskModel(strings.NewReader(strings.Replace(scoringFile, "1.0", "2.0", 1)))
+	assert.NoError(t, err)
+	engine, err := tee.NewRiskEngine(changed, tee.DefaultRiskPercentiles, 0)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, registry.Register(engine), "already registered")
+
+	// The hash covers the thresholds too
+	original, err := tee.LoadRiskModel(strings.NewReader(scoringFile))
+	assert.NoError(t, err)
+	strict, err := tee.NewRiskEngine(original, []float64{40, 70, 90}, 0)
+	assert.NoError(t, err)
+	lenient, err := tee.NewRiskEngine(original, tee.DefaultRiskPercentiles, 0)
+	assert.NoError(t, err)
+	assert.NotEqual(t, strict.Hash(), lenient.Hash())
+
+	invalid := []*config.TEESettings{
+		{DefaultModel: "PGS_MISSING@1"},
+		{ProductModels: []string{"stroke"}},
+		{RiskModelPaths: []string{"missing.txt"}},
+	}
+	for _, settings := range invalid {
+		_, err := tee.NewModelRegistryFromSettings(settings)
+		assert.Error(t, err)
+	}
+
+	t.Run("service picks the product's model", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		service, err := tee.NewTEEService(store, settings)
+		assert.NoError(t, err)
+
+		encrypted, err := attestedEncoder(t, service).EncryptGeneData(readGeneData(t, "bob.txt"))
+		assert.NoError(t, err)
+		fileHash, err := store.Store(encrypted)
+		assert.NoError(t, err)
+
+		models, products := service.GetModels()
+		assert.Len(t, models, 2)
+		assert.Equal(t, "GDAO_STROKE_PANEL@1", products["legacy"])
+
+		for product, expected := range map[string]string{"": "PGS_TEST@2", "legacy": "GDAO_STROKE_PANEL@1"} {
+			result, err := service.ProcessGeneData(fileHash, "1", product)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, result.ModelID)
+
+			model, _ := registry.Get(expected)
+			assert.Equal(t, model.Hash(), result.ModelHash)
+		}
+
+		_, err = service.ProcessGeneData(fileHash, "1", "diabetes")
+		assert.ErrorIs(t, err, tee.ErrUnknownProduct)
+	})
+}
+
+// wasmModel assembles a model looking up rs2383207, with the given imports
+// (module, name, type index) and score body
+func wasmModel(name string, imports [][3]string, body []byte) []byte {
+	vec := func(items ...[]byte) []byte {
+		out := []byte{byte(len(items))}
+		for _, item := range items {
+			out = append(out, item...)
+		}
+		return out
+	}
+	str := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	section := func(id byte, content []byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+
+	var importItems [][]byte
+	for _, imp := range imports {
+		item := append(str(imp[0]), str(imp[1])...)
+		importItems = append(importItems, append(item, 0x00, imp[2][0]-'0'))
+	}
+	score := byte(len(imports))
+
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, vec(
+		[]byte{0x60, 0x03, 0x7f, 0x7f, 0x7f, 0x01, 0x7f},       // genotype
+		[]byte{0x60, 0x05, 0x7c, 0x7c, 0x7f, 0x7f, 0x7f, 0x00}, // result
+		[]byte{0x60, 0x00, 0x00},                               // score
+	))...)
+	module = append(module, section(2, vec(importItems...))...)
+	module = append(module, section(3, vec([]byte{0x02}))...)
+	module = append(module, section(5, vec([]byte{0x00, 0x01}))...)
+	module = append(module, section(7, vec(
+		append(str("memory"), 0x02, 0x00),
+		append(str("score"), 0x00, score),
+	))...)
+	module = append(module, section(10, vec(append([]byte{byte(len(body))}, body...)))...)
+	module = append(module, section(11, vec(
+		append([]byte{0x00, 0x41, 0x00, 0x0b}, str("rs2383207")...),
+	))...)
+	return append(module, section(0, append(str("genomic_model"), name...))...)
+}
+
+func TestWasmModel(t *testing.T) {
+	host := [][3]string{{"genomic", "genotype", "0"}, {"genomic", "result", "1"}}
+
+	// n = genotype("rs2383207", out=64)
+	// result(first allele, 50, n+1, n/2, 1)
+	lookup := []byte{
+		0x01, 0x01, 0x7f, // one i32 local
+		0x41, 0x00, 0x41, 0x09, 0x41, 0xc0, 0x00, 0x10, 0x00, 0x21, 0x00,
+		0x41, 0x00, 0x2d, 0x00, 0xc0, 0x00, 0xb8,
+		0x44, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x49, 0x40,
+		0x20, 0x00, 0x41, 0x01, 0x6a,
+		0x20, 0x00, 0x41, 0x02, 0x6e,
+		0x41, 0x01,
+		0x10, 0x01,
+		0x0b,
+	}
+	// loop br 0 end
+	spin := []byte{0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b}
+	// loop i64.const 1000 global.set 0 br 0 end, refilling the fuel global
+	refill := []byte{0x00, 0x03, 0x40, 0x42, 0xe8, 0x07, 0x24, 0x00, 0x0c, 0x00, 0x0b, 0x0b}
+	// memory.fill(0, 0, 65536)
+	fill := []byte{0x00, 0x41, 0x00, 0x41, 0x00, 0x41, 0x80, 0x80, 0x04, 0xfc, 0x0b, 0x00, 0x0b}
+	// calls the host without reporting a result
+	silent := []byte{0x00, 0x0b}
+
+	table, err := tee.ParseGenotypes(bytes.NewReader(readGeneData(t, "alice.txt")))
+	assert.NoError(t, err)
+	empty, err := tee.ParseGenotypes(strings.NewReader("rs1\t1\t100\tAA\n"))
+	assert.NoError(t, err)
+
+	binary := wasmModel("WASM_TEST@1", host, lookup)
+	model, err := tee.NewWasmModel(binary, 0)
+	assert.NoError(t, err)
+	defer model.Close()
+	assert.Equal(t, "WASM_TEST@1", tee.ModelID(model))
+
+	result, err := model.Score(table)
+	assert.NoError(t, err)
+	assert.Equal(t, float64('A'), result.Score)
+	assert.Equal(t, 50.0, result.Percentile)
+	assert.Equal(t, 3, result.Category)
+	assert.Equal(t, 1.0, result.Coverage)
+	assert.Equal(t, "WASM_TEST@1", result.ModelID)
+
+	result, err = model.Score(empty)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Category)
+	assert.Equal(t, 0.0, result.Coverage)
+
+	t.Run("instruction limit", func(t *testing.T) {
+		model, err := tee.NewWasmModel(wasmModel("SPIN@1", host, spin), 10_000)
+		assert.NoError(t, err)
+		defer model.Close()
+
+		_, err = model.Score(table)
+		assert.ErrorIs(t, err, tee.ErrInstructionLimit)
+
+		// The lookups are metered too
+		model, err = tee.NewWasmModel(binary, 50)
+		assert.NoError(t, err)
+		defer model.Close()
+		_, err = model.Score(table)
+		assert.ErrorIs(t, err, tee.ErrInstructionLimit)
+
+		// The fuel global doesn't exist for the model as written
+		_, err = tee.NewWasmModel(wasmModel("REFILL@1", host, refill), 1000)
+		assert.ErrorContains(t, err, "invalid model")
+
+		// Bulk memory instructions are charged their length
+		model, err = tee.NewWasmModel(wasmModel("FILL@1", host, fill), 10_000)
+		assert.NoError(t, err)
+		defer model.Close()
+		_, err = model.Score(table)
+		assert.ErrorIs(t, err, tee.ErrInstructionLimit)
+
+		model, err = tee.NewWasmModel(wasmModel("FILL@1", host, fill), 100_000)
+		assert.NoError(t, err)
+		defer model.Close()
+		_, err = model.Score(table)
+		assert.ErrorContains(t, err, "no result")
+	})
+
+	t.Run("sandbox", func(t *testing.T) {
+		// No WASI, so no filesystem, network or clock
+		wasi := [][3]string{{"genomic", "genotype", "0"}, {"wasi_snapshot_preview1", "fd_write", "0"}}
+		_, err := tee.NewWasmModel(wasmModel("WASI@1", wasi, silent), 0)
+		assert.ErrorContains(t, err, "only genomic is available")
+
+		_, err = tee.NewWasmModel(wasmModel("", host, lookup), 0)
+		assert.ErrorContains(t, err, "name@version")
+
+		model, err := tee.NewWasmModel(wasmModel("SILENT@1", host, silent), 0)
+		assert.NoError(t, err)
+		defer model.Close()
+		_, err = model.Score(table)
+		assert.ErrorContains(t, err, "no result")
+	})
+
+	t.Run("loaded by hash", func(t *testing.T) {
+		dir := t.TempDir()
+		sum := sha256.Sum256(binary)
+		hash := hex.EncodeToString(sum[:])
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, hash+".wasm"), binary, 0o600))
+
+		model, err := tee.LoadWasmModel(dir, "0x"+hash, 0)
+		assert.NoError(t, err)
+		defer model.Close()
+		assert.Equal(t, "0x"+hash, model.Hash())
+
+		registry, err := tee.NewModelRegistryFromSettings(&config.TEESettings{
+			WasmModelDir:  dir,
+			WasmModels:    []string{hash},
+			ProductModels: []string{"wasm=WASM_TEST@1"},
+		})
+		assert.NoError(t, err)
+		resolved, err := registry.Resolve("wasm")
+		assert.NoError(t, err)
+
+		// The result of the TEE carries the hash the model was loaded by
+		enclave := tee.NewTEE()
+		encrypted, err := enclaveEncoder(t, enclave).EncryptGeneData(readGeneData(t, "alice.txt"))
+		assert.NoError(t, err)
+		geneData, err := enclave.ProcessWithModel(encrypted, "alice", resolved)
+		assert.NoError(t, err)
+		assert.Equal(t, "WASM_TEST@1", geneData.ModelID)
+		assert.Equal(t, "0x"+hash, geneData.ModelHash)
+		assert.Equal(t, 3, geneData.RiskScore)
+
+		// A file that doesn't match its name is rejected
+		other := hex.EncodeToString(make([]byte, 32))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, other+".wasm"), binary, 0o600))
+		_, err = tee.LoadWasmModel(dir, other, 0)
+		assert.ErrorContains(t, err, "does not match")
+
+		_, err = tee.LoadWasmModel(dir, "../"+hash, 0)
+		assert.ErrorContains(t, err, "invalid model hash")
+	})
+}
+
+// syntheticGenome pads a 23andMe file with filler SNPs to about size bytes
+func syntheticGenome(w io.Writer, genome []byte, size int) error {
+	if _, err := w.Write(genome); err != nil {
+		return err
+	}
+	written := len(genome)
+	for i := 0; written < size; i++ {
+		n, err := fmt.Fprintf(w, "rs%d\t%d\t%d\tAG\n", 100000000+i, i%22+1, 1000+i)
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
+
+func TestChunkedEnvelope(t *testing.T) {
+	enclave := tee.NewTEE()
+	model, err := enclave.Models().Resolve("")
+	assert.NoError(t, err)
+	data := readGeneData(t, "alice.txt")
+
+	for _, cipher := range []teesdk.Cipher{teesdk.CipherAESGCM, teesdk.CipherChaCha20Poly1305} {
+		for _, chunkSize := range []int{64, len(data) / 4, len(data), teesdk.DefaultChunkSize} {
+			user := enclaveEncoder(t, enclave).WithCipher(cipher).WithChunkSize(chunkSize)
+			encrypted, err := user.EncryptGeneData(data)
+			assert.NoError(t, err)
+			assert.True(t, teesdk.IsChunked(encrypted))
+
+			geneData, err := enclave.ProcessEncryptedData(encrypted, "alice")
+			assert.NoError(t, err)
+			assert.Equal(t, 4, geneData.RiskScore)
+			salt, _ := hexutil.Decode(geneData.Salt)
+			assert.Equal(t, teesdk.ContentHash(data, salt), geneData.ContentHash)
+		}
+	}
+
+	user := enclaveEncoder(t, enclave).WithChunkSize(128)
+	encrypted, err := user.EncryptGeneData(data)
+	assert.NoError(t, err)
+
+	header, err := teesdk.ReadChunkedHeader(bytes.NewReader(encrypted))
+	assert.NoError(t, err)
+	assert.Equal(t, enclave.GetKeyID(), header.KeyID)
+	assert.Equal(t, teesdk.CipherAESGCM, header.Cipher)
+	encoded, err := header.Bytes()
+	assert.NoError(t, err)
+	chunk := func(i int) int { return len(encoded) + i*(128+16) }
+
+	t.Run("corrupted chunks are named", func(t *testing.T) {
+		corrupted := append([]byte{}, encrypted...)
+		corrupted[chunk(2)+10] ^= 0x01
+		_, err := enclave.ProcessWithModel(corrupted, "alice", model)
+		var chunkErr *teesdk.ChunkError
+		assert.ErrorAs(t, err, &chunkErr)
+		assert.Equal(t, uint64(2), chunkErr.Index)
+
+		// Swapped chunks fail on their index
+		swapped := append([]byte{}, encrypted[:chunk(1)]...)
+		swapped = append(swapped, encrypted[chunk(2):chunk(3)]...)
+		swapped = append(swapped, encrypted[chunk(1):chunk(2)]...)
+		swapped = append(swapped, encrypted[chunk(3):]...)
+		_, err = enclave.ProcessWithModel(swapped, "alice", model)
+		assert.ErrorAs(t, err, &chunkErr)
+		assert.Equal(t, uint64(1), chunkErr.Index)
+
+		// So does an envelope cut at a chunk boundary, the last chunk is marked
+		_, err = enclave.ProcessWithModel(encrypted[:chunk(3)], "alice", model)
+		assert.ErrorAs(t, err, &chunkErr)
+		assert.Equal(t, uint64(2), chunkErr.Index)
+
+		_, err = enclave.ProcessWithModel(append(append([]byte{}, encrypted...), 0), "alice", model)
+		assert.ErrorAs(t, err, &chunkErr)
+	})
+
+	t.Run("rotation rewraps the data key", func(t *testing.T) {
+		rotating := tee.NewTEE()
+		encrypted, err := enclaveEncoder(t, rotating).EncryptGeneData(data)
+		assert.NoError(t, err)
+		before, err := teesdk.ReadChunkedHeader(bytes.NewReader(encrypted))
+		assert.NoError(t, err)
+		beforeSize, _ := before.Bytes()
+
+		_, rewrapped, err := rotating.RewrapHeader(bytes.NewReader(encrypted))
+		assert.NoError(t, err)
+		assert.False(t, rewrapped)
+
+		_, err = rotating.Keyring().Rotate()
+		assert.NoError(t, err)
+		header, rewrapped, err := rotating.RewrapHeader(bytes.NewReader(encrypted))
+		assert.NoError(t, err)
+		assert.True(t, rewrapped)
+
+		// Only the header changes, the chunks are kept as they are
+		after, err := teesdk.ReadChunkedHeader(bytes.NewReader(header))
+		assert.NoError(t, err)
+		assert.Equal(t, rotating.GetKeyID(), after.KeyID)
+		reencrypted := append(header, encrypted[len(beforeSize):]...)
+
+		geneData, err := rotating.ProcessEncryptedData(reencrypted, "alice")
+		assert.NoError(t, err)
+		assert.Equal(t, 4, geneData.RiskScore)
+	})
+
+	t.Run("whole-file envelopes still decrypt", func(t *testing.T) {
+		key := enclave.Keyring().Current()
+		payload, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(&key.PrivateKey.PublicKey), data, nil, nil)
+		assert.NoError(t, err)
+		id, _ := hex.DecodeString(key.ID)
+		legacy := append(append([]byte("GTEE\x01"), id...), payload...)
+
+		geneData, err := enclave.ProcessEncryptedData(legacy, "alice")
+		assert.NoError(t, err)
+		assert.Equal(t, 4, geneData.RiskScore)
+	})
+
+	t.Run("large files stream", func(t *testing.T) {
+		const size = 40 * 1024 * 1024
+		if testing.Short() {
+			t.Skip("streams 40MB")
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			encrypter, err := enclaveEncoder(t, enclave).NewEncryptWriter(writer)
+			if err == nil {
+				err = syntheticGenome(encrypter, data, size)
+			}
+			if err == nil {
+				err = encrypter.Close()
+			}
+			writer.CloseWithError(err)
+		}()
+
+		geneData, err := enclave.ProcessStream(reader, "large", model)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, geneData.RiskScore)
+
+		salt, _ := hexutil.Decode(geneData.Salt)
+		hasher := teesdk.NewContentHasher(salt)
+		assert.NoError(t, syntheticGenome(hasher, data, size))
+		assert.Equal(t, hasher.Sum(), geneData.ContentHash)
+	})
+}
+
+func TestWorkerRPC(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	service, err := tee.NewTEEService(store, &config.TEESettings{})
+	assert.NoError(t, err)
+
+	socket := filepath.Join(t.TempDir(), "worker.sock")
+	serve := func() net.Listener {
+		listener, err := tee.ListenUnix(socket)
+		assert.NoError(t, err)
+		go tee.ServeRPC(listener, service)
+		return listener
+	}
+	listener := serve()
+
+	// The socket is private to the worker's user
+	stat, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), stat.Mode().Perm())
+
+	client := tee.NewClient(socket)
+	defer client.Close()
+
+	info, err := client.GetInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, currentInfo(t, service), info)
+
+	encrypted, err := attestedEncoder(t, client).WithChunkSize(128).EncryptGeneData(readGeneData(t, "bob.txt"))
+	assert.NoError(t, err)
+	fileHash, err := store.Store(encrypted)
+	assert.NoError(t, err)
+
+	result, err := client.ProcessGeneData(fileHash, "7", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.RiskScore)
+	assert.NoError(t, teesdk.VerifyClaim(&teesdk.Claim{
+		DocID:       result.DocID,
+		ContentHash: result.ContentHash,
+		SessionID:   big.NewInt(7),
+		RiskScore:   big.NewInt(int64(result.RiskScore)),
+		ModelID:     result.ModelID,
+		ModelHash:   common.HexToHash(result.ModelHash),
+	}, common.FromHex(result.Proof), common.HexToAddress(info.Signer)))
+
+	catalog, err := client.GetModelCatalog()
+	assert.NoError(t, err)
+	assert.Equal(t, "GDAO_STROKE_PANEL@1", catalog.Products[tee.DefaultProduct])
+
+	document, err := client.GetAttestation("nonce")
+	assert.NoError(t, err)
+	assert.NoError(t, document.Verify(teesdk.AttestationPolicy{
+		RootPublicKey:       info.AttestationRoot,
+		AllowedMeasurements: []string{info.Measurement},
+		Nonce:               "nonce",
+	}))
+
+	t.Run("errors keep their meaning", func(t *testing.T) {
+		_, err := client.ProcessGeneData(fileHash, "7", "diabetes")
+		assert.ErrorIs(t, err, tee.ErrUnknownProduct)
+
+		corrupted := append([]byte{}, encrypted...)
+		corrupted[len(corrupted)-1] ^= 0x01
+		corruptedHash, err := store.Store(corrupted)
+		assert.NoError(t, err)
+		_, err = client.ProcessGeneData(corruptedHash, "8", "")
+		var chunkErr *teesdk.ChunkError
+		assert.ErrorAs(t, err, &chunkErr)
+
+		assert.Error(t, client.RetireKey(info.KeyID))
+	})
+
+	t.Run("client reconnects to a restarted worker", func(t *testing.T) {
+		listener.Close()
+		_, err := client.GetInfo()
+		assert.Error(t, err)
+
+		listener = serve()
+		defer listener.Close()
+		_, err = client.GetInfo()
+		assert.NoError(t, err)
+	})
+}
@@ -1,5 +1,55 @@
 package tee
 
-type Processor interface {
-	ProcessGeneData(fileHash string) (int, error)
+import (
+	"genomic-service/internal/types"
+	teesdk "genomic-service/pkg/tee"
+)
+
+// Model is a versioned risk model the TEE can score genomes with
+type Model interface {
+	Name() string
+	Version() string
+	Hash() string // 0x-prefixed SHA-256 of everything that determines the score
+	Score(table *GenotypeTable) (*RiskResult, error)
+}
+
+// ModelID identifies a model as name@version
+func ModelID(model Model) string {
+	return model.Name() + "@" + model.Version()
+}
+
+// Service is the contract between the gateway and the TEE. TEEService
+// implements it in-process, Client talks to a tee-worker holding the keys and
+// plaintext, so the gateway only ever sees ciphertext and signed results.
+type Service interface {
+	ProcessGeneData(fileHash, sessionID, product string) (*types.ProcessResult, error)
+	GetInfo() (*Info, error)
+	GetAttestation(nonce string) (*teesdk.AttestationDocument, error)
+	GetModelCatalog() (*ModelCatalog, error)
+	RotateKey() (string, error)
+	ReencryptAll() (*ReencryptReport, error)
+	RetireKey(keyID string) error
+}
+
+// Info describes the current TEE key and what clients pin to trust it
+type Info struct {
+	PublicKey       string // hex, compressed
+	KeyID           string
+	Signer          string // address signing proofs
+	AttestationRoot string
+	Measurement     string
+}
+
+// ModelInfo describes a registered model without its content
+type ModelInfo struct {
+	ID      string
+	Name    string
+	Version string
+	Hash    string
+}
+
+// ModelCatalog lists the registered models and the product mapping
+type ModelCatalog struct {
+	Models   []ModelInfo
+	Products map[string]string
 }
@@ -0,0 +1,296 @@
+package tee
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxVCFLine bounds a single record, INFO columns of annotated VCFs get long
+const maxVCFLine = 1024 * 1024
+
+// VCFFilter decides which VCF records are trusted enough to score
+type VCFFilter struct {
+	MinQual float64 // records with a lower QUAL are skipped, "." always passes
+}
+
+// DefaultVCFFilter keeps PASS records with a phred quality of at least 20
+var DefaultVCFFilter = VCFFilter{MinQual: 20}
+
+// ParseGenomeData detects the kind of lab output and parses it into a
+// genotype table: VCF 4.x, plain or bgzip-compressed, or a consumer raw data
+// file. Both kinds end up in the same model, so they are scored the same way.
+func ParseGenomeData(r io.Reader, filter VCFFilter) (*GenotypeTable, error) {
+	reader := bufio.NewReader(r)
+
+	magic, _ := reader.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		// bgzip is a series of gzip members, which gzip reads as one stream
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip data: %v", err)
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+
+	prefix, _ := reader.Peek(len("##fileformat=VCF"))
+	if string(prefix) == "##fileformat=VCF" {
+		return ParseVCF(reader, filter)
+	}
+	return ParseGenotypes(reader)
+}
+
+// ParseVCF reads a single-sample VCF 4.x file, or the first sample of a
+// multi-sample one. Records failing FILTER/QUAL, calls on symbolic alleles and
+// unplaced contigs are skipped and counted, malformed lines are errors.
+func ParseVCF(r io.Reader, filter VCFFilter) (*GenotypeTable, error) {
+	table := &GenotypeTable{Format: FormatVCF, Variants: make(map[string]Genotype)}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxVCFLine)
+
+	lineNo := 0
+	sawFormat, sawHeader := false, false
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "##") {
+			if strings.HasPrefix(line, "##fileformat=") {
+				if !strings.HasPrefix(line, "##fileformat=VCFv4") {
+					return nil, fmt.Errorf("unsupported VCF version: %s", strings.TrimPrefix(line, "##fileformat="))
+				}
+				sawFormat = true
+			}
+			if table.Build == BuildUnknown {
+				table.Build = vcfBuild(line)
+			}
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if strings.HasPrefix(line, "#CHROM") {
+			if len(fields) < 10 {
+				return nil, fmt.Errorf("line %d: VCF has no sample column", lineNo)
+			}
+			sawHeader = true
+			continue
+		}
+
+		if !sawFormat || !sawHeader {
+			return nil, fmt.Errorf("line %d: missing VCF header", lineNo)
+		}
+
+		genotype, ok, err := parseVCFRecord(fields, filter)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if !ok {
+			table.Skipped++
+			continue
+		}
+		table.add(genotype)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read VCF: %v", err)
+	}
+
+	if len(table.Variants) == 0 {
+		return nil, fmt.Errorf("no genotypes found")
+	}
+	return table, nil
+}
+
+// parseVCFRecord normalizes a record of the first sample. It returns false
+// for records that are filtered out or can't be expressed as a genotype.
+func parseVCFRecord(fields []string, filter VCFFilter) (Genotype, bool, error) {
+	if len(fields) < 10 {
+		return Genotype{}, false, fmt.Errorf("expected at least 10 columns, got %d", len(fields))
+	}
+	chrom, pos, id, ref, alt, qual, filterCol, format, sample :=
+		fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6], fields[8], fields[9]
+
+	position, err := strconv.ParseUint(pos, 10, 64)
+	if err != nil {
+		return Genotype{}, false, fmt.Errorf("invalid position %q", pos)
+	}
+
+	if filterCol != "PASS" && filterCol != "." {
+		return Genotype{}, false, nil
+	}
+	if qual != "." {
+		score, err := strconv.ParseFloat(qual, 64)
+		if err != nil {
+			return Genotype{}, false, fmt.Errorf("invalid QUAL %q", qual)
+		}
+		if score < filter.MinQual {
+			return Genotype{}, false, nil
+		}
+	}
+
+	chromosome, err := normalizeChromosome(chrom)
+	if err != nil {
+		// Unplaced contigs and decoys can't be scored
+		return Genotype{}, false, nil
+	}
+
+	// Allele 0 is REF, 1.. are the comma separated ALTs of a multi-allelic site
+	alleles := []string{strings.ToUpper(ref)}
+	if alt != "." {
+		alleles = append(alleles, strings.Split(strings.ToUpper(alt), ",")...)
+	}
+
+	gt, err := sampleGT(format, sample)
+	if err != nil {
+		return Genotype{}, false, err
+	}
+
+	genotype := Genotype{
+		RSID:       vcfVariantID(id, chromosome, position),
+		Chromosome: chromosome,
+		Position:   position,
+	}
+
+	calls := strings.FieldsFunc(gt, func(r rune) bool { return r == '/' || r == '|' })
+	if len(calls) == 0 || len(calls) > 2 {
+		return Genotype{}, false, fmt.Errorf("invalid GT %q", gt)
+	}
+
+	var called strings.Builder
+	for _, call := range calls {
+		if call == "." {
+			// Any missing allele makes it a no-call, like a half call in text files
+			genotype.NoCall = true
+			return genotype, true, nil
+		}
+		index, err := strconv.Atoi(call)
+		if err != nil || index < 0 || index >= len(alleles) {
+			return Genotype{}, false, fmt.Errorf("invalid GT %q", gt)
+		}
+		code, ok := alleleCode(alleles, index)
+		if !ok {
+			return Genotype{}, false, nil
+		}
+		called.WriteString(code)
+	}
+
+	genotype.Alleles = called.String()
+	return genotype, true, nil
+}
+
+// sampleGT returns the GT field of a sample column
+func sampleGT(format, sample string) (string, error) {
+	keys := strings.Split(format, ":")
+	values := strings.Split(sample, ":")
+	for i, key := range keys {
+		if key != "GT" {
+			continue
+		}
+		if i >= len(values) {
+			return ".", nil
+		}
+		return values[i], nil
+	}
+	return "", fmt.Errorf("record has no GT field")
+}
+
+// vcfVariantID returns the rsid of a record, or "chromosome:position" when
+// the ID column is empty. Records merged from several sources may list
+// multiple IDs, the first rsid wins.
+func vcfVariantID(id, chromosome string, position uint64) string {
+	for _, candidate := range strings.Split(id, ";") {
+		candidate = strings.ToLower(candidate)
+		if strings.HasPrefix(candidate, "rs") {
+			return candidate
+		}
+	}
+	return positionKey(chromosome, position)
+}
+
+// alleleCode turns a called allele into the single letter the text formats
+// use: the base for SNVs, and I/D at indel sites relative to the other
+// alleles, the way consumer chips report them. MNPs and symbolic alleles have
+// no such form.
+func alleleCode(alleles []string, index int) (string, bool) {
+	allele := alleles[index]
+	if strings.HasPrefix(allele, "<") || allele == "*" {
+		return "", false
+	}
+
+	ref := alleles[0]
+	indel := false
+	for _, other := range alleles[1:] {
+		if !strings.HasPrefix(other, "<") && other != "*" && len(other) != len(ref) {
+			indel = true
+		}
+	}
+
+	if !indel {
+		if len(allele) != 1 || !validAlleles(allele) {
+			return "", false
+		}
+		return allele, true
+	}
+
+	if len(allele) > len(ref) {
+		return "I", true
+	}
+	if len(allele) < len(ref) {
+		return "D", true
+	}
+
+	// REF itself at an indel site, named by what the ALTs do to it
+	if index != 0 {
+		return "", false
+	}
+	for _, other := range alleles[1:] {
+		switch {
+		case len(other) > len(ref):
+			return "D", true
+		case len(other) < len(ref):
+			return "I", true
+		}
+	}
+	return "", false
+}
+
+// vcfBuild reads the build from the file name of ##reference and ##assembly,
+// or the assembly field of ##contig. Other fields, like contig checksums,
+// are never looked at.
+func vcfBuild(line string) string {
+	key, value, ok := strings.Cut(strings.TrimPrefix(line, "##"), "=")
+	if !ok {
+		return BuildUnknown
+	}
+
+	switch key {
+	case "reference", "assembly":
+		// A path or URL, only its file name names the build
+		value = value[strings.LastIndex(value, "/")+1:]
+	case "contig":
+		value = headerField(value, "assembly")
+	default:
+		return BuildUnknown
+	}
+	return detectBuild(strings.ToLower(value))
+}
+
+// headerField returns a field of a structured header value like
+// <ID=chr1,length=248956422,assembly=b37>
+func headerField(value, name string) string {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+	for _, field := range strings.Split(value, ",") {
+		if key, v, ok := strings.Cut(field, "="); ok && key == name {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
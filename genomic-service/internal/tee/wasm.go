@@ -0,0 +1,307 @@
+package tee
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// DefaultWasmMaxInstructions caps a single scoring run of a WASM model
+const DefaultWasmMaxInstructions = 100_000_000
+
+// wasmMemoryLimitPages caps model memory at 16 MiB
+const wasmMemoryLimitPages = 256
+
+// wasmRunTimeout bounds a scoring run in wall time, on top of the instruction
+// budget
+const wasmRunTimeout = time.Minute
+
+// wasmHostCallCost is charged against the instruction budget per host call
+const wasmHostCallCost = 100
+
+// wasmHostModule is the only module a model may import from
+const wasmHostModule = "genomic"
+
+// ErrInstructionLimit is returned when a model runs out of its instruction budget
+var ErrInstructionLimit = errors.New("model exceeded its instruction limit")
+
+var wasmHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// WasmModel is a risk model compiled to WebAssembly and run in a sandbox.
+//
+// A model exports its memory and a "score" function taking no arguments, and
+// may import only these functions of the "genomic" module, so it has no
+// network, filesystem, clock or randomness:
+//
+//	genotype(rsid_ptr, rsid_len, out_ptr i32) i32
+//	genotype_at(chrom_ptr, chrom_len i32, position i64, out_ptr i32) i32
+//	result(score, percentile f64, category, matched, total i32)
+//
+// The lookups write the called alleles (at most 2 bytes) to out_ptr and
+// return their length, 0 when the variant is missing or not called. score
+// must call result exactly once. The model names itself with a custom section
+// "genomic_model" holding "name@version".
+type WasmModel struct {
+	name    string
+	version string
+	hash    string
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// wasmRun is the state of one scoring run the host functions work on
+type wasmRun struct {
+	table  *GenotypeTable
+	result *RiskResult
+}
+
+type wasmRunKey struct{}
+
+// LoadWasmModel loads the model with the given SHA-256 from dir, where it is
+// stored as <hash>.wasm. The content must match the hash, so the file can't be
+// swapped for another model.
+func LoadWasmModel(dir, hash string, maxInstructions uint64) (*WasmModel, error) {
+	hash = strings.ToLower(strings.TrimPrefix(hash, "0x"))
+	if !wasmHashPattern.MatchString(hash) {
+		return nil, fmt.Errorf("invalid model hash %q", hash)
+	}
+
+	binary, err := os.ReadFile(filepath.Join(dir, hash+".wasm"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model: %v", err)
+	}
+	if sum := sha256.Sum256(binary); hexutil.Encode(sum[:]) != "0x"+hash {
+		return nil, fmt.Errorf("model content does not match hash %s", hash)
+	}
+
+	return NewWasmModel(binary, maxInstructions)
+}
+
+// NewWasmModel instruments and compiles a model. maxInstructions caps every
+// scoring run, DefaultWasmMaxInstructions when 0.
+func NewWasmModel(binary []byte, maxInstructions uint64) (*WasmModel, error) {
+	if maxInstructions == 0 {
+		maxInstructions = DefaultWasmMaxInstructions
+	}
+	if maxInstructions > math.MaxInt64 {
+		return nil, fmt.Errorf("instruction limit too large: %d", maxInstructions)
+	}
+
+	metered, err := meterModule(binary, maxInstructions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid model: %v", err)
+	}
+
+	name, version, ok := strings.Cut(metered.name, "@")
+	if !ok || name == "" || version == "" {
+		return nil, fmt.Errorf("model has no %s section with name@version", wasmModelSection)
+	}
+
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().
+		WithCoreFeatures(api.CoreFeaturesV2).
+		WithMemoryLimitPages(wasmMemoryLimitPages).
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	// The model is validated as written, the metered one would accept an
+	// access to the fuel global, which the model doesn't have
+	original, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("invalid model: %v", err)
+	}
+	original.Close(ctx)
+
+	model := &WasmModel{name: name, version: version, runtime: runtime}
+	sum := sha256.Sum256(binary)
+	model.hash = hexutil.Encode(sum[:])
+
+	if err := instantiateWasmHost(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := runtime.CompileModule(ctx, metered.binary)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile model: %v", err)
+	}
+	for _, fn := range compiled.ImportedFunctions() {
+		moduleName, fnName, _ := fn.Import()
+		if moduleName != wasmHostModule {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("model imports %s.%s, only %s is available", moduleName, fnName, wasmHostModule)
+		}
+	}
+	if len(compiled.ImportedMemories()) > 0 {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("model must define its own memory")
+	}
+	score, ok := compiled.ExportedFunctions()["score"]
+	if !ok || len(score.ParamTypes()) != 0 || len(score.ResultTypes()) != 0 {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("model must export score()")
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("model must export its memory")
+	}
+
+	model.compiled = compiled
+	return model, nil
+}
+
+// instantiateWasmHost provides the genotype table to models. Nothing else of
+// the host is reachable from inside the sandbox.
+func instantiateWasmHost(ctx context.Context, runtime wazero.Runtime) error {
+	_, err := runtime.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, rsidPtr, rsidLen, outPtr uint32) uint32 {
+			run := chargeHostCall(ctx, mod)
+			rsid := readWasmString(mod, rsidPtr, rsidLen)
+			genotype, ok := run.table.Get(rsid)
+			return writeWasmAlleles(mod, outPtr, genotype, ok)
+		}).
+		Export("genotype").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, chromPtr, chromLen uint32, position uint64, outPtr uint32) uint32 {
+			run := chargeHostCall(ctx, mod)
+			chromosome, err := normalizeChromosome(readWasmString(mod, chromPtr, chromLen))
+			if err != nil {
+				return 0
+			}
+			genotype, ok := run.table.GetByPosition(chromosome, position)
+			return writeWasmAlleles(mod, outPtr, genotype, ok)
+		}).
+		Export("genotype_at").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, score, percentile float64, category, matched, total uint32) {
+			run := chargeHostCall(ctx, mod)
+			if run.result != nil {
+				panic(fmt.Errorf("result reported twice"))
+			}
+			run.result = &RiskResult{
+				Score:      score,
+				Percentile: percentile,
+				Category:   int(int32(category)),
+				Matched:    int(int32(matched)),
+				Total:      int(int32(total)),
+			}
+		}).
+		Export("result").
+		Instantiate(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set up model host: %v", err)
+	}
+	return nil
+}
+
+// chargeHostCall bills a host call to the calling model's budget
+func chargeHostCall(ctx context.Context, mod api.Module) *wasmRun {
+	run, ok := ctx.Value(wasmRunKey{}).(*wasmRun)
+	if !ok {
+		panic(fmt.Errorf("host called outside a scoring run"))
+	}
+	fuel, ok := mod.ExportedGlobal(fuelExport).(api.MutableGlobal)
+	if !ok {
+		panic(fmt.Errorf("model is not metered"))
+	}
+	remaining := int64(fuel.Get()) - wasmHostCallCost
+	fuel.Set(uint64(remaining))
+	if remaining < 0 {
+		panic(ErrInstructionLimit)
+	}
+	return run
+}
+
+func readWasmString(mod api.Module, ptr, length uint32) string {
+	data, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		panic(fmt.Errorf("read out of memory bounds"))
+	}
+	return string(data)
+}
+
+func writeWasmAlleles(mod api.Module, ptr uint32, genotype Genotype, ok bool) uint32 {
+	if !ok {
+		return 0
+	}
+	if !mod.Memory().Write(ptr, []byte(genotype.Alleles)) {
+		panic(fmt.Errorf("write out of memory bounds"))
+	}
+	return uint32(len(genotype.Alleles))
+}
+
+func (m *WasmModel) Name() string {
+	return m.name
+}
+
+func (m *WasmModel) Version() string {
+	return m.version
+}
+
+// Hash returns the SHA-256 of the model binary, the hash it's loaded by
+func (m *WasmModel) Hash() string {
+	return m.hash
+}
+
+// Score runs the model in a fresh instance, so runs share no state. A run is
+// stopped once out of instructions or after wasmRunTimeout.
+func (m *WasmModel) Score(table *GenotypeTable) (*RiskResult, error) {
+	run := &wasmRun{table: table}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), wasmRunKey{}, run), wasmRunTimeout)
+	defer cancel()
+
+	instance, err := m.runtime.InstantiateModule(ctx, m.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate model %s: %v", ModelID(m), err)
+	}
+	defer instance.Close(ctx)
+
+	if _, err := instance.ExportedFunction("score").Call(ctx); err != nil {
+		if fuel := instance.ExportedGlobal(fuelExport); fuel != nil && int64(fuel.Get()) < 0 {
+			return nil, fmt.Errorf("model %s: %w", ModelID(m), ErrInstructionLimit)
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("model %s: %w", ModelID(m), ctx.Err())
+		}
+		return nil, fmt.Errorf("model %s failed: %v", ModelID(m), err)
+	}
+
+	result := run.result
+	if result == nil {
+		return nil, fmt.Errorf("model %s reported no result", ModelID(m))
+	}
+	if result.Category < 1 || result.Category > 4 {
+		return nil, fmt.Errorf("model %s reported invalid category %d", ModelID(m), result.Category)
+	}
+	if result.Total <= 0 || result.Matched < 0 || result.Matched > result.Total {
+		return nil, fmt.Errorf("model %s reported invalid coverage %d/%d", ModelID(m), result.Matched, result.Total)
+	}
+	if math.IsNaN(result.Score) || math.IsNaN(result.Percentile) || result.Percentile < 0 || result.Percentile > 100 {
+		return nil, fmt.Errorf("model %s reported invalid score", ModelID(m))
+	}
+
+	result.ModelID = ModelID(m)
+	result.Coverage = float64(result.Matched) / float64(result.Total)
+	return result, nil
+}
+
+// Close releases the compiled model
+func (m *WasmModel) Close() error {
+	return m.runtime.Close(context.Background())
+}
@@ -5,12 +5,34 @@ type GeneData struct {
 	ID            string
 	EncryptedData []byte
 	RiskScore     int
+	Percentile    float64 // polygenic score percentile in the reference population
+	Coverage      float64 // share of the model's variants found in the data
 	FileHash      string
+	ContentHash   string // salted commitment to the decrypted data
+	Salt          string // hex, opens ContentHash
+	ModelID       string // name@version of the risk model that scored the data
+	ModelHash     string // hex
 }
 
 type ProcessResult struct {
 	DocID       string
 	RiskScore   int
-	ContentHash string
+	Percentile  float64
+	Coverage    float64
+	ContentHash string // salted commitment to the genome, anchored on chain
+	Salt        string // hex, returned to the data owner only, never sent on chain
 	SessionID   string
+	ModelID     string // name@version of the risk model
+	ModelHash   string // hex, pins the exact model content
+	Proof       string // hex, TEE signature over the result
+	Signer      string // address of the TEE key that signed the proof
+}
+
+// MintResult is what a mined confirm transaction minted and rewarded
+type MintResult struct {
+	TxHash      string
+	BlockNumber uint64
+	TokenID     string // G-NFT token ID
+	Owner       string // wallet the G-NFT and reward went to
+	Reward      string // PCSP amount in wei
 }
@@ -0,0 +1,297 @@
+package uploads
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"genomic-service/internal/config"
+	"genomic-service/internal/types"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// State is a step in the lifecycle of an upload
+type State string
+
+const (
+	StateUploaded      State = "uploaded"       // blob stored
+	StateSessionOpened State = "session-opened" // upload session mined on chain
+	StateProcessed     State = "processed"      // scored and signed by the TEE
+	StateConfirmed     State = "confirmed"      // confirm transaction sent
+	StateMinted        State = "minted"         // confirm mined, G-NFT minted
+	StateFailed        State = "failed"         // given up, see Error
+)
+
+// next lists the states an upload may move to from each state
+var next = map[State][]State{
+	StateUploaded:      {StateSessionOpened, StateFailed},
+	StateSessionOpened: {StateProcessed, StateFailed},
+	StateProcessed:     {StateConfirmed, StateFailed},
+	StateConfirmed:     {StateMinted, StateFailed},
+}
+
+var (
+	ErrNotFound          = errors.New("upload not found")
+	ErrExists            = errors.New("upload already exists")
+	ErrNonceUsed         = errors.New("upload intent nonce already used")
+	ErrInvalidTransition = errors.New("invalid upload state transition")
+)
+
+var (
+	uploadsBucket = []byte("uploads")
+	noncesBucket  = []byte("intent_nonces") // wallet/nonce -> file hash
+	relayedBucket = []byte("relayed")       // user -> times of their relayed requests
+)
+
+// Intent is the user's signed agreement to an upload, an EIP-712
+// UploadIntent over the file hash, wallet, product and nonce
+type Intent struct {
+	Product   string `json:"product,omitempty"`
+	Nonce     string `json:"nonce"`     // decimal
+	Signature string `json:"signature"` // hex, by the wallet
+}
+
+// Upload is the persisted record of a file hash going through the pipeline
+type Upload struct {
+	FileHash  string               `json:"fileHash"`
+	State     State                `json:"state"`
+	Wallet    string               `json:"wallet,omitempty"` // user's, owns the G-NFT and reward
+	Intent    *Intent              `json:"intent,omitempty"` // signed by the wallet
+	SessionID string               `json:"sessionId,omitempty"`
+	RelayTx   string               `json:"relayTx,omitempty"` // uploadData the user relayed, they send confirm too
+	Product   string               `json:"product,omitempty"`
+	JobID     string               `json:"jobId,omitempty"`  // running confirmation job
+	Result    *types.ProcessResult `json:"result,omitempty"` // kept to confirm without the TEE after a restart
+	ConfirmTx string               `json:"confirmTx,omitempty"`
+	TokenID   string               `json:"tokenId,omitempty"`
+	Error     string               `json:"error,omitempty"` // last failure, the upload may still be retried
+	CreatedAt time.Time            `json:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+}
+
+// InFlight reports whether the upload still has steps to go
+func (u *Upload) InFlight() bool {
+	return u.State != StateMinted && u.State != StateFailed
+}
+
+// Store persists uploads in an embedded bbolt database, so the lifecycle
+// survives restarts. Every change runs in its own transaction.
+type Store struct {
+	db *bolt.DB
+}
+
+func NewStore(settings *config.StateSettings) (*Store, error) {
+	if settings.Path == "" {
+		return nil, fmt.Errorf("state store path is not configured")
+	}
+	if err := os.MkdirAll(filepath.Dir(settings.Path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	db, err := bolt.Open(settings.Path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{uploadsBucket, noncesBucket, relayedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state store: %v", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Create records a blob stored for the user's wallet with the intent they
+// signed, and the uploadData transaction they relayed for it if any. A
+// failed upload of the same file is replaced, any other existing record is
+// kept and ErrExists returned. Each nonce of a wallet goes with one file,
+// ErrNonceUsed is returned for another.
+func (s *Store) Create(fileHash, wallet string, intent *Intent, relayTx string) (*Upload, error) {
+	now := time.Now()
+	upload := &Upload{
+		FileHash:  fileHash,
+		Wallet:    wallet,
+		Intent:    intent,
+		Product:   intent.Product,
+		RelayTx:   relayTx,
+		State:     StateUploaded,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		existing, err := get(tx, fileHash)
+		if err == nil && existing.State != StateFailed {
+			return ErrExists
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		nonces := tx.Bucket(noncesBucket)
+		key := []byte(wallet + "/" + intent.Nonce)
+		if used := nonces.Get(key); used != nil && string(used) != fileHash {
+			return ErrNonceUsed
+		}
+		if err := nonces.Put(key, []byte(fileHash)); err != nil {
+			return err
+		}
+		return put(tx, upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (s *Store) Get(fileHash string) (*Upload, error) {
+	var upload *Upload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		upload, err = get(tx, fileHash)
+		return err
+	})
+	return upload, err
+}
+
+// Update changes a record without moving it to another state. fn runs inside
+// the transaction, so checks it makes can't race with other updates; an error
+// from fn aborts the update.
+func (s *Store) Update(fileHash string, fn func(upload *Upload) error) (*Upload, error) {
+	var upload *Upload
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		upload, err = get(tx, fileHash)
+		if err != nil {
+			return err
+		}
+
+		state := upload.State
+		if err := fn(upload); err != nil {
+			return err
+		}
+		if upload.State != state {
+			return fmt.Errorf("%w: use Transition to leave %s", ErrInvalidTransition, state)
+		}
+		upload.UpdatedAt = time.Now()
+		return put(tx, upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Transition moves a record to the next state, applying fn to it first when
+// not nil
+func (s *Store) Transition(fileHash string, to State, fn func(upload *Upload)) (*Upload, error) {
+	var upload *Upload
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		upload, err = get(tx, fileHash)
+		if err != nil {
+			return err
+		}
+		if !allowed(upload.State, to) {
+			return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, upload.State, to)
+		}
+
+		if fn != nil {
+			fn(upload)
+		}
+		upload.State = to
+		upload.UpdatedAt = time.Now()
+		return put(tx, upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// InFlight lists the uploads that are neither minted nor failed
+func (s *Store) InFlight() ([]*Upload, error) {
+	var uploads []*Upload
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(_, value []byte) error {
+			var upload Upload
+			if err := json.Unmarshal(value, &upload); err != nil {
+				return err
+			}
+			if upload.InFlight() {
+				uploads = append(uploads, &upload)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploads: %v", err)
+	}
+	return uploads, nil
+}
+
+// UpdateRelayed replaces the times of a user's relayed requests by what fn
+// returns, in a single transaction, so the relay quota survives restarts
+func (s *Store) UpdateRelayed(user string, fn func(used []time.Time) []time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(relayedBucket)
+		var used []time.Time
+		if value := bucket.Get([]byte(user)); value != nil {
+			if err := json.Unmarshal(value, &used); err != nil {
+				return fmt.Errorf("corrupt relayed requests of %s: %v", user, err)
+			}
+		}
+
+		used = fn(used)
+		if len(used) == 0 {
+			return bucket.Delete([]byte(user))
+		}
+		value, err := json.Marshal(used)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(user), value)
+	})
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func allowed(from, to State) bool {
+	for _, state := range next[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+func get(tx *bolt.Tx, fileHash string) (*Upload, error) {
+	value := tx.Bucket(uploadsBucket).Get([]byte(fileHash))
+	if value == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, fileHash)
+	}
+	var upload Upload
+	if err := json.Unmarshal(value, &upload); err != nil {
+		return nil, fmt.Errorf("corrupt upload record %s: %v", fileHash, err)
+	}
+	return &upload, nil
+}
+
+func put(tx *bolt.Tx, upload *Upload) error {
+	value, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(uploadsBucket).Put([]byte(upload.FileHash), value)
+}
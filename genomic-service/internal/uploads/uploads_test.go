@@ -0,0 +1,201 @@
+package uploads_test
+
+import (
+	"errors"
+	"genomic-service/internal/config"
+	"genomic-service/internal/types"
+	"genomic-service/internal/uploads"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const wallet = "0x00000000000000000000000000000000000000aa"
+
+var intent = &uploads.Intent{Product: "stroke", Nonce: "1", Signature: "0x01"}
+
+func newStore(t *testing.T, path string) *uploads.Store {
+	store, err := uploads.NewStore(&config.StateSettings{Path: path})
+	assert.NoError(t, err)
+	return store
+}
+
+func TestLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploads.db")
+	store := newStore(t, path)
+
+	upload, err := store.Create("abc", wallet, intent, "")
+	assert.NoError(t, err)
+	assert.Equal(t, uploads.StateUploaded, upload.State)
+	assert.Equal(t, wallet, upload.Wallet)
+	assert.Equal(t, "stroke", upload.Product)
+
+	_, err = store.Create("abc", wallet, intent, "")
+	assert.ErrorIs(t, err, uploads.ErrExists)
+
+	steps := []struct {
+		to     uploads.State
+		update func(upload *uploads.Upload)
+	}{
+		{uploads.StateSessionOpened, func(upload *uploads.Upload) { upload.SessionID = "42" }},
+		{uploads.StateProcessed, func(upload *uploads.Upload) {
+			upload.Result = &types.ProcessResult{DocID: "abc", RiskScore: 3}
+		}},
+		{uploads.StateConfirmed, func(upload *uploads.Upload) { upload.ConfirmTx = "0x01" }},
+	}
+	for _, step := range steps {
+		_, err := store.Transition("abc", step.to, step.update)
+		assert.NoError(t, err)
+	}
+
+	// Records survive a restart
+	assert.NoError(t, store.Close())
+	store = newStore(t, path)
+	defer store.Close()
+
+	upload, err = store.Get("abc")
+	assert.NoError(t, err)
+	assert.Equal(t, uploads.StateConfirmed, upload.State)
+	assert.Equal(t, "42", upload.SessionID)
+	assert.Equal(t, 3, upload.Result.RiskScore)
+	assert.Equal(t, "0x01", upload.ConfirmTx)
+
+	inFlight, err := store.InFlight()
+	assert.NoError(t, err)
+	assert.Len(t, inFlight, 1)
+
+	_, err = store.Transition("abc", uploads.StateMinted, func(upload *uploads.Upload) { upload.TokenID = "7" })
+	assert.NoError(t, err)
+	inFlight, err = store.InFlight()
+	assert.NoError(t, err)
+	assert.Empty(t, inFlight)
+}
+
+func TestTransitions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		path    []uploads.State
+		to      uploads.State
+		allowed bool
+	}{
+		{"Open session", nil, uploads.StateSessionOpened, true},
+		{"Skip the session", nil, uploads.StateProcessed, false},
+		{"Confirm before processing", []uploads.State{uploads.StateSessionOpened}, uploads.StateConfirmed, false},
+		{"Fail while processing", []uploads.State{uploads.StateSessionOpened}, uploads.StateFailed, true},
+		{"Go back", []uploads.State{uploads.StateSessionOpened, uploads.StateProcessed}, uploads.StateSessionOpened, false},
+		{"Leave minted", []uploads.State{uploads.StateSessionOpened, uploads.StateProcessed, uploads.StateConfirmed, uploads.StateMinted}, uploads.StateFailed, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newStore(t, filepath.Join(t.TempDir(), "uploads.db"))
+			defer store.Close()
+
+			_, err := store.Create("abc", wallet, intent, "")
+			assert.NoError(t, err)
+			for _, state := range tc.path {
+				_, err := store.Transition("abc", state, nil)
+				assert.NoError(t, err)
+			}
+
+			_, err = store.Transition("abc", tc.to, nil)
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, uploads.ErrInvalidTransition)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	store := newStore(t, filepath.Join(t.TempDir(), "uploads.db"))
+	defer store.Close()
+
+	_, err := store.Update("missing", func(upload *uploads.Upload) error { return nil })
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+
+	_, err = store.Create("abc", wallet, intent, "")
+	assert.NoError(t, err)
+
+	// An error from the callback leaves the record untouched
+	errBusy := errors.New("busy")
+	_, err = store.Update("abc", func(upload *uploads.Upload) error {
+		upload.JobID = "job"
+		return errBusy
+	})
+	assert.ErrorIs(t, err, errBusy)
+	upload, err := store.Get("abc")
+	assert.NoError(t, err)
+	assert.Empty(t, upload.JobID)
+
+	// State changes must go through Transition
+	_, err = store.Update("abc", func(upload *uploads.Upload) error {
+		upload.State = uploads.StateMinted
+		return nil
+	})
+	assert.ErrorIs(t, err, uploads.ErrInvalidTransition)
+
+	// A failed upload can be uploaded again
+	_, err = store.Transition("abc", uploads.StateFailed, nil)
+	assert.NoError(t, err)
+	upload, err = store.Create("abc", wallet, intent, "")
+	assert.NoError(t, err)
+	assert.Equal(t, uploads.StateUploaded, upload.State)
+}
+
+func TestIntentNonce(t *testing.T) {
+	store := newStore(t, filepath.Join(t.TempDir(), "uploads.db"))
+	defer store.Close()
+
+	_, err := store.Create("abc", wallet, intent, "")
+	assert.NoError(t, err)
+
+	// A nonce signed for one file can't be used for another
+	_, err = store.Create("def", wallet, intent, "")
+	assert.ErrorIs(t, err, uploads.ErrNonceUsed)
+	_, err = store.Get("def")
+	assert.ErrorIs(t, err, uploads.ErrNotFound)
+
+	// Other wallets have their own nonces
+	_, err = store.Create("def", "0x00000000000000000000000000000000000000bb", intent, "")
+	assert.NoError(t, err)
+
+	// The same intent uploads the same file again once it failed
+	_, err = store.Transition("abc", uploads.StateFailed, nil)
+	assert.NoError(t, err)
+	upload, err := store.Create("abc", wallet, intent, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", upload.Intent.Nonce)
+}
+
+func TestUpdateRelayed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploads.db")
+	store := newStore(t, path)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	add := func(used []time.Time) []time.Time { return append(used, now) }
+	assert.NoError(t, store.UpdateRelayed(wallet, add))
+	assert.NoError(t, store.UpdateRelayed(wallet, add))
+
+	// The requests survive a restart
+	assert.NoError(t, store.Close())
+	store = newStore(t, path)
+	defer store.Close()
+
+	var seen []time.Time
+	assert.NoError(t, store.UpdateRelayed(wallet, func(used []time.Time) []time.Time {
+		seen = used
+		return nil
+	}))
+	assert.Equal(t, []time.Time{now, now}, seen)
+
+	// Returning nothing forgets the user
+	assert.NoError(t, store.UpdateRelayed(wallet, func(used []time.Time) []time.Time {
+		seen = used
+		return used
+	}))
+	assert.Empty(t, seen)
+}
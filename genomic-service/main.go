@@ -20,7 +20,9 @@ func main() {
 		log.Fatalf("Failed to run server: %v", err)
 	}
 
-	if err := srv.Run(); err != nil {
+	err = srv.Run()
+	srv.Close()
+	if err != nil {
 		log.Fatalf("Failed to run server: %v", err)
 	}
 }
@@ -0,0 +1,133 @@
+package tee
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Domain separator for attestation signatures
+var attestationDomain = []byte("GENOMIC-TEE-ATTESTATION-V1")
+
+// AttestationDocument binds a TEE public key to the measurement of the code
+// holding it. It is signed by an attestation root, which stands in for the
+// hardware vendor key of a real enclave.
+type AttestationDocument struct {
+	PublicKey   string `json:"publicKey"`   // hex, compressed
+	KeyID       string `json:"keyId"`
+	Measurement string `json:"measurement"` // hex, SHA-256 of the TEE code
+	Timestamp   int64  `json:"timestamp"`   // unix seconds
+	Nonce       string `json:"nonce,omitempty"`
+	Signature   string `json:"signature"` // hex, 65-byte secp256k1 signature by the root
+}
+
+// AttestationPolicy is what the SDK pins before trusting a TEE key
+type AttestationPolicy struct {
+	RootPublicKey       string   // hex, compressed attestation root key
+	AllowedMeasurements []string // hex measurements of trusted TEE builds
+	MaxAge              time.Duration
+	Nonce               string // expected nonce, if the document was requested with one
+}
+
+// Digest returns the hash the attestation root signs
+func (d *AttestationDocument) Digest() ([]byte, error) {
+	pubKey, err := hex.DecodeString(d.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	measurement, err := hex.DecodeString(d.Measurement)
+	if err != nil {
+		return nil, fmt.Errorf("invalid measurement: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(attestationDomain)
+	writeField(&buf, pubKey)
+	writeField(&buf, []byte(d.KeyID))
+	writeField(&buf, measurement)
+	binary.Write(&buf, binary.BigEndian, d.Timestamp)
+	writeField(&buf, []byte(d.Nonce))
+
+	return crypto.Keccak256(buf.Bytes()), nil
+}
+
+// writeField length-prefixes variable fields so they can't be shifted
+func writeField(buf *bytes.Buffer, field []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(field)))
+	buf.Write(field)
+}
+
+// Sign signs the document with the attestation root key
+func (d *AttestationDocument) Sign(rootKey *ecdsa.PrivateKey) error {
+	digest, err := d.Digest()
+	if err != nil {
+		return err
+	}
+
+	signature, err := crypto.Sign(digest, rootKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign attestation: %v", err)
+	}
+	d.Signature = hex.EncodeToString(signature)
+	return nil
+}
+
+// Verify checks the document against the pinned root and allowed measurements
+func (d *AttestationDocument) Verify(policy AttestationPolicy) error {
+	digest, err := d.Digest()
+	if err != nil {
+		return err
+	}
+
+	signature, err := hex.DecodeString(d.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid attestation signature: %v", err)
+	}
+	signer, err := crypto.SigToPub(digest, signature)
+	if err != nil {
+		return fmt.Errorf("invalid attestation signature: %v", err)
+	}
+
+	root, err := parsePublicKeyHex(policy.RootPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid pinned root: %v", err)
+	}
+	if !signer.Equal(root) {
+		return fmt.Errorf("attestation not signed by pinned root")
+	}
+
+	allowed := false
+	for _, measurement := range policy.AllowedMeasurements {
+		if measurement == d.Measurement {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("measurement not allowed: %s", d.Measurement)
+	}
+
+	if policy.MaxAge > 0 && time.Since(time.Unix(d.Timestamp, 0)) > policy.MaxAge {
+		return fmt.Errorf("attestation expired")
+	}
+
+	if policy.Nonce != "" && policy.Nonce != d.Nonce {
+		return fmt.Errorf("attestation nonce mismatch")
+	}
+
+	// The key ID must belong to the attested key
+	keyID, err := KeyIDFromHex(d.PublicKey)
+	if err != nil {
+		return err
+	}
+	if keyID != d.KeyID {
+		return fmt.Errorf("attestation key ID mismatch")
+	}
+
+	return nil
+}
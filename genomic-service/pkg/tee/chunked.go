@@ -0,0 +1,314 @@
+package tee
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher is the AEAD protecting the chunks of an envelope
+type Cipher byte
+
+const (
+	CipherAESGCM           Cipher = 1
+	CipherChaCha20Poly1305 Cipher = 2
+)
+
+const (
+	// DefaultChunkSize is the plaintext size of every chunk but the last
+	DefaultChunkSize = 64 * 1024
+	// MaxChunkSize bounds what a reader allocates for a chunk
+	MaxChunkSize = 4 * 1024 * 1024
+
+	dataKeySize   = 32
+	chunkOverhead = 16 // AEAD tag
+	nonceSize     = 12
+)
+
+// ChunkedHeader follows the common header in a chunked envelope:
+//
+//	cipher (1) | chunk size (4) | wrapped key length (2) | wrapped key
+//
+// Chunks come next, each sealed with a nonce made of its index and a flag
+// marking the last one, so reordered, dropped or truncated chunks fail
+// authentication.
+type ChunkedHeader struct {
+	KeyID      string
+	Cipher     Cipher
+	ChunkSize  int
+	WrappedKey []byte // random data key, ECIES-encrypted to the TEE key
+}
+
+// ChunkError reports a chunk that failed authentication: it was modified,
+// reordered, or the envelope was cut off at it
+type ChunkError struct {
+	Index uint64
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d failed authentication", e.Index)
+}
+
+// WrapDataKey encrypts a data key to a TEE key
+func WrapDataKey(publicKey *ecdsa.PublicKey, dataKey []byte) ([]byte, error) {
+	wrapped, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(publicKey), dataKey, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	return wrapped, nil
+}
+
+// UnwrapDataKey recovers the data key of an envelope with the TEE key
+func UnwrapDataKey(privateKey *ecdsa.PrivateKey, wrapped []byte) ([]byte, error) {
+	dataKey, err := ecies.ImportECDSA(privateKey).Decrypt(wrapped, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	if len(dataKey) != dataKeySize {
+		return nil, fmt.Errorf("invalid data key length: %d", len(dataKey))
+	}
+	return dataKey, nil
+}
+
+// Bytes encodes the header, common part included
+func (h *ChunkedHeader) Bytes() ([]byte, error) {
+	header, err := encodeHeader(h.KeyID, ChunkedEnvelopeVersion)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.WrappedKey) > 0xffff {
+		return nil, fmt.Errorf("wrapped key too long")
+	}
+
+	header = append(header, byte(h.Cipher))
+	header = binary.BigEndian.AppendUint32(header, uint32(h.ChunkSize))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(h.WrappedKey)))
+	return append(header, h.WrappedKey...), nil
+}
+
+// ReadChunkedHeader reads the header of a chunked envelope and leaves r at
+// the first chunk
+func ReadChunkedHeader(r io.Reader) (*ChunkedHeader, error) {
+	fixed := make([]byte, HeaderSize+1+4+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("truncated envelope header")
+	}
+	keyID, rest, ok, err := ParseHeader(fixed)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || !IsChunked(fixed) {
+		return nil, fmt.Errorf("not a chunked envelope")
+	}
+
+	header := &ChunkedHeader{
+		KeyID:     keyID,
+		Cipher:    Cipher(rest[0]),
+		ChunkSize: int(binary.BigEndian.Uint32(rest[1:5])),
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d", header.ChunkSize)
+	}
+	if _, err := header.Cipher.aead(make([]byte, dataKeySize)); err != nil {
+		return nil, err
+	}
+
+	header.WrappedKey = make([]byte, binary.BigEndian.Uint16(rest[5:7]))
+	if _, err := io.ReadFull(r, header.WrappedKey); err != nil {
+		return nil, fmt.Errorf("truncated envelope header")
+	}
+	return header, nil
+}
+
+// aad binds every chunk to the format parameters. The key ID and wrapped key
+// are left out, so the TEE can rewrap the data key after a key rotation
+// without touching the chunks; a different data key fails every chunk anyway.
+func (h *ChunkedHeader) aad() []byte {
+	aad := append([]byte{}, envelopeMagic...)
+	aad = append(aad, ChunkedEnvelopeVersion, byte(h.Cipher))
+	return binary.BigEndian.AppendUint32(aad, uint32(h.ChunkSize))
+}
+
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher: %d", c)
+	}
+}
+
+// chunkNonce is the big-endian chunk index followed by the last chunk flag
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[nonceSize-9:nonceSize-1], index)
+	if final {
+		nonce[nonceSize-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	aad    []byte
+	buf    []byte
+	sealed []byte
+	index  uint64
+	closed bool
+}
+
+// newEncryptWriter writes the header and returns a writer sealing chunks
+func newEncryptWriter(w io.Writer, header *ChunkedHeader, dataKey []byte) (io.WriteCloser, error) {
+	aead, err := header.Cipher.aead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := header.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		aad:    header.aad(),
+		buf:    make([]byte, 0, header.ChunkSize),
+		sealed: make([]byte, 0, header.ChunkSize+chunkOverhead),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, fmt.Errorf("write to closed envelope")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(e.buf) == cap(e.buf) {
+			// More data follows, so the buffered chunk isn't the last one
+			if err := e.flush(false); err != nil {
+				return n, err
+			}
+		}
+		copied := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+copied]
+		p = p[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// Close seals the last chunk, which may be empty. The envelope is invalid
+// without it.
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+func (e *encryptWriter) flush(final bool) error {
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.index, final), e.buf, e.aad)
+	if _, err := e.w.Write(e.sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	aad   []byte
+	chunk []byte
+	plain []byte
+	index uint64
+	done  bool
+	err   error
+}
+
+// NewDecryptReader opens the chunks following a header one at a time, so
+// only a single chunk is ever held in memory. A chunk that fails
+// authentication stops the stream with a *ChunkError naming it; data read
+// before it was authenticated.
+func NewDecryptReader(r io.Reader, header *ChunkedHeader, dataKey []byte) (io.Reader, error) {
+	aead, err := header.Cipher.aead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:     bufio.NewReader(r),
+		aead:  aead,
+		aad:   header.aad(),
+		chunk: make([]byte, header.ChunkSize+chunkOverhead),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		// Shorter than a full chunk, so this has to be the last one
+	default:
+		return fmt.Errorf("failed to read chunk %d: %v", d.index, err)
+	}
+
+	final := err != nil
+	if !final {
+		// A full chunk is the last one when nothing follows
+		if _, err := d.r.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return fmt.Errorf("failed to read chunk %d: %v", d.index, err)
+		}
+	}
+
+	plain, err := d.aead.Open(d.chunk[:0], chunkNonce(d.index, final), d.chunk[:n], d.aad)
+	if err != nil {
+		return &ChunkError{Index: d.index}
+	}
+	d.index++
+	d.plain = plain
+	d.done = final
+	if final && len(plain) == 0 {
+		return io.EOF
+	}
+	return nil
+}
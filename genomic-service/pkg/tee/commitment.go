@@ -0,0 +1,73 @@
+package tee
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"hash"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Domain separator for content commitments
+var contentDomain = []byte("GENOMIC-CONTENT-V1")
+
+// SaltSize is the size of the random salt that hides the genome in its commitment
+const SaltSize = 32
+
+// NewSalt returns a fresh random commitment salt
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return salt, nil
+}
+
+// ContentHash commits to a genome: keccak256(domain || salt || data), hex.
+// Without the salt the on-chain value can't be linked to a candidate genome.
+func ContentHash(data, salt []byte) string {
+	hasher := NewContentHasher(salt)
+	hasher.Write(data)
+	return hasher.Sum()
+}
+
+// ContentHasher computes a ContentHash over data written to it in pieces
+type ContentHasher struct {
+	state hash.Hash
+}
+
+func NewContentHasher(salt []byte) *ContentHasher {
+	state := crypto.NewKeccakState()
+	state.Write(contentDomain)
+	state.Write(salt)
+	return &ContentHasher{state: state}
+}
+
+func (h *ContentHasher) Write(p []byte) (int, error) {
+	return h.state.Write(p)
+}
+
+// Sum returns the commitment to everything written so far
+func (h *ContentHasher) Sum() string {
+	return hexutil.Encode(h.state.Sum(nil))
+}
+
+// VerifyContentHash opens a commitment, letting the data owner prove which
+// genome a G-NFT refers to by sharing the genome and salt with a verifier
+func VerifyContentHash(data []byte, salt, contentHash string) error {
+	saltBytes, err := hexutil.Decode(salt)
+	if err != nil {
+		return fmt.Errorf("invalid salt: %v", err)
+	}
+	if len(saltBytes) != SaltSize {
+		return fmt.Errorf("invalid salt length: %d", len(saltBytes))
+	}
+
+	expected := ContentHash(data, saltBytes)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(contentHash)) != 1 {
+		return fmt.Errorf("content hash mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package tee
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Ciphertext header: magic | format version | key ID.
+// The key ID tells the TEE which key of its keyring to decrypt with.
+var envelopeMagic = []byte("GTEE")
+
+const (
+	EnvelopeVersion        = 1 // the whole file ECIES-encrypted in one piece
+	ChunkedEnvelopeVersion = 2 // ECIES-wrapped data key and AEAD chunks, see NewEncryptWriter
+	keyIDSize              = 8 // bytes
+	// HeaderSize is the number of bytes needed to read a key ID
+	HeaderSize = 4 + 1 + keyIDSize
+)
+
+// KeyID derives the identifier of a TEE key from its public key, so the SDK
+// and the TEE agree on it without any extra exchange
+func KeyID(publicKey *ecdsa.PublicKey) string {
+	hash := crypto.Keccak256(crypto.CompressPubkey(publicKey))
+	return hex.EncodeToString(hash[:keyIDSize])
+}
+
+// KeyIDFromHex derives the key ID from a hex-encoded compressed public key
+func KeyIDFromHex(publicKeyHex string) (string, error) {
+	pubKey, err := parsePublicKeyHex(publicKeyHex)
+	if err != nil {
+		return "", err
+	}
+	return KeyID(pubKey), nil
+}
+
+func encodeHeader(keyID string, version byte) ([]byte, error) {
+	id, err := hex.DecodeString(keyID)
+	if err != nil || len(id) != keyIDSize {
+		return nil, fmt.Errorf("invalid key ID: %s", keyID)
+	}
+
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, envelopeMagic...)
+	header = append(header, version)
+	header = append(header, id...)
+	return header, nil
+}
+
+// ParseHeader splits encrypted data into its key ID and the payload after
+// the common header, which IsChunked tells how to read. Data produced before
+// key IDs existed has no header and returns ok=false.
+func ParseHeader(data []byte) (keyID string, payload []byte, ok bool, err error) {
+	if len(data) < len(envelopeMagic) || !bytes.Equal(data[:len(envelopeMagic)], envelopeMagic) {
+		return "", data, false, nil
+	}
+	if len(data) < HeaderSize {
+		return "", nil, false, fmt.Errorf("truncated envelope header")
+	}
+	if version := data[len(envelopeMagic)]; version != EnvelopeVersion && version != ChunkedEnvelopeVersion {
+		return "", nil, false, fmt.Errorf("unsupported envelope version: %d", version)
+	}
+
+	return hex.EncodeToString(data[len(envelopeMagic)+1 : HeaderSize]), data[HeaderSize:], true, nil
+}
+
+// IsChunked reports whether an envelope, or at least its first HeaderSize
+// bytes, uses the chunked format
+func IsChunked(data []byte) bool {
+	return len(data) > len(envelopeMagic) &&
+		bytes.Equal(data[:len(envelopeMagic)], envelopeMagic) &&
+		data[len(envelopeMagic)] == ChunkedEnvelopeVersion
+}
+
+func parsePublicKeyHex(publicKeyHex string) (*ecdsa.PublicKey, error) {
+	// Decode hex string to bytes
+	pubKeyBytes, err := hex.DecodeString(publicKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key hex: %v", err)
+	}
+
+	// Parse public key from bytes
+	pubKey, err := crypto.DecompressPubkey(pubKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress public key: %v", err)
+	}
+	return pubKey, nil
+}
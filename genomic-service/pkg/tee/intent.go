@@ -0,0 +1,222 @@
+package tee
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EIP-712 domain of upload intents
+const (
+	IntentDomainName    = "GenomicDAO"
+	IntentDomainVersion = "1"
+)
+
+var (
+	domainTypeHash        = crypto.Keccak256Hash([]byte("EIP712Domain(string name,string version,uint256 chainId,address verifyingContract)"))
+	uploadIntentTypeHash  = crypto.Keccak256Hash([]byte("UploadIntent(bytes32 fileHash,address wallet,string product,uint256 nonce)"))
+	confirmIntentTypeHash = crypto.Keccak256Hash([]byte("ConfirmIntent(bytes32 fileHash,uint256 sessionId)"))
+
+	domainArguments        = mustArguments("bytes32", "bytes32", "bytes32", "uint256", "address")
+	uploadIntentArguments  = mustArguments("bytes32", "bytes32", "address", "bytes32", "uint256")
+	confirmIntentArguments = mustArguments("bytes32", "bytes32", "uint256")
+)
+
+func mustArguments(types ...string) abi.Arguments {
+	arguments := make(abi.Arguments, len(types))
+	for i, name := range types {
+		typ, err := abi.NewType(name, "", nil)
+		if err != nil {
+			panic(err)
+		}
+		arguments[i] = abi.Argument{Type: typ}
+	}
+	return arguments
+}
+
+// IntentDomain binds intents to one chain and controller, so a signature
+// can't be replayed against another deployment
+type IntentDomain struct {
+	ChainID           *big.Int
+	VerifyingContract common.Address
+}
+
+// Separator is the EIP-712 domain separator
+func (d *IntentDomain) Separator() (common.Hash, error) {
+	packed, err := domainArguments.Pack(
+		domainTypeHash,
+		crypto.Keccak256Hash([]byte(IntentDomainName)),
+		crypto.Keccak256Hash([]byte(IntentDomainVersion)),
+		d.ChainID,
+		d.VerifyingContract,
+	)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to encode domain: %v", err)
+	}
+	return crypto.Keccak256Hash(packed), nil
+}
+
+// UploadIntent is what a user signs with their wallet to agree to an upload,
+// as EIP-712 typed data:
+// UploadIntent(bytes32 fileHash,address wallet,string product,uint256 nonce)
+type UploadIntent struct {
+	FileHash string         // hex SHA-256 of the encrypted upload, as the gateway names it
+	Wallet   common.Address // receives the G-NFT and reward
+	Product  string         // risk model, empty for the default one
+	Nonce    *big.Int       // chosen by the user, once per wallet
+}
+
+// Digest is the EIP-712 hash the wallet signs
+func (i *UploadIntent) Digest(domain *IntentDomain) ([]byte, error) {
+	if i.Nonce == nil || i.Nonce.Sign() < 0 {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	fileHash, err := decodeFileHash(i.FileHash)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := uploadIntentArguments.Pack(
+		uploadIntentTypeHash,
+		fileHash,
+		i.Wallet,
+		crypto.Keccak256Hash([]byte(i.Product)),
+		i.Nonce,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upload intent: %v", err)
+	}
+	return typedDataDigest(domain, packed)
+}
+
+// SignUploadIntent signs an intent like eth_signTypedData_v4, with v in
+// {27, 28}
+func SignUploadIntent(i *UploadIntent, domain *IntentDomain, key *ecdsa.PrivateKey) ([]byte, error) {
+	digest, err := i.Digest(domain)
+	if err != nil {
+		return nil, err
+	}
+	return signDigest(digest, key)
+}
+
+// RecoverUploadIntentSigner returns the address of the key that signed the
+// intent
+func RecoverUploadIntentSigner(i *UploadIntent, domain *IntentDomain, signature []byte) (common.Address, error) {
+	digest, err := i.Digest(domain)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return recoverSigner(digest, signature)
+}
+
+// VerifyUploadIntent checks that the intent was signed by its wallet
+func VerifyUploadIntent(i *UploadIntent, domain *IntentDomain, signature []byte) error {
+	signer, err := RecoverUploadIntentSigner(i, domain, signature)
+	if err != nil {
+		return err
+	}
+	if signer != i.Wallet {
+		return fmt.Errorf("upload intent signed by %s, not by wallet %s", signer.Hex(), i.Wallet.Hex())
+	}
+	return nil
+}
+
+// ConfirmIntent is what a user signs to have their upload processed, as
+// EIP-712 typed data in the domain of upload intents:
+// ConfirmIntent(bytes32 fileHash,uint256 sessionId)
+type ConfirmIntent struct {
+	FileHash  string // hex SHA-256 of the encrypted upload
+	SessionID *big.Int
+}
+
+// Digest is the EIP-712 hash the wallet signs
+func (i *ConfirmIntent) Digest(domain *IntentDomain) ([]byte, error) {
+	if i.SessionID == nil || i.SessionID.Sign() < 0 {
+		return nil, fmt.Errorf("invalid session ID")
+	}
+	fileHash, err := decodeFileHash(i.FileHash)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := confirmIntentArguments.Pack(confirmIntentTypeHash, fileHash, i.SessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode confirm intent: %v", err)
+	}
+	return typedDataDigest(domain, packed)
+}
+
+// SignConfirmIntent signs a confirm intent like eth_signTypedData_v4
+func SignConfirmIntent(i *ConfirmIntent, domain *IntentDomain, key *ecdsa.PrivateKey) ([]byte, error) {
+	digest, err := i.Digest(domain)
+	if err != nil {
+		return nil, err
+	}
+	return signDigest(digest, key)
+}
+
+// VerifyConfirmIntent checks that the confirm intent was signed by wallet
+func VerifyConfirmIntent(i *ConfirmIntent, domain *IntentDomain, wallet common.Address, signature []byte) error {
+	digest, err := i.Digest(domain)
+	if err != nil {
+		return err
+	}
+	signer, err := recoverSigner(digest, signature)
+	if err != nil {
+		return err
+	}
+	if signer != wallet {
+		return fmt.Errorf("confirm intent signed by %s, not by wallet %s", signer.Hex(), wallet.Hex())
+	}
+	return nil
+}
+
+func decodeFileHash(fileHash string) (common.Hash, error) {
+	decoded, err := hex.DecodeString(fileHash)
+	if err != nil || len(decoded) != common.HashLength {
+		return common.Hash{}, fmt.Errorf("invalid file hash: %s", fileHash)
+	}
+	return common.BytesToHash(decoded), nil
+}
+
+// typedDataDigest hashes an encoded struct in the domain
+func typedDataDigest(domain *IntentDomain, packed []byte) ([]byte, error) {
+	separator, err := domain.Separator()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.Keccak256([]byte{0x19, 0x01}, separator.Bytes(), crypto.Keccak256(packed)), nil
+}
+
+func signDigest(digest []byte, key *ecdsa.PrivateKey) ([]byte, error) {
+	signature, err := crypto.Sign(digest, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign intent: %v", err)
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return signature, nil
+}
+
+// recoverSigner accepts v in {0, 1} or {27, 28}
+func recoverSigner(digest, signature []byte) (common.Address, error) {
+	if len(signature) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("invalid signature length: %d", len(signature))
+	}
+
+	sig := make([]byte, len(signature))
+	copy(sig, signature)
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+
+	pubKey, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid signature: %v", err)
+	}
+	return crypto.PubkeyToAddress(*pubKey), nil
+}
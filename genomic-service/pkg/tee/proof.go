@@ -0,0 +1,109 @@
+package tee
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Claim is the computation result a TEE proof vouches for
+type Claim struct {
+	DocID       string
+	ContentHash string
+	SessionID   *big.Int
+	RiskScore   *big.Int
+	ModelID     string      // name@version of the risk model
+	ModelHash   common.Hash // hash of the risk model
+}
+
+var claimArguments = mustClaimArguments()
+
+func mustClaimArguments() abi.Arguments {
+	stringType, _ := abi.NewType("string", "", nil)
+	uintType, _ := abi.NewType("uint256", "", nil)
+	bytes32Type, _ := abi.NewType("bytes32", "", nil)
+	return abi.Arguments{
+		{Type: stringType},  // docId
+		{Type: stringType},  // contentHash
+		{Type: uintType},    // sessionId
+		{Type: uintType},    // riskScore
+		{Type: stringType},  // modelId
+		{Type: bytes32Type}, // modelHash
+	}
+}
+
+// Digest mirrors Controller.proofDigest:
+// keccak256(abi.encode(docId, contentHash, sessionId, riskScore, modelId, modelHash))
+func (c *Claim) Digest() ([]byte, error) {
+	if c.SessionID == nil || c.RiskScore == nil {
+		return nil, fmt.Errorf("session ID and risk score are required")
+	}
+
+	packed, err := claimArguments.Pack(c.DocID, c.ContentHash, c.SessionID, c.RiskScore, c.ModelID, [32]byte(c.ModelHash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode claim: %v", err)
+	}
+	return crypto.Keccak256(packed), nil
+}
+
+// SignClaim produces the proof submitted to Controller.confirm: an EIP-191
+// personal signature over the claim digest, with v in {27, 28} as ecrecover
+// expects
+func SignClaim(c *Claim, key *ecdsa.PrivateKey) ([]byte, error) {
+	digest, err := c.Digest()
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := crypto.Sign(accounts.TextHash(digest), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign claim: %v", err)
+	}
+	signature[crypto.RecoveryIDOffset] += 27
+	return signature, nil
+}
+
+// RecoverClaimSigner returns the address of the key that signed the proof
+func RecoverClaimSigner(c *Claim, proof []byte) (common.Address, error) {
+	if len(proof) != crypto.SignatureLength {
+		return common.Address{}, fmt.Errorf("invalid proof length: %d", len(proof))
+	}
+
+	digest, err := c.Digest()
+	if err != nil {
+		return common.Address{}, err
+	}
+
+	signature := make([]byte, len(proof))
+	copy(signature, proof)
+	if signature[crypto.RecoveryIDOffset] >= 27 {
+		signature[crypto.RecoveryIDOffset] -= 27
+	}
+
+	pubKey, err := crypto.SigToPub(accounts.TextHash(digest), signature)
+	if err != nil {
+		return common.Address{}, fmt.Errorf("invalid proof: %v", err)
+	}
+	return crypto.PubkeyToAddress(*pubKey), nil
+}
+
+// VerifyClaim checks that the proof was signed by one of the trusted TEE
+// signers, e.g. keys taken from verified attestation documents
+func VerifyClaim(c *Claim, proof []byte, trustedSigners ...common.Address) error {
+	signer, err := RecoverClaimSigner(c, proof)
+	if err != nil {
+		return err
+	}
+
+	for _, trusted := range trustedSigners {
+		if signer == trusted {
+			return nil
+		}
+	}
+	return fmt.Errorf("proof signed by untrusted key %s", signer.Hex())
+}
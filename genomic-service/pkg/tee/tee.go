@@ -1,59 +1,118 @@
 package tee
 
 import (
+	"bytes"
 	"crypto/rand"
-	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
-
-	"github.com/ethereum/go-ethereum/crypto"
-	"github.com/ethereum/go-ethereum/crypto/ecies"
 )
 
 // Client sdk for user to encrypt their data
 type TeeEncoder struct {
 	teePublicKeyHex string
+	cipher          Cipher
+	chunkSize       int
 }
 
-func NewTeeEncoder(teePublicKeyHex string) *TeeEncoder {
+// newTeeEncoder trusts the given key as-is, only NewAttestedTeeEncoder hands
+// out encoders so a malicious gateway can't substitute its own key
+func newTeeEncoder(teePublicKeyHex string) *TeeEncoder {
 	return &TeeEncoder{
 		teePublicKeyHex: teePublicKeyHex,
+		cipher:          CipherAESGCM,
+		chunkSize:       DefaultChunkSize,
 	}
 }
 
+// WithCipher returns an encoder sealing chunks with another AEAD, e.g.
+// ChaCha20-Poly1305 on devices without AES instructions
+func (u *TeeEncoder) WithCipher(cipher Cipher) *TeeEncoder {
+	encoder := *u
+	encoder.cipher = cipher
+	return &encoder
+}
+
+// WithChunkSize returns an encoder using another plaintext chunk size
+func (u *TeeEncoder) WithChunkSize(chunkSize int) *TeeEncoder {
+	encoder := *u
+	encoder.chunkSize = chunkSize
+	return &encoder
+}
+
+// NewAttestedTeeEncoder refuses to encrypt to a key unless its attestation
+// document verifies against the pinned root and allowed measurements
+func NewAttestedTeeEncoder(doc *AttestationDocument, policy AttestationPolicy) (*TeeEncoder, error) {
+	if doc == nil {
+		return nil, fmt.Errorf("attestation document is required")
+	}
+	if err := doc.Verify(policy); err != nil {
+		return nil, fmt.Errorf("attestation verification failed: %v", err)
+	}
+
+	return newTeeEncoder(doc.PublicKey), nil
+}
+
+// EncryptGeneData encrypts data in memory, see NewEncryptWriter
 func (u *TeeEncoder) EncryptGeneData(data []byte) ([]byte, error) {
-	// Decode hex string to bytes
-	pubKeyBytes, err := hex.DecodeString(u.teePublicKeyHex)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode public key hex: %v", err)
+	var buf bytes.Buffer
+	if err := u.EncryptStream(&buf, bytes.NewReader(data)); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	// Parse public key from bytes
-	pubKey, err := crypto.DecompressPubkey(pubKeyBytes)
+// EncryptStream encrypts everything read from r into w
+func (u *TeeEncoder) EncryptStream(w io.Writer, r io.Reader) error {
+	writer, err := u.NewEncryptWriter(w)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decompress public key: %v", err)
+		return err
 	}
+	if _, err := io.Copy(writer, r); err != nil {
+		return fmt.Errorf("failed to encrypt data: %v", err)
+	}
+	return writer.Close()
+}
 
-	// Convert to ECIES public key
-	eciesPubKey := ecies.ImportECDSAPublic(pubKey)
-
-	// Encrypt the data using crypto/rand.Reader directly
-	encrypted, err := ecies.Encrypt(
-		rand.Reader, // Use crypto/rand.Reader instead of bytes.NewReader
-		eciesPubKey,
-		data,
-		nil,
-		nil,
-	)
+// NewEncryptWriter starts a chunked envelope to the TEE key: a fresh data key
+// is ECIES-encrypted to the TEE key, and the data is sealed with it in
+// authenticated chunks as it is written. The header carries the key ID, so
+// the TEE can pick the right key after rotations. Close must be called to
+// finish the envelope.
+func (u *TeeEncoder) NewEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	pubKey, err := parsePublicKeyHex(u.teePublicKeyHex)
+	if err != nil {
+		return nil, err
+	}
+	if u.chunkSize <= 0 || u.chunkSize > MaxChunkSize {
+		return nil, fmt.Errorf("invalid chunk size: %d", u.chunkSize)
+	}
 
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrapped, err := WrapDataKey(pubKey, dataKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt data: %v", err)
+		return nil, err
 	}
 
-	return encrypted, nil
+	header := &ChunkedHeader{
+		KeyID:      KeyID(pubKey),
+		Cipher:     u.cipher,
+		ChunkSize:  u.chunkSize,
+		WrappedKey: wrapped,
+	}
+	return newEncryptWriter(w, header, dataKey)
+}
+
+// KeyID returns the ID of the TEE key this encoder encrypts to
+func (u *TeeEncoder) KeyID() (string, error) {
+	return KeyIDFromHex(u.teePublicKeyHex)
 }
 
-func (u *TeeEncoder) GetFileDataFromFile(filePath string) (*FileData, error) {
+// GetFileDataFromFile reads a gene data file to encrypt
+func GetFileDataFromFile(filePath string) (*FileData, error) {
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("gene data file not found: %v", err)
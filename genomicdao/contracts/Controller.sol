@@ -1,11 +1,14 @@
 // SPDX-License-Identifier: MIT
 pragma solidity ^0.8.9;
 
+import "@openzeppelin/contracts/access/Ownable.sol";
+import "@openzeppelin/contracts/metatx/ERC2771Context.sol";
 import "@openzeppelin/contracts/utils/Counters.sol";
+import "@openzeppelin/contracts/utils/cryptography/ECDSA.sol";
 import "./NFT.sol";
 import "./Token.sol";
 
-contract Controller {
+contract Controller is Ownable, ERC2771Context {
     using Counters for Counters.Counter;
 
     //
@@ -18,13 +21,16 @@ contract Controller {
     struct UploadSession {
         uint256 id;
         address user;
-        string proof;
+        address owner; // receives the G-NFT and the PCSP reward
+        bytes proof;
         bool confirmed;
     }
 
     struct DataDoc {
         string id;
         string hashContent;
+        string modelId;
+        bytes32 modelHash;
     }
 
     mapping(uint256 => UploadSession) sessions;
@@ -32,33 +38,46 @@ contract Controller {
     mapping(string => bool) docSubmits;
     mapping(uint256 => string) nftDocs;
 
+    // TEE enclave keys allowed to sign computation proofs
+    mapping(address => bool) public teeSigners;
+
 
     //
     // EVENTS
     //
-    event UploadData(string docId, uint256 sessionId);
+    event UploadData(string docId, uint256 sessionId, address owner);
     event GeneNFTMinted(uint256 tokenId, string docId);
     event PCSPRewarded(address user, uint256 amount);
+    event TeeSignerUpdated(address signer, bool allowed);
 
-    constructor(address nftAddress, address pcspAddress) {
+    // Calls relayed by the trusted forwarder are attributed to the user who signed them
+    constructor(address nftAddress, address pcspAddress, address trustedForwarder) ERC2771Context(trustedForwarder) {
         geneNFT = GeneNFT(nftAddress);
         pcspToken = PostCovidStrokePrevention(pcspAddress);
     }
 
 
+    function setTeeSigner(address signer, bool allowed) public onlyOwner {
+        teeSigners[signer] = allowed;
+        emit TeeSignerUpdated(signer, allowed);
+    }
+
     modifier docNotSubmited(string memory docId) {
         require(!docSubmits[docId], "Doc already been submitted");
         _;
     }
 
-    function uploadData(string memory docId) public docNotSubmited(docId) returns (uint256) {
+    function uploadData(string memory docId, address wallet) public docNotSubmited(docId) returns (uint256) {
         // to start an uploading gene data session. The doc id is used to identify a unique gene profile. Also should check if the doc id has been submited to the system before. This method return the session id
+        // The wallet is the user's, the gene profile's NFT and reward go there rather than to the caller
+        require(wallet != address(0), "Invalid owner");
 
         // get current session id, and update current session data 
         uint256 sessionId = _sessionIdCounter.current();
         sessions[sessionId] = UploadSession({
             id: sessionId,
-            user: msg.sender,
+            user: _msgSender(),
+            owner: wallet,
             proof: "",
             confirmed: false
         });
@@ -70,7 +89,7 @@ contract Controller {
         _sessionIdCounter.increment();
 
         // emit event
-        emit UploadData(docId, sessionId);
+        emit UploadData(docId, sessionId, wallet);
 
         return sessionId;
     }
@@ -78,33 +97,38 @@ contract Controller {
     function confirm(
         string memory docId,
         string memory contentHash,
-        string memory proof,
+        bytes memory proof,
         uint256 sessionId,
-        uint256 riskScore
+        uint256 riskScore,
+        string memory modelId,
+        bytes32 modelHash
     ) public {
-        // The proof here is used to verify that the result is returned from a valid computation on the gene data. For simplicity, we will skip the proof verification in this implementation. The gene data's owner will receive a NFT as a ownership certicate for his/her gene profile.
+        // The proof is the TEE's signature over the computation result, it shows the result was produced by a trusted enclave from the gene data. The gene data's owner will receive a NFT as a ownership certicate for his/her gene profile.
         require(bytes(docs[docId].id).length == 0, "Doc already been submitted");
 
-        require(getSession(sessionId).user == msg.sender, "Invalid session owner");
+        require(getSession(sessionId).user == _msgSender(), "Invalid session owner");
         require(!getSession(sessionId).confirmed, "Session is ended");
 
 
         // verify proof
-        require(_verifyProof(proof), "Invalid proof");
+        require(_verifyProof(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash), "Invalid proof");
         
        
         // update doc content
         docs[docId] = DataDoc({
             id: docId,
-            hashContent: contentHash
+            hashContent: contentHash,
+            modelId: modelId,
+            modelHash: modelHash
         });
 
-        // Mint NFT 
-        uint256 tokenId = geneNFT.safeMint(msg.sender);
+        // Mint NFT to the session owner
+        address wallet = sessions[sessionId].owner;
+        uint256 tokenId = geneNFT.safeMint(wallet);
         nftDocs[tokenId] = docId;
 
         // Reward PCSP token based on risk stroke
-        uint256 rewardAmount = pcspToken.reward(msg.sender, riskScore);
+        uint256 rewardAmount = pcspToken.reward(wallet, riskScore);
 
         // Close session
         sessions[sessionId].confirmed = true;
@@ -112,7 +136,7 @@ contract Controller {
 
         // emit events
         emit GeneNFTMinted(tokenId, docId);
-        emit PCSPRewarded(msg.sender, rewardAmount);
+        emit PCSPRewarded(wallet, rewardAmount);
     }
 
     function getSession(uint256 sessionId) public view returns(UploadSession memory) {
@@ -124,8 +148,43 @@ contract Controller {
     }
 
 
-    /// @custom:dev-note Proof verification is skipped for development
-    function _verifyProof(string memory /* _proof */) internal pure returns (bool) {
-        return true;
+    // Canonical digest of a computation result, signed by the TEE. The model
+    // ID and hash pin the exact risk model that produced the score.
+    function proofDigest(
+        string memory docId,
+        string memory contentHash,
+        uint256 sessionId,
+        uint256 riskScore,
+        string memory modelId,
+        bytes32 modelHash
+    ) public pure returns (bytes32) {
+        return keccak256(abi.encode(docId, contentHash, sessionId, riskScore, modelId, modelHash));
+    }
+
+    function _verifyProof(
+        string memory docId,
+        string memory contentHash,
+        bytes memory proof,
+        uint256 sessionId,
+        uint256 riskScore,
+        string memory modelId,
+        bytes32 modelHash
+    ) internal view returns (bool) {
+        bytes32 digest = ECDSA.toEthSignedMessageHash(proofDigest(docId, contentHash, sessionId, riskScore, modelId, modelHash));
+        (address signer, ECDSA.RecoverError err) = ECDSA.tryRecover(digest, proof);
+        return err == ECDSA.RecoverError.NoError && teeSigners[signer];
+    }
+
+    // Ownable and ERC2771Context both extend Context, the forwarder-aware versions win
+    function _msgSender() internal view override(Context, ERC2771Context) returns (address) {
+        return ERC2771Context._msgSender();
+    }
+
+    function _msgData() internal view override(Context, ERC2771Context) returns (bytes calldata) {
+        return ERC2771Context._msgData();
+    }
+
+    function _contextSuffixLength() internal view override(Context, ERC2771Context) returns (uint256) {
+        return ERC2771Context._contextSuffixLength();
     }
 }
@@ -0,0 +1,9 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.9;
+
+import "@openzeppelin/contracts/metatx/MinimalForwarder.sol";
+
+// Trusted forwarder of the controller: the gateway relays transactions users
+// signed as EIP-712 ForwardRequests and pays their gas, the controller sees
+// the user as the sender (EIP-2771)
+contract Forwarder is MinimalForwarder {}
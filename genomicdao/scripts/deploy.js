@@ -16,9 +16,15 @@ async function main() {
   await token.waitForDeployment();
   console.log("PCSP Token deployed to:", token.target);
 
+  // Deploy the trusted forwarder relaying users' signed calls
+  const Forwarder = await ethers.getContractFactory("Forwarder");
+  const forwarder = await Forwarder.deploy();
+  await forwarder.waitForDeployment();
+  console.log("Forwarder deployed to:", forwarder.target);
+
   // Deploy Controller
   const Controller = await ethers.getContractFactory("Controller");
-  const controller = await Controller.deploy(nft.target, token.target);
+  const controller = await Controller.deploy(nft.target, token.target, forwarder.target);
   await controller.waitForDeployment();
   console.log("Controller deployed to:", controller.target);
 
@@ -27,12 +33,19 @@ async function main() {
   await token.transferOwnership(controller.target);
   console.log("Ownership transferred to Controller");
 
+  // Allow the TEE enclave key to sign computation proofs
+  if (process.env.TEE_SIGNER_ADDRESS) {
+    await controller.setTeeSigner(process.env.TEE_SIGNER_ADDRESS, true);
+    console.log("TEE signer allowed:", process.env.TEE_SIGNER_ADDRESS);
+  }
+
   // Log all addresses for future reference
   console.log("\nContract Addresses:");
   console.log("-------------------");
   console.log("GeneNFT:", nft.target);
   console.log("PCSP Token:", token.target);
   console.log("Controller:", controller.target);
+  console.log("Forwarder:", forwarder.target);
 }
 
 main().catch((error) => {
@@ -5,79 +5,158 @@ const {
 
 const { expect } = require("chai");
 
+const modelId = "GDAO_STROKE_PANEL@1"
+const modelHash = ethers.id("GDAO_STROKE_PANEL scoring file")
+
+// Sign a computation result the way the TEE does
+async function signProof(signer, docId, contentHash, sessionId, riskScore) {
+  const digest = ethers.keccak256(
+    ethers.AbiCoder.defaultAbiCoder().encode(
+      ["string", "string", "uint256", "uint256", "string", "bytes32"],
+      [docId, contentHash, sessionId, riskScore, modelId, modelHash]
+    )
+  )
+  return signer.signMessage(ethers.getBytes(digest))
+}
+
+// Sign a controller call for the trusted forwarder, like a user's wallet does
+async function signForwardRequest(signer, forwarder, to, data) {
+  const request = {
+    from: signer.address,
+    to,
+    value: 0,
+    gas: 1000000,
+    nonce: await forwarder.getNonce(signer.address),
+    data,
+  }
+  const domain = {
+    name: "MinimalForwarder",
+    version: "0.0.1",
+    chainId: (await ethers.provider.getNetwork()).chainId,
+    verifyingContract: forwarder.target,
+  }
+  const types = {
+    ForwardRequest: [
+      { name: "from", type: "address" },
+      { name: "to", type: "address" },
+      { name: "value", type: "uint256" },
+      { name: "gas", type: "uint256" },
+      { name: "nonce", type: "uint256" },
+      { name: "data", type: "bytes" },
+    ],
+  }
+  return { request, signature: await signer.signTypedData(domain, types, request) }
+}
+
 describe("Controller", function () {
   async function deployControllerFixture() {
     const [owner, addr1, addr2] = await ethers.getSigners();
 
     const nft = await ethers.deployContract("GeneNFT");
     const pcspToken = await ethers.deployContract("PostCovidStrokePrevention");
+    const forwarder = await ethers.deployContract("Forwarder");
 
-    const controller = await ethers.deployContract("Controller", [nft.target, pcspToken.target]);
+    const controller = await ethers.deployContract("Controller", [nft.target, pcspToken.target, forwarder.target]);
 
     await nft.transferOwnership(controller.target)
     await pcspToken.transferOwnership(controller.target)
 
-    return { controller, nft, pcspToken, owner, addr1, addr2 }
+    const tee = ethers.Wallet.createRandom()
+    await controller.setTeeSigner(tee.address, true)
+
+    return { controller, nft, pcspToken, forwarder, owner, addr1, addr2, tee }
   }
 
   describe("Upload Data", function () {
     it("Should receive session id", async function () {
-      const { controller } = await loadFixture(deployControllerFixture);
+      const { controller, addr1 } = await loadFixture(deployControllerFixture);
 
       await expect(
-        controller.uploadData("doc1")
+        controller.uploadData("doc1", addr1.address)
       )
         .to.emit(controller, "UploadData")
-        .withArgs("doc1", 0)
+        .withArgs("doc1", 0, addr1.address)
+    })
+
+    it("Should fail without an owner", async function () {
+      const { controller } = await loadFixture(deployControllerFixture);
+
+      await expect(
+        controller.uploadData("doc1", ethers.ZeroAddress)
+      ).to.be.revertedWith("Invalid owner")
     })
 
     it("Should fail if the doc is submited", async function () {
-      const { controller, addr1, addr2 } = await loadFixture(deployControllerFixture);
+      const { controller, addr1, addr2, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.connect(addr1).uploadData(docId)
-      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       await expect(
-        controller.connect(addr2).uploadData(docId)
+        controller.connect(addr2).uploadData(docId, addr2.address)
       ).to.be.revertedWith("Doc already been submitted")
     })
   })
 
   describe("Confirm data", function () {
     it("Should receive correct nft", async function () {
-      const { controller, nft, owner } = await loadFixture(deployControllerFixture);
+      const { controller, nft, owner, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.uploadData(docId)
-      await controller.confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.uploadData(docId, owner.address)
+      await controller.confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       expect(await nft.ownerOf(0)).to.equal(owner.address);
     })
 
+    it("Should mint and reward the session owner, not the caller", async function () {
+      const { controller, nft, pcspToken, owner, addr1, tee } = await loadFixture(deployControllerFixture);
+
+      const docId = "doc1"
+      const contentHash = "dochash"
+      const riskScore = 1
+      const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
+
+      const awardAmount = BigInt("15000") * BigInt("10") ** BigInt("18")
+
+      await controller.uploadData(docId, addr1.address)
+      await expect(
+        controller.confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
+      )
+        .to.emit(controller, "PCSPRewarded")
+        .withArgs(addr1.address, awardAmount)
+
+      expect(await nft.ownerOf(0)).to.equal(addr1.address);
+      expect(await pcspToken.balanceOf(addr1.address)).to.equal(awardAmount)
+      expect(await pcspToken.balanceOf(owner.address)).to.equal(0)
+      expect((await controller.getSession(sessionId)).owner).to.equal(addr1.address)
+    })
+
     it("Should receive correct pcsp reward", async function () {
-      const { controller, pcspToken, addr1 } = await loadFixture(deployControllerFixture);
+      const { controller, pcspToken, addr1, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
       const awardAmount = BigInt("15000") * BigInt("10") ** BigInt("18")
 
-      await controller.connect(addr1).uploadData(docId)
-      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       const ownerBalance = await pcspToken.balanceOf(addr1.address)
 
@@ -85,16 +164,16 @@ describe("Controller", function () {
     })
 
     it("Should close session", async function () {
-      const { controller, addr1 } = await loadFixture(deployControllerFixture);
+      const { controller, addr1, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.connect(addr1).uploadData(docId)
-      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       const session = await controller.getSession(sessionId)
 
@@ -103,71 +182,187 @@ describe("Controller", function () {
     })
 
     it("Should content hash uploaded", async function () {
-      const { controller, addr1 } = await loadFixture(deployControllerFixture);
+      const { controller, addr1, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.connect(addr1).uploadData(docId)
-      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       const doc = await controller.getDoc(docId)
 
       expect(doc.hashContent).to.equal(contentHash)
+      expect(doc.modelId).to.equal(modelId)
+      expect(doc.modelHash).to.equal(modelHash)
     })
 
     it("Should fail if the doc is submitted", async function () {
-      const { controller, addr1 } = await loadFixture(deployControllerFixture);
+      const { controller, addr1, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.connect(addr1).uploadData(docId)
-      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       await expect(
-        controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+        controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
       ).to.be.revertedWith("Doc already been submitted")
     })
 
     it("Should fail if the session owner is invalid", async function () {
-      const { controller, addr1, addr2 } = await loadFixture(deployControllerFixture);
+      const { controller, addr1, addr2, tee } = await loadFixture(deployControllerFixture);
 
       const docId = "doc1"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.connect(addr1).uploadData(docId)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
 
       await expect(
-        controller.connect(addr2).confirm(docId, contentHash, proof, sessionId, riskScore)
+        controller.connect(addr2).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
       ).to.be.revertedWith("Invalid session owner")
     })
 
-    it("Should fail if the session is end", async function () {
+    it("Should fail if the proof is not signed by a TEE", async function () {
       const { controller, addr1 } = await loadFixture(deployControllerFixture);
 
+      const docId = "doc1"
+      const contentHash = "dochash"
+      const riskScore = 4
+      const sessionId = 0
+      const forged = await signProof(ethers.Wallet.createRandom(), docId, contentHash, sessionId, riskScore)
+
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+
+      await expect(
+        controller.connect(addr1).confirm(docId, contentHash, forged, sessionId, riskScore, modelId, modelHash)
+      ).to.be.revertedWith("Invalid proof")
+    })
+
+    it("Should fail if the result was tampered with", async function () {
+      const { controller, addr1, tee } = await loadFixture(deployControllerFixture);
+
+      const docId = "doc1"
+      const contentHash = "dochash"
+      const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, 1)
+
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+
+      await expect(
+        controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, 4, modelId, modelHash)
+      ).to.be.revertedWith("Invalid proof")
+    })
+
+    it("Should fail if the result is attributed to another model", async function () {
+      const { controller, addr1, tee } = await loadFixture(deployControllerFixture);
+
+      const docId = "doc1"
+      const contentHash = "dochash"
+      const riskScore = 1
+      const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
+
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+
+      await expect(
+        controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, ethers.id("other model"))
+      ).to.be.revertedWith("Invalid proof")
+    })
+
+    it("Should fail if the session is end", async function () {
+      const { controller, addr1, tee } = await loadFixture(deployControllerFixture);
+
       const docId = "doc1"
       const docId2 = "doc2"
       const contentHash = "dochash"
-      const proof = "success"
       const riskScore = 1
       const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
 
-      await controller.connect(addr1).uploadData(docId)
-      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore)
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+      await controller.connect(addr1).confirm(docId, contentHash, proof, sessionId, riskScore, modelId, modelHash)
 
       await expect(
-        controller.connect(addr1).confirm(docId2, contentHash, proof, sessionId, riskScore)
+        controller.connect(addr1).confirm(docId2, contentHash, proof, sessionId, riskScore, modelId, modelHash)
       ).to.be.revertedWith("Session is ended")
     })
   })
-})
\ No newline at end of file
+
+  describe("Meta transactions", function () {
+    it("Should attribute relayed calls to the user who signed them", async function () {
+      const { controller, nft, pcspToken, forwarder, owner, addr1, tee } = await loadFixture(deployControllerFixture);
+
+      const docId = "doc1"
+      const contentHash = "dochash"
+      const riskScore = 1
+      const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
+
+      // addr1 signs, the relayer (owner) pays the gas
+      const upload = await signForwardRequest(
+        addr1, forwarder, controller.target,
+        controller.interface.encodeFunctionData("uploadData", [docId, addr1.address])
+      )
+      expect(await forwarder.verify(upload.request, upload.signature)).to.equal(true)
+      await forwarder.connect(owner).execute(upload.request, upload.signature)
+
+      expect((await controller.getSession(sessionId)).user).to.equal(addr1.address)
+
+      const confirm = await signForwardRequest(
+        addr1, forwarder, controller.target,
+        controller.interface.encodeFunctionData("confirm", [docId, contentHash, proof, sessionId, riskScore, modelId, modelHash])
+      )
+      await forwarder.connect(owner).execute(confirm.request, confirm.signature)
+
+      expect(await nft.ownerOf(0)).to.equal(addr1.address)
+      expect(await pcspToken.balanceOf(addr1.address)).to.equal(BigInt("15000") * BigInt("10") ** BigInt("18"))
+    })
+
+    it("Should not relay a request signed by someone else", async function () {
+      const { controller, forwarder, owner, addr1, addr2 } = await loadFixture(deployControllerFixture);
+
+      const upload = await signForwardRequest(
+        addr2, forwarder, controller.target,
+        controller.interface.encodeFunctionData("uploadData", ["doc1", addr1.address])
+      )
+      upload.request.from = addr1.address
+
+      expect(await forwarder.verify(upload.request, upload.signature)).to.equal(false)
+      await expect(
+        forwarder.connect(owner).execute(upload.request, upload.signature)
+      ).to.be.revertedWith("MinimalForwarder: signature does not match request")
+    })
+
+    it("Should not let a relayed caller confirm another user's session", async function () {
+      const { controller, forwarder, owner, addr1, addr2, tee } = await loadFixture(deployControllerFixture);
+
+      const docId = "doc1"
+      const contentHash = "dochash"
+      const riskScore = 1
+      const sessionId = 0
+      const proof = await signProof(tee, docId, contentHash, sessionId, riskScore)
+
+      await controller.connect(addr1).uploadData(docId, addr1.address)
+
+      // The forwarder doesn't revert when the call does, the session stays open
+      const confirm = await signForwardRequest(
+        addr2, forwarder, controller.target,
+        controller.interface.encodeFunctionData("confirm", [docId, contentHash, proof, sessionId, riskScore, modelId, modelHash])
+      )
+      await forwarder.connect(owner).execute(confirm.request, confirm.signature)
+
+      expect((await controller.getSession(sessionId)).confirmed).to.equal(false)
+    })
+  })
+})
@@ -42,11 +42,20 @@ else
     exit 1
 fi
 
+if [ -f "genomicdao/artifacts/contracts/Forwarder.sol/Forwarder.json" ]; then
+    jq .abi "genomicdao/artifacts/contracts/Forwarder.sol/Forwarder.json" > build/Forwarder.abi
+    echo "Extracted Forwarder ABI"
+else
+    echo "Error: Forwarder artifact not found"
+    exit 1
+fi
+
 echo "Generating Go bindings..."
 # Generate bindings
 abigen --abi build/GeneNFT.abi --pkg contracts --type GeneNFT --out genomic-service/contracts/gene_nft.go
 abigen --abi build/PCSP.abi --pkg contracts --type PCSPToken --out genomic-service/contracts/pcsp_token.go
 abigen --abi build/Controller.abi --pkg contracts --type Controller --out genomic-service/contracts/controller.go
+abigen --abi build/Forwarder.abi --pkg contracts --type Forwarder --out genomic-service/contracts/forwarder.go
 
 echo "Cleaning up..."
 # Clean up